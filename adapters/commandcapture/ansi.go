@@ -0,0 +1,67 @@
+package commandcapture
+
+import "io"
+
+// ANSIStripper is an io.Writer that removes ANSI CSI escape sequences, such as
+// the colour codes "\x1b[31m" and "\x1b[0m", from what is written through it
+// before passing the rest on. It keeps its state between writes, so a sequence
+// split across writes is still removed. Other escape sequences are passed on
+// unchanged. It is not safe for concurrent use.
+type ANSIStripper struct {
+	w     io.Writer
+	state ansiState
+	out   []byte
+}
+
+type ansiState int
+
+const (
+	ansiText ansiState = iota
+	// ansiEscape follows an ESC byte.
+	ansiEscape
+	// ansiCSI is inside a control sequence started by ESC [, which runs up
+	// to a final byte in the range 0x40-0x7e.
+	ansiCSI
+)
+
+// NewANSIStripper returns an ANSIStripper writing to w.
+func NewANSIStripper(w io.Writer) *ANSIStripper {
+	return &ANSIStripper{w: w}
+}
+
+// Write passes p on to the underlying writer without CSI sequences. It reports
+// len(p) bytes written unless the underlying writer fails.
+func (s *ANSIStripper) Write(p []byte) (int, error) {
+	out := s.out[:0]
+	for _, b := range p {
+		switch s.state {
+		case ansiText:
+			if b == 0x1b {
+				s.state = ansiEscape
+				continue
+			}
+			out = append(out, b)
+		case ansiEscape:
+			switch b {
+			case '[':
+				s.state = ansiCSI
+			case 0x1b:
+				out = append(out, 0x1b)
+			default:
+				out = append(out, 0x1b, b)
+				s.state = ansiText
+			}
+		case ansiCSI:
+			if b >= 0x40 && b <= 0x7e {
+				s.state = ansiText
+			}
+		}
+	}
+	s.out = out
+	if len(out) > 0 {
+		if _, err := s.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
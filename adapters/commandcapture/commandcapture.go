@@ -1,7 +1,6 @@
 package commandcapture
 
 import (
-	"bytes"
 	"slices"
 	"sync"
 
@@ -10,7 +9,7 @@ import (
 
 // capture implements port.CommandCapture.
 type capture struct {
-	buf    *bytes.Buffer
+	buf    port.Buffer
 	reset  func()
 	enable bool
 	once   sync.Once
@@ -21,16 +20,10 @@ func New() port.CommandCapture {
 	return &capture{}
 }
 
+// Enable records buf as the capture destination. The buffer is read when
+// Finish is called, so writes made after Enable are part of the output.
 func (c *capture) Enable(buf port.Buffer, reset func()) {
-	b, ok := buf.(*bytes.Buffer)
-	if !ok {
-		bb := &bytes.Buffer{}
-		bb.Grow(128)
-		bb.Write(buf.Bytes())
-		c.buf = bb
-	} else {
-		c.buf = b
-	}
+	c.buf = buf
 	c.reset = reset
 	c.enable = true
 }
@@ -54,3 +47,10 @@ func (c *capture) Restore() {
 		}
 	})
 }
+
+// Truncated reports whether the buffer dropped output, as a Ring or Window
+// does once its limit is reached. Buffers without a limit never truncate.
+func (c *capture) Truncated() bool {
+	t, ok := c.buf.(interface{ Truncated() bool })
+	return ok && t.Truncated()
+}
@@ -3,6 +3,7 @@ package commandcapture
 import (
 	"bytes"
 	"testing"
+	"time"
 )
 
 type stubBuffer struct {
@@ -61,3 +62,102 @@ func TestFinishWithoutEnableReturnsNil(t *testing.T) {
 		t.Fatalf("expected nil output, got %q", out)
 	}
 }
+
+func TestRingKeepsTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		writes []string
+		want   string
+	}{
+		{name: "under size", size: 8, writes: []string{"abc"}, want: "abc"},
+		{name: "exact size", size: 4, writes: []string{"ab", "cd"}, want: "abcd"},
+		{name: "wraps", size: 4, writes: []string{"abc", "def"}, want: "cdef"},
+		{name: "large write", size: 3, writes: []string{"a", "bcdefg"}, want: "efg"},
+		{name: "many small writes", size: 3, writes: []string{"a", "b", "c", "d", "e"}, want: "cde"},
+		{name: "zero size", size: 0, writes: []string{"abc"}, want: ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ring := NewRing(tc.size)
+			for _, w := range tc.writes {
+				if n, err := ring.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if got := string(ring.Bytes()); got != tc.want {
+				t.Fatalf("Bytes() = %q, want %q", got, tc.want)
+			}
+			if truncated := tc.name != "under size" && tc.name != "exact size"; ring.Truncated() != truncated {
+				t.Fatalf("Truncated() = %v, want %v", ring.Truncated(), truncated)
+			}
+		})
+	}
+}
+
+func TestEnableWithRing(t *testing.T) {
+	cap := New()
+	ring := NewRing(4)
+	cap.Enable(ring, nil)
+	ring.Write([]byte("hello world"))
+	if out := cap.Finish(); string(out) != "orld" {
+		t.Fatalf("unexpected tail output: %q", out)
+	}
+}
+
+func TestWindowKeepsRecentOutput(t *testing.T) {
+	now := time.Unix(1000, 0)
+	window := NewWindow(10 * time.Second)
+	window.now = func() time.Time { return now }
+	cap := New()
+	cap.Enable(window, nil)
+
+	window.Write([]byte("old "))
+	if window.Truncated() {
+		t.Fatal("expected no truncation before output leaves the window")
+	}
+	now = now.Add(6 * time.Second)
+	window.Write([]byte("middle "))
+	now = now.Add(6 * time.Second)
+	window.Write([]byte("new"))
+	if got := string(window.Bytes()); got != "middle new" || !window.Truncated() {
+		t.Fatalf("Bytes() = %q, truncated %v, want %q truncated", got, window.Truncated(), "middle new")
+	}
+	now = now.Add(5 * time.Second)
+	if out := cap.Finish(); string(out) != "new" {
+		t.Fatalf("unexpected windowed output: %q", out)
+	}
+
+	empty := NewWindow(0)
+	if n, err := empty.Write([]byte("abc")); n != 3 || err != nil || len(empty.Bytes()) != 0 {
+		t.Fatalf("expected a zero window to discard writes, got %d, %v, %q", n, err, empty.Bytes())
+	}
+}
+
+func TestANSIStripper(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{name: "plain", writes: []string{"hello"}, want: "hello"},
+		{name: "colours", writes: []string{"\x1b[1;31merror\x1b[0m: x"}, want: "error: x"},
+		{name: "split escape", writes: []string{"a\x1b", "[3", "2mb\x1b[", "0", "m"}, want: "ab"},
+		{name: "other escapes kept", writes: []string{"\x1b(B\x1b\x1b[K"}, want: "\x1b(B\x1b"},
+		{name: "unterminated", writes: []string{"ok\x1b[12;"}, want: "ok"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			s := NewANSIStripper(&buf)
+			for _, w := range tc.writes {
+				if n, err := s.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if buf.String() != tc.want {
+				t.Fatalf("got %q, want %q", buf.String(), tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package commandcapture
+
+import (
+	"slices"
+	"sync"
+)
+
+// Ring is a fixed-size buffer that keeps the last bytes written to it. It
+// implements io.Writer and port.Buffer so it can back a CommandCapture whose
+// output must stay bounded.
+type Ring struct {
+	mu   sync.Mutex
+	buf  []byte
+	pos  int
+	full bool
+	// written counts every byte written, retained or not.
+	written int64
+}
+
+// NewRing returns a Ring holding at most n bytes. A Ring of size zero or less
+// discards everything.
+func NewRing(n int) *Ring {
+	return &Ring{buf: make([]byte, max(n, 0))}
+}
+
+// Write stores p, overwriting the oldest bytes once the ring is full. It never
+// fails and always reports len(p) bytes written.
+func (r *Ring) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.written += int64(len(p))
+	size := len(r.buf)
+	if size == 0 {
+		return len(p), nil
+	}
+	if len(p) >= size {
+		copy(r.buf, p[len(p)-size:])
+		r.pos = 0
+		r.full = true
+		return len(p), nil
+	}
+	n := copy(r.buf[r.pos:], p)
+	copy(r.buf, p[n:])
+	end := r.pos + len(p)
+	if end >= size {
+		r.full = true
+	}
+	r.pos = end % size
+	return len(p), nil
+}
+
+// Grow is a no-op; the ring never grows beyond its size.
+func (r *Ring) Grow(int) {}
+
+// Bytes returns a copy of the retained bytes, oldest first.
+func (r *Ring) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return slices.Clone(r.buf[:r.pos])
+	}
+	return append(slices.Clone(r.buf[r.pos:]), r.buf[:r.pos]...)
+}
+
+// Truncated reports whether bytes were overwritten or discarded, so Bytes no
+// longer returns everything written.
+func (r *Ring) Truncated() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.written > int64(len(r.buf))
+}
@@ -0,0 +1,87 @@
+package commandcapture
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"pkt.systems/emrun/internal/clock"
+)
+
+// Window is a buffer that keeps the bytes written to it during the last
+// duration d, stored as timestamped chunks. It implements io.Writer and
+// port.Buffer so it can back a CommandCapture that should hold what happened
+// right before the command exited rather than a fixed number of bytes.
+type Window struct {
+	mu     sync.Mutex
+	d      time.Duration
+	now    func() time.Time
+	chunks []windowChunk
+	// dropped is set once output has left the window or was discarded.
+	dropped bool
+}
+
+type windowChunk struct {
+	at   time.Time
+	data []byte
+}
+
+// NewWindow returns a Window keeping the output of the last d. A Window with a
+// duration of zero or less discards everything.
+func NewWindow(d time.Duration) *Window {
+	return &Window{d: d, now: clock.Get().Now}
+}
+
+// Write stores a copy of p stamped with the current time and drops chunks that
+// have left the window. It never fails and always reports len(p) bytes
+// written.
+func (w *Window) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.now()
+	w.expire(now)
+	switch {
+	case len(p) == 0:
+	case w.d > 0:
+		w.chunks = append(w.chunks, windowChunk{at: now, data: slices.Clone(p)})
+	default:
+		w.dropped = true
+	}
+	return len(p), nil
+}
+
+// expire drops the chunks written before now-d.
+func (w *Window) expire(now time.Time) {
+	cutoff := now.Add(-w.d)
+	i := 0
+	for i < len(w.chunks) && w.chunks[i].at.Before(cutoff) {
+		i++
+	}
+	if i > 0 {
+		w.chunks = slices.Delete(w.chunks, 0, i)
+		w.dropped = true
+	}
+}
+
+// Grow is a no-op; the window holds chunks as they are written.
+func (w *Window) Grow(int) {}
+
+// Bytes returns a copy of the bytes written during the last d, oldest first.
+func (w *Window) Bytes() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.expire(w.now())
+	var out []byte
+	for _, c := range w.chunks {
+		out = append(out, c.data...)
+	}
+	return out
+}
+
+// Truncated reports whether output has left the window or was discarded, so
+// Bytes no longer returns everything written.
+func (w *Window) Truncated() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dropped
+}
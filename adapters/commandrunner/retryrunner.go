@@ -0,0 +1,121 @@
+package commandrunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"pkt.systems/emrun/internal/clock"
+	"pkt.systems/emrun/port"
+)
+
+const (
+	// DefaultRetryAttempts is the number of attempts RetryRunner makes when
+	// Attempts is not set.
+	DefaultRetryAttempts = 3
+	// DefaultRetryBackoff is the pause between attempts when Backoff is not set.
+	DefaultRetryBackoff = 5 * time.Millisecond
+)
+
+// RetryRunner wraps Runner and retries executions that fail with ETXTBSY
+// ("text file busy"). Freshly written executables hit it when another process,
+// typically a concurrently forked child, still holds the file open for writing.
+//
+// os/exec cannot start a Cmd twice and a runner cannot rebuild cmd without the
+// context it was created with, so Run and Start make a single attempt. The emrun
+// and efrun helpers detect port.CommandRetrier and drive retries through
+// RunRetry and StartRetry instead. Runners only see the command, so the
+// context ending the wait between attempts is captured when the runner is
+// built; store a fresh one per operation:
+//
+//	ctx = emrun.WithRunner(ctx, &commandrunner.RetryRunner{Runner: commandrunner.Default, Context: ctx})
+type RetryRunner struct {
+	// Runner executes the commands, commandrunner.Default when nil.
+	Runner port.CommandRunner
+	// Attempts is the total number of attempts, DefaultRetryAttempts when <= 0.
+	Attempts int
+	// Backoff is the pause between attempts, DefaultRetryBackoff when <= 0.
+	Backoff time.Duration
+	// Context, when set, cuts the pause short once it is done: the last error
+	// is returned wrapped in Context.Err() instead of waiting out the backoff
+	// for a clone that could not start anyway.
+	Context context.Context
+}
+
+var _ port.CommandRetrier = (*RetryRunner)(nil)
+
+// Run executes cmd once through the wrapped runner.
+func (r *RetryRunner) Run(cmd *exec.Cmd) error {
+	_, err := r.RunRetry(cmd, nil)
+	return err
+}
+
+// Start starts cmd once through the wrapped runner.
+func (r *RetryRunner) Start(cmd *exec.Cmd) error {
+	_, err := r.StartRetry(cmd, nil)
+	return err
+}
+
+// RunRetry runs cmd, running a clone of it again while the execution fails
+// with ETXTBSY and attempts remain. It returns the command that ran last.
+func (r *RetryRunner) RunRetry(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd) (*exec.Cmd, error) {
+	return r.retry(cmd, clone, r.runner().Run)
+}
+
+// StartRetry is the Start counterpart of RunRetry. It returns the command that
+// was started, which is the one callers must Wait on.
+func (r *RetryRunner) StartRetry(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd) (*exec.Cmd, error) {
+	return r.retry(cmd, clone, r.runner().Start)
+}
+
+func (r *RetryRunner) retry(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd, exec func(*exec.Cmd) error) (*exec.Cmd, error) {
+	attempts := r.Attempts
+	if attempts <= 0 {
+		attempts = DefaultRetryAttempts
+	}
+	backoff := r.Backoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		err := exec(cmd)
+		if err == nil || clone == nil || attempt >= attempts || !IsTextFileBusy(err) {
+			return cmd, err
+		}
+		if cerr := r.pause(backoff); cerr != nil {
+			return cmd, fmt.Errorf("%w: %w", cerr, err)
+		}
+		cmd = clone(cmd)
+	}
+}
+
+// pause waits for backoff, returning Context.Err() early once Context is done.
+func (r *RetryRunner) pause(backoff time.Duration) error {
+	var done <-chan struct{}
+	if r.Context != nil {
+		done = r.Context.Done()
+	}
+	timer := clock.Get().NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-done:
+		return r.Context.Err()
+	}
+}
+
+func (r *RetryRunner) runner() port.CommandRunner {
+	if r.Runner == nil {
+		return Default
+	}
+	return r.Runner
+}
+
+// IsTextFileBusy reports whether err was caused by ETXTBSY.
+func IsTextFileBusy(err error) bool {
+	return errors.Is(err, syscall.ETXTBSY)
+}
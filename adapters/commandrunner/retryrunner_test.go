@@ -0,0 +1,101 @@
+package commandrunner_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"pkt.systems/emrun/adapters/commandrunner"
+	"pkt.systems/emrun/adapters/mockrunner"
+	"pkt.systems/emrun/emruntest"
+)
+
+func textFileBusy(cmd *exec.Cmd) error {
+	return &os.PathError{Op: "fork/exec", Path: cmd.Path, Err: syscall.ETXTBSY}
+}
+
+func cloneCmd(cmd *exec.Cmd) *exec.Cmd {
+	return &exec.Cmd{Path: cmd.Path, Args: cmd.Args}
+}
+
+func TestRetryRunnerRetriesTextFileBusy(t *testing.T) {
+	mock := mockrunner.New(textFileBusy, textFileBusy, func(*exec.Cmd) error { return nil })
+	runner := &commandrunner.RetryRunner{Runner: mock, Attempts: 3, Backoff: time.Microsecond}
+	cmd := &exec.Cmd{Path: "/tool"}
+	ran, err := runner.RunRetry(cmd, cloneCmd)
+	if err != nil {
+		t.Fatalf("RunRetry returned error: %v", err)
+	}
+	if ran == cmd {
+		t.Fatalf("expected the successful attempt to run on a clone")
+	}
+	if mock.Calls != 3 {
+		t.Fatalf("Calls = %d, want 3", mock.Calls)
+	}
+}
+
+func TestRetryRunnerStopsAfterAttempts(t *testing.T) {
+	mock := mockrunner.New(textFileBusy, textFileBusy, textFileBusy)
+	runner := &commandrunner.RetryRunner{Runner: mock, Attempts: 2, Backoff: time.Microsecond}
+	if _, err := runner.StartRetry(&exec.Cmd{Path: "/tool"}, cloneCmd); !commandrunner.IsTextFileBusy(err) {
+		t.Fatalf("expected ETXTBSY, got %v", err)
+	}
+	if mock.Calls != 2 {
+		t.Fatalf("Calls = %d, want 2", mock.Calls)
+	}
+}
+
+func TestRetryRunnerIgnoresOtherErrors(t *testing.T) {
+	sentinel := errors.New("sentinel")
+	mock := mockrunner.New(func(*exec.Cmd) error { return sentinel })
+	runner := &commandrunner.RetryRunner{Runner: mock}
+	if _, err := runner.RunRetry(&exec.Cmd{Path: "/tool"}, cloneCmd); !errors.Is(err, sentinel) {
+		t.Fatalf("expected sentinel, got %v", err)
+	}
+	if mock.Calls != 1 {
+		t.Fatalf("Calls = %d, want 1", mock.Calls)
+	}
+}
+
+func TestRetryRunnerRunSingleAttempt(t *testing.T) {
+	mock := mockrunner.New(textFileBusy, textFileBusy)
+	runner := &commandrunner.RetryRunner{Runner: mock}
+	if err := runner.Run(&exec.Cmd{Path: "/tool"}); !commandrunner.IsTextFileBusy(err) {
+		t.Fatalf("expected ETXTBSY, got %v", err)
+	}
+	if mock.Calls != 1 {
+		t.Fatalf("Calls = %d, want 1", mock.Calls)
+	}
+}
+
+func TestRetryRunnerStopsWaitingOnCancel(t *testing.T) {
+	clk := emruntest.NewFakeClock(time.Unix(0, 0))
+	emruntest.SetClock(t, clk)
+	ctx, cancel := context.WithCancel(context.Background())
+	mock := mockrunner.New(textFileBusy, func(*exec.Cmd) error { return nil })
+	runner := &commandrunner.RetryRunner{Runner: mock, Backoff: time.Hour, Context: ctx}
+	done := make(chan error, 1)
+	go func() {
+		_, err := runner.RunRetry(&exec.Cmd{Path: "/tool"}, cloneCmd)
+		done <- err
+	}()
+	for clk.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) || !commandrunner.IsTextFileBusy(err) {
+			t.Fatalf("expected the cancellation and the last ETXTBSY, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunRetry kept waiting out the backoff after cancellation")
+	}
+	if mock.Calls != 1 {
+		t.Fatalf("Calls = %d, want 1", mock.Calls)
+	}
+}
@@ -0,0 +1,104 @@
+package commandrunner
+
+import (
+	"context"
+	"os/exec"
+
+	"pkt.systems/emrun/port"
+)
+
+// TracePropagatingRunner wraps Runner and adds the environment variables Env
+// derives from Context, such as a W3C TRACEPARENT, to every command before it
+// is run or started, so embedded tools join the caller's trace. Runners only
+// see the command, so the context is captured when the runner is built; store
+// a fresh one per operation with emrun.WithRunner:
+//
+//	ctx = emrun.WithRunner(ctx, &commandrunner.TracePropagatingRunner{
+//		Context: ctx,
+//		Env: func(ctx context.Context) []string {
+//			return []string{"TRACEPARENT=" + traceparent(ctx)}
+//		},
+//	})
+//	out, err := emrun.Run(ctx, payload)
+//
+// Variables are appended to cmd.Env, or to the environment the command would
+// inherit when cmd.Env is nil, so they replace existing values of the same
+// name. Retries are passed through when Runner is a port.CommandRetrier.
+type TracePropagatingRunner struct {
+	// Runner executes the commands, commandrunner.Default when nil.
+	Runner port.CommandRunner
+	// Context is handed to Env, context.Background() when nil.
+	Context context.Context
+	// Env returns "KEY=value" pairs to add. Commands are left untouched when
+	// Env is nil.
+	Env func(context.Context) []string
+}
+
+var _ port.CommandRetrier = (*TracePropagatingRunner)(nil)
+
+// Run adds the trace environment to cmd and runs it through the wrapped runner.
+func (t *TracePropagatingRunner) Run(cmd *exec.Cmd) error {
+	t.inject(cmd)
+	return t.runner().Run(cmd)
+}
+
+// Start adds the trace environment to cmd and starts it through the wrapped
+// runner.
+func (t *TracePropagatingRunner) Start(cmd *exec.Cmd) error {
+	t.inject(cmd)
+	return t.runner().Start(cmd)
+}
+
+// RunRetry is Run for a wrapped port.CommandRetrier; clones get the trace
+// environment as well. Other runners run cmd once.
+func (t *TracePropagatingRunner) RunRetry(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd) (*exec.Cmd, error) {
+	retrier, ok := t.runner().(port.CommandRetrier)
+	if !ok {
+		return cmd, t.Run(cmd)
+	}
+	t.inject(cmd)
+	return retrier.RunRetry(cmd, t.cloner(clone))
+}
+
+// StartRetry is the Start counterpart of RunRetry.
+func (t *TracePropagatingRunner) StartRetry(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd) (*exec.Cmd, error) {
+	retrier, ok := t.runner().(port.CommandRetrier)
+	if !ok {
+		return cmd, t.Start(cmd)
+	}
+	t.inject(cmd)
+	return retrier.StartRetry(cmd, t.cloner(clone))
+}
+
+func (t *TracePropagatingRunner) cloner(clone func(*exec.Cmd) *exec.Cmd) func(*exec.Cmd) *exec.Cmd {
+	if clone == nil {
+		return nil
+	}
+	return func(cmd *exec.Cmd) *exec.Cmd {
+		c := clone(cmd)
+		t.inject(c)
+		return c
+	}
+}
+
+func (t *TracePropagatingRunner) inject(cmd *exec.Cmd) {
+	if t.Env == nil {
+		return
+	}
+	ctx := t.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	vars := t.Env(ctx)
+	if len(vars) == 0 {
+		return
+	}
+	cmd.Env = append(cmd.Environ(), vars...)
+}
+
+func (t *TracePropagatingRunner) runner() port.CommandRunner {
+	if t.Runner == nil {
+		return Default
+	}
+	return t.Runner
+}
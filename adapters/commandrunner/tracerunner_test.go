@@ -0,0 +1,69 @@
+package commandrunner_test
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+
+	"pkt.systems/emrun/adapters/commandrunner"
+	"pkt.systems/emrun/adapters/mockrunner"
+)
+
+type traceKey struct{}
+
+func traceEnv(ctx context.Context) []string {
+	if id, ok := ctx.Value(traceKey{}).(string); ok {
+		return []string{"TRACEPARENT=" + id}
+	}
+	return nil
+}
+
+func TestTracePropagatingRunner(t *testing.T) {
+	ctx := context.WithValue(context.Background(), traceKey{}, "00-trace-span-01")
+	runner := &commandrunner.TracePropagatingRunner{Context: ctx, Env: traceEnv}
+	cmd := exec.Command("/bin/sh", "-c", "echo $TRACEPARENT")
+	cmd.Env = []string{"TRACEPARENT=stale"}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := runner.Run(cmd); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if out.String() != "00-trace-span-01\n" {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+
+	inherit := exec.Command("/bin/true")
+	if err := runner.Start(inherit); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	inherit.Wait()
+	if len(inherit.Env) < 2 || !slices.Contains(inherit.Env, "TRACEPARENT=00-trace-span-01") {
+		t.Fatalf("expected inherited environment plus TRACEPARENT, got %q", inherit.Env)
+	}
+
+	untouched := exec.Command("/bin/true")
+	(&commandrunner.TracePropagatingRunner{Env: traceEnv}).Run(untouched)
+	if untouched.Env != nil {
+		t.Fatalf("expected no environment without trace state, got %q", untouched.Env)
+	}
+}
+
+func TestTracePropagatingRunnerRetries(t *testing.T) {
+	ctx := context.WithValue(context.Background(), traceKey{}, "00-trace-span-01")
+	mock := mockrunner.New(textFileBusy, func(*exec.Cmd) error { return nil })
+	runner := &commandrunner.TracePropagatingRunner{
+		Runner:  &commandrunner.RetryRunner{Runner: mock, Backoff: time.Microsecond},
+		Context: ctx,
+		Env:     traceEnv,
+	}
+	ran, err := runner.StartRetry(&exec.Cmd{Path: "/tool"}, cloneCmd)
+	if err != nil {
+		t.Fatalf("StartRetry returned error: %v", err)
+	}
+	if mock.Calls != 2 || !slices.Contains(ran.Env, "TRACEPARENT=00-trace-span-01") {
+		t.Fatalf("expected a retried clone carrying TRACEPARENT, got %d calls, env %q", mock.Calls, ran.Env)
+	}
+}
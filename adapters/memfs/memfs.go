@@ -0,0 +1,237 @@
+// Package memfs provides an in-memory port.TempFS for tests of code built on
+// efrun, so payloads never touch the disk. Files it holds cannot be executed
+// by the operating system; pair it with a mock runner.
+package memfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"pkt.systems/emrun/port"
+)
+
+// TempDir is the directory CreateTemp uses when dir is empty.
+const TempDir = "/memfs"
+
+// FS is a thread-safe in-memory TempFS. The zero value is ready to use.
+type FS struct {
+	mu    sync.Mutex
+	files map[string]*entry
+	seq   int
+}
+
+var _ port.TempFS = (*FS)(nil)
+
+type entry struct {
+	data []byte
+	mode fs.FileMode
+}
+
+// New returns an empty FS.
+func New() *FS {
+	return &FS{}
+}
+
+// CreateTemp creates a new, empty file named after pattern like
+// os.CreateTemp, with the last "*" replaced by a unique number.
+func (f *FS) CreateTemp(dir, pattern string) (port.TempFile, error) {
+	if dir == "" {
+		dir = TempDir
+	}
+	if strings.ContainsRune(pattern, '/') {
+		return nil, &fs.PathError{Op: "createtemp", Path: pattern, Err: errors.New("pattern contains path separator")}
+	}
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndexByte(pattern, '*'); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.files == nil {
+		f.files = make(map[string]*entry)
+	}
+	for {
+		f.seq++
+		name := path.Join(dir, prefix+strconv.Itoa(f.seq)+suffix)
+		if _, exists := f.files[name]; exists {
+			continue
+		}
+		e := &entry{mode: 0o600}
+		f.files[name] = e
+		return &file{fs: f, entry: e, name: name, writable: true}, nil
+	}
+}
+
+// Chmod sets the permission bits of name.
+func (f *FS) Chmod(name string, mode fs.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.files[name]
+	if !ok {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrNotExist}
+	}
+	e.mode = mode.Perm()
+	return nil
+}
+
+// Remove deletes name. Handles that are still open keep reading its content,
+// as they would after unlink(2).
+func (f *FS) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(f.files, name)
+	return nil
+}
+
+// Open opens name read-only.
+func (f *FS) Open(name string) (port.TempFile, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &file{fs: f, entry: e, name: name}, nil
+}
+
+// ReadFile returns a copy of the content of name.
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return slices.Clone(e.data), nil
+}
+
+// Mode returns the permission bits of name.
+func (f *FS) Mode(name string) (fs.FileMode, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.files[name]
+	if !ok {
+		return 0, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return e.mode, nil
+}
+
+// Names returns the sorted names of all files, e.g. to assert that nothing
+// was left behind.
+func (f *FS) Names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := make([]string, 0, len(f.files))
+	for name := range f.files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// file is an open handle on an entry with its own offset.
+type file struct {
+	fs       *FS
+	entry    *entry
+	name     string
+	offset   int64
+	writable bool
+	closed   bool
+}
+
+func (h *file) Name() string {
+	return h.name
+}
+
+func (h *file) Read(p []byte) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	n, err := h.readAt(p, h.offset, "read")
+	h.offset += int64(n)
+	return n, err
+}
+
+func (h *file) ReadAt(p []byte, off int64) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	n, err := h.readAt(p, off, "readat")
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (h *file) readAt(p []byte, off int64, op string) (int, error) {
+	if h.closed {
+		return 0, &fs.PathError{Op: op, Path: h.name, Err: fs.ErrClosed}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: op, Path: h.name, Err: fs.ErrInvalid}
+	}
+	if off >= int64(len(h.entry.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return copy(p, h.entry.data[off:]), nil
+}
+
+func (h *file) Write(p []byte) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	if h.closed {
+		return 0, &fs.PathError{Op: "write", Path: h.name, Err: fs.ErrClosed}
+	}
+	if !h.writable {
+		return 0, &fs.PathError{Op: "write", Path: h.name, Err: fs.ErrPermission}
+	}
+	end := h.offset + int64(len(p))
+	if end > int64(len(h.entry.data)) {
+		h.entry.data = slices.Grow(h.entry.data, int(end)-len(h.entry.data))[:end]
+	}
+	copy(h.entry.data[h.offset:], p)
+	h.offset = end
+	return len(p), nil
+}
+
+func (h *file) Seek(offset int64, whence int) (int64, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	if h.closed {
+		return 0, &fs.PathError{Op: "seek", Path: h.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += h.offset
+	case io.SeekEnd:
+		offset += int64(len(h.entry.data))
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: h.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: h.name, Err: fs.ErrInvalid}
+	}
+	h.offset = offset
+	return offset, nil
+}
+
+func (h *file) Close() error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	if h.closed {
+		return &fs.PathError{Op: "close", Path: h.name, Err: fs.ErrClosed}
+	}
+	h.closed = true
+	return nil
+}
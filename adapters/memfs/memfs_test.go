@@ -0,0 +1,65 @@
+package memfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFSRoundTrip(t *testing.T) {
+	fsys := New()
+	w, err := fsys.CreateTemp("", "payload-*.exe")
+	if err != nil {
+		t.Fatalf("CreateTemp returned error: %v", err)
+	}
+	name := w.Name()
+	if !strings.HasPrefix(name, TempDir+"/payload-") || !strings.HasSuffix(name, ".exe") {
+		t.Fatalf("unexpected name %q", name)
+	}
+	if _, err := io.WriteString(w, "#!/bin/sh\necho memfs\n"); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if err := fsys.Chmod(name, 0o700); err != nil {
+		t.Fatalf("Chmod returned error: %v", err)
+	}
+	if mode, err := fsys.Mode(name); err != nil || mode != 0o700 {
+		t.Fatalf("Mode = %v, %v", mode, err)
+	}
+
+	r, err := fsys.Open(name)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	if err := iotest.TestReader(r, []byte("#!/bin/sh\necho memfs\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Write([]byte("x")); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected read-only handle, got %v", err)
+	}
+
+	if err := fsys.Remove(name); err != nil {
+		t.Fatalf("Remove returned error: %v", err)
+	}
+	if _, err := fsys.Open(name); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist after Remove, got %v", err)
+	}
+	buf := make([]byte, 2)
+	if _, err := r.ReadAt(buf, 0); err != nil || string(buf) != "#!" {
+		t.Fatalf("open handle lost content after Remove: %q, %v", buf, err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if _, err := r.Read(buf); !errors.Is(err, fs.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if names := fsys.Names(); len(names) != 0 {
+		t.Fatalf("files left behind: %v", names)
+	}
+}
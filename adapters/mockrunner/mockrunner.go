@@ -53,3 +53,12 @@ func (r *Runner) Remaining() int {
 	defer r.mu.Unlock()
 	return len(r.behaviors)
 }
+
+// Snapshot returns Calls, a copy of Paths and Remaining as of a single point
+// in time, so they are consistent with each other even while other goroutines
+// keep calling Run.
+func (r *Runner) Snapshot() (calls int, paths []string, remaining int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Calls, slices.Clone(r.Paths), len(r.behaviors)
+}
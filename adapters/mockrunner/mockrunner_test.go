@@ -2,6 +2,7 @@ package mockrunner
 
 import (
 	"errors"
+	"sync"
 	"testing"
 
 	"os/exec"
@@ -79,3 +80,37 @@ func TestRunnerRunSequentialBehaviors(t *testing.T) {
 		t.Fatalf("Remaining() = %d, want 0", remaining)
 	}
 }
+
+func TestRunnerSnapshot(t *testing.T) {
+	const total = 50
+	behaviors := make([]Behavior, total)
+	for i := range behaviors {
+		behaviors[i] = func(*exec.Cmd) error { return nil }
+	}
+	runner := New(behaviors...)
+
+	var wg sync.WaitGroup
+	for range total {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runner.Run(&exec.Cmd{Path: "tool"})
+		}()
+	}
+	for range total {
+		calls, paths, remaining := runner.Snapshot()
+		if len(paths) != calls || calls+remaining != total {
+			t.Fatalf("inconsistent snapshot: calls=%d paths=%d remaining=%d", calls, len(paths), remaining)
+		}
+	}
+	wg.Wait()
+
+	calls, paths, remaining := runner.Snapshot()
+	if calls != total || len(paths) != total || remaining != 0 {
+		t.Fatalf("Snapshot() = %d, %d paths, %d; want %d, %d paths, 0", calls, len(paths), remaining, total, total)
+	}
+	paths[0] = "mutated"
+	if runner.Paths[0] != "tool" {
+		t.Fatal("Snapshot returned the runner's own Paths slice")
+	}
+}
@@ -0,0 +1,93 @@
+package emrun
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+)
+
+// ErrArchMismatch is reported by CheckArch, and by runs with WithArchCheck,
+// when an ELF payload is built for a machine the host cannot execute.
+var ErrArchMismatch = errors.New("emrun: payload architecture does not match host")
+
+// hostMachines maps GOARCH to the ELF machines the host executes natively,
+// including the 32-bit compat machine where 64-bit kernels usually run it.
+var hostMachines = map[string][]elf.Machine{
+	"386":      {elf.EM_386},
+	"amd64":    {elf.EM_X86_64, elf.EM_386},
+	"arm":      {elf.EM_ARM},
+	"arm64":    {elf.EM_AARCH64, elf.EM_ARM},
+	"loong64":  {elf.EM_LOONGARCH},
+	"mips":     {elf.EM_MIPS},
+	"mipsle":   {elf.EM_MIPS},
+	"mips64":   {elf.EM_MIPS},
+	"mips64le": {elf.EM_MIPS},
+	"ppc64":    {elf.EM_PPC64},
+	"ppc64le":  {elf.EM_PPC64},
+	"riscv64":  {elf.EM_RISCV},
+	"s390x":    {elf.EM_S390},
+}
+
+// machineNames gives the uname -m style names used in mismatch messages.
+var machineNames = map[elf.Machine]string{
+	elf.EM_386:       "i386",
+	elf.EM_X86_64:    "x86_64",
+	elf.EM_ARM:       "arm",
+	elf.EM_AARCH64:   "aarch64",
+	elf.EM_LOONGARCH: "loongarch64",
+	elf.EM_MIPS:      "mips",
+	elf.EM_PPC64:     "ppc64",
+	elf.EM_RISCV:     "riscv64",
+	elf.EM_S390:      "s390x",
+}
+
+func machineName(m elf.Machine) string {
+	if name, ok := machineNames[m]; ok {
+		return name
+	}
+	return strings.ToLower(strings.TrimPrefix(m.String(), "EM_"))
+}
+
+// CheckArch reads the ELF header of the payload behind r and returns an error
+// wrapping ErrArchMismatch, e.g. "payload is aarch64, host is x86_64", when
+// the host cannot execute it. Only the first 20 bytes are read and the offset
+// of r is restored afterwards. Payloads that are not ELF, such as shebang
+// scripts, and hosts whose GOARCH is unknown pass the check.
+func CheckArch(r io.ReadSeeker) error {
+	offset, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("arch check: %w", err)
+	}
+	defer r.Seek(offset, io.SeekStart)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("arch check: %w", err)
+	}
+	var header [20]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("arch check: %w", err)
+	}
+	if n < len(header) || !bytes.Equal(header[:4], []byte(elf.ELFMAG)) {
+		return nil
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if elf.Data(header[elf.EI_DATA]) == elf.ELFDATA2MSB {
+		order = binary.BigEndian
+	}
+	machine := elf.Machine(order.Uint16(header[18:]))
+	host, known := hostMachines[runtime.GOARCH]
+	if !known {
+		return nil
+	}
+	for _, m := range host {
+		if m == machine {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: payload is %s, host is %s", ErrArchMismatch, machineName(machine), machineName(host[0]))
+}
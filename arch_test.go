@@ -0,0 +1,63 @@
+package emrun
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// foreignELFHeader returns a minimal little-endian ELF header for a machine
+// the host cannot run.
+func foreignELFHeader() ([]byte, string) {
+	machine, name := elf.EM_S390, "s390x"
+	if runtime.GOARCH == "s390x" {
+		machine, name = elf.EM_X86_64, "x86_64"
+	}
+	header := make([]byte, 64)
+	copy(header, elf.ELFMAG)
+	header[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	binary.LittleEndian.PutUint16(header[18:], uint16(machine))
+	return header, name
+}
+
+func TestCheckArch(t *testing.T) {
+	self, err := os.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatalf("read test binary: %v", err)
+	}
+	foreign, foreignName := foreignELFHeader()
+	tests := []struct {
+		name    string
+		payload []byte
+		wantErr string
+	}{
+		{name: "host binary", payload: self},
+		{name: "shebang script", payload: []byte("#!/bin/sh\necho hi\n")},
+		{name: "short payload", payload: []byte("\x7fELF")},
+		{name: "foreign machine", payload: foreign, wantErr: "payload is " + foreignName},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bytes.NewReader(tc.payload)
+			r.Seek(3, io.SeekStart)
+			err := CheckArch(r)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("CheckArch returned error: %v", err)
+				}
+			} else if !errors.Is(err, ErrArchMismatch) || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected ErrArchMismatch mentioning %q, got %v", tc.wantErr, err)
+			}
+			if pos, _ := r.Seek(0, io.SeekCurrent); pos != 3 {
+				t.Fatalf("offset not restored: %d", pos)
+			}
+		})
+	}
+}
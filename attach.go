@@ -0,0 +1,126 @@
+//go:build linux || android
+// +build linux android
+
+package emrun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"pkt.systems/emrun/internal/clock"
+)
+
+// attachPollInterval is how often AttachPID checks on the process when the
+// kernel has no pidfd support, and how promptly it notices cancellation.
+const attachPollInterval = 100 * time.Millisecond
+
+// AttachPID wraps the running process pid in a Background, e.g. to wait on a
+// detached process emrun launched earlier from a supervisor that was
+// restarted since. Completion is observed through a pidfd, or by polling with
+// signal 0 on kernels older than 5.3. Cancel kills the process with SIGKILL;
+// use WaitWithContext to stop waiting without killing it. PidFD and Signal work
+// as for Backgrounds from StartBackground.
+//
+// The Result is of limited fidelity since the process was not started by this
+// Background: there is never any output, byte counts or ProcessState. When the
+// process is a child of this process, ExitCode and Error describe how it
+// exited, as os/exec would. Otherwise the exit status belongs to its actual
+// parent and cannot be known: ExitCode is then -1 and Error is nil. Do not
+// also wait on a child with os/exec or Wait4, whichever waits first takes the
+// status.
+//
+//	bg, err := emrun.AttachPID(pid)
+//	if err != nil {
+//		return err
+//	}
+//	res := bg.Wait()
+func AttachPID(pid int) (*Background, error) {
+	if pid <= 0 {
+		return nil, fmt.Errorf("emrun: attach: invalid pid %d", pid)
+	}
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	if errors.Is(err, unix.ENOSYS) {
+		pidfd, err = -1, unix.Kill(pid, 0)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("emrun: attach %d: %w", pid, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan Result, 1)
+	bg := &Background{
+		Context: ctx,
+		Cancel:  cancel,
+		Done:    done,
+		settled: make(chan struct{}),
+	}
+	process, _ := os.FindProcess(pid)
+	bg.track(process, pidfd)
+	go func() {
+		res := waitAttached(ctx, pid, pidfd)
+		bg.untrack()
+		bg.settle(res)
+		done <- res
+		close(done)
+		cancel()
+	}()
+	return bg, nil
+}
+
+// waitAttached blocks until pid has exited, killing it once ctx is cancelled.
+// pidfd is -1 when the kernel has none.
+func waitAttached(ctx context.Context, pid, pidfd int) Result {
+	killed := false
+	for {
+		if !killed && ctx.Err() != nil {
+			killed = true
+			if pidfd >= 0 {
+				unix.PidfdSendSignal(pidfd, unix.SIGKILL, nil, 0)
+			} else {
+				unix.Kill(pid, unix.SIGKILL)
+			}
+		}
+		if res, ok := reapChild(pid); ok {
+			return res
+		}
+		if pidfd >= 0 {
+			fds := []unix.PollFd{{Fd: int32(pidfd), Events: unix.POLLIN}}
+			n, err := unix.Poll(fds, int(attachPollInterval/time.Millisecond))
+			if err != nil && !errors.Is(err, unix.EINTR) {
+				return Result{ExitCode: -1, Error: fmt.Errorf("emrun: wait for %d: %w", pid, err)}
+			}
+			if n > 0 {
+				if res, ok := reapChild(pid); ok {
+					return res
+				}
+				return Result{ExitCode: -1}
+			}
+			continue
+		}
+		if errors.Is(unix.Kill(pid, 0), unix.ESRCH) {
+			return Result{ExitCode: -1}
+		}
+		<-clock.Get().After(attachPollInterval)
+	}
+}
+
+// reapChild collects the exit status of pid if it is an exited child of this
+// process.
+func reapChild(pid int) (Result, bool) {
+	var status unix.WaitStatus
+	wpid, err := unix.Wait4(pid, &status, unix.WNOHANG, nil)
+	if err != nil || wpid != pid {
+		return Result{}, false
+	}
+	switch {
+	case status.Exited() && status.ExitStatus() == 0:
+		return Result{}, true
+	case status.Exited():
+		return Result{ExitCode: status.ExitStatus(), Error: fmt.Errorf("emrun: process %d exited with status %d", pid, status.ExitStatus())}, true
+	default:
+		return Result{ExitCode: -1, Error: fmt.Errorf("emrun: process %d killed by signal %v", pid, status.Signal())}, true
+	}
+}
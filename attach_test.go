@@ -0,0 +1,64 @@
+//go:build linux || android
+// +build linux android
+
+package emrun
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttachPID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	child := exec.Command("/bin/sh", "-c", "sleep 0.2; exit 3")
+	if err := child.Start(); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	bg, err := AttachPID(child.Process.Pid)
+	if err != nil {
+		t.Fatalf("AttachPID returned error: %v", err)
+	}
+	if res := bg.WaitWithContext(ctx); res.ExitCode != 3 || res.Error == nil {
+		t.Fatalf("expected exit code 3 with an error, got %+v", res)
+	}
+
+	// The grandchild is reparented away from us, so its status is unknown.
+	out, err := exec.Command("/bin/sh", "-c", "sleep 0.2 </dev/null >/dev/null 2>&1 & echo $!").Output()
+	if err != nil {
+		t.Fatalf("starting the grandchild failed: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		t.Fatalf("unexpected pid %q", out)
+	}
+	bg, err = AttachPID(pid)
+	if err != nil {
+		t.Fatalf("AttachPID returned error: %v", err)
+	}
+	if res := bg.WaitWithContext(ctx); res.ExitCode != -1 || res.Error != nil {
+		t.Fatalf("expected an unknown exit status, got %+v", res)
+	}
+
+	sleeper := exec.Command("/bin/sh", "-c", "sleep 30")
+	if err := sleeper.Start(); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	bg, err = AttachPID(sleeper.Process.Pid)
+	if err != nil {
+		t.Fatalf("AttachPID returned error: %v", err)
+	}
+	bg.Cancel()
+	if res := bg.WaitWithContext(ctx); res.ExitCode != -1 || res.Error == nil || !strings.Contains(res.Error.Error(), "killed") {
+		t.Fatalf("expected the process to be killed, got %+v", res)
+	}
+
+	if _, err := AttachPID(0); err == nil {
+		t.Fatal("expected an error for pid 0")
+	}
+}
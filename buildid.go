@@ -0,0 +1,77 @@
+package emrun
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNoBuildID is reported by BuildID for ELF payloads linked without a GNU
+// build ID note.
+var ErrNoBuildID = errors.New("emrun: payload has no build ID")
+
+// BuildID returns the GNU build ID of an ELF payload as lowercase hex, read
+// from its .note.gnu.build-id section or, when section headers were stripped,
+// from its PT_NOTE segments. The build ID names the build a binary came from
+// and survives stripping debug information, which changes the content hash,
+// see WithBuildIDRule. It is chosen by the linker, or by whoever builds the
+// payload, so it can be copied into any binary and does not authenticate it.
+// Payloads that are not ELF, such as scripts, return an error, and ELF
+// payloads without the note one wrapping ErrNoBuildID.
+func BuildID(payload []byte) (string, error) {
+	return buildIDFrom(bytes.NewReader(payload))
+}
+
+// buildIDFrom reads the build ID of the ELF file behind r.
+func buildIDFrom(r io.ReaderAt) (string, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return "", fmt.Errorf("build ID: %w", err)
+	}
+	defer f.Close()
+	if s := f.Section(".note.gnu.build-id"); s != nil {
+		if id, ok := findBuildIDNote(s.Open(), f.ByteOrder); ok {
+			return id, nil
+		}
+	}
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_NOTE {
+			continue
+		}
+		if id, ok := findBuildIDNote(p.Open(), f.ByteOrder); ok {
+			return id, nil
+		}
+	}
+	return "", ErrNoBuildID
+}
+
+// findBuildIDNote scans the ELF notes in r for an NT_GNU_BUILD_ID note owned
+// by "GNU" and returns its descriptor as hex.
+func findBuildIDNote(r io.Reader, order binary.ByteOrder) (string, bool) {
+	const ntGNUBuildID = 3
+	data, err := io.ReadAll(io.LimitReader(r, 1<<20))
+	if err != nil {
+		return "", false
+	}
+	// Sizes come from the payload; in uint64 neither they nor their
+	// alignment can wrap around.
+	align4 := func(n uint64) uint64 { return (n + 3) &^ 3 }
+	for len(data) >= 12 {
+		namesz, descsz, typ := uint64(order.Uint32(data[0:])), uint64(order.Uint32(data[4:])), order.Uint32(data[8:])
+		data = data[12:]
+		if align4(namesz)+align4(descsz) > uint64(len(data)) {
+			return "", false
+		}
+		name := data[:namesz]
+		desc := data[align4(namesz) : align4(namesz)+descsz]
+		data = data[align4(namesz)+align4(descsz):]
+		if typ == ntGNUBuildID && string(name) == "GNU\x00" && len(desc) > 0 {
+			return hex.EncodeToString(desc), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,80 @@
+//go:build linux || android
+// +build linux android
+
+package emrun
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBuildID(t *testing.T) {
+	if _, err := BuildID([]byte("#!/bin/sh\necho script\n")); err == nil || errors.Is(err, ErrNoBuildID) {
+		t.Fatalf("BuildID of a script = %v, want a non-ELF error", err)
+	}
+	sh, err := os.ReadFile("/bin/sh")
+	if err != nil {
+		t.Skipf("no /bin/sh to inspect: %v", err)
+	}
+	id, err := BuildID(sh)
+	if errors.Is(err, ErrNoBuildID) {
+		t.Skip("/bin/sh has no build ID")
+	}
+	if err != nil {
+		t.Fatalf("BuildID returned error: %v", err)
+	}
+	if !isHexString(id) || id != strings.ToLower(id) {
+		t.Fatalf("unexpected build ID %q", id)
+	}
+}
+
+func TestFindBuildIDNoteOversizedSizes(t *testing.T) {
+	for _, sizes := range [][2]uint32{{0xffffffff, 0}, {0, 0xffffffff}, {0xfffffffd, 4}} {
+		note := binary.LittleEndian.AppendUint32(nil, sizes[0])
+		note = binary.LittleEndian.AppendUint32(note, sizes[1])
+		note = binary.LittleEndian.AppendUint32(note, 3)
+		note = append(note, "GNU\x00abcd"...)
+		if id, ok := findBuildIDNote(bytes.NewReader(note), binary.LittleEndian); ok {
+			t.Fatalf("sizes %#x: found build ID %q in a truncated note", sizes, id)
+		}
+	}
+}
+
+func TestWithBuildIDRule(t *testing.T) {
+	sh, err := os.ReadFile("/bin/sh")
+	if err != nil {
+		t.Skipf("no /bin/sh to run as a payload: %v", err)
+	}
+	id, err := BuildID(sh)
+	if err != nil {
+		t.Skipf("no build ID on /bin/sh: %v", err)
+	}
+	ctx := WithPolicy(context.Background(), DENY)
+	if _, err := Run(ctx, sh, "-c", "true"); !errors.Is(err, ErrDenied) {
+		t.Fatalf("Run without rule = %v, want ErrDenied", err)
+	}
+	allowed := WithBuildIDRule(ctx, ALLOW, strings.ToUpper(id))
+	if out, err := Run(allowed, sh, "-c", "echo ok"); err != nil || string(out) != "ok\n" {
+		t.Fatalf("Run with allowed build ID = %q, %v", out, err)
+	}
+	denied := WithBuildIDRule(WithPolicy(context.Background(), ALLOW), DENY, id)
+	_, err = Run(denied, sh, "-c", "true")
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) || policyErr.BuildID != id || policyErr.ByDefault {
+		t.Fatalf("Run with denied build ID = %v", err)
+	}
+	sum := sha256.Sum256(sh)
+	if _, err := Run(WithRule(denied, ALLOW, sum), sh, "-c", "true"); err != nil {
+		t.Fatalf("digest rule did not take precedence: %v", err)
+	}
+	// A script has no build ID and falls through to the default verdict.
+	if _, err := Run(allowed, []byte("#!/bin/sh\ntrue\n")); !errors.Is(err, ErrDenied) {
+		t.Fatalf("Run of a script = %v, want ErrDenied", err)
+	}
+}
@@ -0,0 +1,95 @@
+package emrun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// capabilityList validates keep and renders it as the comma separated list
+// dropCapabilities takes.
+func capabilityList(keep []int) (string, error) {
+	fields := make([]string, len(keep))
+	for i, c := range keep {
+		if c < 0 || c > 63 {
+			return "", fmt.Errorf("invalid capability %d", c)
+		}
+		fields[i] = strconv.Itoa(c)
+	}
+	return strings.Join(fields, ","), nil
+}
+
+// dropCapabilities reduces the bounding, permitted, effective and inheritable
+// sets of the calling thread to the comma separated capabilities in keep, and
+// raises the kept ones as ambient so they survive execve(2) for non-root users
+// too.
+func dropCapabilities(keep string) error {
+	var keepMask uint64
+	for _, field := range strings.Split(keep, ",") {
+		if field == "" {
+			continue
+		}
+		c, err := strconv.Atoi(field)
+		if err != nil || c < 0 || c > 63 {
+			return fmt.Errorf("invalid capability %q", field)
+		}
+		keepMask |= 1 << c
+	}
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("capget: %w", err)
+	}
+	permitted := uint64(data[0].Permitted) | uint64(data[1].Permitted)<<32
+	last := lastCap()
+	// Root regains its bounding set on execve(2), so it has to shrink too.
+	// That needs CAP_SETPCAP; without it the caller holds no capabilities to
+	// pass on and only the permitted sets are cleared.
+	if permitted&(1<<unix.CAP_SETPCAP) != 0 {
+		for c := 0; c <= last; c++ {
+			if keepMask&(1<<c) != 0 {
+				continue
+			}
+			if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil && !errors.Is(err, unix.EINVAL) {
+				return fmt.Errorf("drop capability %d from bounding set: %w", c, err)
+			}
+		}
+	}
+	kept := keepMask & permitted
+	for i := range data {
+		half := uint32(kept >> (32 * i))
+		data[i] = unix.CapUserData{Effective: half, Permitted: half, Inheritable: half}
+	}
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("capset: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil && !errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("clear ambient capabilities: %w", err)
+	}
+	for c := 0; c <= last; c++ {
+		if kept&(1<<c) == 0 {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(c), 0, 0); err != nil {
+			return fmt.Errorf("raise ambient capability %d: %w", c, err)
+		}
+	}
+	return nil
+}
+
+// lastCap returns the highest capability the running kernel knows.
+func lastCap() int {
+	data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || last < 0 || last > 63 {
+		return unix.CAP_LAST_CAP
+	}
+	return last
+}
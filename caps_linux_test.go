@@ -0,0 +1,128 @@
+package emrun
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestWithCapabilities(t *testing.T) {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		t.Fatalf("capget: %v", err)
+	}
+	if data[0].Effective&(1<<unix.CAP_SYS_ADMIN) == 0 || data[0].Effective&(1<<unix.CAP_NET_BIND_SERVICE) == 0 {
+		t.Skip("test needs CAP_SYS_ADMIN and CAP_NET_BIND_SERVICE")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = WithOptions(ctx, WithCapabilities(unix.CAP_NET_BIND_SERVICE))
+	out, err := Run(ctx, []byte("#!/bin/sh\ngrep -E '^Cap(Eff|Bnd):' /proc/$$/status\necho args:$0:$1\n"), "first")
+	if err != nil {
+		t.Fatalf("Run returned error: %v (%s)", err, out)
+	}
+	want := fmt.Sprintf("%016x", uint64(1)<<unix.CAP_NET_BIND_SERVICE)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		switch name {
+		case "CapEff", "CapBnd":
+			if value != want {
+				t.Fatalf("%s = %s, want %s", name, value, want)
+			}
+		case "args":
+			if !strings.HasSuffix(value, ":first") {
+				t.Fatalf("arguments not passed through: %q", line)
+			}
+		}
+	}
+
+	out, err = Run(WithOptions(ctx, WithCapabilities()), []byte("#!/bin/sh\ngrep '^CapEff:' /proc/$$/status\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v (%s)", err, out)
+	}
+	if fields := strings.Fields(string(out)); len(fields) != 2 || fields[1] != strings.Repeat("0", 16) {
+		t.Fatalf("expected no effective capabilities, got %q", out)
+	}
+
+	if _, err := Run(WithOptions(ctx, WithCapabilities(64)), []byte("#!/bin/sh\n")); err == nil || !strings.Contains(err.Error(), strconv.Itoa(64)) {
+		t.Fatalf("expected an invalid capability error, got %v", err)
+	}
+}
+
+func TestTrampolineNeedsToken(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := tokenFile("the parent's token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, token := range []string{"", "forged", "the parent's"} {
+		cmd := exec.Command(self, "-test.run=^$")
+		cmd.ExtraFiles = []*os.File{file}
+		cmd.Env = append(os.Environ(), trampolineExecEnv+"=/bin/echo", capsKeepEnv+"=", trampolineFDEnv+"=3", trampolineTokenEnv+"="+token)
+		out, err := cmd.CombinedOutput()
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 127 || !strings.Contains(string(out), "token mismatch") {
+			t.Fatalf("token %q: expected the trampoline to refuse, got %v (%s)", token, err, out)
+		}
+	}
+}
+
+func TestQuarantineVerdict(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("test needs root to create namespaces without a user namespace")
+	}
+	hostNet, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		t.Skipf("no network namespace to compare: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	payload := []byte("#!/bin/sh\ngrep '^CapEff:' /proc/$$/status\nreadlink /proc/$$/ns/net\necho tmp:$TMPDIR\ncat /proc/$$/comm\n")
+	sum := sha256.Sum256(payload)
+	ctx = WithRule(WithPolicy(ctx, DENY), QUARANTINE, sum)
+	// An option asking for capabilities back does not weaken the sandbox,
+	// and naming the child still works inside it.
+	ctx = WithOptions(ctx, WithCapabilities(unix.CAP_SYS_ADMIN), WithComm("sandboxed"))
+	out, err := Run(ctx, payload)
+	if err != nil {
+		t.Fatalf("Run returned error: %v (%s)", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("unexpected output %q", out)
+	}
+	if eff := strings.TrimSpace(strings.TrimPrefix(lines[0], "CapEff:")); eff != "0000000000000000" {
+		t.Fatalf("quarantined payload kept capabilities %s", eff)
+	}
+	if lines[1] == hostNet {
+		t.Fatalf("quarantined payload shares the network namespace %s", hostNet)
+	}
+	if lines[2] == "tmp:" || lines[2] == "tmp:"+os.TempDir() {
+		t.Fatalf("quarantined payload has no private TMPDIR: %s", lines[2])
+	}
+	if lines[3] != "sandboxed" {
+		t.Fatalf("unexpected comm %q under quarantine", lines[3])
+	}
+
+	err = CheckPolicy(ctx, sum, hex.EncodeToString(sum[:]))
+	var policyErr *PolicyError
+	if !errors.Is(err, ErrDenied) || !errors.As(err, &policyErr) || policyErr.Verdict != QUARANTINE {
+		t.Fatalf("CheckPolicy of a quarantined digest = %v, want a QUARANTINE denial", err)
+	}
+}
@@ -0,0 +1,90 @@
+package emrun
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// maxComm is the length the kernel truncates a task's comm to.
+const maxComm = 15
+
+// linkComm makes cmd execute its payload through a symlink called name in a
+// new private directory. The kernel sets a process's comm to the base name of
+// the path given to execve(2), before symlinks are resolved, so the child
+// shows up as name in ps and top whether it runs from a memfd or a temporary
+// file. The returned directory is removed when closed, which is safe once cmd
+// has started.
+func linkComm(cmd *exec.Cmd, name string) (removeAll, error) {
+	if !validFileName(name) {
+		return "", fmt.Errorf("invalid comm name %q", name)
+	}
+	target := cmd.Path
+	if !filepath.IsAbs(target) {
+		abs, err := filepath.Abs(filepath.Join(cmd.Dir, target))
+		if err != nil {
+			return "", fmt.Errorf("comm %s: %w", name, err)
+		}
+		target = abs
+	}
+	dir, err := os.MkdirTemp("", "emrun-comm-*")
+	if err != nil {
+		return "", fmt.Errorf("comm %s: %w", name, err)
+	}
+	link := filepath.Join(dir, name)
+	if err := os.Symlink(target, link); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("comm %s: %w", name, err)
+	}
+	cmd.Path = link
+	return removeAll(dir), nil
+}
+
+// copyAuditName copies the executable of cmd to a file called name in a new
+// private directory and makes cmd execute the copy, so the audit subsystem
+// records a descriptive path instead of /proc/self/fd/N. The returned
+// directory is removed when closed, which is safe once cmd has started.
+func copyAuditName(cmd *exec.Cmd, name string) (removeAll, error) {
+	if !validFileName(name) {
+		return "", fmt.Errorf("invalid audit name %q", name)
+	}
+	src, err := os.Open(cmd.Path)
+	if err != nil {
+		return "", fmt.Errorf("audit name %s: %w", name, err)
+	}
+	defer src.Close()
+	dir, err := os.MkdirTemp("", "emrun-audit-*")
+	if err != nil {
+		return "", fmt.Errorf("audit name %s: %w", name, err)
+	}
+	path := filepath.Join(dir, name)
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o700)
+	if err == nil {
+		_, err = io.Copy(dst, src)
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("audit name %s: %w", name, err)
+	}
+	cmd.Path = path
+	return removeAll(dir), nil
+}
+
+// validFileName reports whether name can be used as the name of a file in a
+// directory of our own.
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
+// removeAll is an io.Closer removing the directory it names.
+type removeAll string
+
+func (d removeAll) Close() error {
+	return os.RemoveAll(string(d))
+}
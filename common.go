@@ -1,11 +1,195 @@
 package emrun
 
-import "context"
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"pkt.systems/emrun/internal/clock"
+	"pkt.systems/emrun/port"
+)
+
+// BackingKind re-exports port.BackingKind; see Runnable.Backing.
+type BackingKind = port.BackingKind
+
+const (
+	BackingNone         = port.BackingNone
+	BackingMemfd        = port.BackingMemfd
+	BackingTempFile     = port.BackingTempFile
+	BackingExistingPath = port.BackingExistingPath
+	BackingFD           = port.BackingFD
+)
 
 type Background struct {
 	Context context.Context
 	Cancel  context.CancelFunc
 	Done    <-chan Result
+
+	// settled is closed once result holds the outcome. StartBackground
+	// settles before sending on Done so waiters that must not consume Done,
+	// such as WaitAny, can observe completion. For Backgrounds built by hand
+	// it is created on demand by a collector reading Done.
+	mu      sync.Mutex
+	settled chan struct{}
+	result  Result
+
+	// process is the child and pidfd a pidfd referring to it, or -1, while
+	// it has not been waited for. tracked tells Backgrounds built by hand,
+	// which have no process, apart. All are guarded by mu.
+	process *os.Process
+	pidfd   int
+	tracked bool
+}
+
+// track records the process behind bg and its pidfd, -1 when there is none,
+// for PidFD and Signal.
+func (bg *Background) track(process *os.Process, pidfd int) {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	bg.process, bg.pidfd, bg.tracked = process, pidfd, true
+}
+
+// untrack closes the pidfd once the process has been waited for, after which
+// its number may be reused.
+func (bg *Background) untrack() {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	if bg.process != nil && bg.pidfd >= 0 {
+		closePidFD(bg.pidfd)
+	}
+	bg.process, bg.pidfd = nil, -1
+}
+
+// PidFD returns a pidfd referring to the background process and true, or
+// false when there is none: on kernels before Linux 5.3, on other platforms,
+// for Backgrounds built by hand and once the process has been waited for. The
+// descriptor belongs to bg and is closed when the outcome settles, so add it
+// to an epoll set, where it becomes readable when the process exits, rather
+// than keeping the number around. Do not close it.
+func (bg *Background) PidFD() (int, bool) {
+	if bg == nil {
+		return -1, false
+	}
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	if bg.process == nil || bg.pidfd < 0 {
+		return -1, false
+	}
+	return bg.pidfd, true
+}
+
+// Signal sends sig to the background process. With a pidfd, see PidFD, the
+// signal cannot reach another process that reused the PID after the child
+// exited. Signalling a process that has exited or been waited for reports
+// os.ErrProcessDone.
+func (bg *Background) Signal(sig os.Signal) error {
+	if bg == nil {
+		return errors.New("emrun: nil background")
+	}
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	if !bg.tracked {
+		return errors.New("emrun: background has no process to signal")
+	}
+	if bg.process == nil {
+		return os.ErrProcessDone
+	}
+	if s, ok := sig.(syscall.Signal); ok && bg.pidfd >= 0 {
+		return pidfdSignal(bg.pidfd, s)
+	}
+	return bg.process.Signal(sig)
+}
+
+// settledChan returns the channel closed when the outcome is known, starting
+// a collector that drains Done when the Background was not created by
+// StartBackground. It returns nil when there is nothing to wait for.
+func (bg *Background) settledChan() <-chan struct{} {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	if bg.settled != nil {
+		return bg.settled
+	}
+	if bg.Done == nil {
+		return nil
+	}
+	bg.settled = make(chan struct{})
+	go func(done <-chan Result, settled chan struct{}) {
+		res := <-done
+		bg.result = res
+		close(settled)
+	}(bg.Done, bg.settled)
+	return bg.settled
+}
+
+// settle records res as the outcome. It must be called at most once and only
+// on Backgrounds created with a settled channel.
+func (bg *Background) settle(res Result) {
+	bg.result = res
+	close(bg.settled)
+}
+
+// WaitAny blocks until one of bgs completes and returns its index in bgs and
+// its Result. Backgrounds that already finished win in argument order. Nil
+// entries are ignored. If ctx is cancelled first, WaitAny returns -1 and a
+// Result whose Error is ctx.Err(). The other Backgrounds keep running and can
+// still be waited on. A Background built by hand rather than by the Run*BG
+// helpers has its Done channel drained by WaitAny, so read its outcome with
+// Wait afterwards instead of from Done.
+//
+//	i, res := emrun.WaitAny(ctx, bgs...)
+//	bgs = slices.Delete(bgs, i, i+1)
+func WaitAny(ctx context.Context, bgs ...*Background) (int, Result) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	chans := make([]<-chan struct{}, len(bgs))
+	pending := 0
+	for i, bg := range bgs {
+		if bg == nil {
+			continue
+		}
+		if chans[i] = bg.settledChan(); chans[i] == nil {
+			continue
+		}
+		pending++
+		select {
+		case <-chans[i]:
+			return i, bg.result
+		default:
+		}
+	}
+	if pending == 0 {
+		return -1, Result{Error: errors.New("emrun: no backgrounds to wait for")}
+	}
+	first := make(chan int, pending)
+	stop := make(chan struct{})
+	defer close(stop)
+	for i, settled := range chans {
+		if settled == nil {
+			continue
+		}
+		go func() {
+			select {
+			case <-settled:
+				first <- i
+			case <-stop:
+			}
+		}()
+	}
+	select {
+	case i := <-first:
+		return i, bgs[i].result
+	case <-ctx.Done():
+		return -1, Result{Error: ctx.Err()}
+	}
 }
 
 // Wait blocks until the background command finishes or the stored context is
@@ -22,6 +206,84 @@ func (bg *Background) Wait() Result {
 	return bg.WaitWithContext(ctx)
 }
 
+// WaitHeartbeat is Wait calling beat every interval with the time elapsed
+// since WaitHeartbeat was called while the command is still running, for
+// liveness logs of long background runs. beat is called from the waiting
+// goroutine, so it never runs once WaitHeartbeat has returned, and a slow
+// beat delays the next one rather than overlapping it. An interval of zero or
+// less, or a nil beat, waits without heartbeats.
+//
+//	res := bg.WaitHeartbeat(5*time.Minute, func(elapsed time.Duration) {
+//		log.Printf("still running after %s", elapsed.Round(time.Second))
+//	})
+func (bg *Background) WaitHeartbeat(interval time.Duration, beat func(elapsed time.Duration)) Result {
+	if interval <= 0 || beat == nil {
+		return bg.Wait()
+	}
+	done := make(chan Result, 1)
+	go func() {
+		done <- bg.Wait()
+	}()
+	clk := clock.Get()
+	start := clk.Now()
+	timer := clk.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case res := <-done:
+			return res
+		case <-timer.C():
+			// The command may have finished while the timer fired.
+			select {
+			case res := <-done:
+				return res
+			default:
+			}
+			beat(clk.Now().Sub(start))
+			timer.Reset(interval)
+		}
+	}
+}
+
+// TryResult returns the Result and true if the background command has
+// finished, or a zero Result and false without blocking if it has not. The
+// outcome is kept, so Wait, WaitAny and further calls to TryResult still
+// return it afterwards.
+//
+//	for {
+//		if res, ok := bg.TryResult(); ok {
+//			return res.Error
+//		}
+//		doOtherWork()
+//	}
+func (bg *Background) TryResult() (Result, bool) {
+	if bg == nil {
+		return Result{}, false
+	}
+	bg.mu.Lock()
+	if bg.settled == nil && bg.Done != nil {
+		// A Background built by hand: take the outcome from Done if it is
+		// there and keep it for later waiters.
+		select {
+		case res := <-bg.Done:
+			bg.settled = make(chan struct{})
+			bg.settle(res)
+		default:
+		}
+	}
+	settled := bg.settled
+	bg.mu.Unlock()
+	if settled == nil {
+		return Result{}, false
+	}
+	select {
+	case <-settled:
+		return bg.result, true
+	default:
+		return Result{}, false
+	}
+}
+
 // WaitWithContext blocks until the background command completes or ctx is
 // cancelled. Cancellation returns a Result whose Error is ctx.Err().
 func (bg *Background) WaitWithContext(ctx context.Context) Result {
@@ -31,6 +293,24 @@ func (bg *Background) WaitWithContext(ctx context.Context) Result {
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	bg.mu.Lock()
+	settled := bg.settled
+	bg.mu.Unlock()
+	if settled != nil {
+		select {
+		case <-settled:
+			return bg.result
+		case <-ctx.Done():
+			// StartBackground cancels bg.Context right after settling, so
+			// both may be ready; the outcome wins.
+			select {
+			case <-settled:
+				return bg.result
+			default:
+				return Result{Error: ctx.Err()}
+			}
+		}
+	}
 	if bg.Done == nil {
 		return Result{}
 	}
@@ -49,4 +329,147 @@ type Result struct {
 	ExitCode       int
 	Error          error
 	CombinedOutput []byte
+	// StdoutBytes and StderrBytes count the bytes the child wrote to separate
+	// stdout and stderr writers. They stay zero when both streams share one
+	// writer or are captured as CombinedOutput. An *os.File, such as a
+	// terminal or an open file, is handed to the child as is, so what it
+	// writes there cannot be counted and its count is -1, not zero.
+	StdoutBytes int64
+	StderrBytes int64
+	// OutputBytes counts everything the child wrote to stdout and stderr
+	// together, whether streamed to writers or captured as CombinedOutput,
+	// where it is counted before capture limits and filters such as
+	// WithTailCapture or WithStripANSI, so it can exceed len(CombinedOutput).
+	// It is -1 when a stream it would include went to an *os.File.
+	OutputBytes int64
+	// Truncated is set when a capture limit, such as WithTailCapture or
+	// WithTimeWindowCapture, dropped bytes, so CombinedOutput is incomplete.
+	// It is always false for unbounded capture.
+	Truncated bool
+	// ProcessState is the state of the exited child, with its user and system
+	// CPU time and rusage. It is nil if the process never started.
+	ProcessState *os.ProcessState
+}
+
+// MarshalJSON renders the result for structured logs as an object with the
+// keys exit_code, error, combined_output_base64, stdout_bytes, stderr_bytes
+// and output_bytes, plus truncated when set and user_time_ns and
+// system_time_ns when ProcessState is set. error is the error's string, or
+// null when there is none. The combined output is emitted in full; truncate
+// CombinedOutput on a copy of the Result first, e.g. to its last few
+// kilobytes, to keep large outputs out of logs.
+func (r Result) MarshalJSON() ([]byte, error) {
+	out := struct {
+		ExitCode       int     `json:"exit_code"`
+		Error          *string `json:"error"`
+		CombinedOutput []byte  `json:"combined_output_base64"`
+		StdoutBytes    int64   `json:"stdout_bytes"`
+		StderrBytes    int64   `json:"stderr_bytes"`
+		OutputBytes    int64   `json:"output_bytes"`
+		Truncated      bool    `json:"truncated,omitempty"`
+		UserTime       *int64  `json:"user_time_ns,omitempty"`
+		SystemTime     *int64  `json:"system_time_ns,omitempty"`
+	}{
+		ExitCode:       r.ExitCode,
+		CombinedOutput: r.CombinedOutput,
+		StdoutBytes:    r.StdoutBytes,
+		StderrBytes:    r.StderrBytes,
+		OutputBytes:    r.OutputBytes,
+		Truncated:      r.Truncated,
+	}
+	if r.Error != nil {
+		msg := r.Error.Error()
+		out.Error = &msg
+	}
+	if r.ProcessState != nil {
+		user, system := int64(r.ProcessState.UserTime()), int64(r.ProcessState.SystemTime())
+		out.UserTime, out.SystemTime = &user, &system
+	}
+	return json.Marshal(out)
+}
+
+// UnexpectedExitError is returned by RunExpect when the payload exits with a
+// different code than expected. Output holds the combined output of the run.
+type UnexpectedExitError struct {
+	Want   int
+	Got    int
+	Output []byte
+}
+
+func (e *UnexpectedExitError) Error() string {
+	return fmt.Sprintf("emrun: exit code %d, want %d", e.Got, e.Want)
+}
+
+// Lines splits CombinedOutput into lines. Both "\n" and "\r\n" terminate a
+// line, a final line without a terminator is kept, and no trailing empty line
+// is produced. Lines returns nil when there is no output.
+func (r Result) Lines() []string {
+	if len(r.CombinedOutput) == 0 {
+		return nil
+	}
+	out := bytes.TrimSuffix(r.CombinedOutput, []byte("\n"))
+	raw := bytes.Split(out, []byte("\n"))
+	lines := make([]string, len(raw))
+	for i, line := range raw {
+		lines[i] = string(bytes.TrimSuffix(line, []byte("\r")))
+	}
+	return lines
+}
+
+// NullRecords splits CombinedOutput into the NUL-terminated records written by
+// tools run with -print0 or -0. A final record without a terminator is kept,
+// and no trailing empty record is produced. The records share CombinedOutput's
+// memory. NullRecords returns nil when there is no output.
+func (r Result) NullRecords() [][]byte {
+	return nullRecords(r.CombinedOutput)
+}
+
+func nullRecords(out []byte) [][]byte {
+	if len(out) == 0 {
+		return nil
+	}
+	return bytes.Split(bytes.TrimSuffix(out, []byte{0}), []byte{0})
+}
+
+// streamJSONLines calls run with a writer for the child's stdout and sends
+// each JSON line written to it on out, see RunJSONLines.
+func streamJSONLines(ctx context.Context, out chan<- json.RawMessage, run func(stdout io.Writer) error) error {
+	defer close(out)
+	onMalformed := configFromContext(ctx).malformedLine
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := run(pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	// Closing the read end makes further writes by the child fail rather
+	// than block, so the run can end when we stop reading early.
+	defer pr.Close()
+	reader := bufio.NewReader(pr)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var err error
+			if !json.Valid(line) {
+				err = json.Unmarshal(line, new(any))
+			}
+			switch {
+			case err == nil:
+				select {
+				case out <- json.RawMessage(line):
+				case <-ctx.Done():
+					pr.CloseWithError(ctx.Err())
+					<-done
+					return ctx.Err()
+				}
+			case onMalformed != nil:
+				onMalformed(line, err)
+			}
+		}
+		if readErr != nil {
+			pr.Close()
+			return <-done
+		}
+	}
 }
@@ -2,7 +2,11 @@ package emrun
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"os/exec"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 )
@@ -18,6 +22,34 @@ func TestBackgroundWaitReturnsResult(t *testing.T) {
 	}
 }
 
+func TestBackgroundWaitHeartbeat(t *testing.T) {
+	done := make(chan Result, 1)
+	bg := &Background{Done: done}
+	time.AfterFunc(200*time.Millisecond, func() { done <- Result{ExitCode: 7} })
+	var mu sync.Mutex
+	var beats []time.Duration
+	res := bg.WaitHeartbeat(20*time.Millisecond, func(elapsed time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		beats = append(beats, elapsed)
+	})
+	if res.ExitCode != 7 {
+		t.Fatalf("unexpected exit code %d", res.ExitCode)
+	}
+	mu.Lock()
+	n := len(beats)
+	mu.Unlock()
+	if n < 2 || !slices.IsSorted(beats) || beats[0] < 20*time.Millisecond {
+		t.Fatalf("unexpected heartbeats %v", beats)
+	}
+	time.Sleep(60 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(beats) != n {
+		t.Fatalf("heartbeat fired after the result was delivered: %v", beats)
+	}
+}
+
 func TestBackgroundWaitNilReceiver(t *testing.T) {
 	var bg *Background
 	got := bg.Wait()
@@ -58,3 +90,152 @@ func TestBackgroundWaitWithContextNilBackground(t *testing.T) {
 		t.Fatalf("expected zero result, got %#v", res)
 	}
 }
+
+func TestBackgroundTryResult(t *testing.T) {
+	done := make(chan Result, 1)
+	bg := &Background{Done: done}
+	if _, ok := bg.TryResult(); ok {
+		t.Fatal("expected no result before completion")
+	}
+	done <- Result{ExitCode: 7}
+	for range 2 {
+		if res, ok := bg.TryResult(); !ok || res.ExitCode != 7 {
+			t.Fatalf("TryResult() = %v, %v; want exit code 7, true", res, ok)
+		}
+	}
+	if res := bg.Wait(); res.ExitCode != 7 {
+		t.Fatalf("Wait after TryResult returned exit code %d, want 7", res.ExitCode)
+	}
+
+	settled := &Background{settled: make(chan struct{})}
+	if _, ok := settled.TryResult(); ok {
+		t.Fatal("expected no result before settling")
+	}
+	settled.settle(Result{ExitCode: 3})
+	if res, ok := settled.TryResult(); !ok || res.ExitCode != 3 {
+		t.Fatalf("TryResult() = %v, %v; want exit code 3, true", res, ok)
+	}
+
+	var nilBG *Background
+	if _, ok := nilBG.TryResult(); ok {
+		t.Fatal("expected false for a nil Background")
+	}
+}
+
+func TestResultLines(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{name: "empty", out: "", want: nil},
+		{name: "trailing newline", out: "a\nb\n", want: []string{"a", "b"}},
+		{name: "no trailing newline", out: "a\nb", want: []string{"a", "b"}},
+		{name: "crlf", out: "a\r\nb\r\n", want: []string{"a", "b"}},
+		{name: "blank lines kept", out: "a\n\nb\n", want: []string{"a", "", "b"}},
+		{name: "single newline", out: "\n", want: []string{""}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Result{CombinedOutput: []byte(tc.out)}.Lines()
+			if !slices.Equal(got, tc.want) || (got == nil) != (tc.want == nil) {
+				t.Fatalf("Lines() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResultNullRecords(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{name: "empty", out: "", want: nil},
+		{name: "trailing nul", out: "a\x00b c\x00", want: []string{"a", "b c"}},
+		{name: "no trailing nul", out: "a\x00b", want: []string{"a", "b"}},
+		{name: "newlines kept", out: "a\nb\x00", want: []string{"a\nb"}},
+		{name: "empty records kept", out: "a\x00\x00b\x00", want: []string{"a", "", "b"}},
+		{name: "single nul", out: "\x00", want: []string{""}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, record := range (Result{CombinedOutput: []byte(tc.out)}).NullRecords() {
+				got = append(got, string(record))
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("NullRecords() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResultMarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		res  Result
+		want string
+	}{
+		{Result{}, `{"exit_code":0,"error":null,"combined_output_base64":null,"stdout_bytes":0,"stderr_bytes":0,"output_bytes":0}`},
+		{
+			Result{ExitCode: 2, Error: errors.New("exit status 2"), CombinedOutput: []byte("oops\n"), OutputBytes: 5},
+			`{"exit_code":2,"error":"exit status 2","combined_output_base64":"b29wcwo=","stdout_bytes":0,"stderr_bytes":0,"output_bytes":5}`,
+		},
+	} {
+		got, err := json.Marshal(tc.res)
+		if err != nil {
+			t.Fatalf("Marshal returned error: %v", err)
+		}
+		if string(got) != tc.want {
+			t.Fatalf("unexpected JSON:\n got %s\nwant %s", got, tc.want)
+		}
+	}
+
+	cmd := exec.Command("/bin/true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run /bin/true: %v", err)
+	}
+	got, err := json.Marshal(Result{ProcessState: cmd.ProcessState})
+	if err != nil {
+		t.Fatalf("Marshal returned error: %v", err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(got, &fields); err != nil {
+		t.Fatalf("Unmarshal returned error: %v", err)
+	}
+	if _, ok := fields["user_time_ns"]; !ok {
+		t.Fatalf("expected CPU times with a ProcessState, got %s", got)
+	}
+}
+
+func TestWaitAnyReturnsFirstCompleted(t *testing.T) {
+	slow := make(chan Result)
+	fast := make(chan Result, 1)
+	fast <- Result{ExitCode: 3}
+	bgs := []*Background{{Done: slow}, nil, {Done: fast}}
+	i, res := WaitAny(context.Background(), bgs...)
+	if i != 2 || res.ExitCode != 3 {
+		t.Fatalf("WaitAny() = %d, %#v; want 2 with exit code 3", i, res)
+	}
+	if again := bgs[2].Wait(); again.ExitCode != 3 {
+		t.Fatalf("Wait after WaitAny lost the result: %#v", again)
+	}
+}
+
+func TestWaitAnyCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	i, res := WaitAny(ctx, &Background{Done: make(chan Result)})
+	if i != -1 || !errors.Is(res.Error, context.Canceled) {
+		t.Fatalf("WaitAny() = %d, %v; want -1 with context.Canceled", i, res.Error)
+	}
+}
+
+func TestWaitAnyNoBackgrounds(t *testing.T) {
+	if i, res := WaitAny(context.Background(), nil); i != -1 || res.Error == nil {
+		t.Fatalf("WaitAny() = %d, %v; want -1 with error", i, res.Error)
+	}
+}
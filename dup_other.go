@@ -0,0 +1,12 @@
+//go:build !unix
+
+package emrun
+
+import (
+	"errors"
+	"os"
+)
+
+func dupFile(int, string) (*os.File, error) {
+	return nil, errors.New("passing descriptors is not supported on this platform")
+}
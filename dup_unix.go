@@ -0,0 +1,23 @@
+//go:build unix
+
+package emrun
+
+import (
+	"os"
+	"syscall"
+)
+
+// dupFile returns a duplicate of fd as an *os.File, which can be closed, or
+// collected, without affecting fd.
+func dupFile(fd int, name string) (*os.File, error) {
+	syscall.ForkLock.RLock()
+	dup, err := syscall.Dup(fd)
+	if err == nil {
+		syscall.CloseOnExec(dup)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, os.NewSyscallError("dup", err)
+	}
+	return os.NewFile(uintptr(dup), name), nil
+}
@@ -5,17 +5,19 @@
 package efrun
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"sync"
 
 	"pkt.systems/emrun"
-	"pkt.systems/emrun/adapters/commandrunner"
 	"pkt.systems/emrun/port"
 )
 
@@ -25,9 +27,10 @@ var (
 
 // Open writes executablePayload to a temporary executable on disk and
 // returns a runnable handle whose Name points at the file. The file
-// is chmod +x and will be removed when Close is called. Payloads can
-// be anything Linux can execute, such as ELF binaries or shebang
-// scripts. Example:
+// is chmod +x (on Windows it is named *.exe instead) and will be
+// removed when Close is called. Payloads can be anything the platform
+// can execute, such as ELF binaries or shebang scripts on Linux or PE
+// executables on Windows. Example:
 //
 //	//go:embed myapp
 //	var elfOrShebangScript []byte
@@ -41,25 +44,79 @@ var (
 //	//...
 //	cmd.Run()
 func Open(executablePayload []byte) (port.Runnable, error) {
+	return OpenOn(OSFS, executablePayload)
+}
+
+// OpenOn is like Open but places the payload on fsys, e.g. an in-memory
+// TempFS in tests. Name refers to a file on fsys, which the operating system
+// can only execute when fsys is backed by the real filesystem.
+func OpenOn(fsys port.TempFS, executablePayload []byte) (port.Runnable, error) {
 	if len(executablePayload) == 0 {
 		return nil, ERR_PAYLOAD_IS_EMPTY
 	}
 	sum := sha256.Sum256(executablePayload)
 	r := &runnable{
+		fs:            fsys,
 		payload:       executablePayload,
 		sha256hex:     hex.EncodeToString(sum[:]),
 		sha256:        sum,
 		deleteOnClose: true,
-		runner:        commandrunner.Default,
 	}
-	if err := r.writeToTemporaryFile(); err != nil {
+	if err := r.writeToTemporaryFile(bytes.NewReader(executablePayload), r.sha256hex); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// OpenReader mirrors emrun.OpenReader: it streams the payload from src into
+// the temporary file, hashing it on the way, so the payload never has to be
+// held in memory. Unlike Open it accepts an empty stream.
+func OpenReader(src io.Reader) (port.Runnable, error) {
+	hash := sha256.New()
+	r := &runnable{fs: OSFS, deleteOnClose: true}
+	if err := r.writeToTemporaryFile(io.TeeReader(src, hash), "efrun"); err != nil {
+		return nil, err
+	}
+	hash.Sum(r.sha256[:0])
+	r.sha256hex = hex.EncodeToString(r.sha256[:])
+	return r, nil
+}
+
+// openContext is OpenOn for the helpers that take a context: the payload goes
+// on the context's TempFS after the emrun.WithPayloadValidator found in its
+// options has accepted it.
+func openContext(ctx context.Context, executablePayload []byte) (port.Runnable, error) {
+	if err := emrun.ValidatePayload(ctx, executablePayload); err != nil {
 		return nil, err
 	}
+	return OpenOn(FSFromContext(ctx), executablePayload)
+}
+
+// OpenFS mirrors emrun.OpenFS without its options: it opens the file name in
+// fsys, e.g. an embed.FS, and streams it into the temporary file like
+// OpenReader, without reading it into memory first.
+//
+//	//go:embed tools
+//	var tools embed.FS
+//	//...
+//	f, err := efrun.OpenFS(tools, "tools/jq")
+func OpenFS(fsys fs.FS, name string) (port.Runnable, error) {
+	src, err := fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open payload %s: %w", name, err)
+	}
+	defer src.Close()
+	r, err := OpenReader(src)
+	if err != nil {
+		return nil, fmt.Errorf("open payload %s: %w", name, err)
+	}
 	return r, nil
 }
 
-func (r *runnable) writeToTemporaryFile() error {
-	tmpf, err := os.CreateTemp("", r.sha256hex+"-*")
+// writeToTemporaryFile copies src to a new executable temporary file whose
+// name starts with prefix and makes it the runnable's backing.
+func (r *runnable) writeToTemporaryFile(src io.Reader, prefix string) error {
+	tmpf, err := r.fs.CreateTemp("", prefix+tempPattern)
 	if err != nil {
 		return err
 	}
@@ -68,19 +125,19 @@ func (r *runnable) writeToTemporaryFile() error {
 	defer func() {
 		if cleanup {
 			tmpf.Close()
-			os.Remove(name)
+			r.fs.Remove(name)
 		}
 	}()
-	if _, err := tmpf.Write(r.payload); err != nil {
-		return fmt.Errorf("unable to write to temporary file: %w", err)
+	if n, err := io.Copy(tmpf, src); err != nil {
+		return fmt.Errorf("unable to write to temporary file after %d bytes: %w", n, err)
 	}
 	if err := tmpf.Close(); err != nil {
 		return fmt.Errorf("close temporary file: %w", err)
 	}
-	if err := os.Chmod(name, 0o700); err != nil {
+	if err := makeExecutable(r.fs, name); err != nil {
 		return fmt.Errorf("chmod +x: %w", err)
 	}
-	rf, err := os.Open(name)
+	rf, err := r.fs.Open(name)
 	if err != nil {
 		return fmt.Errorf("reopen temporary file: %w", err)
 	}
@@ -92,23 +149,37 @@ func (r *runnable) writeToTemporaryFile() error {
 
 // Run executes the payload with ctx in exec.CommandContext with args
 // using (*exec.Cmd).CombinedOutput, returns combined output or
-// error. cmd.Stdin is nil, use RunIO if you want to pass data via
-// stdin.
+// error. cmd.Stdin is nil, which os/exec connects to /dev/null; use
+// RunIO if you want to pass data via stdin. Tools that insist on
+// reading stdin are best run with WithNullStdin in the context options
+// to make that explicit.
 func Run(ctx context.Context, executablePayload []byte, arg ...string) ([]byte, error) {
-	f, err := Open(executablePayload)
+	out, f, err := RunOpen(ctx, executablePayload, arg...)
+	if f != nil {
+		defer f.Close()
+	}
+	return out, err
+}
+
+// RunOpen mirrors emrun.RunOpen: it executes the payload like Run but returns
+// the runnable still open, so callers can inspect Digest() or Name() after the
+// run. The runnable is returned whenever Open succeeded, even if the execution
+// failed, and the caller must Close it to remove the temporary file.
+func RunOpen(ctx context.Context, executablePayload []byte, arg ...string) ([]byte, port.Runnable, error) {
+	f, err := openContext(ctx, executablePayload)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer f.Close()
 	runnable := f.(*runnable)
 	cmd := exec.CommandContext(ctx, runnable.Name(), arg...)
-	return runnable.Run(ctx, cmd, true)
+	out, err := runnable.Run(ctx, cmd, true)
+	return out, f, err
 }
 
 // RunIO is similar to Run but uses r for stdin and w for stdout and
 // stderr. Uses ctx for (*exec.Cmd).CommandContext.
 func RunIO(ctx context.Context, r io.Reader, w io.Writer, executablePayload []byte, arg ...string) error {
-	f, err := Open(executablePayload)
+	f, err := openContext(ctx, executablePayload)
 	if err != nil {
 		return err
 	}
@@ -125,7 +196,7 @@ func RunIO(ctx context.Context, r io.Reader, w io.Writer, executablePayload []by
 // RunIOE is exactly like RunIO except with separate stdout and stderr
 // writers.
 func RunIOE(ctx context.Context, r io.Reader, stdout io.Writer, stderr io.Writer, executablePayload []byte, arg ...string) error {
-	f, err := Open(executablePayload)
+	f, err := openContext(ctx, executablePayload)
 	if err != nil {
 		return err
 	}
@@ -139,6 +210,148 @@ func RunIOE(ctx context.Context, r io.Reader, stdout io.Writer, stderr io.Writer
 	return err
 }
 
+// RunTee mirrors emrun.RunTee but always executes from a temporary file: the
+// combined output is both returned and streamed to live, unless nil, as it is
+// produced.
+func RunTee(ctx context.Context, live io.Writer, executablePayload []byte, arg ...string) ([]byte, error) {
+	f, err := openContext(ctx, executablePayload)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	runnable := f.(*runnable)
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	if live != nil {
+		out = io.MultiWriter(&buf, live)
+	}
+	cmd := exec.CommandContext(ctx, runnable.Name(), arg...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	_, err = runnable.Run(ctx, cmd, false)
+	return buf.Bytes(), err
+}
+
+// RunInto mirrors emrun.RunInto but always executes from a temporary file:
+// the combined output is appended to buf and its length returned.
+func RunInto(ctx context.Context, buf *bytes.Buffer, executablePayload []byte, arg ...string) (int, error) {
+	start := buf.Len()
+	err := RunIO(ctx, nil, buf, executablePayload, arg...)
+	return buf.Len() - start, err
+}
+
+// RunDuplex mirrors emrun.RunDuplex but executes from a temporary file:
+// send is the child's stdin, closed after the last byte, and the combined
+// output is returned.
+func RunDuplex(ctx context.Context, send []byte, executablePayload []byte, arg ...string) ([]byte, error) {
+	f, err := openContext(ctx, executablePayload)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	runnable := f.(*runnable)
+	cmd := exec.CommandContext(ctx, runnable.Name(), arg...)
+	cmd.Stdin = bytes.NewReader(send)
+	return runnable.Run(ctx, cmd, true)
+}
+
+// OpenOutput mirrors emrun.OpenOutput but executes from a temporary file:
+// reading yields the combined output and Close waits for the child and
+// returns its exit error.
+func OpenOutput(ctx context.Context, executablePayload []byte, arg ...string) (io.ReadCloser, error) {
+	f, err := openContext(ctx, executablePayload)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	runnable := f.(*runnable)
+	cmd := exec.CommandContext(ctx, runnable.Name(), arg...)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	started, capture, err := runnable.StartBackground(ctx, cmd, false)
+	// The child holds its own copy of the write end; ours would keep the
+	// reader from ever seeing EOF.
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		f.Close()
+		return nil, err
+	}
+	return &outputReader{File: pr, cmd: started, capture: capture, runnable: f}, nil
+}
+
+// outputReader is the io.ReadCloser returned by OpenOutput.
+type outputReader struct {
+	*os.File
+	cmd      *exec.Cmd
+	capture  port.CommandCapture
+	runnable port.Runnable
+	once     sync.Once
+	err      error
+}
+
+func (o *outputReader) Close() error {
+	o.once.Do(func() {
+		o.File.Close()
+		res := emrun.WaitCommand(o.cmd, o.capture)
+		o.err = res.Error
+		if err := o.runnable.Close(); err != nil && o.err == nil {
+			o.err = err
+		}
+	})
+	return o.err
+}
+
+// Pipeline mirrors emrun.Pipeline but executes every stage from a temporary
+// file.
+func Pipeline(ctx context.Context, stages []Stage) ([]byte, error) {
+	runnables := make([]port.BackgroundRunnable, 0, len(stages))
+	args := make([][]string, 0, len(stages))
+	defer func() {
+		for _, r := range runnables {
+			r.Close()
+		}
+	}()
+	for i, stage := range stages {
+		f, err := openContext(ctx, stage.Payload)
+		if err != nil {
+			return nil, &PipelineError{Stage: i, Err: err}
+		}
+		runnables = append(runnables, f.(*runnable))
+		args = append(args, stage.Args)
+	}
+	return emrun.RunPipeline(ctx, runnables, args)
+}
+
+// RunNull mirrors emrun.RunNull but always executes from a temporary file.
+func RunNull(ctx context.Context, executablePayload []byte, arg ...string) ([][]byte, error) {
+	out, err := Run(ctx, executablePayload, arg...)
+	return Result{CombinedOutput: out}.NullRecords(), err
+}
+
+// RunExpect mirrors emrun.RunExpect but always executes from a temporary
+// file. A different exit code than wantCode is reported as
+// *UnexpectedExitError carrying the output.
+func RunExpect(ctx context.Context, wantCode int, executablePayload []byte, arg ...string) ([]byte, error) {
+	out, err := Run(ctx, executablePayload, arg...)
+	got := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return out, err
+		}
+		got = exitErr.ExitCode()
+	}
+	if got != wantCode {
+		return out, &UnexpectedExitError{Want: wantCode, Got: got, Output: out}
+	}
+	return out, nil
+}
+
 // Do is intended to run shebang scripts inline or from string
 // vars. Uses ctx in exec.CommandContext and returns
 // (*exec.Cmd).CombinedOutput.
@@ -146,6 +359,12 @@ func Do(ctx context.Context, payload string, arg ...string) ([]byte, error) {
 	return Run(ctx, []byte(payload), arg...)
 }
 
+// Shell mirrors emrun.Shell for API parity: the script is passed to the shell
+// with -c and never written to a file, so there is nothing to place on disk.
+func Shell(ctx context.Context, script string, arg ...string) ([]byte, error) {
+	return emrun.Shell(ctx, script, arg...)
+}
+
 // RunBG mirrors emrun.RunBG but always executes from a temporary file. The
 // Background handle allows waiting on completion via select. Example:
 //
@@ -163,7 +382,7 @@ func Do(ctx context.Context, payload string, arg ...string) ([]byte, error) {
 //		return ctx.Err()
 //	}
 func RunBG(ctx context.Context, executablePayload []byte, arg ...string) (*Background, error) {
-	r, err := Open(executablePayload)
+	r, err := openContext(ctx, executablePayload)
 	if err != nil {
 		return nil, err
 	}
@@ -173,7 +392,7 @@ func RunBG(ctx context.Context, executablePayload []byte, arg ...string) (*Backg
 // RunIOBG streams stdin/stdout/stderr via reader/writer while running in the
 // background. Combined output in the Result is nil because output is streamed.
 func RunIOBG(ctx context.Context, r io.Reader, w io.Writer, executablePayload []byte, arg ...string) (*Background, error) {
-	run, err := Open(executablePayload)
+	run, err := openContext(ctx, executablePayload)
 	if err != nil {
 		return nil, err
 	}
@@ -182,13 +401,23 @@ func RunIOBG(ctx context.Context, r io.Reader, w io.Writer, executablePayload []
 
 // RunIOEBG provides distinct stdout and stderr writers for background runs.
 func RunIOEBG(ctx context.Context, r io.Reader, stdout io.Writer, stderr io.Writer, executablePayload []byte, arg ...string) (*Background, error) {
-	run, err := Open(executablePayload)
+	run, err := openContext(ctx, executablePayload)
 	if err != nil {
 		return nil, err
 	}
 	return emrun.StartBackground(ctx, run.(*runnable), arg, r, stdout, stderr, false)
 }
 
+// StartInteractive mirrors emrun.StartInteractive but always executes from a
+// temporary file.
+func StartInteractive(ctx context.Context, executablePayload []byte, arg ...string) (*Background, io.WriteCloser, io.ReadCloser, error) {
+	run, err := openContext(ctx, executablePayload)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return emrun.StartInteractiveBackground(ctx, run.(*runnable), arg)
+}
+
 // DoBG runs the inline script in the background, returning a handle identical
 // to RunBG for lifecycle management.
 func DoBG(ctx context.Context, payload string, arg ...string) (*Background, error) {
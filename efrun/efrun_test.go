@@ -3,12 +3,25 @@ package efrun
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
+	"io/fs"
 	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
+	"testing/fstest"
 	"time"
+
+	"pkt.systems/emrun"
+	"pkt.systems/emrun/adapters/memfs"
+	"pkt.systems/emrun/adapters/mockrunner"
+	"pkt.systems/emrun/port"
 )
 
 func TestOpenCreatesExecutableTempfile(t *testing.T) {
@@ -22,6 +35,9 @@ func TestOpenCreatesExecutableTempfile(t *testing.T) {
 	if runnable.IsMemfd() {
 		t.Fatalf("expected IsMemfd to be false")
 	}
+	if runnable.Backing() != emrun.BackingTempFile {
+		t.Fatalf("unexpected backing %v", runnable.Backing())
+	}
 
 	name := runnable.Name()
 	if name == "" {
@@ -192,3 +208,468 @@ func TestRunIOEBGSeparatesStreams(t *testing.T) {
 		t.Fatalf("unexpected stderr: %q", stderr.String())
 	}
 }
+
+func TestStartInteractive(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	bg, stdin, stdout, err := StartInteractive(ctx, []byte("#!/bin/sh\nread line\necho \"got $line\"\n"))
+	if err != nil {
+		t.Fatalf("StartInteractive returned error: %v", err)
+	}
+	defer bg.Cancel()
+	if _, err := io.WriteString(stdin, "ping\n"); err != nil {
+		t.Fatalf("write stdin: %v", err)
+	}
+	out, err := io.ReadAll(stdout)
+	if err != nil || string(out) != "got ping\n" {
+		t.Fatalf("unexpected output %q, %v", out, err)
+	}
+	if res := bg.Wait(); res.Error != nil {
+		t.Fatalf("background run failed: %v", res.Error)
+	}
+}
+
+func TestRunUsesRunnerFromContext(t *testing.T) {
+	mock := mockrunner.New(func(cmd *exec.Cmd) error {
+		_, err := cmd.Stdout.Write([]byte("mocked\n"))
+		return err
+	})
+	ctx := emrun.WithRunner(context.Background(), mock)
+	out, err := Run(ctx, []byte("#!/bin/sh\necho real\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "mocked\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	if mock.Calls != 1 {
+		t.Fatalf("unexpected number of runner calls: %d", mock.Calls)
+	}
+}
+
+func TestRunWithFS(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho memfs\n")
+	fsys := memfs.New()
+	mock := mockrunner.New(func(cmd *exec.Cmd) error {
+		data, err := fsys.ReadFile(cmd.Path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, payload) {
+			return errors.New("payload not written to the in-memory FS")
+		}
+		if mode, _ := fsys.Mode(cmd.Path); runtime.GOOS != "windows" && mode != 0o700 {
+			return errors.New("payload not made executable: " + mode.String())
+		}
+		_, err = cmd.Stdout.Write([]byte("mocked\n"))
+		return err
+	})
+	ctx := emrun.WithRunner(WithFS(context.Background(), fsys), mock)
+	out, err := Run(ctx, payload)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "mocked\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	_, paths, _ := mock.Snapshot()
+	if len(paths) != 1 || !strings.HasPrefix(paths[0], memfs.TempDir+"/") {
+		t.Fatalf("unexpected executed paths: %v", paths)
+	}
+	if _, err := os.Stat(paths[0]); !os.IsNotExist(err) {
+		t.Fatalf("payload reached the real filesystem: %v", err)
+	}
+	if names := fsys.Names(); len(names) != 0 {
+		t.Fatalf("temporary files left behind: %v", names)
+	}
+}
+
+func TestRunRetriesTextFileBusy(t *testing.T) {
+	busy := func(cmd *exec.Cmd) error {
+		return &os.PathError{Op: "fork/exec", Path: cmd.Path, Err: syscall.ETXTBSY}
+	}
+	mock := mockrunner.New(busy, busy, func(cmd *exec.Cmd) error {
+		_, err := cmd.Stdout.Write([]byte("finally\n"))
+		return err
+	})
+	ctx := emrun.WithRunner(context.Background(), mock)
+	out, f, err := RunOpen(ctx, []byte("#!/bin/sh\necho real\n"))
+	if err != nil {
+		t.Fatalf("RunOpen returned error: %v", err)
+	}
+	defer f.Close()
+	if string(out) != "finally\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	calls, paths, _ := mock.Snapshot()
+	if calls != 3 || paths[2] != f.Name() {
+		t.Fatalf("unexpected executions: %d calls, paths %v", calls, paths)
+	}
+	if f.(port.FileBacked).File() == nil {
+		t.Fatal("the retries closed the read handle")
+	}
+
+	mock = mockrunner.New(busy, busy, busy, busy, busy)
+	ctx = emrun.WithRunner(context.Background(), mock)
+	if _, err := Run(ctx, []byte("#!/bin/sh\necho real\n")); !errors.Is(err, syscall.ETXTBSY) {
+		t.Fatalf("expected ETXTBSY once retries are exhausted, got %v", err)
+	}
+	if calls, _, _ := mock.Snapshot(); calls != textBusyRetries+1 {
+		t.Fatalf("expected %d executions, got %d", textBusyRetries+1, calls)
+	}
+}
+
+func TestSaveAs(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho saved\n")
+	f, err := OpenOn(memfs.New(), payload)
+	if err != nil {
+		t.Fatalf("OpenOn returned error: %v", err)
+	}
+	defer f.Close()
+	path := t.TempDir() + string(os.PathSeparator) + "payload"
+	if err := f.(port.Saver).SaveAs(path, 0o600); err != nil {
+		t.Fatalf("SaveAs returned error: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, payload) {
+		t.Fatalf("unexpected saved payload %q, %v", data, err)
+	}
+}
+
+func TestOpenFS(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho embedded\n")
+	fsys := fstest.MapFS{"tools/tool": {Data: payload}}
+	f, err := OpenFS(fsys, "tools/tool")
+	if err != nil {
+		t.Fatalf("OpenFS returned error: %v", err)
+	}
+	defer f.Close()
+	sum := sha256.Sum256(payload)
+	if f.Digest() != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected digest %s", f.Digest())
+	}
+	if data, err := os.ReadFile(f.Name()); err != nil || !bytes.Equal(data, payload) {
+		t.Fatalf("unexpected temporary file %q, %v", data, err)
+	}
+	if _, err := OpenFS(fsys, "tools/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected a missing file to be reported, got %v", err)
+	}
+}
+
+func TestCloseJoinsCloseAndRemoveErrors(t *testing.T) {
+	fsys := memfs.New()
+	f, err := OpenOn(fsys, []byte("#!/bin/sh\n"))
+	if err != nil {
+		t.Fatalf("OpenOn returned error: %v", err)
+	}
+	r := f.(*runnable)
+	r.file.Close()
+	if err := fsys.Remove(r.Name()); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	err = f.Close()
+	if !errors.Is(err, fs.ErrClosed) || !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected both the close and the remove error, got %v", err)
+	}
+}
+
+func TestRunOpenReturnsOpenRunnable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	payload := []byte("#!/bin/sh\necho run-open\n")
+	out, f, err := RunOpen(ctx, payload)
+	if err != nil {
+		t.Fatalf("RunOpen returned error: %v", err)
+	}
+	defer f.Close()
+	if string(out) != "run-open\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	sum := sha256.Sum256(payload)
+	if f.Digest() != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected digest: %s", f.Digest())
+	}
+	if _, err := os.Stat(f.Name()); err != nil {
+		t.Fatalf("runnable was closed after RunOpen: %v", err)
+	}
+}
+
+func TestReadOnlyViewCannotWrite(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho view\n")
+	f, err := Open(payload)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	viewer, ok := f.(port.ReadOnlyViewer)
+	if !ok {
+		t.Fatalf("runnable does not implement port.ReadOnlyViewer")
+	}
+	view, err := viewer.ReadOnlyView()
+	if err != nil {
+		t.Fatalf("ReadOnlyView returned error: %v", err)
+	}
+	got := make([]byte, len(payload))
+	if _, err := view.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt returned error: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("view contents mismatch: got %q want %q", got, payload)
+	}
+	if _, err := view.(io.Writer).Write([]byte("x")); err == nil {
+		t.Fatalf("expected write through read-only view to fail")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if _, err := view.ReadAt(got, 0); err == nil {
+		t.Fatalf("expected view to be closed with the runnable")
+	}
+}
+
+func TestRunExpect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	payload := []byte("#!/bin/sh\necho code:$1\nexit $1\n")
+	tests := []struct {
+		name    string
+		want    int
+		code    string
+		wantErr bool
+	}{
+		{name: "success", want: 0, code: "0"},
+		{name: "expected failure", want: 2, code: "2"},
+		{name: "unexpected failure", want: 0, code: "3", wantErr: true},
+		{name: "unexpected success", want: 2, code: "0", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := RunExpect(ctx, tc.want, payload, tc.code)
+			if string(out) != "code:"+tc.code+"\n" {
+				t.Fatalf("unexpected output: %q", out)
+			}
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatalf("RunExpect returned error: %v", err)
+				}
+				return
+			}
+			var exitErr *UnexpectedExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("expected *UnexpectedExitError, got %v", err)
+			}
+			if exitErr.Want != tc.want || strconv.Itoa(exitErr.Got) != tc.code || !bytes.Equal(exitErr.Output, out) {
+				t.Fatalf("unexpected error contents: %+v", exitErr)
+			}
+		})
+	}
+}
+
+func TestFileReturnsBackingFile(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho file\n")
+	f, err := Open(payload)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	fb, ok := f.(port.FileBacked)
+	if !ok {
+		t.Fatal("runnable does not implement port.FileBacked")
+	}
+	file := fb.File()
+	if file == nil {
+		t.Fatal("File returned nil for open runnable")
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != int64(len(payload)) {
+		t.Fatalf("unexpected backing file: %v, %v", info, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if fb.File() != nil {
+		t.Fatal("File returned non-nil after Close")
+	}
+}
+
+func TestOpenReaderStreamsDigest(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho streamed\n#" + strings.Repeat("x", 256<<10) + "\n")
+	sum := sha256.Sum256(payload)
+	f, err := OpenReader(bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatalf("OpenReader returned error: %v", err)
+	}
+	defer f.Close()
+	if f.Digest() != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected digest %s", f.Digest())
+	}
+	ctx := emrun.WithRule(emrun.WithPolicy(context.Background(), emrun.DENY), emrun.ALLOW, sum)
+	out, err := f.Run(ctx, exec.CommandContext(ctx, f.Name()), true)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "streamed\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestRunQuarantined(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("test needs root on linux to create namespaces")
+	}
+	hostNet, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		t.Skipf("no network namespace to compare: %v", err)
+	}
+	payload := []byte("#!/bin/sh\nreadlink /proc/$$/ns/net\n")
+	sum := sha256.Sum256(payload)
+	ctx := emrun.WithRule(emrun.WithPolicy(context.Background(), emrun.DENY), emrun.QUARANTINE, sum)
+	out, err := Run(ctx, payload)
+	if err != nil {
+		t.Fatalf("Run returned error: %v (%s)", err, out)
+	}
+	if net := strings.TrimSpace(string(out)); net == "" || net == hostNet {
+		t.Fatalf("quarantined payload shares the network namespace: %q", out)
+	}
+}
+
+func TestRunConsultsPayloadValidator(t *testing.T) {
+	errRejected := errors.New("rejected")
+	calls := 0
+	validator := emrun.WithPayloadValidator(func(payload []byte) error {
+		calls++
+		if bytes.Contains(payload, []byte("perl")) {
+			return errRejected
+		}
+		return nil
+	})
+	mock := mockrunner.New(func(cmd *exec.Cmd) error {
+		_, err := cmd.Stdout.Write([]byte("ran\n"))
+		return err
+	})
+	ctx := emrun.WithOptions(emrun.WithRunner(context.Background(), mock), validator)
+	if out, err := Run(ctx, []byte("#!/bin/sh\necho ran\n")); err != nil || string(out) != "ran\n" {
+		t.Fatalf("Run of an accepted payload = %q, %v", out, err)
+	}
+	if _, err := RunBG(ctx, []byte("#!/usr/bin/env perl\n")); !errors.Is(err, emrun.ErrPayloadRejected) || !errors.Is(err, errRejected) {
+		t.Fatalf("expected RunBG to be rejected, got %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected one validation per open, got %d", calls)
+	}
+	if calls, _, _ := mock.Snapshot(); calls != 1 {
+		t.Fatalf("the rejected payload was executed: %d executions", calls)
+	}
+}
+
+func TestRunTeeReturnsAndStreams(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var live bytes.Buffer
+	out, err := RunTee(ctx, &live, []byte("#!/bin/sh\necho out\necho err 1>&2\nexit 1\n"))
+	if err == nil {
+		t.Fatal("expected exit error")
+	}
+	if string(out) != "out\nerr\n" {
+		t.Fatalf("unexpected returned output: %q", out)
+	}
+	if live.String() != string(out) {
+		t.Fatalf("live output %q differs from returned %q", live.String(), out)
+	}
+	if out, err := RunTee(ctx, nil, []byte("#!/bin/sh\necho quiet\n")); err != nil || string(out) != "quiet\n" {
+		t.Fatalf("RunTee without a live writer = %q, %v", out, err)
+	}
+}
+
+func TestRunInto(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	buf := bytes.NewBufferString("kept:")
+	n, err := RunInto(ctx, buf, []byte("#!/bin/sh\necho out\necho err 1>&2\n"))
+	if err != nil {
+		t.Fatalf("RunInto returned error: %v", err)
+	}
+	if n != 8 || buf.String() != "kept:out\nerr\n" {
+		t.Fatalf("unexpected output %q (%d bytes)", buf.String(), n)
+	}
+}
+
+func TestRunDuplex(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := RunDuplex(ctx, []byte("request\n"), []byte("#!/bin/sh\ntr a-z A-Z\n"))
+	if err != nil {
+		t.Fatalf("RunDuplex returned error: %v", err)
+	}
+	if string(out) != "REQUEST\n" {
+		t.Fatalf("unexpected reply: %q", out)
+	}
+}
+
+func TestOpenOutput(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := OpenOutput(ctx, []byte("#!/bin/sh\necho out\necho err 1>&2\nexit 3\n"))
+	if err != nil {
+		t.Fatalf("OpenOutput returned error: %v", err)
+	}
+	data, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+	if string(data) != "out\nerr\n" {
+		t.Fatalf("unexpected output: %q", data)
+	}
+	var exitErr *exec.ExitError
+	if err := out.Close(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("expected exit code 3 from Close, got %v", err)
+	}
+
+	endless, err := OpenOutput(ctx, []byte("#!/bin/sh\nwhile :; do echo y; done\n"))
+	if err != nil {
+		t.Fatalf("OpenOutput returned error: %v", err)
+	}
+	if _, err := io.ReadFull(endless, make([]byte, 4)); err != nil {
+		t.Fatalf("ReadFull returned error: %v", err)
+	}
+	if err := endless.Close(); err == nil || ctx.Err() != nil {
+		t.Fatalf("expected Close to stop the writer with an error before the deadline, got %v", err)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := Pipeline(ctx, []Stage{
+		{Payload: []byte("#!/bin/sh\nprintf 'b\\na\\nb\\nc\\n'\necho ignored >&2\n")},
+		{Payload: []byte("#!/bin/sh\nexec sort \"$@\"\n"), Args: []string{"-u"}},
+		{Payload: []byte("#!/bin/sh\nexec tr a-z A-Z\n")},
+	})
+	if err != nil {
+		t.Fatalf("Pipeline returned error: %v", err)
+	}
+	if string(out) != "A\nB\nC\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	// The endless first stage dies of SIGPIPE once head exits, which is not a
+	// failure.
+	out, err = Pipeline(ctx, []Stage{
+		{Payload: []byte("#!/bin/sh\nwhile :; do echo y; done\n")},
+		{Payload: []byte("#!/bin/sh\nexec head -n 2\n")},
+	})
+	if err != nil || string(out) != "y\ny\n" {
+		t.Fatalf("unexpected result: %q, %v", out, err)
+	}
+
+	_, err = Pipeline(ctx, []Stage{
+		{Payload: []byte("#!/bin/sh\nsleep 10\n")},
+		{Payload: []byte("#!/bin/sh\nexit 4\n")},
+		{Payload: []byte("#!/bin/sh\ncat\n")},
+	})
+	var pipeErr *PipelineError
+	var exitErr *exec.ExitError
+	if !errors.As(err, &pipeErr) || pipeErr.Stage != 1 || !errors.As(err, &exitErr) || exitErr.ExitCode() != 4 {
+		t.Fatalf("expected stage 1 to fail with exit code 4, got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("expected the failure to cancel the sleeping stage")
+	}
+}
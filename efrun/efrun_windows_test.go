@@ -0,0 +1,28 @@
+package efrun
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOpenNamesTempfileExe(t *testing.T) {
+	exe, err := os.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatalf("read test binary: %v", err)
+	}
+	f, err := Open(exe)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	name := f.Name()
+	if !strings.HasSuffix(name, ".exe") {
+		t.Fatalf("temporary executable lacks .exe extension: %q", name)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("temporary executable not removed: %v", err)
+	}
+}
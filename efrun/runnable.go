@@ -4,28 +4,45 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"os/exec"
+	"syscall"
+	"time"
 
 	"pkt.systems/emrun"
-	"pkt.systems/emrun/adapters/commandrunner"
+	"pkt.systems/emrun/internal/clock"
+	"pkt.systems/emrun/internal/command"
 	"pkt.systems/emrun/port"
 )
 
 type Background = emrun.Background
 type Result = emrun.Result
+type UnexpectedExitError = emrun.UnexpectedExitError
+type Stage = emrun.Stage
+type PipelineError = emrun.PipelineError
 
 type runnable struct {
 	payload       []byte
-	file          *os.File
+	fs            port.TempFS
+	file          port.TempFile
 	name          string
 	sha256hex     string
 	sha256        [32]byte
 	deleteOnClose bool
 	runner        port.CommandRunner
+	views         []port.TempFile
 }
 
+var (
+	_ port.ReadOnlyViewer = (*runnable)(nil)
+	_ port.FileBacked     = (*runnable)(nil)
+	_ port.Saver          = (*runnable)(nil)
+)
+
 func (r *runnable) Name() string {
 	return r.name
 }
@@ -34,6 +51,30 @@ func (r *runnable) IsMemfd() bool {
 	return false
 }
 
+// Backing reports BackingTempFile once the payload has been written; efrun
+// never uses memfds.
+func (r *runnable) Backing() port.BackingKind {
+	if r.name == "" {
+		return port.BackingNone
+	}
+	return port.BackingTempFile
+}
+
+// commandRunner returns the runner assigned to the runnable, or the one
+// carried by ctx (see emrun.WithRunner) when none was assigned.
+func (r *runnable) commandRunner(ctx context.Context) port.CommandRunner {
+	if r.runner != nil {
+		return r.runner
+	}
+	return emrun.RunnerFromContext(ctx)
+}
+
+// Digest returns the hex-encoded SHA-256 digest of the payload.
+func (r *runnable) Digest() string {
+	_, hexDigest := r.ensureDigest()
+	return hexDigest
+}
+
 func (r *runnable) ensureDigest() ([32]byte, string) {
 	if r.sha256hex != "" {
 		return r.sha256, r.sha256hex
@@ -44,27 +85,98 @@ func (r *runnable) ensureDigest() ([32]byte, string) {
 	return r.sha256, r.sha256hex
 }
 
-func (r *runnable) enforce(ctx context.Context) error {
+// enforce applies the context policy and the preflight checks requested by
+// options. The returned context is ctx, or ctx locked down with
+// emrun.WithQuarantine when the policy quarantines the payload, as emrun does.
+func (r *runnable) enforce(ctx context.Context) (context.Context, error) {
 	digest, hexDigest := r.ensureDigest()
-	return emrun.CheckPolicy(ctx, digest, hexDigest)
+	if err := emrun.CheckPolicy(ctx, digest, hexDigest); err != nil {
+		var policyErr *emrun.PolicyError
+		if !errors.As(err, &policyErr) || policyErr.Verdict != emrun.QUARANTINE {
+			return ctx, err
+		}
+		// Applied after the context's options, so none of them weaken it.
+		ctx = emrun.WithOptions(ctx, emrun.WithQuarantine())
+	}
+	return ctx, emrun.Preflight(ctx, r)
+}
+
+// ReadOnlyView reopens the temporary file O_RDONLY and returns it as a view of
+// the payload that cannot be used to modify it. The view is closed together
+// with the runnable.
+func (r *runnable) ReadOnlyView() (io.ReaderAt, error) {
+	if r.name == "" {
+		return nil, os.ErrInvalid
+	}
+	view, err := r.fs.Open(r.name)
+	if err != nil {
+		return nil, fmt.Errorf("open read-only view: %w", err)
+	}
+	r.views = append(r.views, view)
+	return view, nil
+}
+
+// File returns the read-only handle the runnable keeps on its temporary file.
+// It is owned by the runnable and must not be closed. File returns nil once
+// the runnable is closed, and when the payload lives on a TempFS other than
+// OSFS.
+func (r *runnable) File() *os.File {
+	file, _ := r.file.(*os.File)
+	return file
+}
+
+// SaveAs writes the payload to path with mode, see port.Saver. It always
+// writes to the operating system's file system, also when the runnable lives
+// on another TempFS. Saving over the runnable's own temporary file is refused.
+func (r *runnable) SaveAs(path string, mode os.FileMode) (err error) {
+	if r.file == nil {
+		return os.ErrInvalid
+	}
+	if own := r.File(); own != nil {
+		fi, serr := os.Stat(path)
+		ownInfo, oerr := own.Stat()
+		if serr == nil && oerr == nil && os.SameFile(fi, ownInfo) {
+			return fmt.Errorf("save payload to %s: refusing to overwrite the runnable's backing file", path)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return fmt.Errorf("save payload: %w", err)
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("save payload to %s: %w", path, cerr)
+		}
+	}()
+	if n, err := io.Copy(f, io.NewSectionReader(r.file, 0, math.MaxInt64)); err != nil {
+		return fmt.Errorf("save payload to %s after %d bytes: %w", path, n, err)
+	}
+	if err := f.Chmod(mode.Perm()); err != nil {
+		return fmt.Errorf("save payload to %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("save payload to %s: %w", path, err)
+	}
+	return nil
 }
 
 func (r *runnable) Close() error {
-	var fileCloseErr error
+	var viewErrs []error
+	for _, view := range r.views {
+		viewErrs = append(viewErrs, view.Close())
+	}
+	r.views = nil
+	var closeErr, removeErr error
 	if r.file != nil {
-		fileCloseErr = r.file.Close()
+		closeErr = r.file.Close()
 		r.file = nil
 	}
 	if r.deleteOnClose && r.name != "" {
-		if err := os.Remove(r.name); err != nil {
-			if fileCloseErr != nil {
-				return fmt.Errorf("close error: %w; remove error: %w", fileCloseErr, err)
-			}
-			return err
+		if removeErr = r.fs.Remove(r.name); removeErr == nil {
+			r.deleteOnClose = false
 		}
-		r.deleteOnClose = false
 	}
-	return fileCloseErr
+	return errors.Join(append([]error{closeErr, removeErr}, viewErrs...)...)
 }
 
 func (r *runnable) Read(p []byte) (int, error) {
@@ -81,26 +193,73 @@ func (r *runnable) Seek(offset int64, whence int) (int64, error) {
 	return r.file.Seek(offset, whence)
 }
 
+// Run executes cmd, retrying a few times on a clone of it when the kernel
+// refuses with ETXTBSY, see retryTextBusy.
 func (r *runnable) Run(ctx context.Context, cmd *exec.Cmd, combinedOutput bool) ([]byte, error) {
-	if r.runner == nil {
-		r.runner = commandrunner.Default
-	}
-	if err := r.enforce(ctx); err != nil {
+	runner := r.commandRunner(ctx)
+	ctx, err := r.enforce(ctx)
+	if err != nil {
 		return nil, err
 	}
-	return emrun.RunCommand(r.runner, cmd, combinedOutput)
+	for attempt := 0; ; attempt++ {
+		unbind, err := emrun.BindCommand(ctx, r, cmd)
+		if err != nil {
+			return nil, err
+		}
+		out, err := emrun.RunCommandContext(ctx, runner, cmd, combinedOutput)
+		if !r.retryTextBusy(ctx, err, attempt) {
+			return out, err
+		}
+		unbind()
+		cmd = command.Clone(ctx, cmd)
+	}
 }
 
+// StartBackground starts cmd with the same ETXTBSY retries as Run.
 func (r *runnable) StartBackground(ctx context.Context, cmd *exec.Cmd, combinedOutput bool) (*exec.Cmd, port.CommandCapture, error) {
-	if r.runner == nil {
-		r.runner = commandrunner.Default
-	}
-	if err := r.enforce(ctx); err != nil {
-		return nil, nil, err
-	}
-	capture, err := emrun.StartCommand(r.runner, cmd, combinedOutput)
+	runner := r.commandRunner(ctx)
+	ctx, err := r.enforce(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
-	return cmd, capture, nil
+	for attempt := 0; ; attempt++ {
+		unbind, err := emrun.BindCommand(ctx, r, cmd)
+		if err != nil {
+			return nil, nil, err
+		}
+		started, capture, err := emrun.StartCommandContext(ctx, runner, cmd, combinedOutput)
+		if !r.retryTextBusy(ctx, err, attempt) {
+			return started, capture, err
+		}
+		unbind()
+		cmd = command.Clone(ctx, cmd)
+	}
+}
+
+// textBusyRetries is how often an execution failing with ETXTBSY is retried,
+// waiting textBusyBackoff before the first retry and twice as long before
+// each further one.
+const (
+	textBusyRetries = 3
+	textBusyBackoff = 5 * time.Millisecond
+)
+
+// retryTextBusy reports whether the execution that failed with err on the
+// given attempt should be retried. Exec fails with ETXTBSY while any
+// descriptor has the file open for writing. The runnable closed its own
+// writer before it could be executed, but a child forked by another goroutine
+// while that writer was open inherits a copy, which it only drops when it
+// execs or exits, so the execution is retried after a short wait.
+func (r *runnable) retryTextBusy(ctx context.Context, err error, attempt int) bool {
+	if attempt >= textBusyRetries || !errors.Is(err, syscall.ETXTBSY) {
+		return false
+	}
+	timer := clock.Get().NewTimer(textBusyBackoff << attempt)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package efrun
+
+import "pkt.systems/emrun/port"
+
+const tempPattern = "-*"
+
+func makeExecutable(fsys port.TempFS, name string) error {
+	return fsys.Chmod(name, 0o700)
+}
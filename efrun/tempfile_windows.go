@@ -0,0 +1,15 @@
+//go:build windows
+
+package efrun
+
+import "pkt.systems/emrun/port"
+
+// tempPattern gives temporary executables the .exe extension CreateProcess
+// needs to recognise them.
+const tempPattern = "-*.exe"
+
+// makeExecutable is a no-op on Windows, where the extension rather than a
+// mode bit makes a file executable.
+func makeExecutable(port.TempFS, string) error {
+	return nil
+}
@@ -0,0 +1,58 @@
+package efrun
+
+import (
+	"context"
+	"io/fs"
+	"os"
+
+	"pkt.systems/emrun/port"
+)
+
+// OSFS is the TempFS backed by the os package that efrun uses unless WithFS
+// selects another one.
+var OSFS port.TempFS = osFS{}
+
+type osFS struct{}
+
+func (osFS) CreateTemp(dir, pattern string) (port.TempFile, error) {
+	return os.CreateTemp(dir, pattern)
+}
+
+func (osFS) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Open(name string) (port.TempFile, error) {
+	return os.Open(name)
+}
+
+type fsKey struct{}
+
+// WithFS returns a derived context whose Run*/Do* helpers and their
+// background variants place payloads on fsys instead of OSFS. Files on an
+// in-memory TempFS cannot be executed by the operating system, so such a
+// context is meant to be combined with a mock runner (see emrun.WithRunner)
+// in tests. A nil fsys restores OSFS.
+//
+//	ctx = efrun.WithFS(ctx, memfs.New())
+//	ctx = emrun.WithRunner(ctx, mockrunner.New())
+//	out, err := efrun.Run(ctx, payload)
+func WithFS(ctx context.Context, fsys port.TempFS) context.Context {
+	return context.WithValue(ctx, fsKey{}, fsys)
+}
+
+// FSFromContext returns the TempFS stored with WithFS, or OSFS when ctx is nil
+// or carries none.
+func FSFromContext(ctx context.Context) port.TempFS {
+	if ctx == nil {
+		return OSFS
+	}
+	if fsys, ok := ctx.Value(fsKey{}).(port.TempFS); ok && fsys != nil {
+		return fsys
+	}
+	return OSFS
+}
@@ -9,17 +9,24 @@
 package emrun
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
 	"os"
 	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
 
 	"golang.org/x/sys/unix"
-	"pkt.systems/emrun/adapters/commandrunner"
 	"pkt.systems/emrun/port"
 )
 
@@ -30,6 +37,49 @@ var (
 	ERR_NOT_AN_INMEMORY_FD error = errors.New("not an in-memory file descriptor")
 )
 
+// ForceTempfileEnv names the environment variable that, when set to a true
+// value understood by strconv.ParseBool (1, t, true, ...), makes Open skip
+// memfd_create(2) and always write the payload to a temporary file. Use it to
+// debug or to work around hosts where anonymous execution is known to fail.
+const ForceTempfileEnv = "EMRUN_FORCE_TEMPFILE"
+
+func forceTempfile() bool {
+	value := os.Getenv(ForceTempfileEnv)
+	if value == "" {
+		// ParseBool allocates its syntax error, on every Open.
+		return false
+	}
+	force, err := strconv.ParseBool(value)
+	return err == nil && force
+}
+
+// procSelfFD is where memfds are executed from.
+var procSelfFD = "/proc/self/fd"
+
+// ProcMounted reports whether /proc/self/fd is accessible. Payloads in a memfd
+// are executed through /proc/self/fd/N, which fails with a bare ENOENT when
+// /proc is not mounted, as in some minimal container images. Open checks this
+// and writes the payload to a temporary file instead when it is not, counted
+// as a tempfile fallback by RegisterMetrics.
+func ProcMounted() bool {
+	var st unix.Stat_t
+	err := unix.Stat(procSelfFD, &st)
+	return err == nil && st.Mode&unix.S_IFMT == unix.S_IFDIR
+}
+
+// procSelfFDPath returns "/proc/self/fd/<fd>" with a single allocation.
+func procSelfFDPath(fd int) string {
+	var buf [32]byte
+	return string(strconv.AppendInt(append(buf[:0], "/proc/self/fd/"...), int64(fd), 10))
+}
+
+// hexDigest returns the hex encoding of sum with a single allocation.
+func hexDigest(sum *[32]byte) string {
+	var buf [64]byte
+	hex.Encode(buf[:], sum[:])
+	return string(buf[:])
+}
+
 // Open attempts to create a memory file descriptor using
 // memfd_create(2), name will be a sha256 hash of the payload that
 // will show up under /proc/<pid>/{fd,fdinfo}, running process will
@@ -39,7 +89,8 @@ var (
 // the payload as a temporary file with user execute bit set. When
 // Close() is called, the temporary file will be deleted. Payload can
 // be anything Linux/Android can execute (ELF and script
-// shebang). Example:
+// shebang). Setting the ForceTempfileEnv environment variable makes Open
+// go straight to the temporary file. Example:
 //
 //	//go:embed myapp
 //	var elfOrShebangScript []byte
@@ -56,54 +107,332 @@ func Open(executablePayload []byte) (Runnable, error) {
 	sum := sha256.Sum256(executablePayload)
 	r := &runnable{
 		payload:   executablePayload,
-		sha256hex: hex.EncodeToString(sum[:]),
+		sha256hex: hexDigest(&sum),
 		sha256:    sum,
-		runner:    commandrunner.Default,
 	}
-	fd, err := unix.MemfdCreate(r.sha256hex, 0)
+	if err := r.openBacking(bytes.NewReader(executablePayload), r.sha256hex); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// OpenContext is Open for payloads large enough that writing them into the
+// memfd takes noticeable time. ctx is checked before the write and, when
+// WithWriteChunkSize is set in its options, between chunks of that size, so
+// cancelling ctx aborts the open within one chunk. It then fails with an error
+// wrapping ctx.Err() and releases the memfd. Without a chunk size the payload
+// is written in one go like Open does. ctx is only used while opening.
+//
+//	ctx = emrun.WithOptions(ctx, emrun.WithWriteChunkSize(4<<20))
+//	f, err := emrun.OpenContext(ctx, hugePayload)
+func OpenContext(ctx context.Context, executablePayload []byte) (Runnable, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(executablePayload)
+	if err := ValidatePayload(ctx, executablePayload); err != nil {
+		return nil, err
+	}
+	r := &runnable{
+		payload:   executablePayload,
+		sha256hex: hexDigest(&sum),
+		sha256:    sum,
+	}
+	src := &chunkedPayload{ctx: ctx, data: executablePayload, chunk: configFromContext(ctx).writeChunk}
+	if err := r.openBacking(src, r.sha256hex); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// openContext is Open for the helpers that take a context, consulting the
+// WithPayloadValidator found in its options first.
+func openContext(ctx context.Context, executablePayload []byte) (Runnable, error) {
+	if err := ValidatePayload(ctx, executablePayload); err != nil {
+		return nil, err
+	}
+	return Open(executablePayload)
+}
+
+// chunkedPayload hands data to io.Copy in writes of at most chunk bytes,
+// checking ctx before each. A chunk of zero or less writes everything at once.
+type chunkedPayload struct {
+	ctx   context.Context
+	data  []byte
+	chunk int
+}
+
+func (c *chunkedPayload) next() ([]byte, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	n := len(c.data)
+	if c.chunk > 0 && n > c.chunk {
+		n = c.chunk
+	}
+	return c.data[:n], nil
+}
+
+func (c *chunkedPayload) Read(p []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	chunk, err := c.next()
 	if err != nil {
-		// unable to create ananoymous file, dump it as a temporary file instead
-		if err := r.switchToTemporaryFile(); err != nil {
+		return 0, err
+	}
+	n := copy(p, chunk)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+// WriteTo is preferred by io.Copy and writes each chunk with a single call.
+func (c *chunkedPayload) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for len(c.data) > 0 {
+		chunk, err := c.next()
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(chunk)
+		written += int64(n)
+		c.data = c.data[n:]
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// OpenReader is like Open but streams the payload from src instead of taking
+// it as a slice, so huge payloads never have to be held in memory. The SHA-256
+// digest is computed on the way through a TeeReader and is final, ready for
+// policy checks, when OpenReader returns. A later fallback to a temporary file
+// copies the bytes from the memfd. The opts apply like they do for OpenFS.
+func OpenReader(src io.Reader, opts ...Option) (Runnable, error) {
+	r, err := openReader(src, "emrun", opts)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// OpenFS opens the file name in fsys, e.g. an embed.FS, and streams it into a
+// memfd like OpenReader, without reading it into memory first. The memfd is
+// named after the base name of the file unless WithName is given. The other
+// opts apply whenever the runnable is executed, beneath any options in the
+// execution context.
+//
+//	//go:embed tools
+//	var tools embed.FS
+//	//...
+//	f, err := emrun.OpenFS(tools, "tools/jq")
+func OpenFS(fsys fs.FS, name string, opts ...Option) (Runnable, error) {
+	src, err := fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open payload %s: %w", name, err)
+	}
+	defer src.Close()
+	memfdName := newConfig(opts).name
+	if memfdName == "" {
+		memfdName = path.Base(name)
+	}
+	r, err := openReader(src, memfdName, opts)
+	if err != nil {
+		return nil, fmt.Errorf("open payload %s: %w", name, err)
+	}
+	return r, nil
+}
+
+// OpenFSLookup searches dirs of fsys in order for a regular file called name,
+// like a shell searching PATH, and opens the first one found with OpenFS, so
+// tools embedded in several directories can be opened by their short name.
+// Permission bits are not checked since embed.FS reports none. A name
+// containing a slash is opened directly without searching. When no directory
+// holds name, the error wraps fs.ErrNotExist and lists the directories
+// searched.
+//
+//	//go:embed tools
+//	var tools embed.FS
+//	//...
+//	f, err := emrun.OpenFSLookup(tools, "jq", "tools/bin", "tools/contrib")
+func OpenFSLookup(fsys fs.FS, name string, dirs ...string) (Runnable, error) {
+	if strings.Contains(name, "/") {
+		return OpenFS(fsys, name)
+	}
+	for _, dir := range dirs {
+		candidate := path.Join(dir, name)
+		fi, err := fs.Stat(fsys, candidate)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("look up payload %s: %w", name, err)
+		case fi.Mode().IsRegular():
+			return OpenFS(fsys, candidate)
+		}
+	}
+	return nil, fmt.Errorf("look up payload %s: not found in %q: %w", name, dirs, fs.ErrNotExist)
+}
+
+func openReader(src io.Reader, memfdName string, opts []Option) (*runnable, error) {
+	if decrypt := newConfig(opts).decryptor; decrypt != nil {
+		plain, err := decrypt(src)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt payload: %w", err)
+		}
+		src = decryptingReader{plain}
+	}
+	hash := sha256.New()
+	cfg := newConfig(opts)
+	r := &runnable{streamed: true, opts: opts, anonymousTemp: cfg.anonymousTemp, trusted: cfg.trustedSource}
+	if err := r.openBacking(io.TeeReader(src, hash), memfdName); err != nil {
+		return nil, err
+	}
+	hash.Sum(r.sha256[:0])
+	r.sha256hex = hexDigest(&r.sha256)
+	if cfg.validator != nil {
+		// The payload was never held in memory; read it back to validate it,
+		// which costs as much memory as the payload, see
+		// WithPayloadValidator.
+		payload, err := io.ReadAll(io.NewSectionReader(r.file, 0, math.MaxInt64))
+		if err == nil {
+			err = runValidator(cfg.validator, payload)
+		}
+		if err != nil {
+			r.Close()
 			return nil, err
 		}
-		// returns a runnable (actual file descriptor is closed; tempfile deleted on Close())
-		return r, nil
+	}
+	return r, nil
+}
+
+// decryptingReader marks read errors from a WithDecryptor reader as
+// decryption failures.
+type decryptingReader struct {
+	io.Reader
+}
+
+func (d decryptingReader) Read(p []byte) (int, error) {
+	n, err := d.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("decrypt payload: %w", err)
+	}
+	return n, err
+}
+
+// maxMemfdName is the longest name memfd_create(2) accepts.
+const maxMemfdName = 249
+
+// openBacking copies src into a new memfd named memfdName, or into a temporary
+// file when memfd_create(2) fails, ForceTempfileEnv is set or /proc is not
+// mounted, and makes it the runnable's backing.
+func (r *runnable) openBacking(src io.Reader, memfdName string) error {
+	metrics.opens.Add(1)
+	if forceTempfile() || !ProcMounted() {
+		return r.writeTemporaryFile(src)
+	}
+	if len(memfdName) > maxMemfdName {
+		memfdName = memfdName[:maxMemfdName]
+	}
+	fd, err := unix.MemfdCreate(memfdName, 0)
+	if err != nil {
+		// unable to create ananoymous file, dump it as a temporary file instead
+		// (actual file descriptor is closed; tempfile deleted on Close())
+		return r.writeTemporaryFile(src)
 	}
 	// memfd_create(2) succeeded
-	r.name = fmt.Sprintf("/proc/self/fd/%d", fd)
+	r.name = procSelfFDPath(fd)
 	f := os.NewFile(uintptr(fd), r.name)
 	r.file = f
 	r.closer = f
 	r.deleteOnClose = false // nothing to delete (in-memory file)
-	if _, err := r.file.Write(executablePayload); err != nil {
+	// The offset of a failed write tells ENOSPC or ENOMEM at a size limit
+	// apart from an early failure.
+	if n, err := io.Copy(r.file, src); err != nil {
 		if cerr := r.Close(); cerr != nil {
-			return nil, fmt.Errorf("unable to write payload: %w; unable to close memfd: %w", err, cerr)
+			return fmt.Errorf("unable to write payload after %d bytes: %w; unable to close memfd: %w", n, err, cerr)
 		}
-		return nil, fmt.Errorf("unable to write payload: %w", err)
+		return fmt.Errorf("unable to write payload after %d bytes: %w", n, err)
+	}
+	// memfd is open, gets closed on Close() (not deleted)
+	metrics.memfdOpens.Add(1)
+	return nil
+}
+
+// Adopt takes ownership of file, a memfd the caller created, for instance
+// with flags or seals emrun has no option for, and returns a runnable
+// executing it through /proc/self/fd. The file must resolve to a memfd there
+// and is read from offset 0 to compute the digest without moving its file
+// offset. Its close-on-exec flag is cleared, as a script run through
+// /proc/self/fd needs the descriptor to survive into its interpreter, so like
+// emrun's own memfds it is inherited by other children started meanwhile.
+// Closing the runnable closes file; on error file is left open and remains
+// the caller's.
+//
+//	fd, _ := unix.MemfdCreate("tool", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+//	// ... write the payload, add seals ...
+//	r, err := emrun.Adopt(os.NewFile(uintptr(fd), "tool"))
+func Adopt(file *os.File) (Runnable, error) {
+	if file == nil {
+		return nil, fmt.Errorf("adopt: %w", os.ErrInvalid)
+	}
+	name := procSelfFDPath(int(file.Fd()))
+	target, err := os.Readlink(name)
+	if err != nil {
+		return nil, fmt.Errorf("adopt %s: %w", file.Name(), err)
+	}
+	if !strings.HasPrefix(target, "/memfd:") {
+		return nil, fmt.Errorf("adopt %s: not a memfd: %s", file.Name(), target)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, math.MaxInt64)); err != nil {
+		return nil, fmt.Errorf("adopt %s: %w", file.Name(), err)
 	}
-	// return a runnable; memfd is open, gets closed on Close() (not deleted)
+	if _, err := unix.FcntlInt(file.Fd(), unix.F_SETFD, 0); err != nil {
+		return nil, fmt.Errorf("adopt %s: clear close-on-exec: %w", file.Name(), err)
+	}
+	r := &runnable{name: name, file: file, closer: file, streamed: true}
+	hash.Sum(r.sha256[:0])
+	r.sha256hex = hexDigest(&r.sha256)
 	return r, nil
 }
 
 // Run executes the payload with ctx in exec.CommandContext with args
 // using (*exec.Cmd).CombinedOutput, returns combined output or
-// error. cmd.Stdin is nil, use RunIO if you want to pass data via
-// stdin.
+// error. cmd.Stdin is nil, which os/exec connects to /dev/null; use
+// RunIO if you want to pass data via stdin. Tools that insist on
+// reading stdin are best run with WithNullStdin in the context options
+// to make that explicit. If ctx is cancelled during the run, the output
+// produced until then is returned with an error matching ctx.Err().
 func Run(ctx context.Context, executablePayload []byte, arg ...string) ([]byte, error) {
-	f, err := Open(executablePayload)
+	out, f, err := RunOpen(ctx, executablePayload, arg...)
+	if f != nil {
+		defer f.Close()
+	}
+	return out, err
+}
+
+// RunOpen is the building block behind Run: it executes the payload the same
+// way but returns the runnable still open instead of closing it, so callers
+// can inspect it after the run, e.g. IsMemfd() to detect a tempfile fallback,
+// Digest() or Name(). The runnable is returned whenever Open succeeded, even
+// if the execution failed, and the caller must Close it.
+func RunOpen(ctx context.Context, executablePayload []byte, arg ...string) ([]byte, Runnable, error) {
+	f, err := openContext(ctx, executablePayload)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer f.Close()
 	runnable := f.(*runnable)
 	cmd := exec.CommandContext(ctx, runnable.Name(), arg...)
-	return runnable.Run(ctx, cmd, true)
+	out, err := runnable.Run(ctx, cmd, true)
+	return out, f, err
 }
 
 // RunIO is similar to Run but uses r for stdin and w for stdout and
 // stderr. Uses ctx for (*exec.Cmd).CommandContext.
 func RunIO(ctx context.Context, r io.Reader, w io.Writer, executablePayload []byte, arg ...string) error {
-	f, err := Open(executablePayload)
+	f, err := openContext(ctx, executablePayload)
 	if err != nil {
 		return err
 	}
@@ -120,7 +449,7 @@ func RunIO(ctx context.Context, r io.Reader, w io.Writer, executablePayload []by
 // RunIOE is exactly like RunIO except with separate stdout and stderr
 // writers.
 func RunIOE(ctx context.Context, r io.Reader, stdout io.Writer, stderr io.Writer, executablePayload []byte, arg ...string) error {
-	f, err := Open(executablePayload)
+	f, err := openContext(ctx, executablePayload)
 	if err != nil {
 		return err
 	}
@@ -134,11 +463,221 @@ func RunIOE(ctx context.Context, r io.Reader, stdout io.Writer, stderr io.Writer
 	return err
 }
 
+// RunTee runs the payload like Run, returning the combined output, while also
+// streaming that output to live as it is produced, e.g. to a logger. A nil
+// live streams nowhere, like Run. Output written before a failure is returned
+// along with the error.
+func RunTee(ctx context.Context, live io.Writer, executablePayload []byte, arg ...string) ([]byte, error) {
+	f, err := openContext(ctx, executablePayload)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	runnable := f.(*runnable)
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	if live != nil {
+		out = io.MultiWriter(&buf, live)
+	}
+	cmd := exec.CommandContext(ctx, runnable.Name(), arg...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	_, err = runnable.Run(ctx, cmd, false)
+	return buf.Bytes(), err
+}
+
+// RunInto runs the payload like Run but appends the combined output to buf,
+// which the child writes into directly, and returns the number of bytes
+// appended. Nothing is copied out of a capture buffer, so a buf reused across
+// runs, e.g. from a sync.Pool, avoids allocating per run once it has grown.
+// Capture options such as WithTailCapture do not apply. Output written before
+// a failure stays in buf and is counted.
+//
+//	buf.Reset()
+//	n, err := emrun.RunInto(ctx, buf, payload, "--version")
+func RunInto(ctx context.Context, buf *bytes.Buffer, executablePayload []byte, arg ...string) (int, error) {
+	start := buf.Len()
+	err := RunIO(ctx, nil, buf, executablePayload, arg...)
+	return buf.Len() - start, err
+}
+
+// RunDuplex is a request/reply convenience for filter tools: it runs the
+// payload like Run with send as its stdin and returns the combined output,
+// e.g. a document sent to a formatter and the formatted document back. send
+// is written from a goroutine of its own while the output is drained, and
+// stdin is closed right after the last byte, so neither a child that reads
+// all input before writing nor one that writes while reading can deadlock on
+// a full pipe, and the child sees EOF instead of waiting for more input. A
+// child exiting before reading everything is not an error. Options setting
+// stdin, such as WithNullStdin, take precedence over send.
+//
+//	formatted, err := emrun.RunDuplex(ctx, document, formatter, "-")
+func RunDuplex(ctx context.Context, send []byte, executablePayload []byte, arg ...string) ([]byte, error) {
+	f, err := openContext(ctx, executablePayload)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	runnable := f.(*runnable)
+	cmd := exec.CommandContext(ctx, runnable.Name(), arg...)
+	cmd.Stdin = bytes.NewReader(send)
+	return runnable.Run(ctx, cmd, true)
+}
+
+// OpenOutput starts the payload and returns its combined output as a stream,
+// the shape of exec.Cmd.StdoutPipe for stdout and stderr together. The child
+// writes straight into a pipe, one descriptor for both streams, so their order
+// is preserved. Close waits for the child, releases the runnable and returns
+// the exit error, an *exec.ExitError when the payload exited non-zero. Read
+// to EOF before closing: Close closes the read end first, so a child still
+// writing is killed by SIGPIPE rather than left blocking on a full pipe.
+//
+//	out, err := emrun.OpenOutput(ctx, payload, "--list")
+//	if err != nil {
+//		return err
+//	}
+//	scanner := bufio.NewScanner(out)
+//	for scanner.Scan() {
+//		// ...
+//	}
+//	if err := out.Close(); err != nil {
+//		return err
+//	}
+func OpenOutput(ctx context.Context, executablePayload []byte, arg ...string) (io.ReadCloser, error) {
+	f, err := openContext(ctx, executablePayload)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	runnable := f.(*runnable)
+	cmd := exec.CommandContext(ctx, runnable.Name(), arg...)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	started, capture, err := runnable.StartBackground(ctx, cmd, false)
+	// The child holds its own copy of the write end; ours would keep the
+	// reader from ever seeing EOF.
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		f.Close()
+		return nil, err
+	}
+	return &outputReader{File: pr, cmd: started, capture: capture, runnable: f}, nil
+}
+
+// outputReader is the io.ReadCloser returned by OpenOutput.
+type outputReader struct {
+	*os.File
+	cmd      *exec.Cmd
+	capture  port.CommandCapture
+	runnable Runnable
+	once     sync.Once
+	err      error
+}
+
+func (o *outputReader) Close() error {
+	o.once.Do(func() {
+		o.File.Close()
+		res := WaitCommand(o.cmd, o.capture)
+		o.err = res.Error
+		if err := o.runnable.Close(); err != nil && o.err == nil {
+			o.err = err
+		}
+	})
+	return o.err
+}
+
+// Pipeline runs the stages concurrently like a shell pipeline, the stdout of
+// each stage feeding the stdin of the next, and returns the combined output
+// of the last stage. The first stage to fail cancels the rest and is reported
+// as *PipelineError naming it; see RunPipeline for the details.
+//
+//	out, err := emrun.Pipeline(ctx, []emrun.Stage{
+//		{Payload: grep, Args: []string{"-v", "^#", "/etc/services"}},
+//		{Payload: sort},
+//		{Payload: uniq, Args: []string{"-c"}},
+//	})
+func Pipeline(ctx context.Context, stages []Stage) ([]byte, error) {
+	runnables := make([]port.BackgroundRunnable, 0, len(stages))
+	args := make([][]string, 0, len(stages))
+	defer func() {
+		for _, r := range runnables {
+			r.Close()
+		}
+	}()
+	for i, stage := range stages {
+		f, err := openContext(ctx, stage.Payload)
+		if err != nil {
+			return nil, &PipelineError{Stage: i, Err: err}
+		}
+		runnables = append(runnables, f.(*runnable))
+		args = append(args, stage.Args)
+	}
+	return RunPipeline(ctx, runnables, args)
+}
+
+// RunNull runs the payload like Run and splits its combined output into
+// NUL-terminated records, see Result.NullRecords. The records produced before
+// a failure are returned along with the error.
+//
+//	files, err := emrun.RunNull(ctx, finder, root, "-type", "f", "-print0")
+func RunNull(ctx context.Context, executablePayload []byte, arg ...string) ([][]byte, error) {
+	out, err := Run(ctx, executablePayload, arg...)
+	return nullRecords(out), err
+}
+
+// RunJSONLines runs the payload and sends every line it writes to stdout as
+// a json.RawMessage on out, closing out once stdout reaches EOF or the run
+// ends. Blank lines are ignored and lines that are not valid JSON are skipped,
+// or passed to the handler set with WithMalformedLineHandler. A line is read
+// only after the previous one was received, so the capacity of out bounds
+// how far the payload can run ahead of the consumer. stderr is discarded
+// unless options redirect it. The error is that of the run, or ctx.Err()
+// when ctx is cancelled while a line waits to be received.
+//
+//	events := make(chan json.RawMessage, 16)
+//	go func() { errc <- emrun.RunJSONLines(ctx, events, tracer, "--json") }()
+//	for ev := range events {
+//		// ...
+//	}
+func RunJSONLines(ctx context.Context, out chan<- json.RawMessage, executablePayload []byte, arg ...string) error {
+	return streamJSONLines(ctx, out, func(stdout io.Writer) error {
+		return RunIOE(ctx, nil, stdout, nil, executablePayload, arg...)
+	})
+}
+
+// RunExpect runs the payload like Run and checks that it exits with wantCode.
+// A different exit code is reported as *UnexpectedExitError carrying the
+// output; when the code matches, the output is returned with a nil error even
+// if wantCode is non-zero. A wantCode of zero thus behaves like Run. Failures
+// that leave no exit code, such as policy denials, are returned unchanged.
+//
+//	out, err := emrun.RunExpect(ctx, 2, payload, "--bogus-flag")
+func RunExpect(ctx context.Context, wantCode int, executablePayload []byte, arg ...string) ([]byte, error) {
+	out, err := Run(ctx, executablePayload, arg...)
+	got := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return out, err
+		}
+		got = exitErr.ExitCode()
+	}
+	if got != wantCode {
+		return out, &UnexpectedExitError{Want: wantCode, Got: got, Output: out}
+	}
+	return out, nil
+}
+
 // Do is intended to run shebang scripts inline or from string
 // vars. Uses ctx in exec.CommandContext and returns
 // (*exec.Cmd).CombinedOutput.
 func Do(ctx context.Context, payload string, arg ...string) ([]byte, error) {
-	f, err := Open([]byte(payload))
+	f, err := openContext(ctx, []byte(payload))
 	if err != nil {
 		return nil, err
 	}
@@ -165,7 +704,7 @@ func Do(ctx context.Context, payload string, arg ...string) ([]byte, error) {
 //		return ctx.Err()
 //	}
 func RunBG(ctx context.Context, executablePayload []byte, arg ...string) (*Background, error) {
-	r, err := Open(executablePayload)
+	r, err := openContext(ctx, executablePayload)
 	if err != nil {
 		return nil, err
 	}
@@ -176,7 +715,7 @@ func RunBG(ctx context.Context, executablePayload []byte, arg ...string) (*Backg
 // combined stdout/stderr. The returned Result has a nil CombinedOutput since
 // output is streamed to writer.
 func RunIOBG(ctx context.Context, reader io.Reader, writer io.Writer, executablePayload []byte, arg ...string) (*Background, error) {
-	r, err := Open(executablePayload)
+	r, err := openContext(ctx, executablePayload)
 	if err != nil {
 		return nil, err
 	}
@@ -186,13 +725,33 @@ func RunIOBG(ctx context.Context, reader io.Reader, writer io.Writer, executable
 // RunIOEBG is the background variant of RunIOE, streaming stdout and stderr to
 // separate writers while returning a Background handle for lifecycle control.
 func RunIOEBG(ctx context.Context, reader io.Reader, stdout io.Writer, stderr io.Writer, executablePayload []byte, arg ...string) (*Background, error) {
-	r, err := Open(executablePayload)
+	r, err := openContext(ctx, executablePayload)
 	if err != nil {
 		return nil, err
 	}
 	return StartBackground(ctx, r.(*runnable), arg, reader, stdout, stderr, false)
 }
 
+// StartInteractive runs the payload in the background like RunBG and returns
+// pipes to the child's stdin and stdout, the coprocess pattern with a standard
+// Background handle. Stderr is discarded. Close stdin to signal EOF; both
+// pipes are closed when the child exits or the Background is cancelled.
+//
+//	bg, stdin, stdout, err := emrun.StartInteractive(ctx, payload)
+//	if err != nil {
+//		return err
+//	}
+//	defer bg.Cancel()
+//	fmt.Fprintln(stdin, "query")
+//	line, err := bufio.NewReader(stdout).ReadString('\n')
+func StartInteractive(ctx context.Context, executablePayload []byte, arg ...string) (*Background, io.WriteCloser, io.ReadCloser, error) {
+	r, err := openContext(ctx, executablePayload)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return StartInteractiveBackground(ctx, r.(*runnable), arg)
+}
+
 // DoBG runs the provided script string in the background, mirroring Do but
 // returning a Background handle so callers can select on completion or cancel.
 func DoBG(ctx context.Context, payload string, arg ...string) (*Background, error) {
@@ -4,15 +4,25 @@
 package emrun
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
+
+	"pkt.systems/emrun/adapters/mockrunner"
 )
 
 func TestOpenCreatesExecutableMemfd(t *testing.T) {
@@ -26,6 +36,9 @@ func TestOpenCreatesExecutableMemfd(t *testing.T) {
 	if !strings.HasPrefix(f.Name(), "/proc/self/fd/") {
 		t.Fatalf("unexpected file name %q", f.Name())
 	}
+	if f.Backing() != BackingMemfd || !f.IsMemfd() {
+		t.Fatalf("unexpected backing %v", f.Backing())
+	}
 
 	if _, err := f.Seek(0, io.SeekStart); err != nil {
 		t.Fatalf("failed to seek memfd: %v", err)
@@ -39,6 +52,58 @@ func TestOpenCreatesExecutableMemfd(t *testing.T) {
 	}
 }
 
+func TestOpenForceTempfileEnv(t *testing.T) {
+	t.Setenv(ForceTempfileEnv, "1")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	payload := []byte("#!/bin/sh\necho forced\n")
+	out, f, err := RunOpen(ctx, payload)
+	if err != nil {
+		t.Fatalf("RunOpen returned error: %v", err)
+	}
+	if f.IsMemfd() || f.Backing() != BackingTempFile {
+		t.Fatalf("expected tempfile backing, got %v at %q", f.Backing(), f.Name())
+	}
+	if string(out) != "forced\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	name := f.Name()
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("temporary file still exists after close: err=%v", err)
+	}
+}
+
+func TestOpenWithoutProc(t *testing.T) {
+	if !ProcMounted() {
+		t.Skip("/proc is not mounted")
+	}
+	defer func(dir string) { procSelfFD = dir }(procSelfFD)
+	procSelfFD = filepath.Join(t.TempDir(), "missing")
+	if ProcMounted() {
+		t.Fatal("expected ProcMounted to report false")
+	}
+
+	f, err := OpenReader(strings.NewReader("#!/bin/sh\necho noproc\n"), WithAnonymousTempFile())
+	if err != nil {
+		t.Fatalf("OpenReader returned error: %v", err)
+	}
+	defer f.Close()
+	out, err := f.Run(context.Background(), exec.Command(f.Name()), true)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if f.Backing() != BackingTempFile || strings.HasPrefix(f.Name(), "/proc/") {
+		t.Fatalf("expected a named tempfile backing, got %v at %q", f.Backing(), f.Name())
+	}
+	if string(out) != "noproc\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
 func TestRunExecutesPayload(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
@@ -55,6 +120,196 @@ func TestRunExecutesPayload(t *testing.T) {
 	}
 }
 
+func TestWithNullStdinOverridesReader(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = WithOptions(ctx, WithNullStdin())
+	payload := []byte("#!/bin/sh\nif read line; then echo \"got:$line\"; else echo eof; fi\nreadlink /proc/self/fd/0\n")
+	var out bytes.Buffer
+	if err := RunIO(ctx, strings.NewReader("data\n"), &out, payload); err != nil {
+		t.Fatalf("RunIO returned error: %v", err)
+	}
+	if out.String() != "eof\n/dev/null\n" {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+}
+
+func TestRunWithTailCapture(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = WithOptions(ctx, WithTailCapture(6))
+	out, err := Run(ctx, []byte("#!/bin/sh\necho first line\necho error 1>&2\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "error\n" {
+		t.Fatalf("unexpected tail output: %q", out)
+	}
+
+	bg, err := RunBG(ctx, []byte("#!/bin/sh\necho first line\necho error 1>&2\n"))
+	if err != nil {
+		t.Fatalf("RunBG returned error: %v", err)
+	}
+	if res := bg.Wait(); string(res.CombinedOutput) != "error\n" || !res.Truncated {
+		t.Fatalf("expected truncated tail output, got %q truncated=%v", res.CombinedOutput, res.Truncated)
+	}
+	bg, err = RunBG(ctx, []byte("#!/bin/sh\necho ok\n"))
+	if err != nil {
+		t.Fatalf("RunBG returned error: %v", err)
+	}
+	if res := bg.Wait(); string(res.CombinedOutput) != "ok\n" || res.Truncated {
+		t.Fatalf("expected complete output, got %q truncated=%v", res.CombinedOutput, res.Truncated)
+	}
+}
+
+func TestRunWithTimeWindowCapture(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = WithOptions(ctx, WithTailCapture(2), WithTimeWindowCapture(300*time.Millisecond))
+	out, err := Run(ctx, []byte("#!/bin/sh\necho early\nsleep 1\necho late 1>&2\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "late\n" {
+		t.Fatalf("unexpected windowed output: %q", out)
+	}
+}
+
+func TestRunWithStripANSI(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = WithOptions(ctx, WithStripANSI())
+	out, err := Run(ctx, []byte("#!/bin/sh\nprintf '\\033[1;31merror\\033[0m: '\nprintf '\\033[32mok\\033[0m\\n' >&2\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "error: ok\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestRunWithProgress(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var reports []int64
+	ctx = WithOptions(ctx, WithProgress(20*time.Millisecond, func(n int64) {
+		reports = append(reports, n)
+	}))
+	out, err := Run(ctx, []byte("#!/bin/sh\necho first\nsleep 0.3\necho second\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "first\nsecond\n" {
+		t.Fatalf("progress consumed output: %q", out)
+	}
+	if len(reports) < 2 {
+		t.Fatalf("expected periodic reports, got %v", reports)
+	}
+	if !slices.IsSorted(reports) || reports[len(reports)-1] != int64(len(out)) {
+		t.Fatalf("unexpected reports %v for %d bytes", reports, len(out))
+	}
+}
+
+func TestRunJSONLines(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var malformed []string
+	ctx = WithOptions(ctx, WithMalformedLineHandler(func(line []byte, err error) {
+		if err == nil {
+			t.Errorf("expected a decoding error for %q", line)
+		}
+		malformed = append(malformed, string(line))
+	}))
+	payload := []byte("#!/bin/sh\necho '{\"n\":1}'\necho\necho 'not json'\necho noise >&2\nprintf '[2, 3]'\n")
+	out := make(chan json.RawMessage)
+	errc := make(chan error, 1)
+	go func() { errc <- RunJSONLines(ctx, out, payload) }()
+	var got []string
+	for msg := range out {
+		got = append(got, string(msg))
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("RunJSONLines returned error: %v", err)
+	}
+	if !slices.Equal(got, []string{`{"n":1}`, `[2, 3]`}) {
+		t.Fatalf("unexpected lines: %q", got)
+	}
+	if !slices.Equal(malformed, []string{"not json"}) {
+		t.Fatalf("unexpected malformed lines: %q", malformed)
+	}
+
+	short, cancelShort := context.WithCancel(context.Background())
+	out = make(chan json.RawMessage)
+	go func() { errc <- RunJSONLines(short, out, []byte("#!/bin/sh\nwhile :; do echo 1; done\n")) }()
+	<-out
+	cancelShort()
+	for range out {
+	}
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRunWithEnvMap(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	t.Setenv("EMRUN_TEST_INHERITED", "kept")
+	ctx = WithOptions(ctx, WithEnvMap(map[string]string{"EMRUN_TEST_VAR": "a=b"}))
+	out, err := Run(ctx, []byte("#!/bin/sh\necho \"$EMRUN_TEST_VAR $EMRUN_TEST_INHERITED\"\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "a=b kept\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestRunWithTermGrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = WithOptions(ctx, WithTermGrace(5*time.Second))
+	time.AfterFunc(200*time.Millisecond, cancel)
+	payload := []byte("#!/bin/sh\ntrap 'echo terminated; exit 0' TERM\nwhile :; do sleep 0.05; done\n")
+	start := time.Now()
+	out, _ := Run(ctx, payload)
+	if string(out) != "terminated\n" {
+		t.Fatalf("child did not handle SIGTERM: %q", out)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Fatalf("child was not stopped promptly: %v", elapsed)
+	}
+}
+
+func TestRunBadExecutableFormat(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	f, err := Open([]byte("not an executable\n"))
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer f.Close()
+	memfd := f.IsMemfd()
+	_, err = f.Run(ctx, exec.CommandContext(ctx, f.Name()), true)
+	if !errors.Is(err, ErrBadExecutableFormat) || !errors.Is(err, syscall.ENOEXEC) {
+		t.Fatalf("expected ErrBadExecutableFormat wrapping ENOEXEC, got %v", err)
+	}
+	if f.IsMemfd() != memfd {
+		t.Fatal("ENOEXEC must not trigger the tempfile fallback")
+	}
+}
+
+func TestRunWithArchCheck(t *testing.T) {
+	foreign, _ := foreignELFHeader()
+	ctx := WithOptions(context.Background(), WithArchCheck())
+	if _, err := Run(ctx, foreign); !errors.Is(err, ErrArchMismatch) {
+		t.Fatalf("expected ErrArchMismatch, got %v", err)
+	}
+	out, err := Run(ctx, []byte("#!/bin/sh\necho script\n"))
+	if err != nil || string(out) != "script\n" {
+		t.Fatalf("script rejected by arch check: %q, %v", out, err)
+	}
+}
+
 func TestDoExecutesPayload(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
@@ -124,6 +379,9 @@ func TestRunBGReturnsBackgroundResult(t *testing.T) {
 	if string(res.CombinedOutput) != "bg:value\n" {
 		t.Fatalf("unexpected combined output: %q", res.CombinedOutput)
 	}
+	if res.OutputBytes != int64(len("bg:value\n")) {
+		t.Fatalf("unexpected output byte count: %d", res.OutputBytes)
+	}
 }
 
 func TestRunIOBGStreamsOutput(t *testing.T) {
@@ -145,6 +403,145 @@ func TestRunIOBGStreamsOutput(t *testing.T) {
 	if out.String() != "io:demo\nerr:demo\n" {
 		t.Fatalf("unexpected streamed output: %q", out.String())
 	}
+	if res.OutputBytes != int64(out.Len()) || res.StdoutBytes != 0 || res.StderrBytes != 0 {
+		t.Fatalf("unexpected byte counts: output=%d stdout=%d stderr=%d", res.OutputBytes, res.StdoutBytes, res.StderrBytes)
+	}
+}
+
+func TestWithPayloadValidator(t *testing.T) {
+	errNotSh := errors.New("not a /bin/sh script")
+	calls := 0
+	validator := WithPayloadValidator(func(payload []byte) error {
+		calls++
+		if path, _, ok := ShebangInterpreter(payload); !ok || path != "/bin/sh" {
+			return errNotSh
+		}
+		return nil
+	})
+	ctx := WithOptions(context.Background(), validator)
+	out, err := Run(ctx, []byte("#!/bin/sh\necho valid\n"))
+	if err != nil || string(out) != "valid\n" || calls != 1 {
+		t.Fatalf("unexpected result for a valid payload: %q, %v, %d calls", out, err, calls)
+	}
+	rejected := []byte("#!/usr/bin/env perl\nprint 1\n")
+	if _, err := Run(ctx, rejected); !errors.Is(err, ErrPayloadRejected) || !errors.Is(err, errNotSh) {
+		t.Fatalf("expected Run to be rejected, got %v", err)
+	}
+	if _, err := OpenContext(ctx, rejected); !errors.Is(err, errNotSh) {
+		t.Fatalf("expected OpenContext to be rejected, got %v", err)
+	}
+	if _, err := OpenReader(bytes.NewReader(rejected), validator); !errors.Is(err, errNotSh) {
+		t.Fatalf("expected OpenReader to be rejected, got %v", err)
+	}
+	f, err := OpenReader(strings.NewReader("#!/bin/sh\n"), validator)
+	if err != nil {
+		t.Fatalf("OpenReader returned error: %v", err)
+	}
+	f.Close()
+	if calls != 5 {
+		t.Fatalf("expected one validation per open, got %d", calls)
+	}
+	// Open takes no options, so nothing validates what it opens.
+	if f, err := Open(rejected); err != nil || calls != 5 {
+		t.Fatalf("expected Open to skip the validator, got %v after %d calls", err, calls)
+	} else {
+		f.Close()
+	}
+}
+
+func TestRunNull(t *testing.T) {
+	records, err := RunNull(context.Background(), []byte("#!/bin/sh\nprintf 'a b\\000c\\nd\\000'\n"))
+	if err != nil {
+		t.Fatalf("RunNull returned error: %v", err)
+	}
+	if len(records) != 2 || string(records[0]) != "a b" || string(records[1]) != "c\nd" {
+		t.Fatalf("unexpected records: %q", records)
+	}
+}
+
+func TestRunInto(t *testing.T) {
+	buf := bytes.NewBufferString("kept:")
+	n, err := RunInto(context.Background(), buf, []byte("#!/bin/sh\necho out\necho err >&2\n"))
+	if err != nil {
+		t.Fatalf("RunInto returned error: %v", err)
+	}
+	if n != 8 || buf.String() != "kept:out\nerr\n" {
+		t.Fatalf("unexpected output %q (%d bytes)", buf.String(), n)
+	}
+
+	buf.Reset()
+	n, err = RunInto(context.Background(), buf, []byte("#!/bin/sh\necho partial\nexit 2\n"))
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || n != 8 || buf.String() != "partial\n" {
+		t.Fatalf("expected the partial output with the exit error, got %q (%d bytes), %v", buf.String(), n, err)
+	}
+}
+
+func TestRunDuplex(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Larger than a pipe buffer in both directions, and cat only exits on EOF.
+	send := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	out, err := RunDuplex(ctx, send, []byte("#!/bin/sh\ncat\n"))
+	if err != nil {
+		t.Fatalf("RunDuplex returned error: %v", err)
+	}
+	if !bytes.Equal(out, send) {
+		t.Fatalf("echoed %d bytes, sent %d", len(out), len(send))
+	}
+	out, err = RunDuplex(ctx, send, []byte("#!/bin/sh\necho ignored\n"))
+	if err != nil || string(out) != "ignored\n" {
+		t.Fatalf("RunDuplex of a child not reading stdin = %q, %v", out, err)
+	}
+}
+
+func TestStartInteractive(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	payload := []byte("#!/bin/sh\nwhile read line; do echo \"got $line\"; done\necho bye\n")
+	bg, stdin, stdout, err := StartInteractive(ctx, payload)
+	if err != nil {
+		t.Fatalf("StartInteractive returned error: %v", err)
+	}
+	defer bg.Cancel()
+	lines := bufio.NewReader(stdout)
+	for _, word := range []string{"one", "two"} {
+		if _, err := io.WriteString(stdin, word+"\n"); err != nil {
+			t.Fatalf("write stdin: %v", err)
+		}
+		if line, err := lines.ReadString('\n'); err != nil || line != "got "+word+"\n" {
+			t.Fatalf("unexpected reply %q, %v", line, err)
+		}
+	}
+	if err := stdin.Close(); err != nil {
+		t.Fatalf("close stdin: %v", err)
+	}
+	rest, err := io.ReadAll(lines)
+	if err != nil || string(rest) != "bye\n" {
+		t.Fatalf("unexpected tail %q, %v", rest, err)
+	}
+	if res := bg.Wait(); res.Error != nil {
+		t.Fatalf("background run failed: %v", res.Error)
+	}
+}
+
+func TestStartInteractiveCancelClosesPipes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	bg, stdin, stdout, err := StartInteractive(ctx, []byte("#!/bin/sh\nwhile :; do echo spam; done\n"))
+	if err != nil {
+		t.Fatalf("StartInteractive returned error: %v", err)
+	}
+	bg.Cancel()
+	if res := bg.Wait(); res.Error == nil {
+		t.Fatal("expected an error from the cancelled run")
+	}
+	if _, err := io.ReadAll(stdout); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected stdout to fail with the context error, got %v", err)
+	}
+	if _, err := io.WriteString(stdin, "late\n"); err == nil {
+		t.Fatal("expected stdin to be closed after cancellation")
+	}
 }
 
 func TestRunIOEBGSeparatesStreams(t *testing.T) {
@@ -170,6 +567,80 @@ func TestRunIOEBGSeparatesStreams(t *testing.T) {
 	if stderr.String() != "stderr:demo\n" {
 		t.Fatalf("unexpected stderr: %q", stderr.String())
 	}
+	if res.StdoutBytes != int64(stdout.Len()) || res.StderrBytes != int64(stderr.Len()) {
+		t.Fatalf("unexpected byte counts: stdout=%d stderr=%d", res.StdoutBytes, res.StderrBytes)
+	}
+	if res.OutputBytes != res.StdoutBytes+res.StderrBytes {
+		t.Fatalf("unexpected output byte count: %d", res.OutputBytes)
+	}
+}
+
+func TestBackgroundOutputBytes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Counted as written, not as kept by the tail capture or the stripper.
+	payload := []byte("#!/bin/sh\nprintf '\\033[1mbold\\033[0m 0123456789\\n'\n")
+	bg, err := RunBG(WithOptions(ctx, WithTailCapture(4), WithStripANSI()), payload)
+	if err != nil {
+		t.Fatalf("RunBG returned error: %v", err)
+	}
+	res := bg.Wait()
+	if res.Error != nil || string(res.CombinedOutput) != "789\n" {
+		t.Fatalf("unexpected result %q, %v", res.CombinedOutput, res.Error)
+	}
+	if want := int64(len("\033[1mbold\033[0m 0123456789\n")); res.OutputBytes != want {
+		t.Fatalf("OutputBytes = %d, want %d", res.OutputBytes, want)
+	}
+
+	// An *os.File is handed to the child as is, so the child does not write
+	// to a pipe and its bytes are reported as unknown.
+	file, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	bg, err = RunIOBG(ctx, nil, file, []byte("#!/bin/sh\nreadlink /proc/$$/fd/1\n"))
+	if err != nil {
+		t.Fatalf("RunIOBG returned error: %v", err)
+	}
+	if res := bg.Wait(); res.Error != nil || res.OutputBytes != -1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	out, err := os.ReadFile(file.Name())
+	if err != nil || strings.TrimSpace(string(out)) != file.Name() {
+		t.Fatalf("child wrote to %q, want %s", out, file.Name())
+	}
+
+	// A separate stderr writer is still counted.
+	var stderr bytes.Buffer
+	bg, err = RunIOEBG(ctx, nil, file, &stderr, []byte("#!/bin/sh\necho out\necho err 1>&2\n"))
+	if err != nil {
+		t.Fatalf("RunIOEBG returned error: %v", err)
+	}
+	res = bg.Wait()
+	if res.Error != nil || res.StdoutBytes != -1 || res.StderrBytes != int64(len("err\n")) || res.OutputBytes != -1 {
+		t.Fatalf("unexpected byte counts: stdout=%d stderr=%d output=%d, %v", res.StdoutBytes, res.StderrBytes, res.OutputBytes, res.Error)
+	}
+}
+
+func TestWaitAnyKeepsOtherResults(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	slow, err := RunBG(ctx, []byte("#!/bin/sh\nsleep 0.2\necho slow\n"))
+	if err != nil {
+		t.Fatalf("RunBG returned error: %v", err)
+	}
+	fast, err := RunBG(ctx, []byte("#!/bin/sh\necho fast\n"))
+	if err != nil {
+		t.Fatalf("RunBG returned error: %v", err)
+	}
+	i, res := WaitAny(ctx, slow, fast)
+	if i != 1 || string(res.CombinedOutput) != "fast\n" {
+		t.Fatalf("WaitAny() = %d, %q; want the fast background", i, res.CombinedOutput)
+	}
+	if res := <-slow.Done; string(res.CombinedOutput) != "slow\n" {
+		t.Fatalf("slow background lost its result: %q", res.CombinedOutput)
+	}
 }
 
 func TestDoBGMatchesDo(t *testing.T) {
@@ -207,3 +678,223 @@ func TestRunAllowedByPolicy(t *testing.T) {
 		t.Fatalf("Run returned error under allow policy: %v", err)
 	}
 }
+
+func TestRunUsesRunnerFromContext(t *testing.T) {
+	mock := mockrunner.New(func(cmd *exec.Cmd) error {
+		_, err := cmd.Stdout.Write([]byte("mocked\n"))
+		return err
+	})
+	ctx := WithRunner(context.Background(), mock)
+	out, err := Run(ctx, []byte("#!/bin/sh\necho real\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "mocked\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	if mock.Calls != 1 {
+		t.Fatalf("unexpected number of runner calls: %d", mock.Calls)
+	}
+}
+
+func TestRunOpenReturnsOpenRunnable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	payload := []byte("#!/bin/sh\necho run-open\n")
+	out, f, err := RunOpen(ctx, payload)
+	if err != nil {
+		t.Fatalf("RunOpen returned error: %v", err)
+	}
+	defer f.Close()
+	if string(out) != "run-open\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	sum := sha256.Sum256(payload)
+	if f.Digest() != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected digest: %s", f.Digest())
+	}
+	if !f.IsMemfd() {
+		t.Fatalf("expected memfd backing, got %q", f.Name())
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("runnable was closed after RunOpen: %v", err)
+	}
+}
+
+func TestRunExpect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	payload := []byte("#!/bin/sh\necho code:$1\nexit $1\n")
+	tests := []struct {
+		name    string
+		want    int
+		code    string
+		wantErr bool
+	}{
+		{name: "success", want: 0, code: "0"},
+		{name: "expected failure", want: 2, code: "2"},
+		{name: "unexpected failure", want: 0, code: "3", wantErr: true},
+		{name: "unexpected success", want: 2, code: "0", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := RunExpect(ctx, tc.want, payload, tc.code)
+			if string(out) != "code:"+tc.code+"\n" {
+				t.Fatalf("unexpected output: %q", out)
+			}
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatalf("RunExpect returned error: %v", err)
+				}
+				return
+			}
+			var exitErr *UnexpectedExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("expected *UnexpectedExitError, got %v", err)
+			}
+			if exitErr.Want != tc.want || strconv.Itoa(exitErr.Got) != tc.code || !bytes.Equal(exitErr.Output, out) {
+				t.Fatalf("unexpected error contents: %+v", exitErr)
+			}
+		})
+	}
+}
+
+func TestRunTeeReturnsAndStreams(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var live bytes.Buffer
+	out, err := RunTee(ctx, &live, []byte("#!/bin/sh\necho out\necho err 1>&2\nexit 1\n"))
+	if err == nil {
+		t.Fatal("expected exit error")
+	}
+	if string(out) != "out\nerr\n" {
+		t.Fatalf("unexpected returned output: %q", out)
+	}
+	if live.String() != string(out) {
+		t.Fatalf("live output %q differs from returned %q", live.String(), out)
+	}
+	if out, err := RunTee(ctx, nil, []byte("#!/bin/sh\necho quiet\n")); err != nil || string(out) != "quiet\n" {
+		t.Fatalf("RunTee without a live writer = %q, %v", out, err)
+	}
+}
+
+func TestOpenOutput(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := OpenOutput(ctx, []byte("#!/bin/sh\necho out\necho err 1>&2\nexit 3\n"))
+	if err != nil {
+		t.Fatalf("OpenOutput returned error: %v", err)
+	}
+	data, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+	if string(data) != "out\nerr\n" {
+		t.Fatalf("unexpected output: %q", data)
+	}
+	var exitErr *exec.ExitError
+	if err := out.Close(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("expected exit code 3 from Close, got %v", err)
+	}
+
+	endless, err := OpenOutput(ctx, []byte("#!/bin/sh\nwhile :; do echo y; done\n"))
+	if err != nil {
+		t.Fatalf("OpenOutput returned error: %v", err)
+	}
+	if _, err := io.ReadFull(endless, make([]byte, 4)); err != nil {
+		t.Fatalf("ReadFull returned error: %v", err)
+	}
+	if err := endless.Close(); err == nil || ctx.Err() != nil {
+		t.Fatalf("expected Close to stop the writer with an error before the deadline, got %v", err)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := Pipeline(ctx, []Stage{
+		{Payload: []byte("#!/bin/sh\nprintf 'b\\na\\nb\\nc\\n'\necho ignored >&2\n")},
+		{Payload: []byte("#!/bin/sh\nexec sort \"$@\"\n"), Args: []string{"-u"}},
+		{Payload: []byte("#!/bin/sh\nexec tr a-z A-Z\n")},
+	})
+	if err != nil {
+		t.Fatalf("Pipeline returned error: %v", err)
+	}
+	if string(out) != "A\nB\nC\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	// The endless first stage dies of SIGPIPE once head exits, which is not a
+	// failure.
+	out, err = Pipeline(ctx, []Stage{
+		{Payload: []byte("#!/bin/sh\nwhile :; do echo y; done\n")},
+		{Payload: []byte("#!/bin/sh\nexec head -n 2\n")},
+	})
+	if err != nil || string(out) != "y\ny\n" {
+		t.Fatalf("unexpected result: %q, %v", out, err)
+	}
+
+	_, err = Pipeline(ctx, []Stage{
+		{Payload: []byte("#!/bin/sh\nsleep 10\n")},
+		{Payload: []byte("#!/bin/sh\nexit 4\n")},
+		{Payload: []byte("#!/bin/sh\ncat\n")},
+	})
+	var pipeErr *PipelineError
+	var exitErr *exec.ExitError
+	if !errors.As(err, &pipeErr) || pipeErr.Stage != 1 || !errors.As(err, &exitErr) || exitErr.ExitCode() != 4 {
+		t.Fatalf("expected stage 1 to fail with exit code 4, got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("expected the failure to cancel the sleeping stage")
+	}
+}
+
+// cancelAfterContext reports cancellation from the n+1th call to Err on.
+type cancelAfterContext struct {
+	context.Context
+	n     int
+	calls int
+}
+
+func (c *cancelAfterContext) Err() error {
+	c.calls++
+	if c.calls > c.n {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestOpenContext(t *testing.T) {
+	payload := append([]byte("#!/bin/sh\necho chunked\n#"), bytes.Repeat([]byte{'x'}, 8<<20)...)
+	payload = append(payload, '\n')
+	ctx := WithOptions(context.Background(), WithWriteChunkSize(1<<20))
+	f, err := OpenContext(ctx, payload)
+	if err != nil {
+		t.Fatalf("OpenContext returned error: %v", err)
+	}
+	defer f.Close()
+	data, err := os.ReadFile(f.Name())
+	if err != nil || !bytes.Equal(data, payload) {
+		t.Fatalf("payload not written intact: %d bytes, %v", len(data), err)
+	}
+	out, err := f.Run(ctx, exec.CommandContext(ctx, f.Name()), true)
+	if err != nil || string(out) != "chunked\n" {
+		t.Fatalf("unexpected run result: %q, %v", out, err)
+	}
+
+	// The first check happens before opening, then one per chunk.
+	cancelling := &cancelAfterContext{Context: ctx, n: 4}
+	if _, err := OpenContext(cancelling, payload); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation during the write, got %v", err)
+	}
+	if cancelling.calls != 5 {
+		t.Fatalf("expected the write to stop at the first cancelled check, got %d checks", cancelling.calls)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := OpenContext(cancelled, payload); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancelled context to fail, got %v", err)
+	}
+}
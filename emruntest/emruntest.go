@@ -0,0 +1,155 @@
+// Package emruntest provides testing helpers for code built on emrun and
+// efrun. SetClock replaces the clock behind their timeouts and backoffs, such
+// as WithHangDiagnostic, the retries of a text file busy execution and
+// WithTimeWindowCapture, with a FakeClock that a test advances explicitly, so
+// those paths can be exercised deterministically and without sleeping.
+//
+//	clk := emruntest.NewFakeClock(time.Now())
+//	emruntest.SetClock(t, clk)
+//	bg, _ := emrun.RunBG(emrun.WithOptions(ctx, emrun.WithHangDiagnostic(time.Minute)), payload)
+//	clk.Advance(time.Minute) // the payload receives SIGQUIT now
+//
+// The clock is process-wide, so tests that set it must not run in parallel
+// with other tests relying on real time.
+//
+// ReplayRunner answers commands with executions recorded through
+// emrun.WithRecorder, turning a recorded incident into a test fixture.
+package emruntest
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"pkt.systems/emrun/internal/clock"
+	"pkt.systems/emrun/port"
+)
+
+// SetClock makes c the clock used by emrun, efrun and their adapters until
+// the test tb and its subtests complete.
+func SetClock(tb testing.TB, c port.Clock) {
+	tb.Helper()
+	tb.Cleanup(clock.Set(c))
+}
+
+// FakeClock is a port.Clock whose time only moves when Advance is called.
+// Timers fire from within Advance, in order of their deadlines. The zero
+// value is not usable; create one with NewFakeClock.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a FakeClock reading now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the clock's current time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns the channel of a new timer firing after d.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// NewTimer returns a timer sending the clock's time on its channel once the
+// clock has been advanced by d.
+func (c *FakeClock) NewTimer(d time.Duration) port.Timer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// AfterFunc returns a timer calling f once the clock has been advanced by d.
+// f runs in its own goroutine, as with time.AfterFunc.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) port.Timer {
+	t := &fakeTimer{clock: c, f: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d and fires every timer whose deadline
+// has been reached, earliest first.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due []*fakeTimer
+	c.timers = slices.DeleteFunc(c.timers, func(t *fakeTimer) bool {
+		if t.when.After(now) {
+			return false
+		}
+		due = append(due, t)
+		return true
+	})
+	c.mu.Unlock()
+	slices.SortStableFunc(due, func(a, b *fakeTimer) int {
+		return a.when.Compare(b.when)
+	})
+	for _, t := range due {
+		t.fire(now)
+	}
+}
+
+// Pending returns the number of timers that have not fired or been stopped,
+// which lets a test wait until the code under test has armed its timer before
+// advancing the clock.
+func (c *FakeClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	c     chan time.Time
+	f     func()
+	when  time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) fire(now time.Time) {
+	if t.f != nil {
+		go t.f()
+		return
+	}
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+// Stop removes the timer and reports whether it was still pending.
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.timers)
+	c.timers = slices.DeleteFunc(c.timers, func(other *fakeTimer) bool {
+		return other == t
+	})
+	return len(c.timers) < n
+}
+
+// Reset rearms the timer to fire d after the clock's current time and reports
+// whether it was still pending. A zero or negative d fires on the next
+// Advance.
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	active := t.Stop()
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.when = c.now.Add(d)
+	c.timers = append(c.timers, t)
+	return active
+}
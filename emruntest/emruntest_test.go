@@ -0,0 +1,59 @@
+package emruntest_test
+
+import (
+	"testing"
+	"time"
+
+	"pkt.systems/emrun/emruntest"
+	"pkt.systems/emrun/internal/clock"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clk := emruntest.NewFakeClock(start)
+	late := clk.NewTimer(2 * time.Second)
+	early := clk.After(time.Second)
+	stopped := clk.NewTimer(time.Second)
+	fired := make(chan struct{})
+	clk.AfterFunc(3*time.Second, func() { close(fired) })
+	if !stopped.Stop() || clk.Pending() != 3 {
+		t.Fatalf("expected three pending timers after Stop, got %d", clk.Pending())
+	}
+
+	clk.Advance(time.Second)
+	select {
+	case now := <-early:
+		if !now.Equal(start.Add(time.Second)) {
+			t.Fatalf("unexpected fire time %v", now)
+		}
+	default:
+		t.Fatal("expected the one second timer to fire")
+	}
+	select {
+	case <-late.C():
+		t.Fatal("the two second timer fired early")
+	default:
+	}
+
+	clk.Advance(2 * time.Second)
+	if _, ok := <-late.C(); !ok || clk.Pending() != 0 {
+		t.Fatalf("expected every timer to have fired, %d pending", clk.Pending())
+	}
+	<-fired
+	if got := clk.Now(); !got.Equal(start.Add(3 * time.Second)) {
+		t.Fatalf("Now() = %v", got)
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	clk := emruntest.NewFakeClock(time.Unix(1000, 0))
+	t.Run("set", func(t *testing.T) {
+		emruntest.SetClock(t, clk)
+		if clock.Get() != clk {
+			t.Fatal("expected the fake clock to be in use")
+		}
+	})
+	if clock.Get() != clock.Real {
+		t.Fatal("expected the real clock to be restored after the test")
+	}
+}
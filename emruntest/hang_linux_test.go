@@ -0,0 +1,39 @@
+package emruntest_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pkt.systems/emrun"
+	"pkt.systems/emrun/emruntest"
+)
+
+func TestHangDiagnosticWithFakeClock(t *testing.T) {
+	clk := emruntest.NewFakeClock(time.Now())
+	emruntest.SetClock(t, clk)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ready := filepath.Join(t.TempDir(), "ready")
+	payload := []byte("#!/bin/sh\ntrap 'exit 3' QUIT\ntouch " + ready + "\nwhile :; do sleep 0.05; done\n")
+	bg, err := emrun.RunBG(emrun.WithOptions(ctx, emrun.WithHangDiagnostic(time.Hour)), payload)
+	if err != nil {
+		t.Fatalf("RunBG returned error: %v", err)
+	}
+	for {
+		if _, err := os.Stat(ready); err == nil && clk.Pending() == 1 {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatal("payload never became ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	clk.Advance(time.Hour)
+	if res := bg.Wait(); res.ExitCode != 3 {
+		t.Fatalf("expected exit code 3 from the SIGQUIT trap, got %d (%v)", res.ExitCode, res.Error)
+	}
+}
@@ -0,0 +1,121 @@
+package emruntest
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"sync"
+
+	"pkt.systems/emrun"
+	"pkt.systems/emrun/internal/digest"
+	"pkt.systems/emrun/port"
+)
+
+// ErrNoRecord is returned by ReplayRunner for commands no unused record
+// matches.
+var ErrNoRecord = errors.New("emruntest: no recorded execution matches")
+
+// ReplayExitError is returned by ReplayRunner for records with a non-zero exit
+// code, in place of the *exec.ExitError of the recorded execution.
+type ReplayExitError struct {
+	Code int
+}
+
+func (e *ReplayExitError) Error() string {
+	return fmt.Sprintf("exit status %d (replayed)", e.Code)
+}
+
+// ExitCode returns the recorded exit code.
+func (e *ReplayExitError) ExitCode() int {
+	return e.Code
+}
+
+// ReplayRunner is a port.CommandRunner answering commands with executions
+// recorded through emrun.WithRecorder instead of running them, so a recorded
+// incident becomes a deterministic fixture:
+//
+//	ctx = emrun.WithRunner(ctx, emruntest.NewReplayRunner(records...))
+//	out, err := emrun.Run(ctx, payload, "--check")
+//
+// A command matches the first unused record with the same arguments and, when
+// the record has one, the same digest of the executed file. The recorded
+// output is written to the command's stdout, or its stderr when stdout is
+// nil, and each record is used once. Stdin is not read. Background starts
+// are refused, since there is no process for Wait to reap.
+type ReplayRunner struct {
+	mu      sync.Mutex
+	records []emrun.Record
+	used    []bool
+}
+
+var _ port.CommandRunner = (*ReplayRunner)(nil)
+
+// NewReplayRunner returns a ReplayRunner serving records.
+func NewReplayRunner(records ...emrun.Record) *ReplayRunner {
+	return &ReplayRunner{records: slices.Clone(records), used: make([]bool, len(records))}
+}
+
+// Run writes the output of the record matching cmd and returns an error
+// reflecting its exit code, or an error wrapping ErrNoRecord.
+func (r *ReplayRunner) Run(cmd *exec.Cmd) error {
+	rec, ok := r.take(cmd)
+	if !ok {
+		return fmt.Errorf("%w: %s %q", ErrNoRecord, cmd.Path, cmd.Args[min(len(cmd.Args), 1):])
+	}
+	out := cmd.Stdout
+	if out == nil {
+		out = cmd.Stderr
+	}
+	if out != nil && len(rec.Output) > 0 {
+		if _, err := out.Write(rec.Output); err != nil {
+			return err
+		}
+	}
+	if rec.ExitCode != 0 {
+		return &ReplayExitError{Code: rec.ExitCode}
+	}
+	return nil
+}
+
+// Start refuses to start cmd.
+func (r *ReplayRunner) Start(cmd *exec.Cmd) error {
+	return fmt.Errorf("emruntest: cannot replay background execution of %s", cmd.Path)
+}
+
+// Remaining returns the number of records not yet replayed.
+func (r *ReplayRunner) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, used := range r.used {
+		if !used {
+			n++
+		}
+	}
+	return n
+}
+
+// take marks the first unused record matching cmd as used and returns it.
+func (r *ReplayRunner) take(cmd *exec.Cmd) (emrun.Record, bool) {
+	args := cmd.Args[min(len(cmd.Args), 1):]
+	var sum string
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, rec := range r.records {
+		if r.used[i] || !slices.Equal(rec.Args, args) {
+			continue
+		}
+		if rec.Digest != "" {
+			if sum == "" {
+				sum = digest.File(cmd.Path)
+			}
+			if rec.Digest != sum {
+				continue
+			}
+		}
+		r.used[i] = true
+		return rec, true
+	}
+	return emrun.Record{}, false
+}
@@ -0,0 +1,65 @@
+package emruntest_test
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"pkt.systems/emrun"
+	"pkt.systems/emrun/emruntest"
+)
+
+type sliceRecorder struct {
+	mu      sync.Mutex
+	records []emrun.Record
+}
+
+func (s *sliceRecorder) Record(rec emrun.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, rec)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	payload := []byte("#!/bin/sh\necho \"checked $1\"\n[ \"$1\" = good ]\n")
+	rec := &sliceRecorder{}
+	recording := emrun.WithOptions(ctx, emrun.WithRecorder(rec))
+	good, err := emrun.Run(recording, payload, "good")
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if _, err := emrun.Run(recording, payload, "bad"); err == nil {
+		t.Fatal("expected the bad run to fail")
+	}
+	if len(rec.records) != 2 || rec.records[1].ExitCode != 1 {
+		t.Fatalf("unexpected records %+v", rec.records)
+	}
+
+	replay := emruntest.NewReplayRunner(rec.records...)
+	replaying := emrun.WithRunner(ctx, replay)
+	var exitErr *emruntest.ReplayExitError
+	if out, err := emrun.Run(replaying, payload, "bad"); !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 || string(out) != "checked bad\n" {
+		t.Fatalf("replayed bad run = %q, %v", out, err)
+	}
+	out, err := emrun.Run(replaying, payload, "good")
+	if err != nil || string(out) != string(good) {
+		t.Fatalf("replayed good run = %q, %v", out, err)
+	}
+	if _, err := emrun.Run(replaying, payload, "good"); !errors.Is(err, emruntest.ErrNoRecord) {
+		t.Fatalf("record replayed twice: %v", err)
+	}
+	if _, err := emrun.Run(emrun.WithRunner(ctx, emruntest.NewReplayRunner(rec.records...)), []byte("#!/bin/sh\necho other\n"), "good"); !errors.Is(err, emruntest.ErrNoRecord) {
+		t.Fatalf("record replayed for another payload: %v", err)
+	}
+	if replay.Remaining() != 0 {
+		t.Fatalf("Remaining = %d", replay.Remaining())
+	}
+	if err := replay.Start(exec.Command("true")); err == nil {
+		t.Fatal("expected Start to be refused")
+	}
+}
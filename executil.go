@@ -9,8 +9,11 @@ import (
 	"os"
 	"os/exec"
 	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"pkt.systems/emrun/adapters/commandcapture"
+	"pkt.systems/emrun/internal/command"
 	"pkt.systems/emrun/port"
 )
 
@@ -22,7 +25,7 @@ func RunCommand(runner port.CommandRunner, cmd *exec.Cmd, combinedOutput bool) (
 	if runner == nil {
 		return nil, fmt.Errorf("nil command runner")
 	}
-	capture, err := newCommandCapture(cmd, combinedOutput)
+	capture, err := newCommandCapture(cmd, combinedOutput, &config{})
 	if err != nil {
 		return nil, err
 	}
@@ -30,6 +33,61 @@ func RunCommand(runner port.CommandRunner, cmd *exec.Cmd, combinedOutput bool) (
 	return capture.Finish(), err
 }
 
+// RunCommandContext is RunCommand for callers that know the context cmd was
+// created with. Options stored in ctx with WithOptions are applied to cmd and
+// their runner decorators wrap runner. Start failures caused by ENOEXEC wrap
+// ErrBadExecutableFormat. Runners implementing port.CommandRetrier may retry
+// the execution on a clone of cmd rebuilt with ctx, since os/exec refuses to
+// start a Cmd twice.
+//
+// When ctx is cancelled or times out while the command runs, the combined
+// output captured until the child was killed is returned along with an error
+// that wraps both ctx.Err() and the error from os/exec, so errors.Is(err,
+// context.DeadlineExceeded) holds and the *exec.ExitError stays reachable with
+// errors.As.
+func RunCommandContext(ctx context.Context, runner port.CommandRunner, cmd *exec.Cmd, combinedOutput bool) ([]byte, error) {
+	if runner == nil {
+		return nil, fmt.Errorf("nil command runner")
+	}
+	defer boundDigests.Delete(cmd)
+	slot, err := acquireExec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer slot()
+	cfg := configFromContext(ctx)
+	runner = cfg.decorate(runner)
+	cleanup, err := cfg.prepare(ctx, cmd)
+	defer cleanup()
+	if err != nil {
+		return nil, err
+	}
+	release, err := cfg.scratch(cmd)
+	defer release()
+	if err != nil {
+		return nil, err
+	}
+	capture, err := newCommandCapture(cmd, combinedOutput, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if retrier, ok := runner.(port.CommandRetrier); ok {
+		_, err = retrier.RunRetry(cmd, commandCloner(ctx, cfg))
+	} else {
+		err = runner.Run(cmd)
+	}
+	return capture.Finish(), cancelled(ctx, badExecutableFormat(err))
+}
+
+// cancelled wraps err in ctx.Err() when ctx is done, since os/exec reports a
+// command killed on cancellation only by its exit status.
+func cancelled(ctx context.Context, err error) error {
+	if err == nil || ctx == nil || ctx.Err() == nil || errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ctx.Err(), err)
+}
+
 // StartCommand starts cmd using the supplied runner while optionally capturing
 // combined stdout/stderr. The returned CommandCapture must later be passed to
 // WaitCommand (or Restore via Finish) to release resources.
@@ -37,7 +95,7 @@ func StartCommand(runner port.CommandRunner, cmd *exec.Cmd, combinedOutput bool)
 	if runner == nil {
 		return nil, fmt.Errorf("nil command runner")
 	}
-	capture, err := newCommandCapture(cmd, combinedOutput)
+	capture, err := newCommandCapture(cmd, combinedOutput, &config{})
 	if err != nil {
 		return nil, err
 	}
@@ -48,6 +106,106 @@ func StartCommand(runner port.CommandRunner, cmd *exec.Cmd, combinedOutput bool)
 	return capture, nil
 }
 
+// StartCommandContext is StartCommand for callers that know the context cmd was
+// created with. Like RunCommandContext it applies the options stored in ctx.
+// Runners implementing port.CommandRetrier may start a clone of
+// cmd rebuilt with ctx instead, so callers must Wait on the returned command.
+func StartCommandContext(ctx context.Context, runner port.CommandRunner, cmd *exec.Cmd, combinedOutput bool) (*exec.Cmd, port.CommandCapture, error) {
+	if runner == nil {
+		return nil, nil, fmt.Errorf("nil command runner")
+	}
+	defer boundDigests.Delete(cmd)
+	slot, err := acquireExec(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := configFromContext(ctx)
+	runner = cfg.decorate(runner)
+	cleanup, err := cfg.prepare(ctx, cmd)
+	defer cleanup()
+	if err != nil {
+		slot()
+		return nil, nil, err
+	}
+	scratch, err := cfg.scratch(cmd)
+	// The slot is held until the child has exited.
+	release := func() {
+		scratch()
+		slot()
+	}
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	capture, err := newCommandCapture(cmd, combinedOutput, cfg)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	// WaitCommand finishes the capture once the child has exited.
+	capture = &releasingCapture{CommandCapture: capture, release: sync.OnceFunc(release)}
+	started := cmd
+	if retrier, ok := runner.(port.CommandRetrier); ok {
+		started, err = retrier.StartRetry(cmd, commandCloner(ctx, cfg))
+	} else {
+		err = runner.Start(cmd)
+	}
+	if err != nil {
+		capture.Restore()
+		return nil, nil, badExecutableFormat(err)
+	}
+	return started, capture, nil
+}
+
+// releasingCapture calls release when the capture is finished or restored,
+// which happens once a started command has been waited for or failed to
+// start.
+type releasingCapture struct {
+	port.CommandCapture
+	release func()
+}
+
+func (c *releasingCapture) Finish() []byte {
+	defer c.release()
+	return c.CommandCapture.Finish()
+}
+
+func (c *releasingCapture) Restore() {
+	c.CommandCapture.Restore()
+	c.release()
+}
+
+func (c *releasingCapture) Truncated() bool {
+	return captureTruncated(c.CommandCapture)
+}
+
+func (c *releasingCapture) Written() int64 {
+	n, _ := captureWritten(c.CommandCapture)
+	return n
+}
+
+// captureTruncated reports whether capture dropped output because of a
+// capture limit such as WithTailCapture. Captures that cannot tell report
+// false.
+func captureTruncated(capture port.CommandCapture) bool {
+	t, ok := capture.(interface{ Truncated() bool })
+	return ok && t.Truncated()
+}
+
+// ErrBadExecutableFormat is reported, wrapping the ENOEXEC error, when the
+// kernel refuses to execute a payload because it does not recognise its
+// format.
+var ErrBadExecutableFormat = errors.New("emrun: bad executable format")
+
+// badExecutableFormat wraps ENOEXEC errors in ErrBadExecutableFormat with a
+// hint at the usual causes.
+func badExecutableFormat(err error) error {
+	if err == nil || !errors.Is(err, syscall.ENOEXEC) || errors.Is(err, ErrBadExecutableFormat) {
+		return err
+	}
+	return fmt.Errorf("%w (built for another architecture, corrupt, or a script without a #! line?): %w", ErrBadExecutableFormat, err)
+}
+
 // WaitCommand waits for cmd to exit and returns a Result capturing the exit
 // code, error, and any combined output buffered by StartCommand.
 func WaitCommand(cmd *exec.Cmd, capture port.CommandCapture) Result {
@@ -55,13 +213,46 @@ func WaitCommand(cmd *exec.Cmd, capture port.CommandCapture) Result {
 	err := cmd.Wait()
 	res.Error = err
 	res.ExitCode = exitCodeFrom(err, cmd.ProcessState)
+	res.ProcessState = cmd.ProcessState
 	if capture != nil {
 		res.CombinedOutput = capture.Finish()
+		res.Truncated = captureTruncated(capture)
+		res.OutputBytes, _ = captureWritten(capture)
 	}
 	return res
 }
 
-func newCommandCapture(cmd *exec.Cmd, combined bool) (port.CommandCapture, error) {
+// commandCloner returns a clone function for port.CommandRetrier that rebuilds
+// commands with ctx while keeping their path and arguments, and rebinds the
+// settings of cfg that refer to the command itself.
+func commandCloner(ctx context.Context, cfg *config) func(*exec.Cmd) *exec.Cmd {
+	return func(cmd *exec.Cmd) *exec.Cmd {
+		clone := command.Clone(ctx, cmd)
+		cfg.bind(clone)
+		return clone
+	}
+}
+
+// cloneCommandForFallback clones cmd like command.Clone but points both the
+// executable path and argv[0] at path.
+func cloneCommandForFallback(ctx context.Context, cmd *exec.Cmd, path string) *exec.Cmd {
+	fallback := command.Clone(ctx, cmd)
+	if len(fallback.Args) == 0 {
+		fallback.Args = append(fallback.Args, path)
+	} else {
+		fallback.Args[0] = path
+	}
+	fallback.Path = path
+	return fallback
+}
+
+// newCommandCapture redirects stdout and stderr of cmd into a shared buffer
+// when combined is true, bounded and filtered as the capture options in cfg
+// ask. With WithForceCombined, writers already set on cmd are teed into the
+// buffer instead of being an error. When options redirected streams
+// elsewhere, those are left alone and only the unset streams are captured.
+func newCommandCapture(cmd *exec.Cmd, combined bool, cfg *config) (port.CommandCapture, error) {
+	force, keep := cfg.forceCombined, cfg.redirectsOutput()
 	capture := commandcapture.New()
 	if !combined {
 		return capture, nil
@@ -69,19 +260,114 @@ func newCommandCapture(cmd *exec.Cmd, combined bool) (port.CommandCapture, error
 	if cmd == nil {
 		return nil, fmt.Errorf("nil command")
 	}
-	if cmd.Stdout != nil || cmd.Stderr != nil {
+	if (cmd.Stdout != nil || cmd.Stderr != nil) && !force && !keep {
 		return nil, fmt.Errorf("combined output requested with configured stdout or stderr")
 	}
-	buf := &bytes.Buffer{}
-	buf.Grow(128)
+	var buf interface {
+		io.Writer
+		port.Buffer
+	}
+	switch {
+	case cfg.captureWindow > 0:
+		buf = commandcapture.NewWindow(cfg.captureWindow)
+	case cfg.tailCapture > 0:
+		buf = commandcapture.NewRing(cfg.tailCapture)
+	default:
+		b := &bytes.Buffer{}
+		b.Grow(128)
+		buf = b
+	}
+	// dst receives the output and buf keeps what is returned.
+	var dst io.Writer = buf
+	if cfg.stripANSI {
+		dst = commandcapture.NewANSIStripper(buf)
+	}
+	var progress *progressWriter
+	if cfg.progress != nil && cfg.progressInterval > 0 {
+		progress = newProgressWriter(dst, cfg.progressInterval, cfg.progress)
+		dst = progress
+	}
+	// Counted ahead of the buffer, which may drop or strip bytes.
+	written := &countingWriter{w: dst}
+	dst = written
 	origStdout, origStderr := cmd.Stdout, cmd.Stderr
-	cmd.Stdout = buf
-	cmd.Stderr = buf
+	switch {
+	case origStdout == nil && origStderr == nil:
+		cmd.Stdout = dst
+		cmd.Stderr = dst
+	case !force:
+		// keep: one stream is redirected, possibly both, so the buffer has
+		// at most one writer.
+		if origStdout == nil {
+			cmd.Stdout = dst
+		}
+		if origStderr == nil {
+			cmd.Stderr = dst
+		}
+	case sameWriter(origStdout, origStderr):
+		tee := io.MultiWriter(origStdout, dst)
+		cmd.Stdout = tee
+		cmd.Stderr = tee
+	default:
+		// Distinct writers are fed by one os/exec goroutine each, so the
+		// buffer they share has to be locked.
+		shared := &lockedWriter{w: dst}
+		cmd.Stdout = teeWriter(origStdout, shared)
+		cmd.Stderr = teeWriter(origStderr, shared)
+	}
 	capture.Enable(buf, func() {
 		cmd.Stdout = origStdout
 		cmd.Stderr = origStderr
+		if progress != nil {
+			progress.stop()
+		}
 	})
-	return capture, nil
+	return &countingCapture{CommandCapture: capture, written: written}, nil
+}
+
+// countingCapture is a capture that knows how many bytes the child wrote into
+// it, before capture limits and filters applied.
+type countingCapture struct {
+	port.CommandCapture
+	written *countingWriter
+}
+
+func (c *countingCapture) Truncated() bool {
+	return captureTruncated(c.CommandCapture)
+}
+
+func (c *countingCapture) Written() int64 {
+	return c.written.count()
+}
+
+// captureWritten returns the bytes written into capture and true, or false
+// when capture does not count them.
+func captureWritten(capture port.CommandCapture) (int64, bool) {
+	w, ok := capture.(interface{ Written() int64 })
+	if !ok {
+		return 0, false
+	}
+	return w.Written(), true
+}
+
+// teeWriter returns a writer to both orig and w, or w alone when orig is nil.
+func teeWriter(orig, w io.Writer) io.Writer {
+	if orig == nil {
+		return w
+	}
+	return io.MultiWriter(orig, w)
+}
+
+// lockedWriter serialises writes to w.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
 }
 
 func exitCodeFrom(waitErr error, state *os.ProcessState) int {
@@ -104,8 +390,7 @@ func StartBackground(parentCtx context.Context, run port.BackgroundRunnable, arg
 	ctx, cancel := context.WithCancel(parentCtx)
 	cmd := exec.CommandContext(ctx, run.Name(), args...)
 	cmd.Stdin = stdin
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
+	counters := countOutput(cmd, stdout, stderr)
 	startedCmd, capture, err := run.StartBackground(ctx, cmd, combined)
 	if err != nil {
 		run.Close()
@@ -113,21 +398,156 @@ func StartBackground(parentCtx context.Context, run port.BackgroundRunnable, arg
 		return nil, err
 	}
 	done := make(chan Result, 1)
-	var once sync.Once
+	bg := &Background{
+		Context: ctx,
+		Cancel:  cancel,
+		Done:    done,
+		settled: make(chan struct{}),
+	}
+	// The child cannot be reaped before WaitCommand, so the pidfd is sure
+	// to refer to it.
+	bg.track(startedCmd.Process, openPidFD(startedCmd.Process.Pid))
 	go func(rn port.BackgroundRunnable, cap port.CommandCapture, execCmd *exec.Cmd, closer context.CancelFunc) {
 		res := WaitCommand(execCmd, cap)
+		bg.untrack()
+		counters.fill(&res, combined)
 		if err := rn.Close(); err != nil && res.Error == nil {
 			res.Error = err
 		}
-		once.Do(func() {
-			done <- res
-			close(done)
-		})
+		bg.settle(res)
+		done <- res
+		close(done)
 		closer()
 	}(run, capture, startedCmd, cancel)
-	return &Background{
-		Context: ctx,
-		Cancel:  cancel,
-		Done:    done,
-	}, nil
+	return bg, nil
+}
+
+// StartInteractiveBackground starts cmd via the runnable like StartBackground
+// and returns pipes connected to the child's stdin and stdout, so the process
+// can be driven after it has started. Stderr is discarded. Closing stdin
+// signals EOF to the child. Both pipes are closed once the child has exited or
+// the Background is cancelled, so a reader sees EOF, or the context error
+// after a cancellation, instead of blocking.
+func StartInteractiveBackground(parentCtx context.Context, run port.BackgroundRunnable, args []string) (*Background, io.WriteCloser, io.ReadCloser, error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		run.Close()
+		return nil, nil, nil, err
+	}
+	stdoutR, stdoutW := io.Pipe()
+	bg, err := StartBackground(parentCtx, run, args, stdinR, stdoutW, nil, false)
+	// The child holds its own copy of the read end.
+	stdinR.Close()
+	if err != nil {
+		stdinW.Close()
+		return nil, nil, nil, err
+	}
+	settled := bg.settledChan()
+	go func() {
+		select {
+		case <-settled:
+			stdoutW.Close()
+		case <-bg.Context.Done():
+			// A write blocked on an unread stdout would keep os/exec's copy,
+			// and with it Wait, from ever finishing.
+			select {
+			case <-settled:
+				stdoutW.Close()
+			default:
+				stdoutW.CloseWithError(bg.Context.Err())
+			}
+		}
+		stdinW.Close()
+	}()
+	return bg, stdinW, stdoutR, nil
+}
+
+// countingWriter forwards writes to w while counting the bytes it accepted.
+// An uncounted countingWriter stands in for an *os.File the child writes to
+// directly and reports -1.
+type countingWriter struct {
+	w         io.Writer
+	n         atomic.Int64
+	uncounted bool
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func (c *countingWriter) count() int64 {
+	if c == nil {
+		return 0
+	}
+	if c.uncounted {
+		return -1
+	}
+	return c.n.Load()
+}
+
+// outputCounters holds the counting writers StartBackground wraps around the
+// caller's destinations. shared is used when stdout and stderr are the same
+// writer, which keeps them a single stream as far as os/exec is concerned.
+type outputCounters struct {
+	stdout, stderr, shared *countingWriter
+}
+
+// countOutput assigns stdout and stderr to cmd wrapped in counting writers.
+// Nil destinations are left nil so os/exec keeps discarding them and combined
+// capture can still claim them. An *os.File is assigned as is, so the child
+// writes to the file or terminal itself rather than to a pipe copied by
+// os/exec, and its bytes are reported as -1.
+func countOutput(cmd *exec.Cmd, stdout, stderr io.Writer) *outputCounters {
+	counters := &outputCounters{}
+	count := func(w io.Writer) (io.Writer, *countingWriter) {
+		if w == nil {
+			return nil, nil
+		}
+		if _, isFile := w.(*os.File); isFile {
+			return w, &countingWriter{uncounted: true}
+		}
+		counter := &countingWriter{w: w}
+		return counter, counter
+	}
+	if stdout != nil && sameWriter(stdout, stderr) {
+		cmd.Stdout, counters.shared = count(stdout)
+		cmd.Stderr = cmd.Stdout
+		return counters
+	}
+	cmd.Stdout, counters.stdout = count(stdout)
+	cmd.Stderr, counters.stderr = count(stderr)
+	return counters
+}
+
+// fill records the counted byte totals in res. Combined capture has already
+// been measured by WaitCommand as the child wrote it.
+func (c *outputCounters) fill(res *Result, combined bool) {
+	if combined {
+		res.StdoutBytes = c.stdout.count()
+		res.StderrBytes = c.stderr.count()
+		return
+	}
+	if c.shared != nil {
+		res.OutputBytes = c.shared.count()
+		return
+	}
+	res.StdoutBytes = c.stdout.count()
+	res.StderrBytes = c.stderr.count()
+	res.OutputBytes = res.StdoutBytes + res.StderrBytes
+	if res.StdoutBytes < 0 || res.StderrBytes < 0 {
+		res.OutputBytes = -1
+	}
+}
+
+// sameWriter reports whether a and b are the same writer, treating
+// incomparable dynamic types as distinct like os/exec does.
+func sameWriter(a, b io.Writer) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
 }
@@ -5,7 +5,9 @@ import (
 	"context"
 	"errors"
 	"io"
+	"os"
 	"os/exec"
+	"syscall"
 	"testing"
 	"time"
 
@@ -53,6 +55,79 @@ func TestRunCommandPassThroughWriters(t *testing.T) {
 	}
 }
 
+func TestRunCommandContextRetriesOnClone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	mock := mockrunner.New(
+		func(cmd *exec.Cmd) error {
+			return &os.PathError{Op: "fork/exec", Path: cmd.Path, Err: syscall.ETXTBSY}
+		},
+		func(cmd *exec.Cmd) error {
+			_, err := cmd.Stdout.Write([]byte("retried\n"))
+			return err
+		},
+	)
+	runner := &commandrunner.RetryRunner{Runner: mock, Backoff: time.Microsecond}
+	cmd := exec.CommandContext(ctx, "/bin/true", "arg")
+	out, err := RunCommandContext(ctx, runner, cmd, true)
+	if err != nil {
+		t.Fatalf("RunCommandContext returned error: %v", err)
+	}
+	if string(out) != "retried\n" {
+		t.Fatalf("unexpected combined output: %q", out)
+	}
+	if mock.Calls != 2 {
+		t.Fatalf("unexpected number of runner calls: %d", mock.Calls)
+	}
+	if cmd.Stdout != nil || cmd.Stderr != nil {
+		t.Fatalf("expected original writers restored")
+	}
+}
+
+func TestRunCommandContextPartialOutputOnCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", "echo partial; exec sleep 5")
+	out, err := RunCommandContext(ctx, commandrunner.Default, cmd, true)
+	if string(out) != "partial\n" {
+		t.Fatalf("expected the output captured before the timeout, got %q", out)
+	}
+	var exitErr *exec.ExitError
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &exitErr) {
+		t.Fatalf("expected an error wrapping the deadline and the exit status, got %v", err)
+	}
+}
+
+func TestStartCommandContextReturnsStartedClone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	busy := true
+	runner := &commandrunner.RetryRunner{
+		Runner: mockrunner.New(func(cmd *exec.Cmd) error {
+			return &os.PathError{Op: "fork/exec", Path: cmd.Path, Err: syscall.ETXTBSY}
+		}, func(cmd *exec.Cmd) error {
+			busy = false
+			return cmd.Start()
+		}),
+		Backoff: time.Microsecond,
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", "echo started")
+	started, capture, err := StartCommandContext(ctx, runner, cmd, true)
+	if err != nil {
+		t.Fatalf("StartCommandContext returned error: %v", err)
+	}
+	if busy || started == cmd {
+		t.Fatalf("expected a clone to be started")
+	}
+	res := WaitCommand(started, capture)
+	if res.Error != nil {
+		t.Fatalf("WaitCommand returned error: %v", res.Error)
+	}
+	if string(res.CombinedOutput) != "started\n" {
+		t.Fatalf("unexpected combined output: %q", res.CombinedOutput)
+	}
+}
+
 func TestRunCommandNilRunner(t *testing.T) {
 	cmd := exec.Command("/bin/true")
 	if _, err := RunCommand(nil, cmd, true); err == nil {
@@ -76,6 +151,16 @@ func TestStartCommandCombinedOutput(t *testing.T) {
 	if string(res.CombinedOutput) != "stdout\nstderr\n" {
 		t.Fatalf("unexpected combined output: %q", res.CombinedOutput)
 	}
+	if res.ProcessState == nil || !res.ProcessState.Exited() || res.ProcessState.Pid() != cmd.Process.Pid {
+		t.Fatalf("expected the exited child's ProcessState, got %v", res.ProcessState)
+	}
+}
+
+func TestWaitCommandNotStarted(t *testing.T) {
+	res := WaitCommand(exec.Command("/bin/true"), nil)
+	if res.Error == nil || res.ProcessState != nil {
+		t.Fatalf("expected error and nil ProcessState, got %v, %v", res.Error, res.ProcessState)
+	}
 }
 
 func TestStartCommandCombinedOutputConfiguredWriters(t *testing.T) {
@@ -0,0 +1,69 @@
+package emrun
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+)
+
+// fifoPeerRetry is how often openFIFO opens the other end of a FIFO while it
+// waits for a cancelled open to complete.
+const fifoPeerRetry = 10 * time.Millisecond
+
+// openFIFO opens the named pipe at path with flag, os.O_RDONLY or os.O_WRONLY,
+// waiting for the other end to be opened as FIFOs require. If ctx is done
+// first, the pending open is completed by briefly opening the other end
+// without blocking, and ctx.Err() is returned. That open is repeated until
+// the pending one has completed, since it only completes an open already
+// blocked in the kernel and the goroutine making it may not have got there.
+func openFIFO(ctx context.Context, path string, flag int) (*os.File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("open fifo: %w", err)
+	}
+	if info.Mode().Type() != fs.ModeNamedPipe {
+		return nil, fmt.Errorf("open fifo %s: not a named pipe", path)
+	}
+	type opened struct {
+		f   *os.File
+		err error
+	}
+	done := make(chan opened, 1)
+	go func() {
+		f, err := os.OpenFile(path, flag, 0)
+		done <- opened{f, err}
+	}()
+	select {
+	case o := <-done:
+		if o.err != nil {
+			return nil, fmt.Errorf("open fifo: %w", o.err)
+		}
+		return o.f, nil
+	case <-ctx.Done():
+	}
+	peer := os.O_WRONLY
+	if flag == os.O_WRONLY {
+		peer = os.O_RDONLY
+	}
+	retry := time.NewTicker(fifoPeerRetry)
+	defer retry.Stop()
+	for {
+		// Opening the write end without blocking fails with ENXIO until our
+		// read end is open, and the read end opened while our write end is
+		// not yet waiting does not complete it.
+		if p, err := os.OpenFile(path, peer|syscall.O_NONBLOCK, 0); err == nil {
+			p.Close()
+		}
+		select {
+		case o := <-done:
+			if o.f != nil {
+				o.f.Close()
+			}
+			return nil, fmt.Errorf("open fifo %s: %w", path, ctx.Err())
+		case <-retry.C:
+		}
+	}
+}
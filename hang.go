@@ -0,0 +1,82 @@
+package emrun
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+
+	"pkt.systems/emrun/internal/clock"
+	"pkt.systems/emrun/port"
+)
+
+// hangRunner sends SIGQUIT to commands still running after a deadline. It
+// starts commands through the wrapped runner's Start, or StartRetry, and waits
+// for them itself, so the timer is armed with the process that was started.
+// Runners that cannot start commands, such as emruntest.ReplayRunner, cannot
+// be combined with it.
+type hangRunner struct {
+	runner port.CommandRunner
+	after  time.Duration
+}
+
+var _ port.CommandRetrier = (*hangRunner)(nil)
+
+func newHangRunner(runner port.CommandRunner, after time.Duration) port.CommandRunner {
+	return &hangRunner{runner: runner, after: after}
+}
+
+// Run starts cmd like Start and waits for it, disarming the timer once the
+// command has exited.
+func (h *hangRunner) Run(cmd *exec.Cmd) error {
+	_, err := h.RunRetry(cmd, nil)
+	return err
+}
+
+// RunRetry is Run for wrapped runners implementing port.CommandRetrier, which
+// may start a clone of cmd; the command that was started is waited for and
+// returned. Other runners start cmd once.
+func (h *hangRunner) RunRetry(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd) (*exec.Cmd, error) {
+	started, err := h.start(cmd, clone)
+	if err != nil {
+		return started, err
+	}
+	timer := h.arm(started)
+	defer timer.Stop()
+	return started, started.Wait()
+}
+
+// Start starts cmd and arms the timer. The timer is not disarmed when the
+// command exits early; signalling a process that has been waited for is a
+// no-op that reports os.ErrProcessDone.
+func (h *hangRunner) Start(cmd *exec.Cmd) error {
+	_, err := h.StartRetry(cmd, nil)
+	return err
+}
+
+// StartRetry is Start for wrapped runners implementing port.CommandRetrier;
+// the timer is armed for the command that was started.
+func (h *hangRunner) StartRetry(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd) (*exec.Cmd, error) {
+	started, err := h.start(cmd, clone)
+	if err != nil {
+		return started, err
+	}
+	h.arm(started)
+	return started, nil
+}
+
+// start starts cmd, or a clone of it, through the wrapped runner.
+func (h *hangRunner) start(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd) (*exec.Cmd, error) {
+	if retrier, ok := h.runner.(port.CommandRetrier); ok {
+		return retrier.StartRetry(cmd, clone)
+	}
+	return cmd, h.runner.Start(cmd)
+}
+
+// arm schedules SIGQUIT for cmd, which has been started, so its process is
+// read before the timer runs.
+func (h *hangRunner) arm(cmd *exec.Cmd) port.Timer {
+	process := cmd.Process
+	return clock.Get().AfterFunc(h.after, func() {
+		_ = process.Signal(syscall.SIGQUIT)
+	})
+}
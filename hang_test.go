@@ -0,0 +1,76 @@
+package emrun
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"pkt.systems/emrun/adapters/commandrunner"
+)
+
+func TestWithHangDiagnostic(t *testing.T) {
+	payload := []byte("#!/bin/sh\ntrap 'echo quit >&2; exit 3' QUIT\nwhile :; do sleep 0.05; done\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var stderr bytes.Buffer
+	err := RunIOE(WithOptions(ctx, WithHangDiagnostic(100*time.Millisecond)), nil, nil, &stderr, payload)
+	if err == nil || ctx.Err() != nil {
+		t.Fatalf("expected the payload to exit on SIGQUIT before the deadline, got %v", err)
+	}
+	if stderr.String() != "quit\n" {
+		t.Fatalf("unexpected stderr: %q", stderr.String())
+	}
+
+	bg, err := RunBG(WithOptions(ctx, WithHangDiagnostic(100*time.Millisecond)), payload)
+	if err != nil {
+		t.Fatalf("RunBG returned error: %v", err)
+	}
+	if res := bg.Wait(); res.ExitCode != 3 {
+		t.Fatalf("expected exit code 3 from the SIGQUIT trap, got %d (%v)", res.ExitCode, res.Error)
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancelShort()
+	stderr.Reset()
+	err = RunIOE(WithOptions(short, WithHangDiagnostic(0)), nil, nil, &stderr, payload)
+	if err == nil || short.Err() == nil || stderr.Len() != 0 {
+		t.Fatalf("expected zero to disable the diagnostic, got %v, %q", err, stderr.String())
+	}
+}
+
+// busyOnceRunner fails its first start with ETXTBSY.
+type busyOnceRunner struct {
+	starts int
+}
+
+func (r *busyOnceRunner) Run(cmd *exec.Cmd) error {
+	if err := r.Start(cmd); err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+func (r *busyOnceRunner) Start(cmd *exec.Cmd) error {
+	r.starts++
+	if r.starts == 1 {
+		return &os.PathError{Op: "fork/exec", Path: cmd.Path, Err: syscall.ETXTBSY}
+	}
+	return cmd.Start()
+}
+
+func TestHangDiagnosticFollowsRetries(t *testing.T) {
+	payload := []byte("#!/bin/sh\ntrap 'echo quit >&2; exit 3' QUIT\nwhile :; do sleep 0.05; done\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	inner := &busyOnceRunner{}
+	ctx = WithRunner(ctx, &commandrunner.RetryRunner{Runner: inner})
+	var stderr bytes.Buffer
+	err := RunIOE(WithOptions(ctx, WithHangDiagnostic(100*time.Millisecond)), nil, nil, &stderr, payload)
+	if err == nil || inner.starts != 2 || stderr.String() != "quit\n" {
+		t.Fatalf("expected the retried clone to be ended by SIGQUIT, got %d starts, %v, %q", inner.starts, err, stderr.String())
+	}
+}
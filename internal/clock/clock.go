@@ -0,0 +1,55 @@
+// Package clock holds the port.Clock used throughout the module, the real
+// time package unless a test has replaced it through emruntest.SetClock.
+package clock
+
+import (
+	"sync/atomic"
+	"time"
+
+	"pkt.systems/emrun/port"
+)
+
+// Real is the port.Clock backed by the time package.
+var Real port.Clock = realClock{}
+
+type holder struct {
+	port.Clock
+}
+
+var current atomic.Pointer[holder]
+
+// Get returns the clock in use.
+func Get() port.Clock {
+	if h := current.Load(); h != nil {
+		return h.Clock
+	}
+	return Real
+}
+
+// Set makes c the clock in use, or Real when c is nil, and returns a function
+// restoring the previous one.
+func Set(c port.Clock) (restore func()) {
+	var next *holder
+	if c != nil {
+		next = &holder{c}
+	}
+	prev := current.Swap(next)
+	return func() {
+		current.Store(prev)
+	}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) port.Timer    { return realTimer{time.NewTimer(d)} }
+func (realClock) AfterFunc(d time.Duration, f func()) port.Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
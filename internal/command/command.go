@@ -0,0 +1,30 @@
+// Package command holds the exec.Cmd helpers emrun and efrun share.
+package command
+
+import (
+	"context"
+	"os/exec"
+	"slices"
+)
+
+// Clone returns an unstarted copy of cmd bound to ctx. os/exec refuses to
+// start a Cmd twice, so retries and fallbacks execute a clone.
+func Clone(ctx context.Context, cmd *exec.Cmd) *exec.Cmd {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	clone := exec.CommandContext(ctx, cmd.Path)
+	clone.Path = cmd.Path
+	clone.Args = slices.Clone(cmd.Args)
+	clone.Env = slices.Clone(cmd.Env)
+	clone.Dir = cmd.Dir
+	clone.Stdin = cmd.Stdin
+	clone.Stdout = cmd.Stdout
+	clone.Stderr = cmd.Stderr
+	if cmd.ExtraFiles != nil {
+		clone.ExtraFiles = slices.Clone(cmd.ExtraFiles)
+	}
+	clone.SysProcAttr = cmd.SysProcAttr
+	clone.WaitDelay = cmd.WaitDelay
+	return clone
+}
@@ -0,0 +1,25 @@
+// Package digest hashes executed files the way emrun names payloads, shared by
+// the recorder and emruntest's ReplayRunner so both agree on a record's digest.
+package digest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// File returns the hex-encoded SHA-256 digest of the file at path, or "" when
+// it cannot be read.
+func File(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
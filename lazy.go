@@ -0,0 +1,179 @@
+//go:build linux || android
+// +build linux android
+
+package emrun
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"pkt.systems/emrun/port"
+)
+
+// OpenLazy returns a runnable for executablePayload that does not hash the
+// payload or create its memfd until it is first used, for catalogs of
+// embedded tools most of which never run. The first call to Name, Run,
+// StartBackground, Read, Seek or any other method needing the backing file
+// opens it like Open, and later calls reuse it; Digest only hashes. An error
+// from the deferred open is returned by the operation that triggered it and
+// every later one, while Name returns "" and Backing BackingNone. Closing a
+// runnable that was never used releases nothing and makes the open fail with
+// os.ErrClosed.
+//
+//	tools := map[string]emrun.Runnable{
+//		"jq": emrun.OpenLazy(jq),
+//		"yq": emrun.OpenLazy(yq),
+//	}
+func OpenLazy(executablePayload []byte) Runnable {
+	return &lazyRunnable{payload: executablePayload}
+}
+
+// lazyRunnable defers Open until its backing is needed.
+type lazyRunnable struct {
+	payload []byte
+
+	mu     sync.Mutex
+	r      *runnable
+	err    error
+	closed bool
+
+	digestOnce sync.Once
+	digest     string
+}
+
+var (
+	_ port.BackgroundRunnable = (*lazyRunnable)(nil)
+	_ port.ReadOnlyViewer     = (*lazyRunnable)(nil)
+	_ port.FileBacked         = (*lazyRunnable)(nil)
+	_ port.Saver              = (*lazyRunnable)(nil)
+)
+
+// open materialises the runnable on first use.
+func (l *lazyRunnable) open() (*runnable, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.r == nil && l.err == nil {
+		if l.closed {
+			return nil, os.ErrClosed
+		}
+		f, err := Open(l.payload)
+		if err != nil {
+			l.err = err
+		} else {
+			l.r = f.(*runnable)
+		}
+	}
+	return l.r, l.err
+}
+
+// opened returns the runnable if it has been materialised.
+func (l *lazyRunnable) opened() *runnable {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r
+}
+
+func (l *lazyRunnable) Name() string {
+	r, err := l.open()
+	if err != nil {
+		return ""
+	}
+	return r.Name()
+}
+
+func (l *lazyRunnable) IsMemfd() bool {
+	return l.Backing() == port.BackingMemfd
+}
+
+// Backing reports BackingNone until the runnable has been opened, which it
+// does not trigger.
+func (l *lazyRunnable) Backing() port.BackingKind {
+	if r := l.opened(); r != nil {
+		return r.Backing()
+	}
+	return port.BackingNone
+}
+
+// Digest hashes the payload without opening the runnable.
+func (l *lazyRunnable) Digest() string {
+	if r := l.opened(); r != nil {
+		return r.Digest()
+	}
+	l.digestOnce.Do(func() {
+		sum := sha256.Sum256(l.payload)
+		l.digest = hexDigest(&sum)
+	})
+	return l.digest
+}
+
+func (l *lazyRunnable) Read(p []byte) (int, error) {
+	r, err := l.open()
+	if err != nil {
+		return 0, err
+	}
+	return r.Read(p)
+}
+
+func (l *lazyRunnable) Seek(offset int64, whence int) (int64, error) {
+	r, err := l.open()
+	if err != nil {
+		return 0, err
+	}
+	return r.Seek(offset, whence)
+}
+
+func (l *lazyRunnable) Run(ctx context.Context, cmd *exec.Cmd, combinedOutput bool) ([]byte, error) {
+	r, err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return r.Run(ctx, cmd, combinedOutput)
+}
+
+func (l *lazyRunnable) StartBackground(ctx context.Context, cmd *exec.Cmd, combinedOutput bool) (*exec.Cmd, port.CommandCapture, error) {
+	r, err := l.open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.StartBackground(ctx, cmd, combinedOutput)
+}
+
+func (l *lazyRunnable) ReadOnlyView() (io.ReaderAt, error) {
+	r, err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return r.ReadOnlyView()
+}
+
+// File returns nil when the deferred open failed.
+func (l *lazyRunnable) File() *os.File {
+	r, err := l.open()
+	if err != nil {
+		return nil
+	}
+	return r.File()
+}
+
+func (l *lazyRunnable) SaveAs(path string, mode os.FileMode) error {
+	r, err := l.open()
+	if err != nil {
+		return err
+	}
+	return r.SaveAs(path, mode)
+}
+
+// Close closes the runnable if it was opened.
+func (l *lazyRunnable) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.r == nil {
+		return nil
+	}
+	return l.r.Close()
+}
@@ -0,0 +1,59 @@
+//go:build linux || android
+// +build linux android
+
+package emrun
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestOpenLazy(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho lazy\n")
+	f := OpenLazy(payload)
+	defer f.Close()
+	sum := sha256.Sum256(payload)
+	if f.Digest() != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected digest %s", f.Digest())
+	}
+	if f.Backing() != BackingNone || f.(*lazyRunnable).opened() != nil {
+		t.Fatal("expected the runnable to stay unopened until used")
+	}
+	name := f.Name()
+	if name == "" || f.Backing() == BackingNone {
+		t.Fatalf("expected Name to open the runnable, got %q", name)
+	}
+	out, err := f.Run(context.Background(), exec.Command(name), true)
+	if err != nil || string(out) != "lazy\n" {
+		t.Fatalf("unexpected result %q, %v", out, err)
+	}
+	if f.Name() != name {
+		t.Fatalf("expected the open to be reused, got %s and %s", name, f.Name())
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil || string(data) != string(payload) {
+		t.Fatalf("unexpected payload read back: %q, %v", data, err)
+	}
+}
+
+func TestOpenLazyClosedBeforeUse(t *testing.T) {
+	f := OpenLazy([]byte("#!/bin/sh\n"))
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if _, err := f.Run(context.Background(), exec.Command("/bin/true"), true); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("expected os.ErrClosed, got %v", err)
+	}
+	if f.Name() != "" {
+		t.Fatalf("expected no name, got %q", f.Name())
+	}
+}
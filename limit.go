@@ -0,0 +1,134 @@
+package emrun
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// execLimit is the package-wide bound on concurrent executions set with
+// SetMaxConcurrentExecs. wake is closed and replaced whenever a slot is
+// released or the bound changes, waking the goroutines waiting for a slot.
+var execLimit struct {
+	mu     sync.Mutex
+	max    int
+	active int
+	wake   chan struct{}
+}
+
+// SetMaxConcurrentExecs bounds how many payloads may run at the same time
+// across the whole package, as a backstop against a program exhausting the
+// host by running embedded tools from many goroutines. An execution takes a
+// slot before the child is started and holds it until the child has exited,
+// which for background runs is when its Result is available. Executions
+// waiting for a slot give up with ctx.Err() when their context ends first. n
+// of zero or less, the default, means unlimited. Changing the bound affects
+// executions that have not taken a slot yet; running ones are not stopped.
+// Pipelines take a slot for every stage at once, since their stages only
+// finish together, and fail when they have more stages than n.
+func SetMaxConcurrentExecs(n int) {
+	execLimit.mu.Lock()
+	defer execLimit.mu.Unlock()
+	execLimit.max = n
+	wakeExecWaiters()
+}
+
+// acquireExec takes an execution slot, one reserved in ctx by reserveExecs if
+// any is left, and otherwise waits for one to become free until ctx is done.
+// The returned release gives the slot back and may be called more than once.
+func acquireExec(ctx context.Context) (release func(), err error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if r, ok := ctx.Value(execReservationKey{}).(*execReservation); ok && r.take() {
+		return sync.OnceFunc(releaseExec), nil
+	}
+	if err := acquireExecs(ctx, 1); err != nil {
+		return nil, err
+	}
+	return sync.OnceFunc(releaseExec), nil
+}
+
+// reserveExecs takes n execution slots together for executions that must all
+// run at once, like the stages of a pipeline, which would deadlock if each
+// held some slots while waiting for the rest. The returned context hands the
+// slots to the executions run with it; release gives back those not handed
+// out.
+func reserveExecs(ctx context.Context, n int) (_ context.Context, release func(), err error) {
+	if err := acquireExecs(ctx, n); err != nil {
+		return ctx, nil, err
+	}
+	r := &execReservation{n: n}
+	return context.WithValue(ctx, execReservationKey{}, r), r.release, nil
+}
+
+// acquireExecs waits until n slots are free and takes them.
+func acquireExecs(ctx context.Context, n int) error {
+	for {
+		execLimit.mu.Lock()
+		if execLimit.max <= 0 || execLimit.active+n <= execLimit.max {
+			execLimit.active += n
+			execLimit.mu.Unlock()
+			return nil
+		}
+		if n > execLimit.max {
+			max := execLimit.max
+			execLimit.mu.Unlock()
+			return fmt.Errorf("emrun: %d executions at once exceed the limit of %d concurrent executions", n, max)
+		}
+		if execLimit.wake == nil {
+			execLimit.wake = make(chan struct{})
+		}
+		wake := execLimit.wake
+		execLimit.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// execReservation holds the slots reserveExecs took that have not been handed
+// out yet.
+type execReservation struct {
+	mu sync.Mutex
+	n  int
+}
+
+type execReservationKey struct{}
+
+// take hands out one reserved slot, reporting false once none is left.
+func (r *execReservation) take() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.n == 0 {
+		return false
+	}
+	r.n--
+	return true
+}
+
+// release gives the slots not handed out back.
+func (r *execReservation) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for ; r.n > 0; r.n-- {
+		releaseExec()
+	}
+}
+
+func releaseExec() {
+	execLimit.mu.Lock()
+	defer execLimit.mu.Unlock()
+	execLimit.active--
+	wakeExecWaiters()
+}
+
+// wakeExecWaiters must be called with execLimit.mu held.
+func wakeExecWaiters() {
+	if execLimit.wake != nil {
+		close(execLimit.wake)
+		execLimit.wake = nil
+	}
+}
@@ -0,0 +1,90 @@
+//go:build linux || android
+// +build linux android
+
+package emrun
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSetMaxConcurrentExecs(t *testing.T) {
+	SetMaxConcurrentExecs(1)
+	t.Cleanup(func() { SetMaxConcurrentExecs(0) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bg, err := RunBG(ctx, []byte("#!/bin/sh\nsleep 0.3\n"))
+	if err != nil {
+		t.Fatalf("RunBG returned error: %v", err)
+	}
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if _, err := Run(short, []byte("#!/bin/sh\necho never\n")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the second execution to time out waiting for a slot, got %v", err)
+	}
+
+	waited := make(chan error, 1)
+	go func() {
+		_, err := Run(ctx, []byte("#!/bin/sh\necho queued\n"))
+		waited <- err
+	}()
+	select {
+	case err := <-waited:
+		t.Fatalf("expected the queued execution to wait, it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if res := bg.Wait(); res.Error != nil {
+		t.Fatalf("background run failed: %v", res.Error)
+	}
+	if err := <-waited; err != nil {
+		t.Fatalf("queued execution failed: %v", err)
+	}
+
+	SetMaxConcurrentExecs(0)
+	first, err := RunBG(ctx, []byte("#!/bin/sh\nsleep 0.2\n"))
+	if err != nil {
+		t.Fatalf("RunBG returned error: %v", err)
+	}
+	defer first.Wait()
+	quick, cancelQuick := context.WithTimeout(ctx, time.Second)
+	defer cancelQuick()
+	if _, err := Run(quick, []byte("#!/bin/sh\n")); err != nil {
+		t.Fatalf("expected no limit after resetting to zero, got %v", err)
+	}
+}
+
+func TestMaxConcurrentExecsPipeline(t *testing.T) {
+	SetMaxConcurrentExecs(2)
+	t.Cleanup(func() { SetMaxConcurrentExecs(0) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stages := []Stage{
+		{Payload: []byte("#!/bin/sh\necho piped\n")},
+		{Payload: []byte("#!/bin/sh\ncat\n")},
+	}
+
+	// With one slot taken the pipeline waits for both instead of starting
+	// its first stage and blocking on the second.
+	bg, err := RunBG(ctx, []byte("#!/bin/sh\nsleep 0.2\n"))
+	if err != nil {
+		t.Fatalf("RunBG returned error: %v", err)
+	}
+	out, err := Pipeline(ctx, stages)
+	if err != nil || string(out) != "piped\n" {
+		t.Fatalf("Pipeline = %q, %v", out, err)
+	}
+	if res := bg.Wait(); res.Error != nil {
+		t.Fatalf("background run failed: %v", res.Error)
+	}
+
+	SetMaxConcurrentExecs(1)
+	if _, err := Pipeline(ctx, stages); err == nil || ctx.Err() != nil {
+		t.Fatalf("expected a pipeline longer than the limit to fail at once, got %v", err)
+	}
+	if _, err := Run(ctx, []byte("#!/bin/sh\n")); err != nil {
+		t.Fatalf("the refused pipeline kept a slot: %v", err)
+	}
+}
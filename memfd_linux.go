@@ -0,0 +1,86 @@
+package emrun
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// MemfdSizeLimit estimates the largest payload a memfd can currently hold.
+// memfd pages live in shared memory backed by RAM and swap, so with the
+// default overcommit heuristics the estimate is MemAvailable plus SwapFree
+// from /proc/meminfo, and under strict accounting (vm.overcommit_memory=2) it
+// is the commit limit not yet committed. A finite RLIMIT_FSIZE, which memfd
+// writes obey, caps the estimate.
+//
+// The figure is advisory: memory is shared with everything else on the host
+// and cgroup limits are not taken into account. Use it to route payloads that
+// are clearly too large to the tempfile path:
+//
+//	if limit, err := emrun.MemfdSizeLimit(); err == nil && int64(len(payload)) > limit/2 {
+//		r, err = efrun.Open(payload)
+//	}
+func MemfdSizeLimit() (int64, error) {
+	overcommit, err := os.ReadFile("/proc/sys/vm/overcommit_memory")
+	if err != nil {
+		return 0, fmt.Errorf("emrun: memfd size limit: %w", err)
+	}
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, fmt.Errorf("emrun: memfd size limit: %w", err)
+	}
+	defer f.Close()
+	limit, err := memfdLimit(strings.TrimSpace(string(overcommit)), f)
+	if err != nil {
+		return 0, fmt.Errorf("emrun: memfd size limit: %w", err)
+	}
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_FSIZE, &rlim); err == nil && rlim.Cur != unix.RLIM_INFINITY && rlim.Cur < uint64(limit) {
+		limit = int64(rlim.Cur)
+	}
+	return limit, nil
+}
+
+// memfdLimit computes the estimate from the vm.overcommit_memory mode and the
+// contents of /proc/meminfo.
+func memfdLimit(overcommit string, meminfo io.Reader) (int64, error) {
+	fields := make(map[string]int64)
+	scanner := bufio.NewScanner(meminfo)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "kB"))
+		kb, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		fields[key] = kb * 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	need := []string{"MemAvailable", "SwapFree"}
+	if overcommit == "2" {
+		need = []string{"CommitLimit", "Committed_AS"}
+	}
+	for _, key := range need {
+		if _, ok := fields[key]; !ok {
+			return 0, fmt.Errorf("/proc/meminfo has no %s", key)
+		}
+	}
+	if overcommit == "2" {
+		return max(fields["CommitLimit"]-fields["Committed_AS"], 0), nil
+	}
+	if overcommit != "0" && overcommit != "1" {
+		return 0, errors.New("unknown vm.overcommit_memory mode " + strconv.Quote(overcommit))
+	}
+	return fields["MemAvailable"] + fields["SwapFree"], nil
+}
@@ -0,0 +1,34 @@
+package emrun
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemfdLimit(t *testing.T) {
+	meminfo := "MemTotal:        8000000 kB\nMemAvailable:    4000000 kB\nSwapFree:        1000000 kB\nCommitLimit:     6000000 kB\nCommitted_AS:    2500000 kB\n"
+	for _, tc := range []struct {
+		overcommit string
+		want       int64
+	}{
+		{"0", 5000000 * 1024},
+		{"1", 5000000 * 1024},
+		{"2", 3500000 * 1024},
+	} {
+		got, err := memfdLimit(tc.overcommit, strings.NewReader(meminfo))
+		if err != nil || got != tc.want {
+			t.Fatalf("overcommit %s: got %d, %v, want %d", tc.overcommit, got, err, tc.want)
+		}
+	}
+	if _, err := memfdLimit("0", strings.NewReader("MemTotal: 1 kB\n")); err == nil {
+		t.Fatal("expected an error when MemAvailable is missing")
+	}
+
+	limit, err := MemfdSizeLimit()
+	if err != nil {
+		t.Fatalf("MemfdSizeLimit returned error: %v", err)
+	}
+	if limit <= 0 {
+		t.Fatalf("expected a positive limit, got %d", limit)
+	}
+}
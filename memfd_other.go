@@ -0,0 +1,11 @@
+//go:build !linux
+
+package emrun
+
+import "errors"
+
+// MemfdSizeLimit estimates the largest payload a memfd can currently hold. It
+// is only supported on Linux and returns an error elsewhere.
+func MemfdSizeLimit() (int64, error) {
+	return 0, errors.New("emrun: memfd size limit is only supported on linux")
+}
@@ -0,0 +1,40 @@
+package emrun
+
+import (
+	"expvar"
+	"sync"
+)
+
+// metrics holds the counters RegisterMetrics publishes. They are always
+// maintained; publishing is what is opt-in.
+var metrics struct {
+	opens             expvar.Int
+	memfdOpens        expvar.Int
+	tempfileFallbacks expvar.Int
+	policyDenials     expvar.Int
+}
+
+var registerMetrics sync.Once
+
+// RegisterMetrics publishes emrun's counters through expvar as the map
+// "emrun", served on /debug/vars by expvar's HTTP handler:
+//
+//   - opens: payloads opened by Open, OpenReader and OpenFS.
+//   - memfd_opens: opens that ended up in a memfd.
+//   - tempfile_fallbacks: payloads written to a temporary file instead, at
+//     open time (memfd_create failed, ForceTempfileEnv is set or /proc is not
+//     mounted) or when executing the memfd was refused.
+//   - policy_denials: executions refused by the context policy, including
+//     CheckPolicy calls.
+//
+// tempfile_fallbacks shows how often the no-disk guarantee is given up. Nothing
+// is published unless RegisterMetrics is called; calling it again is a no-op.
+func RegisterMetrics() {
+	registerMetrics.Do(func() {
+		m := expvar.NewMap("emrun")
+		m.Set("opens", &metrics.opens)
+		m.Set("memfd_opens", &metrics.memfdOpens)
+		m.Set("tempfile_fallbacks", &metrics.tempfileFallbacks)
+		m.Set("policy_denials", &metrics.policyDenials)
+	})
+}
@@ -0,0 +1,59 @@
+package emrun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"testing"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	RegisterMetrics()
+	RegisterMetrics()
+	published, ok := expvar.Get("emrun").(*expvar.Map)
+	if !ok {
+		t.Fatal("expected an expvar map named emrun")
+	}
+	counter := func(name string) int64 {
+		v, ok := published.Get(name).(*expvar.Int)
+		if !ok {
+			t.Fatalf("counter %s not published", name)
+		}
+		return v.Value()
+	}
+	opens, memfd, fallbacks, denials := counter("opens"), counter("memfd_opens"), counter("tempfile_fallbacks"), counter("policy_denials")
+
+	payload := []byte("#!/bin/sh\n")
+	f, err := Open(payload)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	f.Close()
+	if counter("opens") != opens+1 {
+		t.Fatalf("opens = %d, want %d", counter("opens"), opens+1)
+	}
+	if counter("memfd_opens")+counter("tempfile_fallbacks") != memfd+fallbacks+1 {
+		t.Fatal("expected the open to count as memfd or tempfile")
+	}
+	t.Setenv(ForceTempfileEnv, "1")
+	f, err = Open(payload)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	f.Close()
+	if counter("tempfile_fallbacks") < fallbacks+1 {
+		t.Fatal("expected a forced tempfile to count as a fallback")
+	}
+
+	if _, err := Run(WithPolicy(context.Background(), DENY), payload); !errors.Is(err, ErrDenied) {
+		t.Fatalf("expected ErrDenied, got %v", err)
+	}
+	if counter("policy_denials") != denials+1 {
+		t.Fatalf("policy_denials = %d, want %d", counter("policy_denials"), denials+1)
+	}
+	var decoded map[string]int64
+	if err := json.Unmarshal([]byte(published.String()), &decoded); err != nil || len(decoded) != 4 {
+		t.Fatalf("unexpected expvar rendering %s: %v", published.String(), err)
+	}
+}
@@ -0,0 +1,1047 @@
+package emrun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"pkt.systems/emrun/internal/clock"
+	"pkt.systems/emrun/port"
+)
+
+// Option adjusts how payloads are opened and executed. Options are attached to
+// a context with WithOptions and apply to every runnable executed under that
+// context, or are given to an Open variant such as OpenFS, in which case they
+// apply to that runnable with the context options taking precedence.
+type Option func(*config)
+
+// config is the resolved form of a list of Options.
+type config struct {
+	// name is the memfd name shown in /proc/<pid>/fd links.
+	name      string
+	strace    io.Writer
+	nullStdin bool
+	shell     string
+	cgroup    string
+	// groups are the supplementary group IDs set by WithGroups.
+	groups []uint32
+	// tailCapture bounds combined output to its last tailCapture bytes.
+	tailCapture int
+	// captureWindow bounds combined output to what was written during the
+	// last captureWindow.
+	captureWindow time.Duration
+	stripANSI     bool
+	// progress receives the combined output byte count every
+	// progressInterval.
+	progress         func(bytesSoFar int64)
+	progressInterval time.Duration
+	stdinBuffer      int
+	env              map[string]string
+	termGrace        time.Duration
+	killGroup        bool
+	archCheck        bool
+	selfFDEnv        string
+	decryptor        func(io.Reader) (io.Reader, error)
+	validator        func([]byte) error
+	hangAfter        time.Duration
+	comm             string
+	auditName        string
+	cleanArgv0       bool
+	// keepCaps lists the capabilities WithCapabilities keeps when dropCaps.
+	keepCaps    []int
+	dropCaps    bool
+	mergeStderr bool
+	// forceCombined tees configured writers into combined capture.
+	forceCombined bool
+	privateTmpdir bool
+	foreground    bool
+	// anonymousTemp selects O_TMPFILE for the tempfile fallback.
+	anonymousTemp bool
+	trustedSource bool
+	// stdinFD is the descriptor WithStdinFD connects when hasStdinFD.
+	stdinFD    int
+	hasStdinFD bool
+	writeChunk int
+	stdinFIFO  string
+	stdoutFIFO string
+	stdoutFile string
+	stderrFile string
+	// inheritStdio connects the parent's standard streams.
+	inheritStdio bool
+	closeFDs     bool
+	// isolate starts the child in new namespaces, see WithQuarantine.
+	isolate bool
+	// malformedLine receives the lines RunJSONLines skips.
+	malformedLine func(line []byte, err error)
+	recorder      Recorder
+}
+
+type optionsKey struct{}
+
+// WithOptions returns a derived context carrying opts in addition to the
+// options already stored in ctx. Later options win when they configure the
+// same setting.
+//
+//	ctx = emrun.WithOptions(ctx, emrun.WithStrace(os.Stderr))
+//	out, err := emrun.Run(ctx, payload)
+func WithOptions(ctx context.Context, opts ...Option) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	merged := append(slices.Clone(optionsFromContext(ctx)), opts...)
+	return context.WithValue(ctx, optionsKey{}, merged)
+}
+
+// withDefaultOptions returns ctx with opts placed before the options already
+// in ctx, so the context options win. Runnables use it to apply the options
+// they were opened with.
+func withDefaultOptions(ctx context.Context, opts []Option) context.Context {
+	if len(opts) == 0 {
+		return ctx
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	merged := append(slices.Clone(opts), optionsFromContext(ctx)...)
+	return context.WithValue(ctx, optionsKey{}, merged)
+}
+
+func optionsFromContext(ctx context.Context) []Option {
+	if ctx == nil {
+		return nil
+	}
+	opts, _ := ctx.Value(optionsKey{}).([]Option)
+	return opts
+}
+
+func configFromContext(ctx context.Context) *config {
+	return newConfig(optionsFromContext(ctx))
+}
+
+func newConfig(opts []Option) *config {
+	cfg := &config{}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(cfg)
+		}
+	}
+	return cfg
+}
+
+// decorate wraps runner with the runner decorators requested by the options.
+func (c *config) decorate(runner port.CommandRunner) port.CommandRunner {
+	if c.hangAfter > 0 {
+		runner = newHangRunner(runner, c.hangAfter)
+	}
+	// The tracer must start the command itself, so it goes outermost.
+	if c.strace != nil {
+		runner = newStraceRunner(runner, c.strace)
+	}
+	// The recorder only tees stdio around Run, which the tracer allows.
+	if c.recorder != nil {
+		runner = newRecordingRunner(runner, c.recorder)
+	}
+	return runner
+}
+
+// Preflight runs the checks requested through options in ctx, such as
+// WithArchCheck, against r before it is executed. The runnables returned by
+// emrun and efrun call it from Run and StartBackground after the policy check;
+// custom port.Runnable implementations can do the same.
+func Preflight(ctx context.Context, r port.Runnable) error {
+	cfg := configFromContext(ctx)
+	if cfg.archCheck {
+		if err := CheckArch(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BindCommand applies the options in ctx that tie cmd to the runnable r, such
+// as WithSelfFDEnv handing the child r's backing file or WithCleanArgv0 naming
+// it after r's digest, and gives WithRecorder r's digest for the Record. The
+// returned unbind restores the fields of cmd it changed, so a clone made for
+// another backing, like the tempfile fallback, can be bound afresh. Runnables
+// call it before executing cmd.
+func BindCommand(ctx context.Context, r port.Runnable, cmd *exec.Cmd) (unbind func(), err error) {
+	env, extraFiles, args := cmd.Env, cmd.ExtraFiles, cmd.Args
+	unbind = func() {
+		cmd.Env, cmd.ExtraFiles, cmd.Args = env, extraFiles, args
+		boundDigests.Delete(cmd)
+	}
+	cfg := configFromContext(ctx)
+	if cfg.recorder != nil {
+		boundDigests.Store(cmd, r.Digest())
+	}
+	if cfg.cleanArgv0 {
+		cmd.Args = append([]string{cfg.argv0(r)}, args[min(len(args), 1):]...)
+	}
+	if cfg.selfFDEnv != "" {
+		var file *os.File
+		if fb, ok := r.(port.FileBacked); ok {
+			file = fb.File()
+		}
+		if file == nil {
+			return unbind, fmt.Errorf("%s: runnable has no open backing file to pass", cfg.selfFDEnv)
+		}
+		// ExtraFiles entry i becomes descriptor 3+i in the child.
+		cmd.ExtraFiles = append(slices.Clip(extraFiles), file)
+		fd := 3 + len(cmd.ExtraFiles) - 1
+		if cmd.Env, err = mergeEnv(env, map[string]string{cfg.selfFDEnv: strconv.Itoa(fd)}); err != nil {
+			unbind()
+			return unbind, err
+		}
+	}
+	return unbind, nil
+}
+
+// argv0 returns the argv[0] WithCleanArgv0 gives commands executing r.
+func (c *config) argv0(r port.Runnable) string {
+	if c.comm != "" {
+		return c.comm
+	}
+	digest := r.Digest()
+	return "emrun-" + digest[:min(len(digest), 12)]
+}
+
+// bind applies the settings that refer to cmd itself, such as a Cancel
+// function signalling its process. Clones of cmd have to be bound again.
+func (c *config) bind(cmd *exec.Cmd) {
+	switch {
+	case c.killGroup && c.termGrace > 0:
+		cmd.Cancel = func() error {
+			// os/exec kills only the child once the grace has passed. The
+			// group is pinned while the child still leads it, so the
+			// SIGKILL cannot reach another group that took over its ID
+			// after the whole group exited.
+			group := pinProcessGroup(cmd.Process)
+			clock.Get().AfterFunc(c.termGrace, func() {
+				group.signal(syscall.SIGKILL)
+				group.close()
+			})
+			return group.signal(syscall.SIGTERM)
+		}
+		cmd.WaitDelay = c.termGrace
+	case c.killGroup:
+		cmd.Cancel = func() error {
+			return signalProcessGroup(cmd.Process, syscall.SIGKILL)
+		}
+	case c.termGrace > 0:
+		cmd.Cancel = func() error {
+			return cmd.Process.Signal(syscall.SIGTERM)
+		}
+		cmd.WaitDelay = c.termGrace
+	}
+}
+
+// prepare applies the options that modify cmd itself. The returned cleanup
+// releases what prepare opened and is safe to call as soon as the child has
+// started. ctx bounds blocking steps such as opening FIFOs.
+func (c *config) prepare(ctx context.Context, cmd *exec.Cmd) (cleanup func(), err error) {
+	c.bind(cmd)
+	var closers []io.Closer
+	cleanup = func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}
+	if c.nullStdin {
+		devNull, err := os.Open(os.DevNull)
+		if err != nil {
+			return cleanup, fmt.Errorf("open %s for stdin: %w", os.DevNull, err)
+		}
+		closers = append(closers, devNull)
+		cmd.Stdin = devNull
+	}
+	if c.hasStdinFD {
+		stdin, err := dupFile(c.stdinFD, "stdin")
+		if err != nil {
+			return cleanup, fmt.Errorf("stdin descriptor %d: %w", c.stdinFD, err)
+		}
+		closers = append(closers, stdin)
+		cmd.Stdin = stdin
+	}
+	if c.stdinFIFO != "" {
+		fifo, err := openFIFO(ctx, c.stdinFIFO, os.O_RDONLY)
+		if err != nil {
+			return cleanup, err
+		}
+		closers = append(closers, fifo)
+		cmd.Stdin = fifo
+	}
+	if c.stdoutFIFO != "" {
+		fifo, err := openFIFO(ctx, c.stdoutFIFO, os.O_WRONLY)
+		if err != nil {
+			return cleanup, err
+		}
+		closers = append(closers, fifo)
+		cmd.Stdout = fifo
+	}
+	for _, out := range []struct {
+		name string
+		path string
+		dst  *io.Writer
+	}{{"stdout", c.stdoutFile, &cmd.Stdout}, {"stderr", c.stderrFile, &cmd.Stderr}} {
+		if out.path == "" {
+			continue
+		}
+		file, err := os.OpenFile(out.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o666)
+		if err != nil {
+			return cleanup, fmt.Errorf("%s file: %w", out.name, err)
+		}
+		closers = append(closers, file)
+		*out.dst = file
+	}
+	if c.inheritStdio {
+		// Teeing the terminal into a buffer is not what inheriting means.
+		if c.forceCombined {
+			return cleanup, errors.New("WithInheritStdio cannot be combined with WithForceCombined")
+		}
+		if cmd.Stdin == nil {
+			cmd.Stdin = os.Stdin
+		}
+		if cmd.Stdout == nil {
+			cmd.Stdout = os.Stdout
+		}
+		if cmd.Stderr == nil {
+			cmd.Stderr = os.Stderr
+		}
+	}
+	if c.stdinBuffer > 0 && cmd.Stdin != nil {
+		if _, isFile := cmd.Stdin.(*os.File); !isFile {
+			cmd.Stdin = &bufferedStdin{r: cmd.Stdin, size: c.stdinBuffer}
+		}
+	}
+	if c.mergeStderr {
+		cmd.Stderr = cmd.Stdout
+	}
+	if len(c.env) > 0 {
+		env, err := mergeEnv(cmd.Env, c.env)
+		if err != nil {
+			return cleanup, err
+		}
+		cmd.Env = env
+	}
+	if c.cgroup != "" {
+		dir, err := applyCgroup(cmd, c.cgroup)
+		if err != nil {
+			return cleanup, err
+		}
+		closers = append(closers, dir)
+	}
+	if c.killGroup {
+		if err := applyProcessGroup(cmd); err != nil {
+			return cleanup, err
+		}
+	}
+	if c.groups != nil {
+		if err := applyGroups(cmd, c.groups); err != nil {
+			return cleanup, err
+		}
+	}
+	if c.isolate {
+		if err := applyNamespaces(cmd); err != nil {
+			return cleanup, err
+		}
+	}
+	return cleanup, nil
+}
+
+// scratch sets up what the child uses while it runs and has to be undone once
+// it has exited, unlike what prepare opens, such as the private TMPDIR of
+// WithPrivateTmpdir, the terminal handed over by WithForeground or the path
+// the trampoline of WithCapabilities execs. release is
+// never nil and must be called after the child has been waited for, or when
+// it never started.
+func (c *config) scratch(cmd *exec.Cmd) (release func(), err error) {
+	var releases []func()
+	release = func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	if c.privateTmpdir {
+		dir, err := os.MkdirTemp("", "emrun-tmp-*")
+		if err != nil {
+			return release, fmt.Errorf("private TMPDIR: %w", err)
+		}
+		releases = append(releases, func() {
+			os.RemoveAll(dir)
+		})
+		env, err := mergeEnv(cmd.Env, map[string]string{"TMPDIR": dir})
+		if err != nil {
+			return release, err
+		}
+		cmd.Env = env
+	}
+	if c.foreground {
+		restore, err := applyForeground(cmd)
+		if err != nil {
+			return release, err
+		}
+		releases = append(releases, restore)
+	}
+	// The trampoline execs the path it is given after Start has returned,
+	// so the audit copy and the comm link have to outlive the child, and
+	// come first for the trampoline to exec them.
+	for _, step := range []struct {
+		name  string
+		apply func(*exec.Cmd, string) (removeAll, error)
+	}{{c.auditName, copyAuditName}, {c.comm, linkComm}} {
+		if step.name == "" {
+			continue
+		}
+		dir, err := step.apply(cmd, step.name)
+		if err != nil {
+			return release, err
+		}
+		releases = append(releases, func() {
+			dir.Close()
+		})
+	}
+	if c.dropCaps || c.closeFDs {
+		token, err := applyTrampoline(cmd, c)
+		if err != nil {
+			return release, err
+		}
+		releases = append(releases, func() {
+			token.Close()
+		})
+	}
+	return release, nil
+}
+
+// mergeEnv returns base, or the parent's environment when base is nil, with
+// the variables in vars set. Replaced entries are dropped and vars are
+// appended sorted by name so the result is deterministic.
+func mergeEnv(base []string, vars map[string]string) ([]string, error) {
+	if base == nil {
+		base = os.Environ()
+	}
+	names := slices.Sorted(maps.Keys(vars))
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return nil, fmt.Errorf("invalid environment variable name %q", name)
+		}
+	}
+	env := make([]string, 0, len(base)+len(names))
+	for _, kv := range base {
+		name, _, _ := strings.Cut(kv, "=")
+		if _, replaced := vars[name]; !replaced {
+			env = append(env, kv)
+		}
+	}
+	for _, name := range names {
+		env = append(env, name+"="+vars[name])
+	}
+	return env, nil
+}
+
+// bufferedStdin makes os/exec copy stdin into the child's pipe with a buffer
+// of size bytes. os/exec copies with io.Copy, which prefers WriterTo, so the
+// copy happens in WriteTo with both sides stripped of their optional interfaces
+// to keep them from replacing the buffer with their own.
+type bufferedStdin struct {
+	r    io.Reader
+	size int
+}
+
+func (b *bufferedStdin) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func (b *bufferedStdin) WriteTo(w io.Writer) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{b.r}, make([]byte, b.size))
+}
+
+// ownSysProcAttr gives cmd a SysProcAttr of its own, copying any existing one
+// since clones of a command share the pointer, and returns it for editing.
+func ownSysProcAttr(cmd *exec.Cmd) *syscall.SysProcAttr {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	} else {
+		attr := *cmd.SysProcAttr
+		cmd.SysProcAttr = &attr
+	}
+	return cmd.SysProcAttr
+}
+
+// WithStrace logs every syscall made by the child to w, one line per syscall,
+// by tracing it with ptrace(2). It is a debugging aid only: the child stops on
+// every syscall entry and exit and waits for the tracer, which slows it down
+// by orders of magnitude and pins an OS thread for its whole lifetime. Do not
+// use it in production. Processes forked by the child are not traced, and
+// platforms other than linux/amd64 fail to start the command.
+func WithStrace(w io.Writer) Option {
+	return func(c *config) {
+		c.strace = w
+	}
+}
+
+// WithRecorder hands rec a Record of every execution once it has exited:
+// the payload digest, arguments, environment, stdin read from a reader and
+// the combined output, so a production incident can be replayed as a test
+// fixture with emruntest.ReplayRunner. Stdin and output are teed through the
+// recorder and held in memory until the command exits, so only record
+// commands with bounded I/O. Stdin and output that are files, such as with
+// WithInheritStdio, are handed to the child as they are and not recorded.
+// Executions started in the background are not recorded. Storing records is
+// up to rec.
+//
+//	ctx = emrun.WithOptions(ctx, emrun.WithRecorder(jsonRecorder))
+func WithRecorder(rec Recorder) Option {
+	return func(c *config) {
+		c.recorder = rec
+	}
+}
+
+// WithStdinFIFO connects the named pipe (see mkfifo(1)) at path as the child's
+// stdin, replacing any reader supplied by RunIO-style helpers. Opening a FIFO
+// for reading blocks until a writer opens it too, so executing the payload
+// waits for the writer; cancelling the context gives up waiting. The child
+// reads EOF once the last writer closes the FIFO. emrun's descriptor is closed
+// once the child has started.
+func WithStdinFIFO(path string) Option {
+	return func(c *config) {
+		c.stdinFIFO = path
+	}
+}
+
+// WithStdoutFIFO is WithStdinFIFO for stdout: the child writes to the named
+// pipe at path, and executing it waits until a reader has opened the FIFO.
+// Stderr is left alone unless WithMergeStderr is given too. Combined capture,
+// as done by Run and RunBG, then only captures stderr. When both FIFOs are
+// set, stdin is opened first.
+func WithStdoutFIFO(path string) Option {
+	return func(c *config) {
+		c.stdoutFIFO = path
+	}
+}
+
+// WithStdoutFile appends the child's stdout to the file at path, creating it
+// with mode 0666 before umask if needed, instead of any writer supplied by
+// RunIO-style helpers. The file is opened before the child is started, so a
+// path that cannot be opened fails the execution without starting anything.
+// The child writes to the file directly; emrun's descriptor is closed once it
+// has started and the child's own is closed when it exits. Combined capture,
+// as done by Run and RunBG, then only captures stderr.
+//
+//	ctx = emrun.WithOptions(ctx, emrun.WithStdoutFile("/var/log/helper.log"),
+//		emrun.WithStderrFile("/var/log/helper.err"))
+//	bg, err := emrun.RunBG(ctx, daemon, "--foreground")
+func WithStdoutFile(path string) Option {
+	return func(c *config) {
+		c.stdoutFile = path
+	}
+}
+
+// WithStderrFile is WithStdoutFile for stderr. Given the same path as
+// WithStdoutFile, both streams are appended to that file. WithMergeStderr
+// takes precedence over it.
+func WithStderrFile(path string) Option {
+	return func(c *config) {
+		c.stderrFile = path
+	}
+}
+
+// WithCloseInheritedFDs keeps descriptors the process holds without
+// close-on-exec from leaking into the child, hardening the execution of
+// untrusted tools. Go opens its own files close-on-exec, but C libraries and
+// descriptors inherited from the parent's parent may not be. In the child,
+// every descriptor above stderr is marked close-on-exec except those passed
+// in ExtraFiles, such as by WithSelfFDEnv, and the memfd the payload runs
+// from; the emrun process and its other children are not affected. Like
+// WithCapabilities it runs the child through the trampoline described there,
+// with the same limits. Only supported on linux; elsewhere the execution
+// fails.
+func WithCloseInheritedFDs() Option {
+	return func(c *config) {
+		c.closeFDs = true
+	}
+}
+
+// WithInheritStdio connects the parent's os.Stdin, os.Stdout and os.Stderr
+// to the child, so a CLI wrapping an embedded tool can hand it the terminal
+// with any helper: Run then returns no output, as everything went to the
+// parent's streams. Readers and writers supplied by RunIO-style helpers, and
+// streams set by options such as WithNullStdin or WithStdoutFile, are kept.
+// Capturing the inherited streams is refused: combined with WithForceCombined
+// the execution fails without starting anything.
+//
+//	ctx = emrun.WithOptions(ctx, emrun.WithInheritStdio())
+//	_, err := emrun.Run(ctx, editor, path)
+func WithInheritStdio() Option {
+	return func(c *config) {
+		c.inheritStdio = true
+	}
+}
+
+// redirectsOutput reports whether options send stdout or stderr somewhere of
+// their own, which combined capture then leaves alone.
+func (c *config) redirectsOutput() bool {
+	return c.stdoutFIFO != "" || c.stdoutFile != "" || c.stderrFile != "" || c.inheritStdio
+}
+
+// WithWriteChunkSize makes OpenContext write the payload into the memfd, or
+// the temporary file it falls back to, in chunks of n bytes and check its
+// context between them. Smaller chunks abort a cancelled open sooner at the
+// cost of more system calls; a few MiB is a reasonable size. Zero or less
+// writes the payload at once.
+func WithWriteChunkSize(n int) Option {
+	return func(c *config) {
+		c.writeChunk = n
+	}
+}
+
+// WithStdinFD makes the open descriptor fd, e.g. of a large input file or a
+// pipe, the child's stdin, replacing any reader supplied by RunIO-style
+// helpers. The child reads from the descriptor itself instead of through a
+// goroutine copying into a pipe, so no data passes through the Go program. A
+// duplicate is handed to the child and closed once it has started; emrun
+// never closes fd itself, which stays owned by the caller. The child shares
+// fd's file offset. It is not supported on Windows.
+//
+//	in, _ := os.Open("huge.log")
+//	defer in.Close()
+//	ctx = emrun.WithOptions(ctx, emrun.WithStdinFD(int(in.Fd())))
+func WithStdinFD(fd int) Option {
+	return func(c *config) {
+		c.stdinFD = fd
+		c.hasStdinFD = true
+	}
+}
+
+// WithNullStdin connects the child's stdin to an opened /dev/null, replacing
+// any reader supplied by RunIO-style helpers, so tools that wait for input
+// read EOF immediately instead of blocking.
+func WithNullStdin() Option {
+	return func(c *config) {
+		c.nullStdin = true
+	}
+}
+
+// WithShell selects the shell Shell runs scripts with instead of DefaultShell.
+// The shell must accept a script through -c like sh(1).
+func WithShell(path string) Option {
+	return func(c *config) {
+		c.shell = path
+	}
+}
+
+// WithGroups sets the supplementary group IDs of the child to groups, e.g. to
+// give an embedded tool access to a device node owned by a secondary group.
+// The user and primary group stay those of a Credential already set in
+// cmd.SysProcAttr, or otherwise those of the current process. Changing groups
+// takes CAP_SETGID, which normally means running as root. A Credential with
+// NoSetGroups set would skip setgroups(2) and silently ignore groups, so that
+// combination fails to start the command instead; an empty list drops all
+// supplementary groups. It is only supported on Linux.
+func WithGroups(groups []uint32) Option {
+	return func(c *config) {
+		c.groups = append([]uint32{}, groups...)
+	}
+}
+
+// WithCgroup starts the child directly inside the cgroup v2 directory at path,
+// e.g. "/sys/fs/cgroup/system.slice/tools.scope", so its resource usage is
+// accounted there from the first instruction. The directory descriptor is
+// closed once the child has started. It needs Linux 5.7 or later
+// (clone3 with CLONE_INTO_CGROUP), a cgroup v2 hierarchy and write access to
+// the cgroup's cgroup.procs; elsewhere starting the command fails.
+func WithCgroup(path string) Option {
+	return func(c *config) {
+		c.cgroup = path
+	}
+}
+
+// WithTailCapture keeps only the last n bytes of combined output, in a ring
+// buffer of n bytes, so CombinedOutput of arbitrarily verbose tools stays
+// bounded while the most recent output, usually the error, is preserved.
+// Values of n below one capture everything, which is the default.
+func WithTailCapture(n int) Option {
+	return func(c *config) {
+		c.tailCapture = n
+	}
+}
+
+// WithTimeWindowCapture keeps only the combined output written during the
+// last d before the command exited, dropping older output as new output
+// arrives, so CombinedOutput of a tool that logs steadily shows what happened
+// right before it failed. It takes precedence over WithTailCapture. Values of
+// d of zero or less capture everything, which is the default.
+func WithTimeWindowCapture(d time.Duration) Option {
+	return func(c *config) {
+		c.captureWindow = d
+	}
+}
+
+// WithStripANSI removes ANSI CSI escape sequences, such as colour codes, from
+// captured combined output, for tools that colourise even when not attached
+// to a terminal. Sequences split across writes are removed as well. Writers
+// set by the caller and files set with WithStdoutFile or WithStderrFile
+// receive the output unchanged.
+func WithStripANSI() Option {
+	return func(c *config) {
+		c.stripANSI = true
+	}
+}
+
+// WithProgress calls fn every interval during a run with the number of bytes
+// of combined output written so far, and once more when the command has
+// finished, for progress indication of long runs without streaming the
+// output. The count is taken before WithStripANSI removes anything. Calls never
+// overlap, so fn runs on a timer goroutine and should return quickly. Runs
+// without combined output, and values of interval of zero or less, report
+// nothing.
+func WithProgress(interval time.Duration, fn func(bytesSoFar int64)) Option {
+	return func(c *config) {
+		c.progress = fn
+		c.progressInterval = interval
+	}
+}
+
+// WithStdinBufferSize copies stdin supplied as a reader, as with RunIO, into
+// the child using an n-byte buffer instead of the 32 KiB io.Copy default, so
+// large inputs cross the pipe in fewer, larger writes. Stdin given as an
+// *os.File is handed to the child directly and is unaffected. Values of n
+// below one keep the default.
+func WithStdinBufferSize(n int) Option {
+	return func(c *config) {
+		c.stdinBuffer = n
+	}
+}
+
+// WithEnvMap sets the variables in vars in the child's environment on top of
+// cmd.Env, or of the parent's environment when cmd.Env is nil. Values are
+// passed as-is. Names that are empty or contain '=' make the run fail before
+// anything starts. Repeated WithEnvMap options merge, later values winning.
+//
+//	ctx = emrun.WithOptions(ctx, emrun.WithEnvMap(map[string]string{"LANG": "C"}))
+func WithEnvMap(vars map[string]string) Option {
+	return func(c *config) {
+		if c.env == nil {
+			c.env = make(map[string]string, len(vars))
+		}
+		maps.Copy(c.env, vars)
+	}
+}
+
+// WithAuditName makes the child execute from a copy of the payload called name
+// in a private temporary directory, so the audit subsystem and other tools
+// that log the executed path record a descriptive one rather than
+// /proc/self/fd/N or a random tempfile name. This gives up executing from
+// memory: the payload is written to os.TempDir, which TMPDIR selects, and the
+// copy is removed once the child has exited. Combine it with WithComm for a
+// matching comm. name must not contain a slash.
+//
+//	ctx = emrun.WithOptions(ctx, emrun.WithAuditName("backup-helper"))
+func WithAuditName(name string) Option {
+	return func(c *config) {
+		c.auditName = name
+	}
+}
+
+// WithName sets the name of the memfd an Open variant creates, which shows up
+// in /proc/<pid>/fd and /proc/<pid>/maps as "memfd:<name>". It only affects
+// opening and is ignored in context options.
+func WithName(name string) Option {
+	return func(c *config) {
+		c.name = name
+	}
+}
+
+// WithComm sets the child's comm, the name shown by ps, top and
+// /proc/<pid>/comm, instead of the fd number or random tempfile name it would
+// get from its path. The payload is executed through a symlink called name in
+// a private temporary directory, which works for memfd and tempfile backings
+// alike; argv[0] is left as is unless WithCleanArgv0 is set. The kernel
+// truncates comm to 15 bytes. name must not contain a slash.
+func WithComm(name string) Option {
+	return func(c *config) {
+		c.comm = name
+	}
+}
+
+// WithCleanArgv0 replaces argv[0] of the child, which the helpers otherwise
+// set to the runnable's path such as /proc/self/fd/7, with a friendly name:
+// the name given to WithComm, or else "emrun-" followed by the first 12 hex
+// digits of the payload's SHA-256 digest. The executable path is unchanged.
+// It is meant for multi-call tools that pick their behaviour from argv[0], and
+// it is applied again to the clone executed after a tempfile fallback. Scripts
+// do not see it: the kernel passes the script's path to the interpreter.
+func WithCleanArgv0() Option {
+	return func(c *config) {
+		c.cleanArgv0 = true
+	}
+}
+
+// WithMalformedLineHandler makes RunJSONLines call fn with every non-blank
+// line that is not valid JSON, and the error decoding it, instead of skipping
+// it silently. fn is called from the goroutine running RunJSONLines, so the
+// next line is not read until it returns.
+func WithMalformedLineHandler(fn func(line []byte, err error)) Option {
+	return func(c *config) {
+		c.malformedLine = fn
+	}
+}
+
+// WithCapabilities drops every Linux capability from the child except keep,
+// given as capability numbers such as unix.CAP_NET_BIND_SERVICE. An empty keep
+// drops them all. The kept capabilities stay permitted, effective and
+// inheritable and are raised as ambient, so they survive into the payload for
+// non-root callers as well; capabilities the caller does not hold cannot be
+// kept.
+//
+// os/exec offers no hook between fork and exec, so the child first re-executes
+// the current program through /proc/self/exe. An init function in emrun
+// recognises the re-execution, drops the capabilities on its thread and
+// execs the payload, before main runs. The trampoline only acts on a one-time
+// token the parent hands the child in a sealed memfd, and never in a program
+// that gained privileges on exec, such as a setuid or setcap binary, so it
+// cannot be used to run arbitrary programs with those privileges.
+// Initializers of packages that are initialized before emrun do run in the
+// trampoline and must not have side effects. The bounding set is reduced too
+// when the caller holds CAP_SETPCAP, as root does. Because the payload is
+// executed by the trampoline, a memfd that cannot be executed makes the child
+// exit with code 127 instead of falling back to a temporary file, and the
+// links of WithComm and WithAuditName are kept until the child has exited. It
+// is only supported on Linux.
+//
+//	ctx = emrun.WithOptions(ctx, emrun.WithCapabilities(unix.CAP_NET_BIND_SERVICE))
+func WithCapabilities(keep ...int) Option {
+	return func(c *config) {
+		c.keepCaps = slices.Clone(keep)
+		c.dropCaps = true
+	}
+}
+
+// WithTrustedSource marks a payload opened with OpenFS or OpenReader as coming
+// from a trusted source, typically an embed.FS compiled into the program, so
+// a default-DENY policy (see WithPolicy) does not stop it. Rules still apply:
+// a digest matched by an explicit DENY rule is denied as before. Payloads
+// opened without it, or with Open, remain subject to the default verdict.
+//
+// The threat model is that whoever can change the program binary can change
+// what it executes anyway, so allow-listing the digests of embedded tools
+// adds nothing, while payloads loaded at run time, from disk, the network or
+// an os.DirFS, are what the policy guards against. emrun cannot tell where a
+// reader or fs.FS gets its bytes from; the option is the caller's assertion
+// and must never be given for payloads an attacker could influence, such as
+// files next to the binary or anything downloaded. It only affects opening and
+// is ignored in context options.
+//
+//	//go:embed tools
+//	var tools embed.FS
+//	//...
+//	f, err := emrun.OpenFS(tools, "tools/jq", emrun.WithTrustedSource())
+func WithTrustedSource() Option {
+	return func(c *config) {
+		c.trustedSource = true
+	}
+}
+
+// WithAnonymousTempFile makes the fallback used when a memfd cannot be created
+// or executed write the payload to an unlinked O_TMPFILE, opened with O_EXCL
+// so it can never be linked, instead of a named file in os.TempDir. The file
+// is executed through /proc/self/fd/N like a memfd and never appears in the
+// directory, leaving no named executable on disk even briefly; it vanishes
+// when the runnable is closed. When the kernel or file system does not support
+// O_TMPFILE, or /proc is not mounted, the named temporary file is used as
+// before. It applies to OpenReader and OpenFS when given to them, and to the
+// fallback during execution when set in the context.
+func WithAnonymousTempFile() Option {
+	return func(c *config) {
+		c.anonymousTemp = true
+	}
+}
+
+// WithMergeStderr sends the child's stderr wherever its stdout goes, like 2>&1
+// in a shell, replacing any stderr writer given to RunIOE-style helpers. When
+// stdout and stderr are the same writer os/exec hands the child a single pipe
+// for both, so the kernel keeps the order in which the child wrote to them;
+// combined capture (Run, RunTee and friends) always works this way. Separate
+// writers are fed from two pipes and lose the relative order, which
+// WithMergeStderr avoids at the price of the streams no longer being
+// distinguishable. Result.StdoutBytes then counts both. When stdout is
+// discarded, stderr is discarded too.
+func WithMergeStderr() Option {
+	return func(c *config) {
+		c.mergeStderr = true
+	}
+}
+
+// WithForceCombined lets combined capture coexist with stdout or stderr
+// writers already set on the command: instead of failing with "combined
+// output requested with configured stdout or stderr", the output is teed into
+// those writers and the capture buffer alike. The check exists to catch
+// commands that were meant to be streamed and are accidentally captured, so
+// only set this where both are wanted, e.g. for a cmd.Stdout that is a
+// deliberate MultiWriter to a log.
+func WithForceCombined() Option {
+	return func(c *config) {
+		c.forceCombined = true
+	}
+}
+
+// WithPrivateTmpdir gives every execution a fresh directory of its own as
+// TMPDIR, overriding one set with WithEnvMap, so scratch files cannot leak from
+// one run into the next. The directory and everything the child left in it
+// are removed once the child has exited, including when it fails or is
+// cancelled. For background runs that is when the Background settles.
+func WithPrivateTmpdir() Option {
+	return func(c *config) {
+		c.privateTmpdir = true
+	}
+}
+
+// WithForeground starts the child in a process group of its own and makes
+// that the foreground process group of the controlling terminal, so Ctrl-C and
+// the other signals the terminal generates go to the child, as a shell does
+// for the jobs it runs in the foreground. It is meant for interactive tools
+// such as REPLs. Once the child has exited the terminal is handed back to the
+// process group that had it from an OS thread that blocks SIGTTOU meanwhile,
+// so the handover cannot stop the program; the process-wide disposition of
+// SIGTTOU, and any signal.Notify for it, are left untouched. Without a
+// controlling terminal the execution fails before anything is started. Only
+// supported on Linux.
+func WithForeground() Option {
+	return func(c *config) {
+		c.foreground = true
+	}
+}
+
+// WithHangDiagnostic sends SIGQUIT to the child when it is still running
+// after the given time, measured from start. Go programs answer SIGQUIT by
+// dumping the stacks of all goroutines to stderr, so the configured stderr
+// shows where a hung tool is stuck. The child is not killed; context
+// cancellation, WithTermGrace and the like proceed as usual. The child is
+// started through the runner's Start, so runners that cannot start commands,
+// such as emruntest.ReplayRunner, cannot be combined with it. Zero or a
+// negative after disables it.
+//
+//	ctx = emrun.WithOptions(ctx, emrun.WithHangDiagnostic(time.Minute))
+//	err := emrun.RunIOE(ctx, nil, os.Stdout, os.Stderr, tool)
+func WithHangDiagnostic(after time.Duration) Option {
+	return func(c *config) {
+		c.hangAfter = after
+	}
+}
+
+// WithDecryptor makes OpenReader and OpenFS pass the payload through decrypt
+// and stream the plaintext it returns into the memfd, so a payload can be
+// embedded encrypted without emrun knowing the key or cipher. The digest used
+// for policy checks is that of the plaintext. When decrypt, or reading from
+// the reader it returned, fails, opening fails with a "decrypt payload" error
+// wrapping the cause and the memfd is closed. Like WithName it only affects
+// opening and is ignored in context options.
+//
+//	f, err := emrun.OpenFS(tools, "tools/jq.enc", emrun.WithDecryptor(func(r io.Reader) (io.Reader, error) {
+//		return cipher.StreamReader{S: cipher.NewCTR(block, iv), R: r}, nil
+//	}))
+func WithDecryptor(decrypt func(io.Reader) (io.Reader, error)) Option {
+	return func(c *config) {
+		c.decryptor = decrypt
+	}
+}
+
+// WithPayloadValidator makes opening a payload call validate with its bytes
+// and fail with an error wrapping ErrPayloadRejected and the validator's
+// error when it returns one, e.g. to require statically linked ELF binaries.
+// It is an extension point beside the digest policy, not part of it, and runs
+// once per open rather than per execution. OpenContext and the Run*/Do*
+// helpers of emrun and efrun take it from the context options and call it
+// before the payload is written. OpenReader and OpenFS take it from their
+// opts and, since they stream the payload, call it on the bytes read back
+// from the memfd before returning: the whole payload is then held in memory
+// for the call after all, so leave it out for streamed payloads too large for
+// that. Open, and efrun's Open, OpenOn, OpenReader and OpenFS, take neither a
+// context nor options and never call it, so a validator does not guard
+// payloads opened through them.
+func WithPayloadValidator(validate func(payload []byte) error) Option {
+	return func(c *config) {
+		c.validator = validate
+	}
+}
+
+// ErrPayloadRejected is wrapped by the error returned when a validator set
+// with WithPayloadValidator rejects a payload.
+var ErrPayloadRejected = errors.New("emrun: payload rejected by validator")
+
+// ValidatePayload runs the WithPayloadValidator hook in the options of ctx on
+// payload, returning an error wrapping ErrPayloadRejected when it rejects it.
+// The helpers of emrun and efrun that take a context call it when opening a
+// payload; custom helpers can do the same.
+func ValidatePayload(ctx context.Context, payload []byte) error {
+	return runValidator(configFromContext(ctx).validator, payload)
+}
+
+func runValidator(validate func([]byte) error, payload []byte) error {
+	if validate == nil {
+		return nil
+	}
+	if err := validate(payload); err != nil {
+		return fmt.Errorf("%w: %w", ErrPayloadRejected, err)
+	}
+	return nil
+}
+
+// WithTermGrace makes cancelling the context stop the child gracefully: it is
+// sent SIGTERM first and only killed if it is still running d later. os/exec
+// implements this through cmd.Cancel and cmd.WaitDelay, so commands must be
+// created with exec.CommandContext, as all helpers do. The grace also applies
+// to retries and the tempfile fallback. On Windows, which has no SIGTERM, the
+// child is killed once d has passed.
+func WithTermGrace(d time.Duration) Option {
+	return func(c *config) {
+		c.termGrace = d
+	}
+}
+
+// WithKillProcessGroup starts the child in a process group of its own and
+// makes cancelling the context kill the whole group rather than the child
+// alone, so grandchildren it forked do not linger as orphans. With
+// WithTermGrace the group receives SIGTERM and, if anything in it is still
+// running d later, SIGKILL; once every process that was in the group at
+// cancellation is gone, its ID may belong to another group and the SIGKILL
+// is not sent. Only cancellation reaches the group: processes
+// left running after the child exited on its own are not touched. Processes
+// that move to another group or session, as daemons do, escape it. Only
+// supported on Linux.
+func WithKillProcessGroup() Option {
+	return func(c *config) {
+		c.killGroup = true
+	}
+}
+
+// WithArchCheck makes runnables read the ELF header of the payload before
+// executing it and fail with ErrArchMismatch when it targets another machine
+// than the host, see CheckArch. Scripts and other non-ELF payloads are not
+// affected. It is opt-in since it costs a seek and a read per execution.
+func WithArchCheck() Option {
+	return func(c *config) {
+		c.archCheck = true
+	}
+}
+
+// WithSelfFDEnv passes the runnable's backing file to the child as an extra,
+// inherited descriptor and stores its number in the environment variable
+// varName, so the child can inspect or verify itself through
+// /proc/self/fd/$varName. The descriptor stays open across exec in the child
+// and in anything it executes in turn, and for memfds it is the writable
+// original: a child able to write to it changes what later executions of the
+// same runnable run. Only use it for payloads you trust with that.
+func WithSelfFDEnv(varName string) Option {
+	return func(c *config) {
+		c.selfFDEnv = varName
+	}
+}
@@ -0,0 +1,535 @@
+package emrun
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"pkt.systems/emrun/adapters/commandrunner"
+)
+
+type recordingWriter struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	return w.Buffer.Write(p)
+}
+
+func TestWithStdinBufferSize(t *testing.T) {
+	input := strings.Repeat("x", 100<<10)
+	cmd := exec.Command("true")
+	cmd.Stdin = strings.NewReader(input)
+	cfg := &config{}
+	WithStdinBufferSize(64 << 10)(cfg)
+	cleanup, err := cfg.prepare(context.Background(), cmd)
+	defer cleanup()
+	if err != nil {
+		t.Fatalf("prepare returned error: %v", err)
+	}
+	var w recordingWriter
+	if _, err := io.Copy(&w, cmd.Stdin); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if w.String() != input {
+		t.Fatal("stdin contents changed by buffering")
+	}
+	if len(w.writes) != 2 || w.writes[0] != 64<<10 {
+		t.Fatalf("unexpected write sizes: %v", w.writes)
+	}
+
+	cmd.Stdin = os.Stdin
+	if _, err := cfg.prepare(context.Background(), cmd); err != nil || cmd.Stdin != os.Stdin {
+		t.Fatalf("expected *os.File stdin to be left alone, got %T (%v)", cmd.Stdin, err)
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    []string
+		vars    map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "appends sorted",
+			base: []string{"PATH=/bin"},
+			vars: map[string]string{"B": "2", "A": "1"},
+			want: []string{"PATH=/bin", "A=1", "B=2"},
+		},
+		{
+			name: "replaces existing",
+			base: []string{"A=old", "PATH=/bin", "A=older"},
+			vars: map[string]string{"A": "new=value"},
+			want: []string{"PATH=/bin", "A=new=value"},
+		},
+		{
+			name:    "rejects equals in name",
+			base:    []string{},
+			vars:    map[string]string{"A=B": "1"},
+			wantErr: true,
+		},
+		{
+			name:    "rejects empty name",
+			base:    []string{},
+			vars:    map[string]string{"": "1"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := mergeEnv(tc.base, tc.vars)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mergeEnv returned error: %v", err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("mergeEnv() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWithComm(t *testing.T) {
+	ctx := WithOptions(context.Background(), WithComm("embedded-helper-tool"))
+	out, err := Run(ctx, []byte("#!/bin/sh\ncat /proc/$$/comm\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "embedded-helper\n" {
+		t.Fatalf("unexpected comm: %q", out)
+	}
+
+	// The trampoline execs the link after Start has returned.
+	out, err = Run(WithOptions(ctx, WithCloseInheritedFDs()), []byte("#!/bin/sh\ncat /proc/$$/comm\n"))
+	if err != nil || string(out) != "embedded-helper\n" {
+		t.Fatalf("Run with WithCloseInheritedFDs = %q, %v", out, err)
+	}
+
+	cmd := exec.Command("/bin/true")
+	release, err := newConfig([]Option{WithComm("tool")}).scratch(cmd)
+	if err != nil {
+		t.Fatalf("scratch returned error: %v", err)
+	}
+	if filepath.Base(cmd.Path) != "tool" {
+		t.Fatalf("expected the command to run through a link named tool, got %s", cmd.Path)
+	}
+	release()
+	if _, err := os.Lstat(filepath.Dir(cmd.Path)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the link directory to be removed, got %v", err)
+	}
+
+	if _, err := newConfig([]Option{WithComm("a/b")}).scratch(exec.Command("/bin/true")); err == nil {
+		t.Fatal("expected an error for a comm name with a slash")
+	}
+}
+
+func TestWithCleanArgv0(t *testing.T) {
+	sh, err := os.ReadFile("/bin/sh")
+	if err != nil {
+		t.Skipf("no /bin/sh to run as a payload: %v", err)
+	}
+	sum := sha256.Sum256(sh)
+	ctx := WithOptions(context.Background(), WithCleanArgv0())
+	out, err := Run(ctx, sh, "-c", "echo $0")
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if want := "emrun-" + hex.EncodeToString(sum[:])[:12] + "\n"; string(out) != want {
+		t.Fatalf("unexpected argv[0] %q, want %q", out, want)
+	}
+	out, err = Run(WithOptions(ctx, WithComm("mytool")), sh, "-c", "echo $0")
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "mytool\n" {
+		t.Fatalf("unexpected argv[0] %q", out)
+	}
+
+	r, err := Open(sh)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer r.Close()
+	cmd := exec.Command(r.Name(), "-c", "true")
+	unbind, err := BindCommand(ctx, r, cmd)
+	if err != nil {
+		t.Fatalf("BindCommand returned error: %v", err)
+	}
+	if cmd.Path != r.Name() || cmd.Args[0] == r.Name() || len(cmd.Args) != 3 {
+		t.Fatalf("unexpected bound command: %s %q", cmd.Path, cmd.Args)
+	}
+	unbind()
+	if cmd.Args[0] != r.Name() {
+		t.Fatalf("expected unbind to restore argv[0], got %q", cmd.Args[0])
+	}
+}
+
+func TestWithAuditName(t *testing.T) {
+	ctx := WithOptions(context.Background(), WithAuditName("audit-tool"))
+	out, err := Run(ctx, []byte("#!/bin/sh\necho \"$0\"\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	path := strings.TrimSpace(string(out))
+	if filepath.Base(path) != "audit-tool" || strings.HasPrefix(path, "/proc/") {
+		t.Fatalf("expected the payload to run as audit-tool, got %q", path)
+	}
+	if _, err := os.Stat(filepath.Dir(path)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the audit copy to be removed, got %v", err)
+	}
+
+	if _, err := Run(WithOptions(context.Background(), WithAuditName("a/b")), []byte("#!/bin/sh\n")); err == nil {
+		t.Fatal("expected an error for an audit name with a slash")
+	}
+	out, err = Run(WithOptions(ctx, WithCapabilities()), []byte("#!/bin/sh\necho \"$0\"\n"))
+	if err != nil || filepath.Base(strings.TrimSpace(string(out))) != "audit-tool" {
+		t.Fatalf("Run with WithCapabilities = %q, %v", out, err)
+	}
+}
+
+func TestWithMergeStderr(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho one\necho two >&2\necho three\necho four >&2\n")
+	var stdout, stderr bytes.Buffer
+	ctx := WithOptions(context.Background(), WithMergeStderr())
+	if err := RunIOE(ctx, nil, &stdout, &stderr, payload); err != nil {
+		t.Fatalf("RunIOE returned error: %v", err)
+	}
+	if stdout.String() != "one\ntwo\nthree\nfour\n" || stderr.Len() != 0 {
+		t.Fatalf("unexpected output: stdout %q, stderr %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestWithForceCombined(t *testing.T) {
+	newCmd := func(log *bytes.Buffer) *exec.Cmd {
+		cmd := exec.Command("/bin/sh", "-c", "echo out; echo err >&2")
+		cmd.Stdout = log
+		return cmd
+	}
+	var log bytes.Buffer
+	if _, err := RunCommandContext(context.Background(), commandrunner.Default, newCmd(&log), true); err == nil {
+		t.Fatal("expected combined capture with a configured stdout to fail without WithForceCombined")
+	}
+	ctx := WithOptions(context.Background(), WithForceCombined())
+	out, err := RunCommandContext(ctx, commandrunner.Default, newCmd(&log), true)
+	if err != nil {
+		t.Fatalf("RunCommandContext returned error: %v", err)
+	}
+	if string(out) != "out\nerr\n" && string(out) != "err\nout\n" {
+		t.Fatalf("unexpected combined output: %q", out)
+	}
+	if log.String() != "out\n" {
+		t.Fatalf("configured stdout did not receive its stream: %q", log.String())
+	}
+}
+
+func TestWithPrivateTmpdir(t *testing.T) {
+	ctx := WithOptions(context.Background(), WithPrivateTmpdir())
+	payload := []byte("#!/bin/sh\ntouch \"$TMPDIR/scratch\" && echo \"$TMPDIR\"\n")
+	first, err := Run(ctx, payload)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	second, err := Run(ctx, payload)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	dir := strings.TrimSpace(string(first))
+	if dir == "" || dir == os.TempDir() || dir == strings.TrimSpace(string(second)) {
+		t.Fatalf("expected a fresh private TMPDIR per run, got %q and %q", first, second)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected %s to be removed, got %v", dir, err)
+	}
+
+	bg, err := RunBG(ctx, []byte("#!/bin/sh\necho \"$TMPDIR\"\nexit 3\n"))
+	if err != nil {
+		t.Fatalf("RunBG returned error: %v", err)
+	}
+	res := bg.Wait()
+	if res.ExitCode != 3 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	dir = strings.TrimSpace(string(res.CombinedOutput))
+	if _, err := os.Stat(dir); dir == "" || !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the background run's TMPDIR %q to be removed, got %v", dir, err)
+	}
+}
+
+func TestWithOutputFiles(t *testing.T) {
+	dir := t.TempDir()
+	stdout, stderr := filepath.Join(dir, "out.log"), filepath.Join(dir, "err.log")
+	if err := os.WriteFile(stdout, []byte("earlier\n"), 0o600); err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+	ctx := WithOptions(context.Background(), WithStdoutFile(stdout), WithStderrFile(stderr))
+	bg, err := RunBG(ctx, []byte("#!/bin/sh\necho out\necho err >&2\n"))
+	if err != nil {
+		t.Fatalf("RunBG returned error: %v", err)
+	}
+	if res := bg.Wait(); res.Error != nil || len(res.CombinedOutput) != 0 {
+		t.Fatalf("unexpected result: %v, output %q", res.Error, res.CombinedOutput)
+	}
+	for path, want := range map[string]string{stdout: "earlier\nout\n", stderr: "err\n"} {
+		if data, err := os.ReadFile(path); err != nil || string(data) != want {
+			t.Fatalf("%s: got %q, %v; want %q", path, data, err, want)
+		}
+	}
+
+	out, err := Run(WithOptions(context.Background(), WithStdoutFile(stdout)), []byte("#!/bin/sh\necho again\necho captured >&2\n"))
+	if err != nil || string(out) != "captured\n" {
+		t.Fatalf("expected Run to capture only stderr, got %q, %v", out, err)
+	}
+
+	marker := filepath.Join(dir, "started")
+	missing := WithOptions(context.Background(), WithStderrFile(filepath.Join(dir, "missing", "err.log")))
+	if _, err := Run(missing, []byte("#!/bin/sh\ntouch "+marker+"\n")); err == nil {
+		t.Fatal("expected an error for an unopenable stderr file")
+	}
+	if _, err := os.Stat(marker); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the child not to be started, got %v", err)
+	}
+}
+
+func TestWithStdinFD(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "input")
+	if err := os.WriteFile(name, []byte("from descriptor\n"), 0o600); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	in, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("open input: %v", err)
+	}
+	defer in.Close()
+	ctx := WithOptions(context.Background(), WithStdinFD(int(in.Fd())))
+	out, err := Run(ctx, []byte("#!/bin/sh\ncat\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "from descriptor\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("expected the caller's descriptor to stay open, got %v", err)
+	}
+
+	if _, err := Run(WithOptions(context.Background(), WithStdinFD(-1)), []byte("#!/bin/sh\ncat\n")); err == nil {
+		t.Fatal("expected an error for an invalid descriptor")
+	}
+}
+
+func TestWithFIFOs(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	for _, fifo := range []string{in, out} {
+		if err := syscall.Mkfifo(fifo, 0o600); err != nil {
+			t.Fatalf("mkfifo: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		w, err := os.OpenFile(in, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer w.Close()
+		io.WriteString(w, "through fifos\n")
+	}()
+	received := make(chan string, 1)
+	go func() {
+		r, err := os.Open(out)
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer r.Close()
+		data, _ := io.ReadAll(r)
+		received <- string(data)
+	}()
+	fifoCtx := WithOptions(ctx, WithStdinFIFO(in), WithStdoutFIFO(out))
+	if err := RunIO(fifoCtx, nil, nil, []byte("#!/bin/sh\ntr a-z A-Z\n")); err != nil {
+		t.Fatalf("RunIO returned error: %v", err)
+	}
+	if got := <-received; got != "THROUGH FIFOS\n" {
+		t.Fatalf("unexpected output: %q", got)
+	}
+
+	waiting, cancelWaiting := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelWaiting()
+	err := RunIO(WithOptions(waiting, WithStdinFIFO(in)), nil, nil, []byte("#!/bin/sh\ncat\n"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected giving up on a FIFO without writer, got %v", err)
+	}
+
+	if err := RunIO(WithOptions(ctx, WithStdinFIFO(filepath.Join(dir, "missing"))), nil, nil, []byte("#!/bin/sh\n")); err == nil {
+		t.Fatal("expected an error for a missing FIFO")
+	}
+}
+
+func TestOpenFIFOCancelledBeforeOpening(t *testing.T) {
+	fifo := filepath.Join(t.TempDir(), "fifo")
+	if err := syscall.Mkfifo(fifo, 0o600); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	// With ctx already done, the goroutine opening the FIFO usually has not
+	// reached open(2) when the other end is first opened.
+	for i := 0; i < 20; i++ {
+		for _, flag := range []int{os.O_RDONLY, os.O_WRONLY} {
+			done := make(chan error, 1)
+			go func() {
+				_, err := openFIFO(cancelled, fifo, flag)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Fatalf("openFIFO with flag %d = %v, want context.Canceled", flag, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("openFIFO with flag %d hangs after cancellation", flag)
+			}
+		}
+	}
+}
+
+func TestWithForegroundWithoutTerminal(t *testing.T) {
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		tty.Close()
+		t.Skip("test needs to run without a controlling terminal")
+	}
+	marker := filepath.Join(t.TempDir(), "started")
+	ctx := WithOptions(context.Background(), WithForeground())
+	if _, err := Run(ctx, []byte("#!/bin/sh\ntouch "+marker+"\n")); err == nil {
+		t.Fatal("expected an error without a controlling terminal")
+	}
+	if _, err := os.Stat(marker); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the payload not to start, got %v", err)
+	}
+}
+
+type recorderFunc func(Record)
+
+func (f recorderFunc) Record(rec Record) { f(rec) }
+
+func TestWithRecorder(t *testing.T) {
+	payload := []byte("#!/bin/sh\nread line\necho \"in:$line $EMRUN_REC\"\necho err >&2\n")
+	var got []Record
+	ctx := WithOptions(context.Background(), WithRecorder(recorderFunc(func(rec Record) {
+		got = append(got, rec)
+	})), WithEnvMap(map[string]string{"EMRUN_REC": "set"}))
+	var out bytes.Buffer
+	if err := RunIO(ctx, strings.NewReader("hello\n"), &out, payload, "arg"); err != nil {
+		t.Fatalf("RunIO returned error: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected one record, got %d", len(got))
+	}
+	rec := got[0]
+	sum := sha256.Sum256(payload)
+	if rec.Digest != hex.EncodeToString(sum[:]) || !slices.Equal(rec.Args, []string{"arg"}) {
+		t.Fatalf("unexpected digest %s or args %q", rec.Digest, rec.Args)
+	}
+	if string(rec.Stdin) != "hello\n" || string(rec.Output) != "in:hello set\nerr\n" || rec.ExitCode != 0 {
+		t.Fatalf("unexpected stdin %q, output %q or exit code %d", rec.Stdin, rec.Output, rec.ExitCode)
+	}
+	if !slices.Contains(rec.Env, "EMRUN_REC=set") {
+		t.Fatal("environment not recorded")
+	}
+	if out.String() != "in:hello set\nerr\n" {
+		t.Fatalf("recording changed the output: %q", out.String())
+	}
+
+	// A file stays the child's stdout rather than becoming a pipe, and the
+	// trampoline does not replace the payload's digest with its own.
+	file, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	got = nil
+	payload = []byte("#!/bin/sh\n[ -f /dev/stdout ] && echo file\n")
+	if err := RunIO(WithOptions(ctx, WithCloseInheritedFDs()), nil, file, payload); err != nil {
+		t.Fatalf("RunIO returned error: %v", err)
+	}
+	if data, _ := os.ReadFile(file.Name()); string(data) != "file\n" {
+		t.Fatalf("stdout was not the file itself: %q", data)
+	}
+	sum = sha256.Sum256(payload)
+	if len(got) != 1 || got[0].Digest != hex.EncodeToString(sum[:]) || len(got[0].Output) != 0 {
+		t.Fatalf("unexpected records %+v", got)
+	}
+}
+
+func TestWithRecorderKeepsRetries(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var got []Record
+	inner := &busyOnceRunner{}
+	ctx = WithRunner(ctx, &commandrunner.RetryRunner{Runner: inner})
+	ctx = WithOptions(ctx, WithRecorder(recorderFunc(func(rec Record) {
+		got = append(got, rec)
+	})))
+	payload := []byte("#!/bin/sh\necho retried\n")
+	out, err := Run(ctx, payload)
+	if err != nil || string(out) != "retried\n" || inner.starts != 2 {
+		t.Fatalf("Run = %q, %v after %d starts, want the retried clone to run", out, err, inner.starts)
+	}
+	sum := sha256.Sum256(payload)
+	if len(got) != 1 || string(got[0].Output) != "retried\n" || got[0].Digest != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected records %+v", got)
+	}
+}
+
+func TestWithInheritStdio(t *testing.T) {
+	stdout, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	orig := os.Stdout
+	os.Stdout = stdout
+	defer func() { os.Stdout = orig }()
+
+	ctx := WithOptions(context.Background(), WithInheritStdio())
+	out, err := Run(ctx, []byte("#!/bin/sh\necho inherited\n"))
+	os.Stdout = orig
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("Run captured inherited output: %q", out)
+	}
+	if data, _ := os.ReadFile(stdout.Name()); string(data) != "inherited\n" {
+		t.Fatalf("unexpected output on the parent's stdout: %q", data)
+	}
+	var buf bytes.Buffer
+	if err := RunIO(ctx, nil, &buf, []byte("#!/bin/sh\necho explicit\n")); err != nil || buf.String() != "explicit\n" {
+		t.Fatalf("RunIO = %q, %v; want the explicit writer kept", buf.String(), err)
+	}
+	if _, err := Run(WithOptions(ctx, WithForceCombined()), []byte("#!/bin/sh\ntrue\n")); err == nil {
+		t.Fatal("expected an error combining WithInheritStdio with WithForceCombined")
+	}
+}
@@ -0,0 +1,148 @@
+package emrun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"pkt.systems/emrun/port"
+)
+
+// Stage is one command of a pipeline: a payload and its arguments.
+type Stage struct {
+	Payload []byte
+	Args    []string
+}
+
+// PipelineError reports the pipeline stage, by index, that failed first.
+type PipelineError struct {
+	Stage int
+	Err   error
+}
+
+func (e *PipelineError) Error() string {
+	return fmt.Sprintf("emrun: pipeline stage %d: %v", e.Stage, e.Err)
+}
+
+func (e *PipelineError) Unwrap() error {
+	return e.Err
+}
+
+// RunPipeline is the engine behind the Pipeline helpers of emrun and efrun. It
+// runs the opened runnables concurrently, each with args of the same index,
+// connecting the stdout of every stage to the stdin of the next through an
+// os.Pipe, and returns the combined output of the last stage. The stderr of
+// earlier stages is discarded. The first stage to fail cancels the others and
+// is reported as *PipelineError; a stage killed by SIGPIPE because a later
+// stage stopped reading does not count as failed, like in a shell. Under
+// SetMaxConcurrentExecs the execution slots of all stages are taken at once
+// before the first stage starts. The runnables are not closed.
+func RunPipeline(ctx context.Context, runnables []port.BackgroundRunnable, args [][]string) ([]byte, error) {
+	if len(runnables) == 0 {
+		return nil, errors.New("emrun: empty pipeline")
+	}
+	if len(args) != len(runnables) {
+		return nil, fmt.Errorf("emrun: %d argument lists for %d pipeline stages", len(args), len(runnables))
+	}
+	ctx, release, err := reserveExecs(ctx, len(runnables))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type process struct {
+		cmd     *exec.Cmd
+		capture port.CommandCapture
+	}
+	var out bytes.Buffer
+	procs := make([]process, 0, len(runnables))
+	abort := func(stage int, err error) ([]byte, error) {
+		cancel()
+		for _, p := range procs {
+			WaitCommand(p.cmd, p.capture)
+		}
+		return nil, &PipelineError{Stage: stage, Err: err}
+	}
+	// stdin is the read end of the pipe feeding the next stage.
+	var stdin *os.File
+	for i, run := range runnables {
+		cmd := exec.CommandContext(ctx, run.Name(), args[i]...)
+		if stdin != nil {
+			cmd.Stdin = stdin
+		}
+		var next, w *os.File
+		if i < len(runnables)-1 {
+			var err error
+			if next, w, err = os.Pipe(); err != nil {
+				if stdin != nil {
+					stdin.Close()
+				}
+				return abort(i, err)
+			}
+			cmd.Stdout = w
+		} else {
+			cmd.Stdout = &out
+			cmd.Stderr = &out
+		}
+		started, capture, err := run.StartBackground(ctx, cmd, false)
+		// The children hold their own copies of the pipe ends; the parent's
+		// would keep readers from seeing EOF.
+		if stdin != nil {
+			stdin.Close()
+		}
+		if w != nil {
+			w.Close()
+		}
+		if err != nil {
+			if next != nil {
+				next.Close()
+			}
+			return abort(i, err)
+		}
+		procs = append(procs, process{cmd: started, capture: capture})
+		stdin = next
+	}
+	var (
+		mu       sync.Mutex
+		failed   = -1
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for i, p := range procs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := WaitCommand(p.cmd, p.capture)
+			if res.Error == nil || killedBy(res.ProcessState, syscall.SIGPIPE) {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if failed < 0 {
+				failed, firstErr = i, res.Error
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	if failed >= 0 {
+		return out.Bytes(), &PipelineError{Stage: failed, Err: firstErr}
+	}
+	return out.Bytes(), nil
+}
+
+// killedBy reports whether the process described by state was terminated by
+// signal.
+func killedBy(state *os.ProcessState, signal syscall.Signal) bool {
+	if state == nil {
+		return false
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == signal
+}
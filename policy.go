@@ -1,35 +1,67 @@
 package emrun
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"os/exec"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
+
+	"pkt.systems/emrun/port"
 )
 
 type Verdict int
 
 const (
+	// ALLOW lets a payload run. Allowing by digest trusts exactly the bytes
+	// hashed; allowing by build ID or interpreter trusts whatever claims it.
 	ALLOW Verdict = iota
 	DENY
+	// QUARANTINE allows a payload to run, but only inside the sandbox of
+	// WithQuarantine, whatever the other options say.
+	QUARANTINE
 )
 
 type Digest any
 
 var ErrDenied = errors.New("emrun: execution denied by policy")
 
+// PolicyError reports a payload rejected by the context policy. ByDefault is
+// true when no explicit rule matched the digest and the denial came from the
+// default verdict set with WithPolicy, i.e. the digest was never allow-listed
+// rather than explicitly denied. Interpreter is set when the denial came from
+// a WithInterpreterRule entry for the script's interpreter, BuildID when it
+// came from a WithBuildIDRule entry. A Verdict of QUARANTINE is reported where
+// a quarantined payload cannot be sandboxed, such as by CheckPolicy, and
+// still matches ErrDenied.
 type PolicyError struct {
-	Verdict Verdict
-	Digest  string
+	Verdict     Verdict
+	Digest      string
+	ByDefault   bool
+	Interpreter string
+	BuildID     string
 }
 
 func (e *PolicyError) Error() string {
 	if e == nil {
 		return "<nil>"
 	}
+	if e.BuildID != "" {
+		return fmt.Sprintf("emrun: %s build ID %s (digest %s)", e.Verdict.String(), e.BuildID, e.Digest)
+	}
+	if e.Interpreter != "" {
+		return fmt.Sprintf("emrun: %s interpreter %s (digest %s)", e.Verdict.String(), e.Interpreter, e.Digest)
+	}
+	if e.ByDefault {
+		return fmt.Sprintf("emrun: %s digest %s (default verdict)", e.Verdict.String(), e.Digest)
+	}
 	return fmt.Sprintf("emrun: %s digest %s", e.Verdict.String(), e.Digest)
 }
 
@@ -43,17 +75,143 @@ func (v Verdict) String() string {
 		return "allow"
 	case DENY:
 		return "deny"
+	case QUARANTINE:
+		return "quarantine"
 	default:
 		return fmt.Sprintf("verdict(%d)", v)
 	}
 }
 
+// Policy is a plain-value description of an execution policy: the default
+// verdict and the explicitly allowed, denied and quarantined SHA-256 digests.
+type Policy struct {
+	Default    Verdict
+	Allow      [][32]byte
+	Deny       [][32]byte
+	Quarantine [][32]byte
+}
+
+// Diff reports how other differs from p, e.g. after reloading a policy:
+// digests allowed or denied in other but not in p are added, those only in p
+// are removed. Each slice is sorted bytewise and free of duplicates.
+// defaultChanged is true when the default verdicts differ. Quarantined
+// digests are not compared; diff the Quarantine fields with slices.Equal.
+func (p Policy) Diff(other Policy) (addedAllow, removedAllow, addedDeny, removedDeny [][32]byte, defaultChanged bool) {
+	addedAllow, removedAllow = diffDigests(p.Allow, other.Allow)
+	addedDeny, removedDeny = diffDigests(p.Deny, other.Deny)
+	return addedAllow, removedAllow, addedDeny, removedDeny, p.Default != other.Default
+}
+
+// ErrPolicyConflict is reported by Policy.Validate and Policy.Apply when a
+// digest has more than one of the verdicts allowed, denied and quarantined.
+var ErrPolicyConflict = errors.New("emrun: digest has conflicting verdicts")
+
+// Validate checks that p can be applied: its default verdict is ALLOW, DENY
+// or QUARANTINE and no digest appears in more than one of Allow, Deny and
+// Quarantine. WithRule keeps the sets apart, but a Policy assembled by hand or
+// decoded from configuration may not, and an overlap is almost always a
+// mistake. The first conflicting digest in bytewise order is reported wrapped
+// in ErrPolicyConflict.
+func (p Policy) Validate() error {
+	if p.Default != ALLOW && p.Default != DENY && p.Default != QUARANTINE {
+		return fmt.Errorf("unsupported verdict %d", p.Default)
+	}
+	seen := make(map[[32]byte]struct{}, len(p.Allow)+len(p.Quarantine))
+	for _, digest := range p.Allow {
+		seen[digest] = struct{}{}
+	}
+	var conflicts [][32]byte
+	for _, set := range [][][32]byte{p.Quarantine, p.Deny} {
+		for _, digest := range set {
+			if _, ok := seen[digest]; ok {
+				conflicts = append(conflicts, digest)
+			}
+		}
+		for _, digest := range set {
+			seen[digest] = struct{}{}
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%w: %x", ErrPolicyConflict, slices.MinFunc(conflicts, compareDigests))
+	}
+	return nil
+}
+
+// Apply returns a derived context enforcing p in place of the default verdict
+// and digest rules of ctx, the inverse of PolicySnapshot. Interpreter and
+// build ID rules set with WithInterpreterRule and WithBuildIDRule are kept. p
+// is validated first and the context is returned unchanged with the error if
+// it is invalid. Should overlapping sets reach the runtime policy some other
+// way, deny still wins, followed by quarantine.
+//
+//	ctx, err := policy.Apply(ctx)
+func (p Policy) Apply(ctx context.Context) (context.Context, error) {
+	if err := p.Validate(); err != nil {
+		return ctx, err
+	}
+	policy := policyFromContext(ctx).clone()
+	policy.defaultVerdict = p.Default
+	policy.allow = make(map[[32]byte]struct{}, len(p.Allow))
+	for _, digest := range p.Allow {
+		policy.allow[digest] = struct{}{}
+	}
+	policy.deny = make(map[[32]byte]struct{}, len(p.Deny))
+	for _, digest := range p.Deny {
+		policy.deny[digest] = struct{}{}
+	}
+	policy.quarantine = nil
+	if len(p.Quarantine) > 0 {
+		policy.quarantine = make(map[[32]byte]struct{}, len(p.Quarantine))
+		for _, digest := range p.Quarantine {
+			policy.quarantine[digest] = struct{}{}
+		}
+	}
+	return context.WithValue(ctx, policyKey{}, policy), nil
+}
+
+// diffDigests returns the sorted digests only in next (added) and only in prev
+// (removed).
+func diffDigests(prev, next [][32]byte) (added, removed [][32]byte) {
+	prevSet := make(map[[32]byte]struct{}, len(prev))
+	for _, digest := range prev {
+		prevSet[digest] = struct{}{}
+	}
+	nextSet := make(map[[32]byte]struct{}, len(next))
+	for _, digest := range next {
+		nextSet[digest] = struct{}{}
+	}
+	for digest := range nextSet {
+		if _, ok := prevSet[digest]; !ok {
+			added = append(added, digest)
+		}
+	}
+	for digest := range prevSet {
+		if _, ok := nextSet[digest]; !ok {
+			removed = append(removed, digest)
+		}
+	}
+	slices.SortFunc(added, compareDigests)
+	slices.SortFunc(removed, compareDigests)
+	return added, removed
+}
+
+func compareDigests(a, b [32]byte) int {
+	return bytes.Compare(a[:], b[:])
+}
+
 type policyKey struct{}
 
+// executionPolicy is the policy stored in a context. It is copy-on-write: an
+// executionPolicy and its maps are never mutated once stored with
+// context.WithValue, WithPolicy and WithRule modify a clone, so any number of
+// goroutines may evaluate it and derive contexts from it concurrently.
 type executionPolicy struct {
 	defaultVerdict Verdict
 	allow          map[[32]byte]struct{}
 	deny           map[[32]byte]struct{}
+	quarantine     map[[32]byte]struct{}
+	interpreters   map[string]Verdict
+	buildIDs       map[string]Verdict
 }
 
 func newExecutionPolicy() *executionPolicy {
@@ -87,6 +245,15 @@ func (p *executionPolicy) clone() *executionPolicy {
 	} else {
 		clone.deny = make(map[[32]byte]struct{})
 	}
+	if len(p.quarantine) > 0 {
+		clone.quarantine = maps.Clone(p.quarantine)
+	}
+	if len(p.interpreters) > 0 {
+		clone.interpreters = maps.Clone(p.interpreters)
+	}
+	if len(p.buildIDs) > 0 {
+		clone.buildIDs = maps.Clone(p.buildIDs)
+	}
 	return clone
 }
 
@@ -100,8 +267,36 @@ func policyFromContext(ctx context.Context) *executionPolicy {
 	return nil
 }
 
+// PolicySnapshot returns the policy carried by ctx as a Policy value whose
+// Allow, Deny and Quarantine slices are sorted bytewise and owned by the
+// caller, so it can be shared, compared with Diff or logged without affecting
+// ctx. A context without policy yields the zero Policy, whose default verdict
+// is ALLOW.
+func PolicySnapshot(ctx context.Context) Policy {
+	policy := policyFromContext(ctx)
+	if policy == nil {
+		return Policy{Default: ALLOW}
+	}
+	snapshot := Policy{Default: policy.defaultVerdict}
+	for digest := range policy.allow {
+		snapshot.Allow = append(snapshot.Allow, digest)
+	}
+	for digest := range policy.deny {
+		snapshot.Deny = append(snapshot.Deny, digest)
+	}
+	for digest := range policy.quarantine {
+		snapshot.Quarantine = append(snapshot.Quarantine, digest)
+	}
+	slices.SortFunc(snapshot.Allow, compareDigests)
+	slices.SortFunc(snapshot.Deny, compareDigests)
+	slices.SortFunc(snapshot.Quarantine, compareDigests)
+	return snapshot
+}
+
 // WithPolicy returns a derived context that sets the default verdict consulted
-// when no explicit allow/deny rule matches a payload digest.
+// when no explicit allow/deny rule matches a payload digest. A QUARANTINE
+// default runs every payload not explicitly allowed in the WithQuarantine
+// sandbox.
 //
 //	ctx := emrun.WithPolicy(context.Background(), emrun.DENY)
 //	ctx = emrun.WithRule(ctx, emrun.ALLOW, sha256FileBytes)
@@ -119,8 +314,11 @@ func WithPolicy(ctx context.Context, verdict Verdict) context.Context {
 
 // WithRule returns a derived context containing explicit allow/deny entries for
 // SHA-256 digests. Each argument may be a raw digest type (string, []byte,
-// [32]byte) or sha256sum-formatted content; filenames are ignored. WithRule must
-// succeed - invalid input causes a panic.
+// [32]byte) or sha256sum-formatted content; filenames are ignored. Entries of
+// mixed manifests for other algorithms, such as "sha512:<hex>", are skipped,
+// but content listing no SHA-256 digest at all is invalid. WithRule must
+// succeed - invalid input causes a panic. A QUARANTINE rule lets the digests
+// run, but only in the WithQuarantine sandbox.
 //
 //	ctx := emrun.WithPolicy(ctx, emrun.DENY)
 //	ctx = emrun.WithRule(ctx, emrun.ALLOW, []byte("<digest>  tool"))
@@ -155,9 +353,18 @@ func WithRuleCatchError(ctx context.Context, rule Verdict, sha256Digests ...Dige
 		case ALLOW:
 			policy.allow[digest] = struct{}{}
 			delete(policy.deny, digest)
+			delete(policy.quarantine, digest)
 		case DENY:
 			policy.deny[digest] = struct{}{}
 			delete(policy.allow, digest)
+			delete(policy.quarantine, digest)
+		case QUARANTINE:
+			if policy.quarantine == nil {
+				policy.quarantine = make(map[[32]byte]struct{})
+			}
+			policy.quarantine[digest] = struct{}{}
+			delete(policy.allow, digest)
+			delete(policy.deny, digest)
 		default:
 			return ctx, fmt.Errorf("unsupported verdict %d", rule)
 		}
@@ -165,6 +372,67 @@ func WithRuleCatchError(ctx context.Context, rule Verdict, sha256Digests ...Dige
 	return context.WithValue(ctx, policyKey{}, policy), nil
 }
 
+// WithInterpreterRule returns a derived context that allows or denies shebang
+// scripts by the interpreter named on their #! line, as parsed by
+// ShebangInterpreter, and Shell scripts by the shell running them. Digest
+// rules take precedence, so an explicitly denied script stays denied under an
+// allowed interpreter. Payloads without an interpreter, such as ELF binaries,
+// are not affected and fall through to the default verdict. An unsupported
+// verdict causes a panic.
+//
+//	ctx := emrun.WithPolicy(ctx, emrun.DENY)
+//	ctx = emrun.WithInterpreterRule(ctx, emrun.ALLOW, "/bin/sh")
+func WithInterpreterRule(ctx context.Context, rule Verdict, interpreters ...string) context.Context {
+	if rule != ALLOW && rule != DENY {
+		panic(fmt.Errorf("unsupported verdict %d", rule))
+	}
+	if len(interpreters) == 0 {
+		return ctx
+	}
+	policy := policyFromContext(ctx).clone()
+	if policy.interpreters == nil {
+		policy.interpreters = make(map[string]Verdict, len(interpreters))
+	}
+	for _, interpreter := range interpreters {
+		policy.interpreters[interpreter] = rule
+	}
+	return context.WithValue(ctx, policyKey{}, policy)
+}
+
+// WithBuildIDRule returns a derived context that allows or denies ELF payloads
+// by their GNU build ID, as returned by BuildID, instead of by content hash.
+// IDs are hex strings and matched case-insensitively. A build ID identifies a
+// binary across stripping and re-signing, which change its SHA-256 digest, so
+// an allow rule trusts everything carrying the ID: use it for builds from a
+// pipeline you control. Digest rules take precedence, and build ID rules take
+// precedence over interpreter rules. A build ID is not a security boundary:
+// anyone building a binary can give it any ID, so an allow rule is only as
+// strong as the control over what gets executed. Payloads without a build ID,
+// such as scripts, are not affected. An unsupported verdict or an ID that is
+// not hex causes a panic.
+//
+//	ctx := emrun.WithPolicy(ctx, emrun.DENY)
+//	ctx = emrun.WithBuildIDRule(ctx, emrun.ALLOW, "3f2a...c01d")
+func WithBuildIDRule(ctx context.Context, rule Verdict, ids ...string) context.Context {
+	if rule != ALLOW && rule != DENY {
+		panic(fmt.Errorf("unsupported verdict %d", rule))
+	}
+	if len(ids) == 0 {
+		return ctx
+	}
+	policy := policyFromContext(ctx).clone()
+	if policy.buildIDs == nil {
+		policy.buildIDs = make(map[string]Verdict, len(ids))
+	}
+	for _, id := range ids {
+		if !isHexString(id) || len(id)%2 != 0 {
+			panic(fmt.Errorf("invalid build ID %q", id))
+		}
+		policy.buildIDs[strings.ToLower(id)] = rule
+	}
+	return context.WithValue(ctx, policyKey{}, policy)
+}
+
 func collectDigests(values ...Digest) ([][32]byte, error) {
 	var result [][32]byte
 	for _, v := range values {
@@ -236,6 +504,11 @@ func digestsFromBytes(data []byte) ([][32]byte, error) {
 	}
 }
 
+// parallelDigestLines is the number of lines from which digestsFromString
+// spreads checksum lines over several workers. Below it the goroutine and
+// merge overhead outweighs the decode time (see BenchmarkDigestsFromString).
+const parallelDigestLines = 4096
+
 func digestsFromString(value string) ([][32]byte, error) {
 	trimmed := strings.TrimSpace(value)
 	if trimmed == "" {
@@ -244,32 +517,115 @@ func digestsFromString(value string) ([][32]byte, error) {
 	if !strings.ContainsAny(trimmed, " \t\n\r") && len(trimmed) == 64 && isHexString(trimmed) {
 		return decodeSingleDigest(trimmed)
 	}
-	scanner := bufio.NewScanner(strings.NewReader(value))
-	var digests [][32]byte
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+	lines := strings.Split(value, "\n")
+	var (
+		digests [][32]byte
+		skipped int
+		err     error
+	)
+	workers := runtime.GOMAXPROCS(0)
+	if len(lines) < parallelDigestLines || workers < 2 {
+		digests, skipped, err = digestsFromLines(lines, 1)
+	} else {
+		digests, skipped, err = digestsFromLinesParallel(lines, workers)
+	}
+	if err == nil && len(digests) == 0 && skipped > 0 {
+		// Accepting it would turn a rule into no rule at all.
+		return nil, fmt.Errorf("no sha256 digests, only %d of other algorithms", skipped)
+	}
+	return digests, err
+}
+
+// digestsFromLinesParallel splits lines into one contiguous chunk per worker
+// and concatenates the results in input order. When several chunks fail, the
+// error of the earliest chunk is returned so the reported line number is the
+// same as for a serial parse.
+func digestsFromLinesParallel(lines []string, workers int) ([][32]byte, int, error) {
+	chunk := (len(lines) + workers - 1) / workers
+	type part struct {
+		digests [][32]byte
+		skipped int
+		err     error
+	}
+	parts := make([]part, (len(lines)+chunk-1)/chunk)
+	var wg sync.WaitGroup
+	for i := range parts {
+		lo := i * chunk
+		hi := min(lo+chunk, len(lines))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			digests, skipped, err := digestsFromLines(lines[lo:hi], lo+1)
+			parts[i] = part{digests: digests, skipped: skipped, err: err}
+		}()
+	}
+	wg.Wait()
+	total, skipped := 0, 0
+	for _, p := range parts {
+		if p.err != nil {
+			return nil, 0, p.err
+		}
+		total += len(p.digests)
+		skipped += p.skipped
+	}
+	digests := make([][32]byte, 0, total)
+	for _, p := range parts {
+		digests = append(digests, p.digests...)
+	}
+	return digests, skipped, nil
+}
+
+// digestsFromLines decodes the leading sha256 digest of every non-empty,
+// non-comment line. A digest may carry an algorithm prefix as written by
+// supply-chain tools, "sha256:<hex>". Policies only hold SHA-256 digests, so
+// the entries of mixed manifests for other algorithms, such as
+// "sha512:<hex>", are checked to be hex and skipped; skipped counts them.
+// first is the line number of lines[0] and is used in error messages.
+func digestsFromLines(lines []string, first int) (digests [][32]byte, skipped int, err error) {
+	for i, raw := range lines {
+		line := strings.TrimSpace(raw)
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
+		if algorithm, rest, ok := strings.Cut(line, ":"); ok && isAlgorithmName(algorithm) {
+			if algorithm != "sha256" {
+				if other, _, _ := strings.Cut(rest, " "); !isHexString(other) {
+					return nil, 0, fmt.Errorf("line %d: invalid %s digest: %q", first+i, algorithm, other)
+				}
+				skipped++
+				continue
+			}
+			line = rest
+		}
 		if len(line) < 64 {
-			return nil, fmt.Errorf("line shorter than sha256 digest: %q", line)
+			return nil, 0, fmt.Errorf("line %d: line shorter than sha256 digest: %q", first+i, line)
 		}
 		candidate := line[:64]
 		if !isHexString(candidate) {
-			return nil, fmt.Errorf("invalid sha256 digest: %q", candidate)
-		}
-		digestBytes, err := hex.DecodeString(candidate)
-		if err != nil {
-			return nil, fmt.Errorf("decode sha256 digest: %w", err)
+			return nil, 0, fmt.Errorf("line %d: invalid sha256 digest: %q", first+i, candidate)
 		}
 		var digest [32]byte
-		copy(digest[:], digestBytes)
+		if _, err := hex.Decode(digest[:], []byte(candidate)); err != nil {
+			return nil, 0, fmt.Errorf("line %d: decode sha256 digest: %w", first+i, err)
+		}
 		digests = append(digests, digest)
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	return digests, skipped, nil
+}
+
+// isAlgorithmName reports whether s looks like the algorithm prefix of a
+// digest, such as sha256 or sha512, as opposed to the start of a bare hex
+// digest followed by a file name containing a colon.
+func isAlgorithmName(s string) bool {
+	if s == "" || len(s) > 16 || s[0] < 'a' || s[0] > 'z' {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
 	}
-	return digests, nil
+	return true
 }
 
 func decodeSingleDigest(hexDigest string) ([][32]byte, error) {
@@ -299,7 +655,9 @@ func isHexString(value string) bool {
 }
 
 // CheckPolicy inspects the context policy and returns ErrDenied if the digest
-// violates the configured rules.
+// violates the configured rules. Quarantined digests are reported as denied
+// too, as a *PolicyError with the QUARANTINE verdict, since CheckPolicy cannot
+// sandbox what the caller runs; see WithQuarantine.
 //
 //	ctx := emrun.WithRule(context.Background(), emrun.DENY, "deadbeef...")
 //	digest := sha256.Sum256(payload)
@@ -307,33 +665,113 @@ func isHexString(value string) bool {
 //		return err
 //	}
 func CheckPolicy(ctx context.Context, digest [32]byte, hexDigest string) error {
-	return enforcePolicy(ctx, digest, hexDigest)
+	return enforcePolicy(ctx, digest, hexDigest, "", "", false)
 }
 
-func enforcePolicy(ctx context.Context, digest [32]byte, hexDigest string) error {
+// policyRule names the kind of rule a verdict came from.
+type policyRule int
+
+const (
+	ruleDefault policyRule = iota
+	ruleDigest
+	ruleBuildID
+	ruleInterpreter
+)
+
+// enforcePolicy applies the context policy to digest and, when known, the
+// payload's build ID and, for scripts, its interpreter. A trusted payload (see
+// WithTrustedSource) is exempt from the default verdict but not from explicit
+// deny rules. A quarantined payload is reported as a *PolicyError with the
+// QUARANTINE verdict, which callers able to sandbox it turn into a run with
+// WithQuarantine, see quarantined.
+func enforcePolicy(ctx context.Context, digest [32]byte, hexDigest, buildID, interpreter string, trusted bool) error {
 	policy := policyFromContext(ctx)
 	if policy == nil {
 		return nil
 	}
-	switch policy.evaluate(digest) {
-	case ALLOW:
+	verdict, rule := policy.evaluate(digest, buildID, interpreter)
+	switch {
+	case verdict == ALLOW:
 		return nil
-	case DENY:
-		return &PolicyError{Verdict: DENY, Digest: hexDigest}
-	default:
+	case rule == ruleDefault && trusted:
 		return nil
+	case verdict == QUARANTINE:
+		return &PolicyError{Verdict: QUARANTINE, Digest: hexDigest, ByDefault: rule == ruleDefault}
+	default:
+		metrics.policyDenials.Add(1)
+		err := &PolicyError{Verdict: DENY, Digest: hexDigest, ByDefault: rule == ruleDefault}
+		switch rule {
+		case ruleBuildID:
+			err.BuildID = buildID
+		case ruleInterpreter:
+			err.Interpreter = interpreter
+		}
+		return err
 	}
 }
 
-func (p *executionPolicy) evaluate(digest [32]byte) Verdict {
+// evaluate returns the verdict for digest, buildID and interpreter and the
+// kind of rule it came from. Digest rules win over build ID rules, which win
+// over interpreter rules; the default verdict applies when none matches.
+// Among digest rules deny wins over quarantine, which wins over allow.
+func (p *executionPolicy) evaluate(digest [32]byte, buildID, interpreter string) (Verdict, policyRule) {
 	if p == nil {
-		return ALLOW
+		return ALLOW, ruleDefault
 	}
 	if _, denied := p.deny[digest]; denied {
-		return DENY
+		return DENY, ruleDigest
+	}
+	if _, quarantined := p.quarantine[digest]; quarantined {
+		return QUARANTINE, ruleDigest
 	}
 	if _, allowed := p.allow[digest]; allowed {
-		return ALLOW
+		return ALLOW, ruleDigest
+	}
+	if verdict, ok := p.buildIDs[buildID]; ok && buildID != "" {
+		return verdict, ruleBuildID
 	}
-	return p.defaultVerdict
+	if verdict, ok := p.interpreters[interpreter]; ok && interpreter != "" {
+		return verdict, ruleInterpreter
+	}
+	return p.defaultVerdict, ruleDefault
+}
+
+// WithFixedPolicy returns r decorated to enforce the policy carried by ctx on
+// every Run and StartBackground, whatever policy the context of the call
+// carries, for runnables opened once and run from call sites that may not
+// attach one. Only the policy is taken from ctx: cancellation, deadlines and
+// options still come from the call. A ctx without policy fixes r to run
+// without one. The decorator implements port.BackgroundRunnable when r does;
+// other optional interfaces such as port.Saver are reached through r itself.
+//
+//	r = emrun.WithFixedPolicy(r, emrun.WithRule(emrun.WithPolicy(ctx, emrun.DENY), emrun.ALLOW, digest))
+func WithFixedPolicy(r port.Runnable, ctx context.Context) port.Runnable {
+	fixed := fixedPolicy{Runnable: r, policy: policyFromContext(ctx)}
+	if _, ok := r.(port.BackgroundRunnable); ok {
+		return fixedPolicyBackground{fixed}
+	}
+	return fixed
+}
+
+// fixedPolicy replaces the policy of the contexts passed to Runnable.
+type fixedPolicy struct {
+	port.Runnable
+	policy *executionPolicy
+}
+
+func (f fixedPolicy) withPolicy(ctx context.Context) context.Context {
+	return context.WithValue(ctx, policyKey{}, f.policy)
+}
+
+func (f fixedPolicy) Run(ctx context.Context, cmd *exec.Cmd, combinedOutput bool) ([]byte, error) {
+	return f.Runnable.Run(f.withPolicy(ctx), cmd, combinedOutput)
+}
+
+// fixedPolicyBackground is a fixedPolicy over a port.BackgroundRunnable.
+type fixedPolicyBackground struct {
+	fixedPolicy
+}
+
+func (f fixedPolicyBackground) StartBackground(ctx context.Context, cmd *exec.Cmd, combinedOutput bool) (*exec.Cmd, port.CommandCapture, error) {
+	return f.Runnable.(port.BackgroundRunnable).StartBackground(f.withPolicy(ctx), cmd, combinedOutput)
 }
@@ -5,7 +5,14 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -69,6 +76,38 @@ func TestWithRuleFromReader(t *testing.T) {
 		t.Fatalf("expected reader checksum to be allowed, got %v", err)
 	}
 }
+
+func TestPolicyErrorByDefault(t *testing.T) {
+	denied := sha256.Sum256([]byte("explicitly denied"))
+	deniedHex := hex.EncodeToString(denied[:])
+	unknown := sha256.Sum256([]byte("never listed"))
+	unknownHex := hex.EncodeToString(unknown[:])
+
+	ctx := WithPolicy(context.Background(), DENY)
+	ctx = WithRule(ctx, DENY, deniedHex)
+
+	cases := []struct {
+		name      string
+		digest    [32]byte
+		hexDigest string
+		byDefault bool
+	}{
+		{"explicit-deny", denied, deniedHex, false},
+		{"default-deny", unknown, unknownHex, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var policyErr *PolicyError
+			if err := CheckPolicy(ctx, tc.digest, tc.hexDigest); !errors.As(err, &policyErr) {
+				t.Fatalf("expected PolicyError, got %v", err)
+			}
+			if policyErr.ByDefault != tc.byDefault {
+				t.Fatalf("ByDefault = %v want %v", policyErr.ByDefault, tc.byDefault)
+			}
+		})
+	}
+}
+
 func TestWithRulePanicsOnInvalidInput(t *testing.T) {
 	defer func() {
 		if r := recover(); r == nil {
@@ -77,3 +116,367 @@ func TestWithRulePanicsOnInvalidInput(t *testing.T) {
 	}()
 	_ = WithRule(context.Background(), ALLOW, "invalid")
 }
+
+func TestLoadPolicyFromURL(t *testing.T) {
+	allowed := sha256.Sum256([]byte("allowed payload"))
+	allowedHex := hex.EncodeToString(allowed[:])
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("# approved tools\n" + allowedHex + "  tool\n"))
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/garbage", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not a checksum manifest\n"))
+	})
+	sha512Line := "sha512:" + strings.Repeat("ab", 64) + "  tool\n"
+	mux.HandleFunc("/mixed", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sha512Line + "sha256:" + allowedHex + "  tool\n"))
+	})
+	mux.HandleFunc("/sha512", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sha512Line))
+	})
+	mux.HandleFunc("/huge", func(w http.ResponseWriter, r *http.Request) {
+		line := []byte(allowedHex + "  tool\n")
+		for n := 0; n <= maxPolicyManifest; n += len(line) {
+			if _, err := w.Write(line); err != nil {
+				return
+			}
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	base := WithPolicy(context.Background(), DENY)
+	ctx, err := LoadPolicyFromURL(base, srv.URL+"/ok", srv.Client())
+	if err != nil {
+		t.Fatalf("LoadPolicyFromURL returned error: %v", err)
+	}
+	if err := CheckPolicy(ctx, allowed, allowedHex); err != nil {
+		t.Fatalf("expected manifest digest to be allowed, got %v", err)
+	}
+	if ctx, err = LoadPolicyFromURL(base, srv.URL+"/mixed", srv.Client()); err != nil {
+		t.Fatalf("expected the sha512 line of a mixed manifest to be skipped, got %v", err)
+	}
+	if err := CheckPolicy(ctx, allowed, allowedHex); err != nil {
+		t.Fatalf("expected the sha256 digest of a mixed manifest to be allowed, got %v", err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/missing", want: "404"},
+		{path: "/garbage", want: "parse policy manifest"},
+		{path: "/sha512", want: "no sha256 digests"},
+		{path: "/huge", want: "larger than"},
+	}
+	for _, tc := range tests {
+		got, err := LoadPolicyFromURL(base, srv.URL+tc.path, srv.Client())
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: expected error containing %q, got %v", tc.path, tc.want, err)
+		}
+		if got != base {
+			t.Fatalf("%s: expected context to be unchanged on error", tc.path)
+		}
+	}
+}
+
+func TestPolicyDiff(t *testing.T) {
+	a := sha256.Sum256([]byte("a"))
+	b := sha256.Sum256([]byte("b"))
+	c := sha256.Sum256([]byte("c"))
+	d := sha256.Sum256([]byte("d"))
+	sorted := func(digests ...[32]byte) [][32]byte {
+		slices.SortFunc(digests, compareDigests)
+		return digests
+	}
+	old := Policy{Default: ALLOW, Allow: [][32]byte{a, b}, Deny: [][32]byte{c}}
+	next := Policy{Default: DENY, Allow: [][32]byte{d, b, c, d}, Deny: nil}
+
+	addedAllow, removedAllow, addedDeny, removedDeny, defaultChanged := old.Diff(next)
+	if !slices.Equal(addedAllow, sorted(c, d)) {
+		t.Fatalf("unexpected addedAllow: %x", addedAllow)
+	}
+	if !slices.Equal(removedAllow, [][32]byte{a}) {
+		t.Fatalf("unexpected removedAllow: %x", removedAllow)
+	}
+	if len(addedDeny) != 0 {
+		t.Fatalf("unexpected addedDeny: %x", addedDeny)
+	}
+	if !slices.Equal(removedDeny, [][32]byte{c}) {
+		t.Fatalf("unexpected removedDeny: %x", removedDeny)
+	}
+	if !defaultChanged {
+		t.Fatal("expected defaultChanged")
+	}
+
+	addedAllow, removedAllow, addedDeny, removedDeny, defaultChanged = old.Diff(old)
+	if addedAllow != nil || removedAllow != nil || addedDeny != nil || removedDeny != nil || defaultChanged {
+		t.Fatal("expected no differences between identical policies")
+	}
+}
+
+// checksumFile returns a sha256sum-style listing of n distinct digests.
+func checksumFile(n int) (string, [][32]byte) {
+	var b strings.Builder
+	digests := make([][32]byte, n)
+	for i := range digests {
+		digests[i] = sha256.Sum256([]byte(strconv.Itoa(i)))
+		fmt.Fprintf(&b, "%x  ./bin/tool-%d\n", digests[i], i)
+	}
+	return b.String(), digests
+}
+
+func TestDigestsFromStringParallel(t *testing.T) {
+	file, want := checksumFile(3 * parallelDigestLines)
+	got, err := digestsFromString(file)
+	if err != nil {
+		t.Fatalf("digestsFromString: %v", err)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatal("parallel parse did not preserve digests or their order")
+	}
+	serial, _, err := digestsFromLines(strings.Split(file, "\n"), 1)
+	if err != nil {
+		t.Fatalf("digestsFromLines: %v", err)
+	}
+	if !slices.Equal(serial, got) {
+		t.Fatal("parallel and serial parse disagree")
+	}
+}
+
+func TestDigestsFromStringReportsLineNumber(t *testing.T) {
+	for _, n := range []int{10, 3 * parallelDigestLines} {
+		file, _ := checksumFile(n)
+		lines := strings.Split(file, "\n")
+		lines[n-3] = "not-a-digest"
+		lines[n-1] = strings.Repeat("z", 64)
+		_, err := digestsFromString(strings.Join(lines, "\n"))
+		want := fmt.Sprintf("line %d: ", n-2)
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Fatalf("%d lines: expected error starting with %q, got %v", n, want, err)
+		}
+	}
+}
+
+func TestDigestsFromStringAlgorithmPrefix(t *testing.T) {
+	sum := sha256.Sum256([]byte("prefixed"))
+	hexSum := hex.EncodeToString(sum[:])
+	digests, err := digestsFromString("sha256:" + hexSum + "  tool\n" + hexSum + "  tool:v2\n")
+	if err != nil {
+		t.Fatalf("digestsFromString returned error: %v", err)
+	}
+	if len(digests) != 2 || digests[0] != sum || digests[1] != sum {
+		t.Fatalf("unexpected digests %x", digests)
+	}
+	sha512Line := "sha512:" + strings.Repeat("ab", 64) + "  tool\n"
+	mixed := "sha256:" + hexSum + "  tool\n" + sha512Line
+	if digests, err = digestsFromString(mixed); err != nil || len(digests) != 1 || digests[0] != sum {
+		t.Fatalf("expected the sha512 line to be skipped, got %x, %v", digests, err)
+	}
+	ctx := WithRule(WithPolicy(context.Background(), DENY), ALLOW, mixed)
+	if err := CheckPolicy(ctx, sum, hexSum); err != nil {
+		t.Fatalf("expected WithRule to allow the sha256 digest of a mixed manifest, got %v", err)
+	}
+	if _, err = digestsFromString(sha512Line); err == nil || !strings.Contains(err.Error(), "no sha256 digests") {
+		t.Fatalf("expected a sha512-only manifest to be rejected, got %v", err)
+	}
+	if _, err = digestsFromString(mixed + "sha512:xyz  tool\n"); err == nil || !strings.Contains(err.Error(), `line 3: invalid sha512 digest`) {
+		t.Fatalf("expected a malformed sha512 digest to be rejected, got %v", err)
+	}
+}
+
+func BenchmarkDigestsFromString(b *testing.B) {
+	for _, n := range []int{100, parallelDigestLines, 50000} {
+		file, _ := checksumFile(n)
+		lines := strings.Split(file, "\n")
+		b.Run(fmt.Sprintf("serial/%d", n), func(b *testing.B) {
+			for b.Loop() {
+				if _, _, err := digestsFromLines(lines, 1); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("parallel/%d", n), func(b *testing.B) {
+			for b.Loop() {
+				if _, _, err := digestsFromLinesParallel(lines, runtime.GOMAXPROCS(0)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPolicySnapshot(t *testing.T) {
+	if got := PolicySnapshot(context.Background()); got.Default != ALLOW || got.Allow != nil || got.Deny != nil {
+		t.Fatalf("unexpected snapshot without policy: %+v", got)
+	}
+	a := sha256.Sum256([]byte("a"))
+	b := sha256.Sum256([]byte("b"))
+	c := sha256.Sum256([]byte("c"))
+	ctx := WithRule(WithRule(WithPolicy(context.Background(), DENY), ALLOW, b, a), DENY, c)
+	got := PolicySnapshot(ctx)
+	want := Policy{Default: DENY, Allow: [][32]byte{a, b}, Deny: [][32]byte{c}}
+	slices.SortFunc(want.Allow, compareDigests)
+	if got.Default != want.Default || !slices.Equal(got.Allow, want.Allow) || !slices.Equal(got.Deny, want.Deny) {
+		t.Fatalf("PolicySnapshot() = %+v, want %+v", got, want)
+	}
+	got.Allow[0] = c
+	if err := CheckPolicy(ctx, want.Allow[0], hex.EncodeToString(want.Allow[0][:])); err != nil {
+		t.Fatalf("mutating a snapshot affected the context policy: %v", err)
+	}
+}
+
+func TestPolicyApply(t *testing.T) {
+	a := sha256.Sum256([]byte("a"))
+	b := sha256.Sum256([]byte("b"))
+	c := sha256.Sum256([]byte("c"))
+	base := WithInterpreterRule(WithRule(context.Background(), ALLOW, c), DENY, "/bin/sh")
+	ctx, err := Policy{Default: DENY, Allow: [][32]byte{a}, Deny: [][32]byte{b}}.Apply(base)
+	if err != nil {
+		t.Fatalf("Apply returned error: %v", err)
+	}
+	if err := CheckPolicy(ctx, a, hex.EncodeToString(a[:])); err != nil {
+		t.Fatalf("expected a to be allowed: %v", err)
+	}
+	for _, digest := range [][32]byte{b, c} {
+		if err := CheckPolicy(ctx, digest, hex.EncodeToString(digest[:])); !errors.Is(err, ErrDenied) {
+			t.Fatalf("expected %x to be denied, got %v", digest, err)
+		}
+	}
+	if got := policyFromContext(ctx).interpreters["/bin/sh"]; got != DENY {
+		t.Fatalf("expected interpreter rules to be kept, got %v", got)
+	}
+	if err := CheckPolicy(base, c, hex.EncodeToString(c[:])); err != nil {
+		t.Fatalf("Apply modified the parent context: %v", err)
+	}
+
+	conflicting := Policy{Default: ALLOW, Allow: [][32]byte{a, b, c}, Deny: [][32]byte{c, b}}
+	got, err := conflicting.Apply(base)
+	if !errors.Is(err, ErrPolicyConflict) || got != base {
+		t.Fatalf("expected ErrPolicyConflict and the unchanged context, got %v", err)
+	}
+	first := slices.MinFunc([][32]byte{b, c}, compareDigests)
+	if want := hex.EncodeToString(first[:]); !strings.Contains(err.Error(), want) {
+		t.Fatalf("expected the error to name %s, got %v", want, err)
+	}
+	if err := (Policy{Default: Verdict(7)}).Validate(); err == nil {
+		t.Fatal("expected an error for an unsupported default verdict")
+	}
+}
+
+func TestPolicyQuarantine(t *testing.T) {
+	a := sha256.Sum256([]byte("a"))
+	b := sha256.Sum256([]byte("b"))
+	ctx := WithRule(WithRule(WithPolicy(context.Background(), ALLOW), QUARANTINE, a, b), DENY, b)
+	snapshot := PolicySnapshot(ctx)
+	if !slices.Equal(snapshot.Quarantine, [][32]byte{a}) || !slices.Equal(snapshot.Deny, [][32]byte{b}) {
+		t.Fatalf("unexpected snapshot %+v", snapshot)
+	}
+	err := enforcePolicy(ctx, a, hex.EncodeToString(a[:]), "", "", false)
+	if !quarantined(err) {
+		t.Fatalf("enforcePolicy = %v, want a quarantine verdict", err)
+	}
+	if err := enforcePolicy(ctx, b, hex.EncodeToString(b[:]), "", "", false); quarantined(err) || !errors.Is(err, ErrDenied) {
+		t.Fatalf("expected deny to win over quarantine, got %v", err)
+	}
+	trusted := WithPolicy(context.Background(), QUARANTINE)
+	if err := enforcePolicy(trusted, a, hex.EncodeToString(a[:]), "", "", true); err != nil {
+		t.Fatalf("trusted payload quarantined by default verdict: %v", err)
+	}
+	if err := (Policy{Quarantine: [][32]byte{a}, Allow: [][32]byte{a}}).Validate(); !errors.Is(err, ErrPolicyConflict) {
+		t.Fatalf("expected ErrPolicyConflict for an allowed quarantined digest, got %v", err)
+	}
+	applied, err := snapshot.Apply(context.Background())
+	if err != nil || !quarantined(enforcePolicy(applied, a, hex.EncodeToString(a[:]), "", "", false)) {
+		t.Fatalf("Apply did not restore the quarantine set: %v", err)
+	}
+}
+
+// TestPolicyConcurrentDerivation derives and evaluates many contexts from one
+// base concurrently; run with -race to verify the copy-on-write contract.
+func TestPolicyConcurrentDerivation(t *testing.T) {
+	shared := sha256.Sum256([]byte("shared"))
+	base := WithRule(WithPolicy(context.Background(), DENY), ALLOW, shared)
+	const children = 64
+	var wg sync.WaitGroup
+	for i := range children {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			own := sha256.Sum256([]byte(strconv.Itoa(i)))
+			ctx := WithRule(base, ALLOW, own)
+			ctx = WithRule(ctx, DENY, shared)
+			if i%2 == 0 {
+				ctx = WithPolicy(ctx, ALLOW)
+			}
+			if err := CheckPolicy(ctx, own, hex.EncodeToString(own[:])); err != nil {
+				t.Errorf("child %d: own digest denied: %v", i, err)
+			}
+			if err := CheckPolicy(ctx, shared, hex.EncodeToString(shared[:])); !errors.Is(err, ErrDenied) {
+				t.Errorf("child %d: expected shared digest denied, got %v", i, err)
+			}
+			if err := CheckPolicy(base, shared, hex.EncodeToString(shared[:])); err != nil {
+				t.Errorf("child %d: base policy changed: %v", i, err)
+			}
+			PolicySnapshot(base)
+		}()
+	}
+	wg.Wait()
+	if got := PolicySnapshot(base); got.Default != DENY || len(got.Allow) != 1 || len(got.Deny) != 0 {
+		t.Fatalf("base policy changed: %+v", got)
+	}
+}
+
+func TestWithInterpreterRule(t *testing.T) {
+	denied := sha256.Sum256([]byte("#!/bin/sh\nrm -rf /\n"))
+	deniedHex := hex.EncodeToString(denied[:])
+	allowed := sha256.Sum256([]byte("#!/usr/bin/perl\nprint 1\n"))
+	allowedHex := hex.EncodeToString(allowed[:])
+	other := sha256.Sum256([]byte("other"))
+	otherHex := hex.EncodeToString(other[:])
+
+	ctx := WithPolicy(context.Background(), DENY)
+	ctx = WithRule(ctx, DENY, deniedHex)
+	ctx = WithRule(ctx, ALLOW, allowedHex)
+	ctx = WithInterpreterRule(ctx, ALLOW, "/bin/sh")
+	ctx = WithInterpreterRule(ctx, DENY, "/usr/bin/perl")
+
+	cases := []struct {
+		name        string
+		digest      [32]byte
+		hexDigest   string
+		interpreter string
+		wantErr     bool
+		byRule      string
+	}{
+		{"allowed-interpreter", other, otherHex, "/bin/sh", false, ""},
+		{"denied-interpreter", other, otherHex, "/usr/bin/perl", true, "/usr/bin/perl"},
+		{"digest-deny-wins", denied, deniedHex, "/bin/sh", true, ""},
+		{"digest-allow-wins", allowed, allowedHex, "/usr/bin/perl", false, ""},
+		{"elf-falls-through", other, otherHex, "", true, ""},
+		{"unlisted-interpreter", other, otherHex, "/bin/bash", true, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := enforcePolicy(ctx, tc.digest, tc.hexDigest, "", tc.interpreter, false)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("enforcePolicy = %v, want error %v", err, tc.wantErr)
+			}
+			var policyErr *PolicyError
+			if errors.As(err, &policyErr) && policyErr.Interpreter != tc.byRule {
+				t.Fatalf("Interpreter = %q want %q", policyErr.Interpreter, tc.byRule)
+			}
+		})
+	}
+
+	derived := WithInterpreterRule(ctx, ALLOW, "/usr/bin/perl")
+	if err := enforcePolicy(derived, other, otherHex, "", "/usr/bin/perl", false); err != nil {
+		t.Fatalf("derived rule not applied: %v", err)
+	}
+	if err := enforcePolicy(ctx, other, otherHex, "", "/usr/bin/perl", false); err == nil {
+		t.Fatal("WithInterpreterRule modified the parent context's policy")
+	}
+}
@@ -0,0 +1,58 @@
+package emrun
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxPolicyManifest is the largest manifest LoadPolicyFromURL reads, room for
+// about a million sha256sum lines.
+const maxPolicyManifest = 128 << 20
+
+// LoadPolicyFromURL fetches a sha256sum-formatted manifest from url and returns
+// a derived context with every listed digest added as an ALLOW rule. A nil
+// client uses http.DefaultClient. The manifest is parsed like the content
+// given to WithRule: digests may carry a "sha256:" prefix, and lines for other
+// algorithms, such as sha512, are skipped as long as the manifest lists
+// SHA-256 digests as well. Non-2xx responses, manifests larger than 128 MiB
+// and malformed manifests are reported as errors and leave ctx unchanged. The
+// manifest is trusted as-is; verify its signature or serve it over an
+// authenticated channel.
+//
+//	ctx := emrun.WithPolicy(context.Background(), emrun.DENY)
+//	ctx, err := emrun.LoadPolicyFromURL(ctx, "https://ci.example/tools.sha256", nil)
+func LoadPolicyFromURL(ctx context.Context, url string, client *http.Client) (context.Context, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return ctx, fmt.Errorf("fetch policy manifest: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ctx, fmt.Errorf("fetch policy manifest: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return ctx, fmt.Errorf("fetch policy manifest %s: unexpected status %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPolicyManifest+1))
+	if err != nil {
+		return ctx, fmt.Errorf("read policy manifest %s: %w", url, err)
+	}
+	if len(body) > maxPolicyManifest {
+		return ctx, fmt.Errorf("read policy manifest %s: larger than %d bytes", url, maxPolicyManifest)
+	}
+	digests, err := digestsFromBytes(body)
+	if err != nil {
+		return ctx, fmt.Errorf("parse policy manifest %s: %w", url, err)
+	}
+	rules := make([]Digest, len(digests))
+	for i, digest := range digests {
+		rules[i] = digest
+	}
+	return WithRuleCatchError(ctx, ALLOW, rules...)
+}
@@ -0,0 +1,25 @@
+package port
+
+import "time"
+
+// Clock abstracts the time functions emrun uses for timeouts, backoffs and
+// capture windows, so tests can replace real time with a clock they advance
+// themselves; see the emruntest package.
+type Clock interface {
+	Now() time.Time
+	// After returns a channel that receives the current time once d has
+	// elapsed, like time.After.
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+	// AfterFunc calls f in its own goroutine once d has elapsed, like
+	// time.AfterFunc. The returned Timer has a nil channel.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is the timer returned by Clock, mirroring *time.Timer with its channel
+// behind a method.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
@@ -10,3 +10,12 @@ type CommandRunner interface {
 	Run(cmd *exec.Cmd) error
 	Start(cmd *exec.Cmd) error
 }
+
+// CommandRetrier is an optional extension of CommandRunner for runners that
+// retry failed executions. os/exec refuses to start a Cmd twice, so a retry has
+// to run a replacement produced by clone. Both methods return the command that
+// was actually run or started; a nil clone disables retries.
+type CommandRetrier interface {
+	RunRetry(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd) (*exec.Cmd, error)
+	StartRetry(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd) (*exec.Cmd, error)
+}
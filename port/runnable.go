@@ -2,7 +2,9 @@ package port
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"os"
 	"os/exec"
 )
 
@@ -15,12 +17,76 @@ type Runnable interface {
 	io.Seeker
 	Name() string
 	IsMemfd() bool
+	// Backing reports what the executable path refers to.
+	Backing() BackingKind
+	// Digest returns the hex-encoded SHA-256 digest of the payload.
+	Digest() string
 	Run(ctx context.Context, cmd *exec.Cmd, combinedOutput bool) ([]byte, error)
 }
 
+// BackingKind identifies what backs a runnable's executable path.
+type BackingKind int
+
+const (
+	// BackingNone is reported by runnables that were never backed by a file.
+	BackingNone BackingKind = iota
+	// BackingMemfd is an anonymous memfd_create(2) file under /proc/self/fd.
+	BackingMemfd
+	// BackingTempFile is a temporary file removed when the runnable closes.
+	BackingTempFile
+	// BackingExistingPath is a file on disk the runnable does not own.
+	BackingExistingPath
+	// BackingFD is a descriptor supplied by the caller, reached through
+	// /proc/self/fd.
+	BackingFD
+)
+
+func (k BackingKind) String() string {
+	switch k {
+	case BackingNone:
+		return "none"
+	case BackingMemfd:
+		return "memfd"
+	case BackingTempFile:
+		return "tempfile"
+	case BackingExistingPath:
+		return "path"
+	case BackingFD:
+		return "fd"
+	default:
+		return fmt.Sprintf("BackingKind(%d)", int(k))
+	}
+}
+
 // BackgroundRunnable describes the runnable contract required to start a
 // background process via StartBackground.
 type BackgroundRunnable interface {
 	Runnable
 	StartBackground(ctx context.Context, cmd *exec.Cmd, combinedOutput bool) (*exec.Cmd, CommandCapture, error)
 }
+
+// ReadOnlyViewer is implemented by runnables that can expose their payload
+// through a descriptor opened read-only, for consumers such as ELF parsers that
+// must not be able to mutate what gets executed. Views stay valid until the
+// runnable is closed, which also closes them.
+type ReadOnlyViewer interface {
+	ReadOnlyView() (io.ReaderAt, error)
+}
+
+// FileBacked is implemented by runnables that can expose the open file behind
+// their executable path for operations emrun has no option for, such as
+// fcntl(F_ADD_SEALS) on a memfd. The file is owned by the runnable: do not
+// close it, and do not use it after the runnable is closed.
+type FileBacked interface {
+	// File returns the live file, or nil once the runnable is closed.
+	File() *os.File
+}
+
+// Saver is implemented by runnables that can export their payload, e.g. to
+// keep the exact bytes that were executed for later analysis.
+type Saver interface {
+	// SaveAs writes the payload to path, replacing any file there, with the
+	// permission bits of mode. The file belongs to the caller and outlives
+	// the runnable.
+	SaveAs(path string, mode os.FileMode) error
+}
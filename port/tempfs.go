@@ -0,0 +1,27 @@
+package port
+
+import (
+	"io"
+	"io/fs"
+)
+
+// TempFS abstracts the filesystem operations efrun uses to place payloads on
+// disk, so code built on efrun can be tested against an in-memory
+// implementation such as adapters/memfs. Errors should be *fs.PathError values
+// wrapping fs.ErrNotExist and friends, as the os package returns them.
+type TempFS interface {
+	// CreateTemp creates a new file for writing like os.CreateTemp.
+	CreateTemp(dir, pattern string) (TempFile, error)
+	Chmod(name string, mode fs.FileMode) error
+	Remove(name string) error
+	// Open opens name read-only like os.Open.
+	Open(name string) (TempFile, error)
+}
+
+// TempFile is the file handle returned by TempFS. *os.File implements it.
+type TempFile interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.Closer
+	Name() string
+}
@@ -0,0 +1,61 @@
+package emrun
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pkt.systems/emrun/internal/clock"
+	"pkt.systems/emrun/port"
+)
+
+// progressWriter counts the bytes written through it to w and reports the
+// running total to fn every interval until stopped, and once more when
+// stopped. Calls to fn never overlap and the final one comes last.
+type progressWriter struct {
+	w        io.Writer
+	written  atomic.Int64
+	interval time.Duration
+	fn       func(bytesSoFar int64)
+
+	mu      sync.Mutex
+	timer   port.Timer
+	stopped bool
+}
+
+func newProgressWriter(w io.Writer, interval time.Duration, fn func(int64)) *progressWriter {
+	p := &progressWriter{w: w, interval: interval, fn: fn}
+	p.mu.Lock()
+	p.timer = clock.Get().AfterFunc(interval, p.tick)
+	p.mu.Unlock()
+	return p
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written.Add(int64(n))
+	return n, err
+}
+
+func (p *progressWriter) tick() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return
+	}
+	p.fn(p.written.Load())
+	p.timer.Reset(p.interval)
+}
+
+// stop ends the periodic reports and delivers the final count.
+func (p *progressWriter) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return
+	}
+	p.stopped = true
+	p.timer.Stop()
+	p.fn(p.written.Load())
+}
@@ -0,0 +1,41 @@
+package emrun
+
+import (
+	"context"
+	"errors"
+)
+
+// WithQuarantine runs the payload as locked down as emrun can: with every
+// capability dropped (WithCapabilities with none kept), in new mount, IPC,
+// UTS and network namespaces, with a private TMPDIR (WithPrivateTmpdir),
+// stray descriptors closed (WithCloseInheritedFDs) and the whole process group
+// killed on cancellation (WithKillProcessGroup). Payloads quarantined by the
+// policy, see QUARANTINE, get it whatever the other options say; it can also
+// be given explicitly. Unprivileged callers get a user namespace mapping only
+// their own user and group, which fails where user namespaces are disabled.
+// No seccomp filter is installed. The sandbox fails closed: where a step is
+// unsupported, such as off Linux, the execution fails without starting
+// anything.
+func WithQuarantine() Option {
+	return func(c *config) {
+		c.keepCaps = nil
+		c.dropCaps = true
+		c.privateTmpdir = true
+		c.closeFDs = true
+		c.killGroup = true
+		c.isolate = true
+	}
+}
+
+// quarantined reports whether err is the verdict of enforcePolicy for a
+// payload that may only run under WithQuarantine.
+func quarantined(err error) bool {
+	var policyErr *PolicyError
+	return errors.As(err, &policyErr) && policyErr.Verdict == QUARANTINE
+}
+
+// withQuarantine returns ctx with WithQuarantine after all its options, so
+// none of them can weaken it.
+func withQuarantine(ctx context.Context) context.Context {
+	return WithOptions(ctx, WithQuarantine())
+}
@@ -0,0 +1,144 @@
+package emrun
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+
+	"pkt.systems/emrun/internal/clock"
+	"pkt.systems/emrun/internal/digest"
+	"pkt.systems/emrun/port"
+)
+
+// Record describes one finished execution, as handed to a Recorder.
+type Record struct {
+	// Digest is the hex-encoded SHA-256 digest of the payload of the runnable
+	// the command was bound to with BindCommand, as runnables opened by emrun
+	// and efrun do, and otherwise of the executed file.
+	Digest string
+	// Args are the arguments after argv[0].
+	Args []string
+	// Env is the environment the command ran with.
+	Env []string
+	// Stdin is what the command read from a reader given as its stdin.
+	// Files handed to the child directly, such as with WithNullStdin, are
+	// not recorded.
+	Stdin []byte
+	// Output is everything the command wrote to stdout and stderr, in the
+	// order written. Output written to files handed to the child directly,
+	// such as with WithInheritStdio, is not recorded.
+	Output   []byte
+	ExitCode int
+	Start    time.Time
+	Duration time.Duration
+}
+
+// Recorder receives a Record for every execution, see WithRecorder. It is
+// called from the goroutine running the command once the command has exited,
+// possibly from several goroutines at once.
+type Recorder interface {
+	Record(rec Record)
+}
+
+// recordingRunner hands a Record of every command it runs to a Recorder.
+type recordingRunner struct {
+	runner   port.CommandRunner
+	recorder Recorder
+}
+
+var _ port.CommandRetrier = (*recordingRunner)(nil)
+
+func newRecordingRunner(runner port.CommandRunner, recorder Recorder) port.CommandRunner {
+	return &recordingRunner{runner: runner, recorder: recorder}
+}
+
+// boundDigests maps commands BindCommand bound while a recorder was configured
+// to the digest of their runnable, which the recorder would otherwise have to
+// hash again from the executed file. Entries are removed once the command has
+// run or been started.
+var boundDigests sync.Map // *exec.Cmd -> string
+
+// commandDigest returns the digest recorded for cmd.
+func commandDigest(cmd *exec.Cmd) string {
+	if d, ok := boundDigests.Load(cmd); ok {
+		return d.(string)
+	}
+	return digest.File(executedPath(cmd))
+}
+
+// teed returns w teeing into output, or w itself when it is a file the child
+// writes to directly: teeing it would hand the child a pipe in its place.
+func teed(w, output io.Writer) io.Writer {
+	if _, isFile := w.(*os.File); isFile || w == nil {
+		return w
+	}
+	return io.MultiWriter(w, output)
+}
+
+// Run runs cmd with its stdin and output teed into a Record.
+func (r *recordingRunner) Run(cmd *exec.Cmd) error {
+	_, err := r.RunRetry(cmd, nil)
+	return err
+}
+
+// RunRetry is Run for wrapped runners implementing port.CommandRetrier. The
+// clones they run take over cmd's teed stdio, and the Record describes the
+// command that ran last. Other runners run cmd once.
+func (r *recordingRunner) RunRetry(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd) (*exec.Cmd, error) {
+	var stdin, outputBuf bytes.Buffer
+	output := &lockedWriter{w: &outputBuf}
+	origStdin, origStdout, origStderr := cmd.Stdin, cmd.Stdout, cmd.Stderr
+	if origStdin != nil {
+		if _, isFile := origStdin.(*os.File); !isFile {
+			cmd.Stdin = io.TeeReader(origStdin, &stdin)
+		}
+	}
+	if sameWriter(origStdout, origStderr) {
+		// One writer keeps os/exec feeding both streams through one pipe.
+		tee := teed(origStdout, output)
+		cmd.Stdout, cmd.Stderr = tee, tee
+	} else {
+		cmd.Stdout, cmd.Stderr = teed(origStdout, output), teed(origStderr, output)
+	}
+	defer func() {
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = origStdin, origStdout, origStderr
+	}()
+	start := clock.Get().Now()
+	ran, err := cmd, error(nil)
+	if retrier, ok := r.runner.(port.CommandRetrier); ok {
+		ran, err = retrier.RunRetry(cmd, clone)
+	} else {
+		err = r.runner.Run(cmd)
+	}
+	r.recorder.Record(Record{
+		// The digest was bound to cmd, not to its clones.
+		Digest:   commandDigest(cmd),
+		Args:     slices.Clone(ran.Args[min(len(ran.Args), 1):]),
+		Env:      ran.Environ(),
+		Stdin:    stdin.Bytes(),
+		Output:   outputBuf.Bytes(),
+		ExitCode: exitCodeFrom(err, ran.ProcessState),
+		Start:    start,
+		Duration: clock.Get().Now().Sub(start),
+	})
+	return ran, err
+}
+
+// Start starts cmd without recording it, since the runner does not see a
+// background command exit.
+func (r *recordingRunner) Start(cmd *exec.Cmd) error {
+	return r.runner.Start(cmd)
+}
+
+// StartRetry starts cmd through a wrapped port.CommandRetrier without
+// recording it, like Start.
+func (r *recordingRunner) StartRetry(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd) (*exec.Cmd, error) {
+	if retrier, ok := r.runner.(port.CommandRetrier); ok {
+		return retrier.StartRetry(cmd, clone)
+	}
+	return cmd, r.runner.Start(cmd)
+}
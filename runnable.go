@@ -4,19 +4,19 @@
 package emrun
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
 	"os"
 	"os/exec"
-	"slices"
 	"strings"
 
 	"golang.org/x/sys/unix"
-	"pkt.systems/emrun/adapters/commandrunner"
 	"pkt.systems/emrun/port"
 )
 
@@ -29,10 +29,60 @@ type runnable struct {
 	sha256        [32]byte
 	deleteOnClose bool
 	runner        port.CommandRunner
+	views         []*os.File
+	// streamed runnables were opened from a reader and hold no payload copy;
+	// the memfd is their only copy of the bytes.
+	streamed bool
+	// opts were given when opening and apply beneath the context options.
+	opts []Option
+	// anonymousTemp makes the next temporary file an unlinked O_TMPFILE, see
+	// WithAnonymousTempFile. anonymous is set once the backing is one, since
+	// its /proc/self/fd name looks like a memfd's.
+	anonymousTemp bool
+	anonymous     bool
+	// trusted is set by WithTrustedSource when opening.
+	trusted bool
 }
 
+var (
+	_ port.ReadOnlyViewer = (*runnable)(nil)
+	_ port.FileBacked     = (*runnable)(nil)
+	_ port.Saver          = (*runnable)(nil)
+)
+
+// IsMemfd is shorthand for Backing() == BackingMemfd.
 func (r *runnable) IsMemfd() bool {
-	return strings.HasPrefix(r.name, "/proc/self/fd/")
+	return r.Backing() == port.BackingMemfd
+}
+
+// Backing reports whether the runnable executes from a memfd or, after a
+// fallback, from a temporary file.
+func (r *runnable) Backing() port.BackingKind {
+	switch {
+	case r.anonymous:
+		return port.BackingTempFile
+	case strings.HasPrefix(r.name, "/proc/self/fd/"):
+		return port.BackingMemfd
+	case r.Name() == "":
+		return port.BackingNone
+	default:
+		return port.BackingTempFile
+	}
+}
+
+// commandRunner returns the runner assigned to the runnable, or the one
+// carried by ctx (see WithRunner) when none was assigned.
+func (r *runnable) commandRunner(ctx context.Context) port.CommandRunner {
+	if r.runner != nil {
+		return r.runner
+	}
+	return RunnerFromContext(ctx)
+}
+
+// Digest returns the hex-encoded SHA-256 digest of the payload.
+func (r *runnable) Digest() string {
+	_, hexDigest := r.ensureDigest()
+	return hexDigest
 }
 
 func (r *runnable) ensureDigest() ([32]byte, string) {
@@ -41,10 +91,68 @@ func (r *runnable) ensureDigest() ([32]byte, string) {
 	}
 	sum := sha256.Sum256(r.payload)
 	r.sha256 = sum
-	r.sha256hex = hex.EncodeToString(sum[:])
+	r.sha256hex = hexDigest(&sum)
 	return r.sha256, r.sha256hex
 }
 
+// enforce applies the context policy and the preflight checks requested by
+// options before the runnable is executed. The returned context is ctx, or
+// ctx locked down with WithQuarantine when the policy quarantines the payload.
+func (r *runnable) enforce(ctx context.Context) (context.Context, error) {
+	// Without a policy the digest would be computed for nothing; Digest still
+	// computes it on demand.
+	if policyFromContext(ctx) != nil {
+		digest, hexDigest := r.ensureDigest()
+		err := enforcePolicy(ctx, digest, hexDigest, r.buildID(ctx), r.interpreter(ctx), r.trusted)
+		switch {
+		case quarantined(err):
+			ctx = withQuarantine(ctx)
+		case err != nil:
+			return ctx, err
+		}
+	}
+	return ctx, Preflight(ctx, r)
+}
+
+// buildID returns the payload's build ID when the context policy has build ID
+// rules to match it against, and "" otherwise or when it has none. Streamed
+// payloads are read back from their backing file.
+func (r *runnable) buildID(ctx context.Context) string {
+	if len(policyFromContext(ctx).buildIDs) == 0 {
+		return ""
+	}
+	var src io.ReaderAt = bytes.NewReader(r.payload)
+	if r.streamed {
+		if r.file == nil {
+			return ""
+		}
+		src = r.file
+	}
+	id, _ := buildIDFrom(src)
+	return id
+}
+
+// interpreter returns the interpreter of a script payload when the context
+// policy has interpreter rules to match it against, and "" otherwise or for
+// payloads that are not scripts. Streamed payloads have their #! line read
+// back from their backing file.
+func (r *runnable) interpreter(ctx context.Context) string {
+	if len(policyFromContext(ctx).interpreters) == 0 {
+		return ""
+	}
+	header := r.payload
+	if r.streamed {
+		if r.file == nil {
+			return ""
+		}
+		buf := make([]byte, maxShebang+1)
+		n, _ := io.NewSectionReader(r.file, 0, int64(len(buf))).Read(buf)
+		header = buf[:n]
+	}
+	interpreter, _, _ := ShebangInterpreter(header)
+	return interpreter
+}
+
 // switchToTemporaryFile attempts to transition the runnable from an
 // in-memory file descriptor to a temporary file. It checks if the
 // current setup is valid, handles errors during the process, and
@@ -55,13 +163,45 @@ func (r *runnable) switchToTemporaryFile() error {
 	if !r.IsMemfd() {
 		return ERR_NOT_AN_INMEMORY_FD
 	}
-	if len(r.payload) == 0 {
+	if !r.streamed {
+		if len(r.payload) == 0 {
+			return ERR_PAYLOAD_IS_EMPTY
+		}
+		// Close any previous instance
+		r.release()
+		return r.writeTemporaryFile(bytes.NewReader(r.payload))
+	}
+	// A streamed payload only lives in the memfd, so reopen it before the
+	// memfd is released and copy it across.
+	src, err := os.Open(r.name)
+	if err != nil {
+		return fmt.Errorf("reopen memfd: %w", err)
+	}
+	defer src.Close()
+	if info, err := src.Stat(); err == nil && info.Size() == 0 {
 		return ERR_PAYLOAD_IS_EMPTY
 	}
-	// Close any previous instance
-	r.Close()
-	r.ensureDigest()
-	tmpf, err := os.CreateTemp("", r.sha256hex+"-*")
+	r.release()
+	return r.writeTemporaryFile(src)
+}
+
+// writeTemporaryFile writes the payload read from src to a new temporary file
+// with the user execute bit set and makes it the runnable's backing; the file
+// is deleted on Close.
+func (r *runnable) writeTemporaryFile(src io.Reader) error {
+	metrics.tempfileFallbacks.Add(1)
+	if r.anonymousTemp && ProcMounted() {
+		err := r.writeAnonymousTemporaryFile(src)
+		if !errors.Is(err, errNoTmpfile) {
+			return err
+		}
+	}
+	pattern := "emrun-*"
+	if r.sha256hex != "" || !r.streamed {
+		r.ensureDigest()
+		pattern = r.sha256hex + "-*"
+	}
+	tmpf, err := os.CreateTemp("", pattern)
 	if err != nil {
 		return err
 	}
@@ -69,21 +209,92 @@ func (r *runnable) switchToTemporaryFile() error {
 	r.closer = tmpf
 	r.name = tmpf.Name()
 	r.deleteOnClose = true
-	if _, err := r.file.Write(r.payload); err != nil {
+	if n, err := io.Copy(r.file, src); err != nil {
 		if cerr := r.Close(); cerr != nil {
-			return fmt.Errorf("unable to write to temporary file: %w; unable to close temporary file: %w", err, cerr)
+			return fmt.Errorf("unable to write to temporary file after %d bytes: %w; unable to close temporary file: %w", n, err, cerr)
 		}
-		return fmt.Errorf("unable to write to temporary file: %w", err)
+		return fmt.Errorf("unable to write to temporary file after %d bytes: %w", n, err)
 	}
-	// Clsoe underlying tempfile
+	if err := makeExecutable(r.file); err != nil {
+		if cerr := r.Close(); cerr != nil {
+			return fmt.Errorf("unable to chmod temporary file: %w; unable to close temporary file: %w", err, cerr)
+		}
+		return fmt.Errorf("chmod +x: %w", err)
+	}
+	// Close underlying tempfile
 	r.file.Close()
 	r.closer = nil
-	if err := os.Chmod(r.name, 0o0700); err != nil {
+	// Keep a read-only handle so Read, Seek and File keep working; unlike a
+	// writable one it does not make exec fail with ETXTBSY.
+	rf, err := os.Open(r.name)
+	if err != nil {
 		if cerr := r.Close(); cerr != nil {
-			return fmt.Errorf("unable to chmod temporary file: %w; unable to close temporary file: %w", err, cerr)
+			return fmt.Errorf("unable to reopen temporary file: %w; unable to close temporary file: %w", err, cerr)
 		}
+		return fmt.Errorf("reopen temporary file: %w", err)
+	}
+	r.file = rf
+	r.closer = rf
+	return nil
+}
+
+// executableMode is the mode temporary files are given before execution.
+const executableMode fs.FileMode = 0o700
+
+// makeExecutable sets the mode of the open file f to executableMode with
+// fchmod, so unlike chmod by path it cannot be redirected to another file, and
+// umask plays no part. The mode is read back because some file systems, such
+// as those mounted with fixed permission options, silently ignore it.
+func makeExecutable(f *os.File) error {
+	if err := f.Chmod(executableMode); err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if mode := fi.Mode().Perm(); mode != executableMode {
+		return fmt.Errorf("%s has mode %v after chmod, want %v", f.Name(), mode, executableMode)
+	}
+	return nil
+}
+
+// errNoTmpfile reports that O_TMPFILE could not be used and nothing was read
+// from the source yet, so a named temporary file can be written instead.
+var errNoTmpfile = errors.New("O_TMPFILE unavailable")
+
+// writeAnonymousTemporaryFile writes the payload read from src to an unlinked
+// O_TMPFILE in the temporary directory and makes a read-only descriptor of it,
+// executed through /proc/self/fd/N like a memfd, the runnable's backing. O_EXCL
+// keeps the file from ever being linked into the file system; it disappears
+// when the descriptor is closed.
+func (r *runnable) writeAnonymousTemporaryFile(src io.Reader) error {
+	wfd, err := unix.Open(os.TempDir(), unix.O_TMPFILE|unix.O_EXCL|unix.O_RDWR|unix.O_CLOEXEC, 0o700)
+	if err != nil {
+		return errNoTmpfile
+	}
+	w := os.NewFile(uintptr(wfd), "emrun-tmpfile")
+	defer w.Close()
+	if n, err := io.Copy(w, src); err != nil {
+		return fmt.Errorf("unable to write to temporary file after %d bytes: %w", n, err)
+	}
+	if err := makeExecutable(w); err != nil {
 		return fmt.Errorf("chmod +x: %w", err)
 	}
+	// Executing a file that is open for writing fails with ETXTBSY, so the
+	// backing is a read-only descriptor and the writable one is closed on
+	// return. Like the memfd it is inherited by the child, which scripts need
+	// to reach it through /proc/self/fd.
+	rfd, err := unix.Open(procSelfFDPath(wfd), unix.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("reopen temporary file: %w", err)
+	}
+	r.name = procSelfFDPath(rfd)
+	f := os.NewFile(uintptr(rfd), r.name)
+	r.file = f
+	r.closer = f
+	r.deleteOnClose = false
+	r.anonymous = true
 	return nil
 }
 
@@ -97,24 +308,98 @@ func (r *runnable) Name() string {
 }
 
 // Close releases resources associated with the runnable, closing the
-// file if open and removing the temporary file if it was created
-// during the process.
+// file if open, any read-only views, and removing the temporary file
+// if it was created during the process.
 func (r *runnable) Close() error {
-	var fileCloseErr error
+	var viewErrs []error
+	for _, view := range r.views {
+		viewErrs = append(viewErrs, view.Close())
+	}
+	r.views = nil
+	return errors.Join(append([]error{r.release()}, viewErrs...)...)
+}
+
+// File returns the memfd, or the temporary file after a fallback, that backs
+// the runnable. It is owned by the runnable and must not be closed. File
+// returns nil once the runnable is closed.
+func (r *runnable) File() *os.File {
+	if r.closer == nil {
+		return nil
+	}
+	return r.file
+}
+
+// ReadOnlyView returns a view of the payload opened O_RDONLY through
+// /proc/self/fd/N for memfd backings, or by reopening the temporary file. The
+// view does not share the runnable's file offset and cannot be used to write to
+// the payload. It is closed together with the runnable.
+func (r *runnable) ReadOnlyView() (io.ReaderAt, error) {
+	name := r.Name()
+	if name == "" {
+		return nil, os.ErrInvalid
+	}
+	view, err := os.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open read-only view: %w", err)
+	}
+	r.views = append(r.views, view)
+	return view, nil
+}
+
+// SaveAs writes the payload to path with mode, see port.Saver. The bytes are
+// read from the backing file with pread, so what is saved is what executes
+// and the offset used by Read and Seek is left alone. Saving over the
+// runnable's own backing is refused.
+func (r *runnable) SaveAs(path string, mode os.FileMode) error {
+	if r.file == nil {
+		return os.ErrInvalid
+	}
+	if fi, err := os.Stat(path); err == nil {
+		if own, err := r.file.Stat(); err == nil && os.SameFile(fi, own) {
+			return fmt.Errorf("save payload to %s: refusing to overwrite the runnable's backing file", path)
+		}
+	}
+	return savePayload(path, mode, io.NewSectionReader(r.file, 0, math.MaxInt64))
+}
+
+// savePayload copies src to path, created or truncated, and sets its mode with
+// fchmod so the umask does not apply.
+func savePayload(path string, mode os.FileMode, src io.Reader) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return fmt.Errorf("save payload: %w", err)
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("save payload to %s: %w", path, cerr)
+		}
+	}()
+	if n, err := io.Copy(f, src); err != nil {
+		return fmt.Errorf("save payload to %s after %d bytes: %w", path, n, err)
+	}
+	if err := f.Chmod(mode.Perm()); err != nil {
+		return fmt.Errorf("save payload to %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("save payload to %s: %w", path, err)
+	}
+	return nil
+}
+
+// release closes the backing file and removes a temporary file backing. When
+// both fail, the errors are joined.
+func (r *runnable) release() error {
+	var closeErr, removeErr error
 	if r.file != nil && r.closer != nil {
-		fileCloseErr = r.file.Close()
+		closeErr = r.file.Close()
 		r.closer = nil
 	}
 	if r.deleteOnClose && r.name != "" {
-		if err := os.Remove(r.name); err != nil {
-			if fileCloseErr != nil {
-				return fmt.Errorf("close error: %w; remove error: %w", fileCloseErr, err)
-			}
-			return err
+		if removeErr = os.Remove(r.name); removeErr == nil {
+			r.deleteOnClose = false
 		}
-		r.deleteOnClose = false
 	}
-	return fileCloseErr
+	return errors.Join(closeErr, removeErr)
 }
 
 func (r *runnable) Read(p []byte) (int, error) {
@@ -133,81 +418,67 @@ func (r *runnable) Seek(offset int64, whence int) (int64, error) {
 
 // Run executes the command with the provided context, handling fallback to a
 // temporary file if permission errors are encountered with the in-memory file
-// descriptor.
-
+// descriptor. The switch is permanent: later executions, whose commands must
+// be built from the new Name, run the temporary file directly and report its
+// errors without another fallback.
 func (r *runnable) Run(ctx context.Context, cmd *exec.Cmd, combinedOutput bool) ([]byte, error) {
-	if r.runner == nil {
-		r.runner = commandrunner.Default
+	ctx = withDefaultOptions(ctx, r.opts)
+	runner := r.commandRunner(ctx)
+	ctx, err := r.enforce(ctx)
+	if err != nil {
+		return nil, err
 	}
-	digest, hexDigest := r.ensureDigest()
-	if err := enforcePolicy(ctx, digest, hexDigest); err != nil {
+	unbind, err := BindCommand(ctx, r, cmd)
+	if err != nil {
 		return nil, err
 	}
-	out, err := RunCommand(r.runner, cmd, combinedOutput)
+	out, err := RunCommandContext(ctx, runner, cmd, combinedOutput)
 	if err == nil {
 		return out, nil
 	}
 	if !r.IsMemfd() || !isPermissionErr(err) {
 		return out, err
 	}
+	unbind()
+	r.anonymousTemp = configFromContext(ctx).anonymousTemp
 	if serr := r.switchToTemporaryFile(); serr != nil {
 		return out, fmt.Errorf("memfd execution failed: %w; fallback to tempfile failed: %w", err, serr)
 	}
 	fallback := cloneCommandForFallback(ctx, cmd, r.Name())
-	return RunCommand(r.runner, fallback, combinedOutput)
+	if _, err := BindCommand(ctx, r, fallback); err != nil {
+		return out, err
+	}
+	return RunCommandContext(ctx, runner, fallback, combinedOutput)
 }
 
 func (r *runnable) StartBackground(ctx context.Context, cmd *exec.Cmd, combinedOutput bool) (*exec.Cmd, port.CommandCapture, error) {
-	if r.runner == nil {
-		r.runner = commandrunner.Default
+	ctx = withDefaultOptions(ctx, r.opts)
+	runner := r.commandRunner(ctx)
+	ctx, err := r.enforce(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
-	digest, hexDigest := r.ensureDigest()
-	if err := enforcePolicy(ctx, digest, hexDigest); err != nil {
+	unbind, err := BindCommand(ctx, r, cmd)
+	if err != nil {
 		return nil, nil, err
 	}
-	capture, err := StartCommand(r.runner, cmd, combinedOutput)
+	started, capture, err := StartCommandContext(ctx, runner, cmd, combinedOutput)
 	if err == nil {
-		return cmd, capture, nil
+		return started, capture, nil
 	}
 	if !r.IsMemfd() || !isPermissionErr(err) {
 		return nil, nil, err
 	}
+	unbind()
+	r.anonymousTemp = configFromContext(ctx).anonymousTemp
 	if serr := r.switchToTemporaryFile(); serr != nil {
 		return nil, nil, fmt.Errorf("memfd execution failed: %w; fallback to tempfile failed: %w", err, serr)
 	}
 	fallback := cloneCommandForFallback(ctx, cmd, r.Name())
-	fallbackCapture, startErr := StartCommand(r.runner, fallback, combinedOutput)
-	if startErr != nil {
-		fallbackCapture.Restore()
-		return nil, nil, startErr
-	}
-	return fallback, fallbackCapture, nil
-}
-
-func cloneCommandForFallback(ctx context.Context, cmd *exec.Cmd, path string) *exec.Cmd {
-	origArgs := slices.Clone(cmd.Args)
-	if len(origArgs) == 0 {
-		origArgs = append(origArgs, path)
-	} else {
-		origArgs[0] = path
-	}
-	if ctx == nil {
-		ctx = context.Background()
-	}
-	fallback := exec.CommandContext(ctx, path)
-	fallback.Args = origArgs
-	fallback.Path = origArgs[0]
-	fallback.Env = slices.Clone(cmd.Env)
-	fallback.Dir = cmd.Dir
-	fallback.Stdin = cmd.Stdin
-	fallback.Stdout = cmd.Stdout
-	fallback.Stderr = cmd.Stderr
-	if cmd.ExtraFiles != nil {
-		fallback.ExtraFiles = slices.Clone(cmd.ExtraFiles)
-	}
-	fallback.SysProcAttr = cmd.SysProcAttr
-	fallback.WaitDelay = cmd.WaitDelay
-	return fallback
+	if _, err := BindCommand(ctx, r, fallback); err != nil {
+		return nil, nil, err
+	}
+	return StartCommandContext(ctx, runner, fallback, combinedOutput)
 }
 
 func isPermissionErr(runErr error) bool {
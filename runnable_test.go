@@ -6,17 +6,27 @@ package emrun
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"syscall"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 	"time"
 
 	"golang.org/x/sys/unix"
 
 	"pkt.systems/emrun/adapters/mockrunner"
+	"pkt.systems/emrun/port"
 )
 
 func TestRunnableRunFallsBackToTempfile(t *testing.T) {
@@ -81,6 +91,49 @@ func TestRunnableRunFallsBackToTempfile(t *testing.T) {
 	}
 }
 
+func TestRunnableFallbackIsSticky(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	f, err := Open([]byte("#!/bin/sh\necho sticky\n"))
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	r := f.(*runnable)
+	defer r.Close()
+	if !r.IsMemfd() {
+		t.Skip("memfd unavailable; cannot exercise fallback path")
+	}
+	run := func(cmd *exec.Cmd) error { return cmd.Run() }
+	denied := func(cmd *exec.Cmd) error {
+		return &os.PathError{Op: "fork/exec", Path: cmd.Path, Err: unix.EACCES}
+	}
+	mock := mockrunner.New(denied, run, run, run, denied)
+	r.runner = mock
+	for i := range 3 {
+		out, err := r.Run(ctx, exec.CommandContext(ctx, r.Name()), true)
+		if err != nil || string(out) != "sticky\n" {
+			t.Fatalf("run %d: unexpected result %q, %v", i, out, err)
+		}
+	}
+	tempfile := r.Name()
+	if r.Backing() != BackingTempFile {
+		t.Fatalf("expected a tempfile backing, got %v", r.Backing())
+	}
+	if _, err := r.Run(ctx, exec.CommandContext(ctx, r.Name()), true); !errors.Is(err, unix.EACCES) {
+		t.Fatalf("expected the tempfile's permission error without another fallback, got %v", err)
+	}
+	calls, paths, remaining := mock.Snapshot()
+	if calls != 5 || remaining != 0 || r.Name() != tempfile {
+		t.Fatalf("unexpected executions: %d calls, %d remaining, name %s", calls, remaining, r.Name())
+	}
+	for i, path := range paths[1:] {
+		if path != tempfile {
+			t.Fatalf("execution %d did not reuse the tempfile: %s", i+1, path)
+		}
+	}
+}
+
 func TestRunnableRunFallbackSwitchFailure(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
@@ -133,6 +186,53 @@ func TestSwitchToTemporaryFileSuccess(t *testing.T) {
 	})
 }
 
+func TestMakeExecutableSetsExactMode(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "mode-*")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	defer f.Close()
+	if err := f.Chmod(0o4755); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if err := makeExecutable(f); err != nil {
+		t.Fatalf("makeExecutable returned error: %v", err)
+	}
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Mode() != executableMode {
+		t.Fatalf("mode = %v, want %v", info.Mode(), executableMode)
+	}
+	f.Close()
+	if err := makeExecutable(f); err == nil {
+		t.Fatal("expected an error for a closed file")
+	}
+}
+
+func TestCloseJoinsCloseAndRemoveErrors(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "backing-*")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	file.Close()
+	r := &runnable{
+		file:          file,
+		closer:        file,
+		name:          filepath.Join(t.TempDir(), "missing"),
+		deleteOnClose: true,
+	}
+	err = r.Close()
+	if !errors.Is(err, os.ErrClosed) || !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected both the close and the remove error, got %v", err)
+	}
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) {
+		t.Fatalf("expected a *fs.PathError, got %T", err)
+	}
+}
+
 func TestSwitchToTemporaryFileErrors(t *testing.T) {
 	r := &runnable{payload: []byte("data")}
 	if err := r.switchToTemporaryFile(); !errors.Is(err, ERR_NOT_AN_INMEMORY_FD) {
@@ -218,3 +318,568 @@ func TestIsPermissionErr(t *testing.T) {
 		})
 	}
 }
+
+func TestReadOnlyViewCannotWrite(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho view\n")
+	f, err := Open(payload)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	viewer, ok := f.(port.ReadOnlyViewer)
+	if !ok {
+		t.Fatalf("runnable does not implement port.ReadOnlyViewer")
+	}
+	view, err := viewer.ReadOnlyView()
+	if err != nil {
+		t.Fatalf("ReadOnlyView returned error: %v", err)
+	}
+	got := make([]byte, len(payload))
+	if _, err := view.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt returned error: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("view contents mismatch: got %q want %q", got, payload)
+	}
+	if _, err := view.(io.Writer).Write([]byte("x")); err == nil {
+		t.Fatalf("expected write through read-only view to fail")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if _, err := view.ReadAt(got, 0); err == nil {
+		t.Fatalf("expected view to be closed with the runnable")
+	}
+}
+
+func TestFileReturnsBackingFile(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho file\n")
+	f, err := Open(payload)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	fb, ok := f.(port.FileBacked)
+	if !ok {
+		t.Fatal("runnable does not implement port.FileBacked")
+	}
+	file := fb.File()
+	if file == nil {
+		t.Fatal("File returned nil for open runnable")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatalf("stat backing file: %v", err)
+	}
+	if info.Size() != int64(len(payload)) {
+		t.Fatalf("unexpected backing file size %d", info.Size())
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if fb.File() != nil {
+		t.Fatal("File returned non-nil after Close")
+	}
+}
+
+func TestOpenReaderStreamsDigest(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho streamed\n#" + strings.Repeat("x", 256<<10) + "\n")
+	sum := sha256.Sum256(payload)
+	f, err := OpenReader(bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatalf("OpenReader returned error: %v", err)
+	}
+	defer f.Close()
+	if f.Digest() != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected digest %s", f.Digest())
+	}
+
+	ctx := WithRule(WithPolicy(context.Background(), DENY), ALLOW, sum)
+	cmd := exec.CommandContext(ctx, f.Name())
+	out, err := f.Run(ctx, cmd, true)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "streamed\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestOpenReaderInterpreterRule(t *testing.T) {
+	f, err := OpenReader(strings.NewReader("#!/bin/sh\necho streamed\n"))
+	if err != nil {
+		t.Fatalf("OpenReader returned error: %v", err)
+	}
+	defer f.Close()
+	ctx := WithInterpreterRule(context.Background(), DENY, "/bin/sh")
+	var policyErr *PolicyError
+	if _, err := f.Run(ctx, exec.CommandContext(ctx, f.Name()), true); !errors.As(err, &policyErr) || policyErr.Interpreter != "/bin/sh" {
+		t.Fatalf("expected the interpreter rule to deny the streamed script, got %v", err)
+	}
+}
+
+func TestSwitchToTemporaryFileStreamed(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho streamed\n")
+	f, err := OpenReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("OpenReader returned error: %v", err)
+	}
+	r := f.(*runnable)
+	defer r.Close()
+	if !r.IsMemfd() {
+		t.Skip("memfd unavailable")
+	}
+	if err := r.switchToTemporaryFile(); err != nil {
+		t.Fatalf("switchToTemporaryFile returned error: %v", err)
+	}
+	data, err := os.ReadFile(r.Name())
+	if err != nil {
+		t.Fatalf("read temporary file: %v", err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Fatalf("temporary file contents mismatch: %q", data)
+	}
+}
+
+func TestWithAnonymousTempFile(t *testing.T) {
+	t.Setenv(ForceTempfileEnv, "1")
+	payload := []byte("#!/bin/sh\necho anonymous\n")
+	f, err := OpenReader(bytes.NewReader(payload), WithAnonymousTempFile())
+	if err != nil {
+		t.Fatalf("OpenReader returned error: %v", err)
+	}
+	defer f.Close()
+	if !f.(*runnable).anonymous {
+		t.Skip("O_TMPFILE unsupported in the temporary directory")
+	}
+	if f.Backing() != BackingTempFile || !strings.HasPrefix(f.Name(), "/proc/self/fd/") {
+		t.Fatalf("expected an anonymous tempfile backing, got %v at %s", f.Backing(), f.Name())
+	}
+	if link, err := os.Readlink(f.Name()); err != nil || !strings.HasSuffix(link, " (deleted)") {
+		t.Fatalf("expected an unlinked file, got %q, %v", link, err)
+	}
+	ctx := context.Background()
+	out, err := f.Run(ctx, exec.CommandContext(ctx, f.Name()), true)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "anonymous\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	t.Setenv(ForceTempfileEnv, "")
+	m, err := Open(payload)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	r := m.(*runnable)
+	defer r.Close()
+	if !r.IsMemfd() {
+		t.Skip("memfd unavailable")
+	}
+	r.anonymousTemp = true
+	if err := r.switchToTemporaryFile(); err != nil {
+		t.Fatalf("switchToTemporaryFile returned error: %v", err)
+	}
+	data, err := os.ReadFile(r.Name())
+	if err != nil || !bytes.Equal(data, payload) || r.Backing() != BackingTempFile {
+		t.Fatalf("unexpected fallback: %q, %v, %v", data, err, r.Backing())
+	}
+}
+
+func TestOpenFS(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho from-fs:$EMRUN_FS_VAR\n")
+	fsys := fstest.MapFS{"tools/hello.sh": &fstest.MapFile{Data: payload, Mode: 0o755}}
+	f, err := OpenFS(fsys, "tools/hello.sh", WithEnvMap(map[string]string{"EMRUN_FS_VAR": "opened"}))
+	if err != nil {
+		t.Fatalf("OpenFS returned error: %v", err)
+	}
+	defer f.Close()
+	sum := sha256.Sum256(payload)
+	if f.Digest() != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected digest %s", f.Digest())
+	}
+	if f.IsMemfd() {
+		link, err := os.Readlink(f.Name())
+		if err != nil {
+			t.Fatalf("readlink %s: %v", f.Name(), err)
+		}
+		if !strings.Contains(link, "memfd:hello.sh") {
+			t.Fatalf("memfd not named after file: %q", link)
+		}
+	}
+	ctx := context.Background()
+	out, err := f.Run(ctx, exec.CommandContext(ctx, f.Name()), true)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "from-fs:opened\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	named, err := OpenFS(fsys, "tools/hello.sh", WithName("custom"))
+	if err != nil {
+		t.Fatalf("OpenFS returned error: %v", err)
+	}
+	defer named.Close()
+	if named.IsMemfd() {
+		if link, _ := os.Readlink(named.Name()); !strings.Contains(link, "memfd:custom") {
+			t.Fatalf("WithName not applied: %q", link)
+		}
+	}
+
+	if _, err := OpenFS(fsys, "tools/missing"); !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), "tools/missing") {
+		t.Fatalf("expected wrapped fs.ErrNotExist naming the file, got %v", err)
+	}
+}
+
+func TestOpenFSLookup(t *testing.T) {
+	fsys := fstest.MapFS{
+		"tools/bin/hello":     &fstest.MapFile{Data: []byte("#!/bin/sh\necho bin\n")},
+		"tools/contrib/hello": &fstest.MapFile{Data: []byte("#!/bin/sh\necho contrib\n")},
+		"tools/contrib/only":  &fstest.MapFile{Data: []byte("#!/bin/sh\necho only\n")},
+		"tools/dir/only/x":    &fstest.MapFile{Data: []byte("x")},
+	}
+	ctx := context.Background()
+	for name, want := range map[string]string{"hello": "bin\n", "only": "only\n", "tools/contrib/hello": "contrib\n"} {
+		f, err := OpenFSLookup(fsys, name, "tools/dir", "tools/bin", "tools/contrib")
+		if err != nil {
+			t.Fatalf("OpenFSLookup(%s) returned error: %v", name, err)
+		}
+		out, err := f.Run(ctx, exec.CommandContext(ctx, f.Name()), true)
+		f.Close()
+		if err != nil || string(out) != want {
+			t.Fatalf("%s: unexpected output %q, %v", name, out, err)
+		}
+	}
+	_, err := OpenFSLookup(fsys, "missing", "tools/bin", "tools/contrib")
+	if !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), "tools/contrib") {
+		t.Fatalf("unexpected error for a missing payload: %v", err)
+	}
+}
+
+// xorReader is a stand-in cipher for WithDecryptor tests.
+type xorReader struct {
+	r   io.Reader
+	key byte
+}
+
+func (x xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	for i := range p[:n] {
+		p[i] ^= x.key
+	}
+	return n, err
+}
+
+func TestOpenReaderReportsBytesWrittenOnFailure(t *testing.T) {
+	errBroken := errors.New("broken source")
+	src := io.MultiReader(strings.NewReader("#!/bin/sh\n"), iotest.ErrReader(errBroken))
+	f, err := OpenReader(src)
+	if err == nil {
+		f.Close()
+		t.Fatal("expected OpenReader to fail")
+	}
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("expected the source error to be wrapped, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "after 10 bytes") {
+		t.Fatalf("expected the written byte count in %q", err)
+	}
+}
+
+func TestSaveAs(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho saved\n")
+	f, err := Open(payload)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(3, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "payload")
+	if err := f.(port.Saver).SaveAs(path, 0o750); err != nil {
+		t.Fatalf("SaveAs returned error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(data, payload) {
+		t.Fatalf("unexpected saved payload %q, %v", data, err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode() != 0o750 {
+		t.Fatalf("unexpected saved mode: %v, %v", fi.Mode(), err)
+	}
+	if pos, err := f.Seek(0, io.SeekCurrent); err != nil || pos != 3 {
+		t.Fatalf("SaveAs moved the read offset to %d, %v", pos, err)
+	}
+	if err := f.(port.Saver).SaveAs(f.Name(), 0o700); err == nil {
+		t.Fatal("expected saving over the backing file to be refused")
+	}
+	if out, err := f.Run(context.Background(), exec.Command(f.Name()), true); err != nil || string(out) != "saved\n" {
+		t.Fatalf("runnable unusable after SaveAs: %q, %v", out, err)
+	}
+	f.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("saved file did not outlive the runnable: %v", err)
+	}
+}
+
+func TestOpenReaderWithDecryptor(t *testing.T) {
+	plain := []byte("#!/bin/sh\necho decrypted\n")
+	cipher, _ := io.ReadAll(xorReader{bytes.NewReader(plain), 0x5a})
+	decrypt := WithDecryptor(func(r io.Reader) (io.Reader, error) {
+		return xorReader{r, 0x5a}, nil
+	})
+	f, err := OpenReader(bytes.NewReader(cipher), decrypt)
+	if err != nil {
+		t.Fatalf("OpenReader returned error: %v", err)
+	}
+	defer f.Close()
+	sum := sha256.Sum256(plain)
+	if f.Digest() != hex.EncodeToString(sum[:]) {
+		t.Fatalf("digest not computed over plaintext: %s", f.Digest())
+	}
+	ctx := context.Background()
+	out, err := f.Run(ctx, exec.CommandContext(ctx, f.Name()), true)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "decrypted\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	errBadKey := errors.New("bad key")
+	for _, decrypt := range []func(io.Reader) (io.Reader, error){
+		func(io.Reader) (io.Reader, error) { return nil, errBadKey },
+		func(r io.Reader) (io.Reader, error) {
+			return io.MultiReader(io.LimitReader(r, 4), iotest.ErrReader(errBadKey)), nil
+		},
+	} {
+		_, err := OpenReader(bytes.NewReader(cipher), WithDecryptor(decrypt))
+		if !errors.Is(err, errBadKey) || !strings.Contains(err.Error(), "decrypt payload") {
+			t.Fatalf("expected wrapped decryption error, got %v", err)
+		}
+	}
+}
+
+func TestWithTrustedSource(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho trusted\n")
+	fsys := fstest.MapFS{"tools/trusted.sh": &fstest.MapFile{Data: payload, Mode: 0o755}}
+	sum := sha256.Sum256(payload)
+	denyByDefault := WithPolicy(context.Background(), DENY)
+	for _, tc := range []struct {
+		name    string
+		ctx     context.Context
+		opts    []Option
+		allowed bool
+	}{
+		{"trusted under default deny", denyByDefault, []Option{WithTrustedSource()}, true},
+		{"untrusted under default deny", denyByDefault, nil, false},
+		{"trusted with explicit deny", WithRule(denyByDefault, DENY, sum), []Option{WithTrustedSource()}, false},
+		{"trusted in context only", WithOptions(denyByDefault, WithTrustedSource()), nil, false},
+	} {
+		f, err := OpenFS(fsys, "tools/trusted.sh", tc.opts...)
+		if err != nil {
+			t.Fatalf("%s: OpenFS returned error: %v", tc.name, err)
+		}
+		out, err := f.Run(tc.ctx, exec.CommandContext(tc.ctx, f.Name()), true)
+		f.Close()
+		if tc.allowed && (err != nil || string(out) != "trusted\n") {
+			t.Fatalf("%s: expected the payload to run, got %q, %v", tc.name, out, err)
+		}
+		if !tc.allowed && !errors.Is(err, ErrDenied) {
+			t.Fatalf("%s: expected ErrDenied, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestRunWithSelfFDEnv(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = WithOptions(ctx, WithSelfFDEnv("EMRUN_SELF_FD"))
+	out, err := Run(ctx, []byte("#!/bin/sh\necho $EMRUN_SELF_FD\nhead -c 9 /proc/self/fd/$EMRUN_SELF_FD\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v (%s)", err, out)
+	}
+	if string(out) != "3\n#!/bin/sh" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestSelfFDEnvRebindsAfterFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ctx = WithOptions(ctx, WithSelfFDEnv("EMRUN_SELF_FD"))
+	f, err := Open([]byte("#!/bin/sh\necho fallback\n"))
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	r := f.(*runnable)
+	defer r.Close()
+	if !r.IsMemfd() {
+		t.Skip("memfd unavailable; cannot exercise fallback path")
+	}
+	memfd := r.File()
+	r.runner = mockrunner.New(
+		func(cmd *exec.Cmd) error {
+			if len(cmd.ExtraFiles) != 1 || cmd.ExtraFiles[0] != memfd {
+				t.Fatalf("memfd not passed to child: %v", cmd.ExtraFiles)
+			}
+			return &os.PathError{Op: "fork/exec", Path: cmd.Path, Err: unix.EACCES}
+		},
+		func(cmd *exec.Cmd) error {
+			if len(cmd.ExtraFiles) != 1 || cmd.ExtraFiles[0] != r.File() {
+				t.Fatalf("fallback did not pass the tempfile: %v", cmd.ExtraFiles)
+			}
+			if !slices.Contains(cmd.Env, "EMRUN_SELF_FD=3") {
+				t.Fatal("fallback lost the fd environment variable")
+			}
+			return nil
+		},
+	)
+	if _, err := r.Run(ctx, exec.CommandContext(ctx, r.Name()), true); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+}
+
+func TestEnforceSkipsDigestWithoutPolicy(t *testing.T) {
+	r := &runnable{payload: []byte("#!/bin/sh\n")}
+	if _, err := r.enforce(context.Background()); err != nil {
+		t.Fatalf("enforce returned error: %v", err)
+	}
+	if r.sha256hex != "" {
+		t.Fatal("expected no digest to be computed without a policy")
+	}
+	if _, err := r.enforce(WithPolicy(context.Background(), ALLOW)); err != nil {
+		t.Fatalf("enforce returned error: %v", err)
+	}
+	sum := sha256.Sum256(r.payload)
+	if r.sha256hex != hex.EncodeToString(sum[:]) {
+		t.Fatalf("expected the digest to be computed for a policy, got %q", r.sha256hex)
+	}
+}
+
+// BenchmarkEnforce measures the policy check of a runnable whose digest has
+// not been computed yet, as it would be for a large payload.
+func BenchmarkEnforce(b *testing.B) {
+	payload := bytes.Repeat([]byte{0x90}, 64<<20)
+	for _, bc := range []struct {
+		name string
+		ctx  context.Context
+	}{
+		{"no-policy", context.Background()},
+		{"policy", WithPolicy(context.Background(), ALLOW)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			for b.Loop() {
+				r := &runnable{payload: payload}
+				if _, err := r.enforce(bc.ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkOpen measures opening and closing a small payload, as a service
+// opening many short-lived runnables does. The allocations per op are the
+// figure to watch.
+func BenchmarkOpen(b *testing.B) {
+	payload := []byte("#!/bin/sh\necho bench\n")
+	b.ReportAllocs()
+	for b.Loop() {
+		r, err := Open(payload)
+		if err != nil {
+			b.Fatal(err)
+		}
+		r.Close()
+	}
+}
+
+func TestWithFixedPolicy(t *testing.T) {
+	r, err := Open([]byte("#!/bin/sh\necho fixed\n"))
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer r.Close()
+	fixed := WithFixedPolicy(r, WithPolicy(context.Background(), DENY))
+	if _, err := fixed.Run(context.Background(), exec.Command(r.Name()), true); !errors.Is(err, ErrDenied) {
+		t.Fatalf("Run under the fixed policy = %v, want ErrDenied", err)
+	}
+	bg, ok := fixed.(port.BackgroundRunnable)
+	if !ok {
+		t.Fatal("decorator of a background runnable cannot start in the background")
+	}
+	if _, err := StartBackground(context.Background(), bg, nil, nil, nil, nil, true); !errors.Is(err, ErrDenied) {
+		t.Fatalf("StartBackground under the fixed policy = %v, want ErrDenied", err)
+	}
+
+	// The call's own policy is ignored, in both directions.
+	allowed := WithFixedPolicy(r, WithRule(WithPolicy(context.Background(), DENY), ALLOW, r.Digest()))
+	out, err := allowed.Run(WithPolicy(context.Background(), DENY), exec.Command(r.Name()), true)
+	if err != nil || string(out) != "fixed\n" {
+		t.Fatalf("Run under an allowing fixed policy = %q, %v", out, err)
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	payload := []byte("#!/bin/sh\necho adopted\n")
+	// A close-on-exec memfd would vanish before /bin/sh could open the script.
+	fd, err := unix.MemfdCreate("adopted", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		t.Skipf("memfd_create unavailable: %v", err)
+	}
+	file := os.NewFile(uintptr(fd), "adopted")
+	if _, err := file.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unix.FcntlInt(file.Fd(), unix.F_ADD_SEALS, unix.F_SEAL_WRITE|unix.F_SEAL_SHRINK|unix.F_SEAL_GROW); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Adopt(file)
+	if err != nil {
+		t.Fatalf("Adopt returned error: %v", err)
+	}
+	sum := sha256.Sum256(payload)
+	if r.Digest() != hex.EncodeToString(sum[:]) || !r.IsMemfd() {
+		t.Fatalf("unexpected digest %s or backing %s", r.Digest(), r.Backing())
+	}
+	ctx := context.Background()
+	out, err := r.Run(WithPolicy(WithRule(ctx, ALLOW, sum), DENY), exec.Command(r.Name()), true)
+	if err != nil || string(out) != "adopted\n" {
+		t.Fatalf("Run = %q, %v", out, err)
+	}
+	var policyErr *PolicyError
+	if _, err := r.Run(WithInterpreterRule(ctx, DENY, "/bin/sh"), exec.Command(r.Name()), true); !errors.As(err, &policyErr) || policyErr.Interpreter != "/bin/sh" {
+		t.Fatalf("expected the interpreter rule to deny the adopted script, got %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_GET_SEALS, 0); err == nil {
+		t.Fatal("Close left the adopted memfd open")
+	}
+
+	tmp, err := os.CreateTemp(t.TempDir(), "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmp.Close()
+	if _, err := Adopt(tmp); err == nil {
+		t.Fatal("expected Adopt to refuse a regular file")
+	}
+	if _, err := tmp.Stat(); err != nil {
+		t.Fatalf("refused file was closed: %v", err)
+	}
+}
+
+func TestOpenPathHelpersMatchFormatting(t *testing.T) {
+	for _, fd := range []int{0, 3, 99, 100, 4096, 1<<31 - 1} {
+		if got, want := procSelfFDPath(fd), fmt.Sprintf("/proc/self/fd/%d", fd); got != want {
+			t.Fatalf("procSelfFDPath(%d) = %q, want %q", fd, got, want)
+		}
+	}
+	sum := sha256.Sum256([]byte("digest"))
+	if got, want := hexDigest(&sum), hex.EncodeToString(sum[:]); got != want {
+		t.Fatalf("hexDigest = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,34 @@
+package emrun
+
+import (
+	"context"
+
+	"pkt.systems/emrun/adapters/commandrunner"
+	"pkt.systems/emrun/port"
+)
+
+type runnerKey struct{}
+
+// WithRunner returns a derived context carrying runner. The Run*/Do* helpers
+// and their background variants execute commands through the runner found in
+// the context instead of commandrunner.Default, which makes it possible to
+// decorate every execution (tracing, retries, mocks) without building
+// runnables by hand. A nil runner restores the default.
+//
+//	ctx = emrun.WithRunner(ctx, tracingRunner)
+//	out, err := emrun.Run(ctx, payload)
+func WithRunner(ctx context.Context, runner port.CommandRunner) context.Context {
+	return context.WithValue(ctx, runnerKey{}, runner)
+}
+
+// RunnerFromContext returns the runner stored with WithRunner, or
+// commandrunner.Default when ctx is nil or carries no runner.
+func RunnerFromContext(ctx context.Context) port.CommandRunner {
+	if ctx == nil {
+		return commandrunner.Default
+	}
+	if runner, ok := ctx.Value(runnerKey{}).(port.CommandRunner); ok && runner != nil {
+		return runner
+	}
+	return commandrunner.Default
+}
@@ -0,0 +1,30 @@
+package emrun
+
+import (
+	"context"
+	"testing"
+
+	"pkt.systems/emrun/adapters/commandrunner"
+	"pkt.systems/emrun/adapters/mockrunner"
+)
+
+func TestRunnerFromContext(t *testing.T) {
+	mock := mockrunner.New()
+	cases := []struct {
+		name string
+		ctx  context.Context
+		want any
+	}{
+		{"nil-context", nil, commandrunner.Default},
+		{"no-runner", context.Background(), commandrunner.Default},
+		{"nil-runner", WithRunner(context.Background(), nil), commandrunner.Default},
+		{"stored-runner", WithRunner(context.Background(), mock), mock},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := RunnerFromContext(tc.ctx); got != tc.want {
+				t.Fatalf("RunnerFromContext() = %#v want %#v", got, tc.want)
+			}
+		})
+	}
+}
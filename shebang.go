@@ -0,0 +1,39 @@
+package emrun
+
+import (
+	"bytes"
+	"strings"
+)
+
+// maxShebang is the number of bytes of a #! line the kernel looks at,
+// BINPRM_BUF_SIZE less the terminating NUL on the kernels that truncate.
+const maxShebang = 127
+
+// ShebangInterpreter parses the #! line of a script payload the way the
+// kernel does: the interpreter is the first word after "#!" and everything
+// after it, with surrounding blanks trimmed, is passed as one optional
+// argument, so "#!/usr/bin/env -S sh -e" yields "/usr/bin/env" and
+// ["-S sh -e"]. Only the first 127 bytes of the line are considered. ok is
+// false when payload does not start with "#!" or names no interpreter.
+//
+//	if path, _, ok := emrun.ShebangInterpreter(script); !ok || path != "/bin/sh" {
+//		return errors.New("unexpected interpreter")
+//	}
+func ShebangInterpreter(payload []byte) (path string, args []string, ok bool) {
+	if !bytes.HasPrefix(payload, []byte("#!")) {
+		return "", nil, false
+	}
+	line := payload[:min(len(payload), maxShebang)]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	rest := strings.TrimRight(strings.TrimLeft(string(line[2:]), " \t"), " \t\r")
+	if rest == "" {
+		return "", nil, false
+	}
+	i := strings.IndexAny(rest, " \t")
+	if i < 0 {
+		return rest, nil, true
+	}
+	return rest[:i], []string{strings.TrimLeft(rest[i:], " \t")}, true
+}
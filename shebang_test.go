@@ -0,0 +1,32 @@
+package emrun
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestShebangInterpreter(t *testing.T) {
+	tests := []struct {
+		payload string
+		path    string
+		args    []string
+		ok      bool
+	}{
+		{"#!/bin/sh\necho hi\n", "/bin/sh", nil, true},
+		{"#! /bin/sh -e\n", "/bin/sh", []string{"-e"}, true},
+		{"#!/usr/bin/env -S sh -e \r\n", "/usr/bin/env", []string{"-S sh -e"}, true},
+		{"#!\t/bin/bash\t-x", "/bin/bash", []string{"-x"}, true},
+		{"#!\n/bin/sh\n", "", nil, false},
+		{"echo hi\n", "", nil, false},
+		{"\x7fELF", "", nil, false},
+		{"", "", nil, false},
+		{"#!/bin/sh " + strings.Repeat("x", 200) + "\n", "/bin/sh", []string{strings.Repeat("x", maxShebang-len("#!/bin/sh "))}, true},
+	}
+	for _, tt := range tests {
+		path, args, ok := ShebangInterpreter([]byte(tt.payload))
+		if path != tt.path || !slices.Equal(args, tt.args) || ok != tt.ok {
+			t.Errorf("ShebangInterpreter(%q) = %q, %q, %v; want %q, %q, %v", tt.payload, path, args, ok, tt.path, tt.args, tt.ok)
+		}
+	}
+}
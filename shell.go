@@ -0,0 +1,40 @@
+package emrun
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os/exec"
+)
+
+// DefaultShell is the interpreter Shell runs scripts with unless WithShell
+// selects another one.
+const DefaultShell = "/bin/sh"
+
+// Shell runs script with the configured shell as "shell -c script shell
+// arg...", so arg are available to the script as $1, $2 and so on, and returns
+// the combined output. Unlike Do the script needs no shebang and is never
+// written to a file. When ctx carries a policy it is checked against the
+// SHA-256 digest of script, and the shell as its interpreter, before anything
+// is started; without one the script is not hashed.
+//
+//	out, err := emrun.Shell(ctx, `ls -l "$1" | wc -l`, dir)
+func Shell(ctx context.Context, script string, arg ...string) ([]byte, error) {
+	shell := configFromContext(ctx).shell
+	if shell == "" {
+		shell = DefaultShell
+	}
+	if policyFromContext(ctx) != nil {
+		digest := sha256.Sum256([]byte(script))
+		err := enforcePolicy(ctx, digest, hex.EncodeToString(digest[:]), "", shell, false)
+		switch {
+		case quarantined(err):
+			ctx = withQuarantine(ctx)
+		case err != nil:
+			return nil, err
+		}
+	}
+	args := append([]string{"-c", script, shell}, arg...)
+	cmd := exec.CommandContext(ctx, shell, args...)
+	return RunCommandContext(ctx, RunnerFromContext(ctx), cmd, true)
+}
@@ -0,0 +1,53 @@
+package emrun
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShell(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := Shell(ctx, `printf '%s:%s\n' "$1" "$2"`, "one", "two")
+	if err != nil {
+		t.Fatalf("Shell returned error: %v", err)
+	}
+	if string(out) != "one:two\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestShellWithShellOption(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = WithOptions(ctx, WithShell("/no/such/shell"))
+	if _, err := Shell(ctx, "true"); err == nil {
+		t.Fatal("expected error from missing shell")
+	}
+}
+
+func TestShellChecksPolicy(t *testing.T) {
+	script := "echo allowed"
+	ctx := WithPolicy(context.Background(), DENY)
+	if _, err := Shell(ctx, script); !errors.Is(err, ErrDenied) {
+		t.Fatalf("expected ErrDenied, got %v", err)
+	}
+	ctx = WithRule(ctx, ALLOW, sha256.Sum256([]byte(script)))
+	out, err := Shell(ctx, script)
+	if err != nil {
+		t.Fatalf("Shell returned error: %v", err)
+	}
+	if string(out) != "allowed\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestShellInterpreterRule(t *testing.T) {
+	ctx := WithInterpreterRule(WithPolicy(context.Background(), DENY), ALLOW, DefaultShell)
+	if out, err := Shell(ctx, "echo by interpreter"); err != nil || string(out) != "by interpreter\n" {
+		t.Fatalf("unexpected result %q, %v", out, err)
+	}
+}
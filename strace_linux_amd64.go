@@ -0,0 +1,169 @@
+package emrun
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+	"pkt.systems/emrun/port"
+)
+
+// cldTrapped is the siginfo code of a ptrace stop (CLD_TRAPPED).
+const cldTrapped = 4
+
+// straceRunner starts commands under ptrace and logs their syscalls.
+type straceRunner struct {
+	runner port.CommandRunner
+	w      io.Writer
+}
+
+var _ port.CommandRetrier = (*straceRunner)(nil)
+
+func newStraceRunner(runner port.CommandRunner, w io.Writer) port.CommandRunner {
+	return &straceRunner{runner: runner, w: w}
+}
+
+// Run starts cmd like Start and waits for both the command and its tracer, so
+// the trace is complete when Run returns.
+func (s *straceRunner) Run(cmd *exec.Cmd) error {
+	_, err := s.RunRetry(cmd, nil)
+	return err
+}
+
+// Start starts cmd on a goroutine locked to its OS thread, since the thread
+// that forks a PTRACE_TRACEME child is its tracer, and keeps that goroutine
+// tracing until the child exits. The exit itself is left for cmd.Wait to reap.
+func (s *straceRunner) Start(cmd *exec.Cmd) error {
+	_, err := s.StartRetry(cmd, nil)
+	return err
+}
+
+// RunRetry is Run for wrapped runners implementing port.CommandRetrier, which
+// may start a clone of cmd; the command that was started is traced, waited
+// for and returned. Other runners start cmd once.
+func (s *straceRunner) RunRetry(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd) (*exec.Cmd, error) {
+	started, traced, err := s.start(cmd, clone)
+	if err != nil {
+		return started, err
+	}
+	err = started.Wait()
+	<-traced
+	return started, err
+}
+
+// StartRetry is the Start counterpart of RunRetry.
+func (s *straceRunner) StartRetry(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd) (*exec.Cmd, error) {
+	started, _, err := s.start(cmd, clone)
+	return started, err
+}
+
+// start starts cmd, or a clone of it when the wrapped runner retries, from
+// the tracing goroutine. Clones share cmd's SysProcAttr and so ask to be
+// traced as well.
+func (s *straceRunner) start(cmd *exec.Cmd, clone func(*exec.Cmd) *exec.Cmd) (*exec.Cmd, <-chan struct{}, error) {
+	ownSysProcAttr(cmd).Ptrace = true
+	type result struct {
+		cmd *exec.Cmd
+		err error
+	}
+	started := make(chan result, 1)
+	traced := make(chan struct{})
+	go func() {
+		defer close(traced)
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		c, err := cmd, error(nil)
+		if retrier, ok := s.runner.(port.CommandRetrier); ok {
+			c, err = retrier.StartRetry(cmd, clone)
+		} else {
+			err = s.runner.Start(cmd)
+		}
+		started <- result{c, err}
+		if err == nil {
+			s.trace(c.Process.Pid)
+		}
+	}()
+	res := <-started
+	if res.err != nil {
+		return res.cmd, nil, res.err
+	}
+	return res.cmd, traced, nil
+}
+
+func (s *straceRunner) trace(pid int) {
+	// The child stops with SIGTRAP once it has exec'd.
+	var signal int
+	if !s.waitStop(pid, &signal) {
+		return
+	}
+	if err := unix.PtraceSetOptions(pid, unix.PTRACE_O_TRACESYSGOOD|unix.PTRACE_O_EXITKILL); err != nil {
+		fmt.Fprintf(s.w, "[%d] ptrace options: %v\n", pid, err)
+	}
+	var (
+		entered bool
+		regs    unix.PtraceRegs
+		call    string
+	)
+	for {
+		if err := unix.PtraceSyscall(pid, signal); err != nil {
+			return
+		}
+		signal = 0
+		if !s.waitStop(pid, &signal) {
+			return
+		}
+		if signal != 0 {
+			continue
+		}
+		if err := unix.PtraceGetRegs(pid, &regs); err != nil {
+			return
+		}
+		// Lines are written while the child is stopped so they all land
+		// before the child can exit.
+		if !entered {
+			call = fmt.Sprintf("[%d] syscall(%d, %#x, %#x, %#x)", pid, regs.Orig_rax, regs.Rdi, regs.Rsi, regs.Rdx)
+			if regs.Orig_rax == unix.SYS_EXIT || regs.Orig_rax == unix.SYS_EXIT_GROUP {
+				fmt.Fprintf(s.w, "%s = ?\n", call)
+			}
+		} else {
+			fmt.Fprintf(s.w, "%s = %d\n", call, int64(regs.Rax))
+		}
+		entered = !entered
+	}
+}
+
+// waitStop consumes the next stop of pid, reporting false once the child is
+// gone. Syscall stops leave signal untouched; other stops store the signal to
+// hand back to the child when it is resumed.
+func (s *straceRunner) waitStop(pid int, signal *int) bool {
+	if !s.peekStop(pid) {
+		return false
+	}
+	var status unix.WaitStatus
+	if _, err := unix.Wait4(pid, &status, unix.WALL, nil); err != nil || !status.Stopped() {
+		return false
+	}
+	if sig := status.StopSignal(); sig != unix.SIGTRAP|0x80 && sig != unix.SIGTRAP {
+		*signal = int(sig)
+	}
+	return true
+}
+
+// peekStop blocks until pid changes state without reaping it and reports
+// whether the change is a ptrace stop. Exits are left for cmd.Wait.
+func (s *straceRunner) peekStop(pid int) bool {
+	var info unix.Siginfo
+	for {
+		err := unix.Waitid(unix.P_PID, pid, &info, unix.WEXITED|unix.WSTOPPED|unix.WNOWAIT|unix.WALL, nil)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return false
+		}
+		return info.Code == cldTrapped
+	}
+}
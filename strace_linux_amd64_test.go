@@ -0,0 +1,44 @@
+package emrun
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"pkt.systems/emrun/adapters/commandrunner"
+)
+
+func TestRunWithStrace(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var trace bytes.Buffer
+	ctx = WithOptions(ctx, WithStrace(&trace))
+	out, err := Run(ctx, []byte("#!/bin/sh\necho traced\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if string(out) != "traced\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	if !strings.Contains(trace.String(), "] syscall(") || !strings.Contains(trace.String(), " = ?\n") {
+		t.Fatalf("unexpected trace:\n%s", trace.String())
+	}
+}
+
+func TestStraceKeepsRetries(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	inner := &busyOnceRunner{}
+	ctx = WithRunner(ctx, &commandrunner.RetryRunner{Runner: inner})
+	var trace bytes.Buffer
+	ctx = WithOptions(ctx, WithStrace(&trace), WithHangDiagnostic(time.Minute))
+	out, err := Run(ctx, []byte("#!/bin/sh\necho traced\n"))
+	if err != nil || string(out) != "traced\n" || inner.starts != 2 {
+		t.Fatalf("Run = %q, %v after %d starts, want the retried clone to run", out, err, inner.starts)
+	}
+	if !strings.Contains(trace.String(), "] syscall(") {
+		t.Fatalf("the retried clone was not traced:\n%s", trace.String())
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !linux || !amd64
+
+package emrun
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+
+	"pkt.systems/emrun/port"
+)
+
+var errStraceUnsupported = errors.New("strace is only supported on linux/amd64")
+
+type straceRunner struct{}
+
+func newStraceRunner(port.CommandRunner, io.Writer) port.CommandRunner {
+	return straceRunner{}
+}
+
+func (straceRunner) Run(*exec.Cmd) error {
+	return errStraceUnsupported
+}
+
+func (straceRunner) Start(*exec.Cmd) error {
+	return errStraceUnsupported
+}
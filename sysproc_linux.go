@@ -0,0 +1,320 @@
+package emrun
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// applyCgroup opens the cgroup v2 directory at path and makes cmd start
+// directly inside it via clone3(CLONE_INTO_CGROUP). The returned closer
+// releases the directory descriptor, which is no longer needed once the child
+// has started.
+func applyCgroup(cmd *exec.Cmd, path string) (io.Closer, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open cgroup: %w", err)
+	}
+	attr := ownSysProcAttr(cmd)
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(dir.Fd())
+	return dir, nil
+}
+
+// applyGroups makes cmd start with the supplementary groups, keeping the user
+// and primary group of an existing Credential or of this process.
+func applyGroups(cmd *exec.Cmd, groups []uint32) error {
+	attr := ownSysProcAttr(cmd)
+	cred := syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if attr.Credential != nil {
+		if attr.Credential.NoSetGroups {
+			return errors.New("supplementary groups cannot be set with Credential.NoSetGroups")
+		}
+		cred = *attr.Credential
+	}
+	cred.Groups = slices.Clone(groups)
+	attr.Credential = &cred
+	return nil
+}
+
+// applyProcessGroup makes cmd start as the leader of a new process group.
+func applyProcessGroup(cmd *exec.Cmd) error {
+	attr := ownSysProcAttr(cmd)
+	attr.Setpgid = true
+	attr.Pgid = 0
+	return nil
+}
+
+// signalProcessGroup sends sig to the process group led by process. A group
+// that no longer exists is reported as os.ErrProcessDone, as os.Process does
+// for a process.
+func signalProcessGroup(process *os.Process, sig syscall.Signal) error {
+	if err := syscall.Kill(-process.Pid, sig); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+	return nil
+}
+
+// pinnedGroup is a process group together with pidfds for the members it had
+// when it was pinned. While one of them exists, even as a zombie, the group
+// ID cannot be reused, so the group can be signalled later without reaching
+// an unrelated group that took over the ID after all of them were gone.
+type pinnedGroup struct {
+	pgid   int
+	pidfds []int
+	// unpinned is set on kernels without pidfd_open(2), where the group is
+	// signalled by its ID alone.
+	unpinned bool
+}
+
+// pinProcessGroup pins the process group led by process, finding its members
+// in /proc. It returns nil when process is nil.
+func pinProcessGroup(process *os.Process) *pinnedGroup {
+	if process == nil {
+		return nil
+	}
+	g := &pinnedGroup{pgid: process.Pid}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		g.unpinned = true
+		return g
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || processGroupOf(pid) != g.pgid {
+			continue
+		}
+		fd, err := unix.PidfdOpen(pid, 0)
+		if errors.Is(err, unix.ENOSYS) {
+			g.close()
+			g.unpinned = true
+			return g
+		}
+		if err != nil {
+			continue
+		}
+		// The PID may have been reused between reading its group and
+		// opening the pidfd.
+		if processGroupOf(pid) != g.pgid {
+			unix.Close(fd)
+			continue
+		}
+		g.pidfds = append(g.pidfds, fd)
+	}
+	return g
+}
+
+// processGroupOf returns the process group of pid from /proc/<pid>/stat, or
+// -1 when it cannot be read.
+func processGroupOf(pid int) int {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return -1
+	}
+	// The command name in parentheses may contain spaces; the state, the
+	// parent and the group follow the last closing parenthesis.
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return -1
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 3 {
+		return -1
+	}
+	pgrp, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return -1
+	}
+	return pgrp
+}
+
+// signal sends sig to the group while a pinned member still exists, and
+// reports os.ErrProcessDone without signalling anything once none does.
+func (g *pinnedGroup) signal(sig syscall.Signal) error {
+	if g == nil {
+		return os.ErrProcessDone
+	}
+	if !g.unpinned && !slices.ContainsFunc(g.pidfds, func(fd int) bool {
+		return unix.PidfdSendSignal(fd, 0, nil, 0) == nil
+	}) {
+		return os.ErrProcessDone
+	}
+	if err := syscall.Kill(-g.pgid, sig); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+	return nil
+}
+
+// close releases the pidfds.
+func (g *pinnedGroup) close() {
+	if g == nil {
+		return
+	}
+	for _, fd := range g.pidfds {
+		unix.Close(fd)
+	}
+	g.pidfds = nil
+}
+
+// openPidFD returns a pidfd for pid, or -1 when the kernel has no
+// pidfd_open(2).
+func openPidFD(pid int) int {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		return -1
+	}
+	return fd
+}
+
+func closePidFD(fd int) {
+	unix.Close(fd)
+}
+
+// pidfdSignal sends sig through pidfd_send_signal(2). A process that has
+// exited is reported as os.ErrProcessDone.
+func pidfdSignal(pidfd int, sig syscall.Signal) error {
+	if err := unix.PidfdSendSignal(pidfd, sig, nil, 0); err != nil {
+		if errors.Is(err, unix.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return os.NewSyscallError("pidfd_send_signal", err)
+	}
+	return nil
+}
+
+// keptFDs lists, comma separated, the descriptors the child of cmd keeps
+// under WithCloseInheritedFDs: its ExtraFiles and the memfd it executes
+// through /proc/self/fd, directly or through a symlink, which a script's
+// interpreter opens by that path.
+func keptFDs(cmd *exec.Cmd) string {
+	// ExtraFiles entry i becomes descriptor 3+i in the child.
+	keep := make([]string, 0, len(cmd.ExtraFiles)+1)
+	for i := range cmd.ExtraFiles {
+		keep = append(keep, strconv.Itoa(3+i))
+	}
+	// WithComm executes the memfd through a symlink to it.
+	fd, ok := procSelfFDNumber(cmd.Path)
+	if target, err := os.Readlink(cmd.Path); !ok && err == nil {
+		fd, ok = procSelfFDNumber(target)
+	}
+	if ok {
+		keep = append(keep, strconv.Itoa(fd))
+	}
+	return strings.Join(keep, ",")
+}
+
+// closeInheritedFDs marks every descriptor above stderr close-on-exec except
+// the comma separated ones in keep. It runs in the trampoline, so the flags
+// of the emrun process are left alone.
+func closeInheritedFDs(keep string) error {
+	kept := make(map[int]bool)
+	for _, field := range strings.Split(keep, ",") {
+		if field == "" {
+			continue
+		}
+		fd, err := strconv.Atoi(field)
+		if err != nil {
+			return fmt.Errorf("invalid descriptor %q", field)
+		}
+		kept[fd] = true
+	}
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return fmt.Errorf("close inherited descriptors: %w", err)
+	}
+	for _, entry := range entries {
+		fd, err := strconv.Atoi(entry.Name())
+		if err != nil || fd <= 2 || kept[fd] {
+			continue
+		}
+		syscall.CloseOnExec(fd)
+	}
+	return nil
+}
+
+// applyNamespaces starts cmd in new mount, IPC, UTS and network namespaces.
+// Without root a user namespace mapping the caller's user and group to
+// themselves is created as well, since the others need CAP_SYS_ADMIN.
+func applyNamespaces(cmd *exec.Cmd) error {
+	attr := ownSysProcAttr(cmd)
+	attr.Cloneflags |= syscall.CLONE_NEWNS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS | syscall.CLONE_NEWNET
+	if uid := os.Geteuid(); uid != 0 {
+		gid := os.Getegid()
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+		attr.GidMappingsEnableSetgroups = false
+	}
+	return nil
+}
+
+// procSelfFDNumber returns the descriptor number in a /proc/self/fd path.
+func procSelfFDNumber(path string) (int, bool) {
+	rest, ok := strings.CutPrefix(path, "/proc/self/fd/")
+	if !ok {
+		return 0, false
+	}
+	fd, err := strconv.Atoi(rest)
+	return fd, err == nil
+}
+
+// applyForeground makes cmd start as the foreground process group of the
+// controlling terminal, so the signals the terminal generates, such as SIGINT
+// on Ctrl-C, reach the child rather than this process. The returned restore
+// hands the terminal back to the process group that held it before and must
+// be called once the child has exited.
+func applyForeground(cmd *exec.Cmd) (restore func(), err error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("foreground: no controlling terminal: %w", err)
+	}
+	pgrp, err := unix.IoctlGetInt(int(tty.Fd()), unix.TIOCGPGRP)
+	if err != nil {
+		tty.Close()
+		return nil, fmt.Errorf("foreground: %w", err)
+	}
+	attr := ownSysProcAttr(cmd)
+	// The child sets its new process group as the foreground one before
+	// exec, using the descriptor it inherited from us.
+	attr.Foreground = true
+	attr.Ctty = int(tty.Fd())
+	return func() {
+		setForegroundBlockingSIGTTOU(int(tty.Fd()), pgrp)
+		tty.Close()
+	}, nil
+}
+
+// setForegroundBlockingSIGTTOU makes pgrp the foreground process group of the
+// terminal fd. As a background process group we would be stopped by SIGTTOU
+// for changing the foreground one, so the signal is blocked around the call
+// on the calling thread only. The process-wide disposition, and with it any
+// signal.Notify of the caller, stays as it is.
+func setForegroundBlockingSIGTTOU(fd, pgrp int) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	// Signal n is bit n-1; SIGTTOU falls in the first word whether the set
+	// is made of 32 or 64 bit words.
+	var set, old unix.Sigset_t
+	set.Val[0] |= 1 << (uint(syscall.SIGTTOU) - 1)
+	if err := unix.PthreadSigmask(unix.SIG_BLOCK, &set, &old); err != nil {
+		return
+	}
+	unix.IoctlSetPointerInt(fd, unix.TIOCSPGRP, pgrp)
+	unix.PthreadSigmask(unix.SIG_SETMASK, &old, nil)
+}
@@ -0,0 +1,240 @@
+package emrun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRunWithCgroup(t *testing.T) {
+	var root string
+	for _, candidate := range []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"} {
+		if _, err := os.Stat(filepath.Join(candidate, "cgroup.procs")); err == nil {
+			if _, err := os.Stat(filepath.Join(candidate, "cgroup.controllers")); err == nil {
+				root = candidate
+				break
+			}
+		}
+	}
+	if root == "" {
+		t.Skip("no cgroup v2 hierarchy mounted")
+	}
+	group := filepath.Join(root, "emrun-test-"+strings.ReplaceAll(t.Name(), "/", "-"))
+	if err := os.Mkdir(group, 0o755); err != nil {
+		t.Skipf("cannot create cgroup: %v", err)
+	}
+	defer os.Remove(group)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = WithOptions(ctx, WithCgroup(group))
+	out, err := Run(ctx, []byte("#!/bin/sh\ngrep '^0::' /proc/self/cgroup\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v (%s)", err, out)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(string(out)), "/"+filepath.Base(group)) {
+		t.Fatalf("child not placed in cgroup: %q", out)
+	}
+}
+
+func TestRunWithMissingCgroup(t *testing.T) {
+	ctx := WithOptions(context.Background(), WithCgroup("/nonexistent/cgroup"))
+	if _, err := Run(ctx, []byte("#!/bin/sh\ntrue\n")); err == nil || !strings.Contains(err.Error(), "open cgroup") {
+		t.Fatalf("expected open cgroup error, got %v", err)
+	}
+}
+
+func TestRunWithGroups(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("setting supplementary groups needs root")
+	}
+	ctx := WithOptions(context.Background(), WithGroups([]uint32{4242, 4343}))
+	out, err := Run(ctx, []byte("#!/bin/sh\ngrep '^Groups:' /proc/self/status\n"))
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if got := strings.Fields(string(out)); len(got) != 3 || got[1] != "4242" || got[2] != "4343" {
+		t.Fatalf("unexpected groups: %q", out)
+	}
+
+	cmd := exec.Command("/bin/true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{NoSetGroups: true}}
+	if err := applyGroups(cmd, []uint32{4242}); err == nil {
+		t.Fatal("expected an error with NoSetGroups")
+	}
+}
+
+func TestWithKillProcessGroup(t *testing.T) {
+	for _, grace := range []time.Duration{0, 100 * time.Millisecond} {
+		pidFile := filepath.Join(t.TempDir(), "grandchild")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx = WithOptions(ctx, WithKillProcessGroup(), WithTermGrace(grace))
+		payload := []byte("#!/bin/sh\nsh -c 'trap \"\" TERM; exec sleep 30' </dev/null >/dev/null 2>&1 &\necho $! > " + pidFile + ".tmp\nmv " + pidFile + ".tmp " + pidFile + "\nwait\n")
+		bg, err := RunBG(ctx, payload)
+		if err != nil {
+			cancel()
+			t.Fatalf("RunBG returned error: %v", err)
+		}
+		var pid int
+		for pid == 0 {
+			if data, err := os.ReadFile(pidFile); err == nil {
+				pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+			}
+			if ctx.Err() != nil {
+				cancel()
+				t.Fatal("grandchild never started")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+		bg.Wait()
+		deadline := time.Now().Add(2 * time.Second)
+		for processAlive(pid) {
+			if time.Now().After(deadline) {
+				syscall.Kill(pid, syscall.SIGKILL)
+				t.Fatalf("grace %v: grandchild %d survived cancellation", grace, pid)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestPinnedGroupOutlivedIsNotSignalled(t *testing.T) {
+	cmd := exec.Command("/bin/sleep", "30")
+	applyProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	group := pinProcessGroup(cmd.Process)
+	defer group.close()
+	if group.unpinned {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Skip("kernel without pidfd support")
+	}
+	if len(group.pidfds) != 1 {
+		t.Fatalf("pinned %d members, want the child", len(group.pidfds))
+	}
+	if err := group.signal(syscall.SIGKILL); err != nil {
+		t.Fatalf("signal returned error: %v", err)
+	}
+	cmd.Wait()
+	// Once the child is reaped nothing pins the group ID any more.
+	if err := group.signal(syscall.SIGKILL); !errors.Is(err, os.ErrProcessDone) {
+		t.Fatalf("signal after the group exited = %v, want os.ErrProcessDone", err)
+	}
+	if err := (*pinnedGroup)(nil).signal(syscall.SIGTERM); !errors.Is(err, os.ErrProcessDone) {
+		t.Fatalf("signal of a nil group = %v", err)
+	}
+}
+
+// processAlive reports whether pid is running, counting zombies as dead.
+func processAlive(pid int) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	_, rest, _ := strings.Cut(string(data), ") ")
+	return !strings.HasPrefix(rest, "Z") && !strings.HasPrefix(rest, "X")
+}
+
+func TestSetForegroundKeepsSIGTTOUNotify(t *testing.T) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTTOU)
+	defer signal.Stop(ch)
+	// Not a terminal, so only the signal handling around the ioctl runs.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	setForegroundBlockingSIGTTOU(int(r.Fd()), os.Getpid())
+	if signal.Ignored(syscall.SIGTTOU) {
+		t.Fatal("SIGTTOU left ignored")
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGTTOU)
+	select {
+	case <-ch:
+	case <-time.After(2 * time.Second):
+		t.Fatal("signal.Notify for SIGTTOU no longer delivers")
+	}
+}
+
+func TestBackgroundPidFD(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	bg, err := RunBG(ctx, []byte("#!/bin/sh\nexec sleep 30\n"))
+	if err != nil {
+		t.Fatalf("RunBG returned error: %v", err)
+	}
+	fd, ok := bg.PidFD()
+	if !ok {
+		bg.Cancel()
+		t.Skip("kernel without pidfd support")
+	}
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	if n, err := unix.Poll(fds, 0); n != 0 || err != nil {
+		t.Fatalf("expected the pidfd not to be readable while running, got %d, %v", n, err)
+	}
+	if err := bg.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Signal returned error: %v", err)
+	}
+	res := bg.Wait()
+	if status, ok := res.ProcessState.Sys().(syscall.WaitStatus); !ok || status.Signal() != syscall.SIGTERM {
+		t.Fatalf("expected the process to die of SIGTERM, got %+v", res)
+	}
+	if _, ok := bg.PidFD(); ok {
+		t.Fatal("expected no pidfd after the process was waited for")
+	}
+	if err := bg.Signal(syscall.SIGTERM); !errors.Is(err, os.ErrProcessDone) {
+		t.Fatalf("expected os.ErrProcessDone, got %v", err)
+	}
+	if err := (&Background{}).Signal(syscall.SIGTERM); err == nil {
+		t.Fatal("expected an error signalling a Background built by hand")
+	}
+}
+
+func TestWithCloseInheritedFDs(t *testing.T) {
+	// syscall.Open, unlike os.Open, leaves the descriptor inheritable.
+	leaked, err := syscall.Open(os.DevNull, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(leaked)
+	other, err := Open([]byte("#!/bin/sh\necho other\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	payload := []byte(fmt.Sprintf("#!/bin/sh\nif [ -e /proc/$$/fd/%d ]; then echo leaked; else echo closed; fi\n", leaked))
+	out, err := Run(context.Background(), payload)
+	if err != nil || string(out) != "leaked\n" {
+		t.Fatalf("Run without the option = %q, %v", out, err)
+	}
+	ctx := WithOptions(context.Background(), WithCloseInheritedFDs())
+	out, err = Run(ctx, payload)
+	if err != nil || string(out) != "closed\n" {
+		t.Fatalf("Run with WithCloseInheritedFDs = %q, %v", out, err)
+	}
+	// The descriptors of this process, such as the memfd of another open
+	// runnable, must stay inheritable.
+	if flags, err := unix.FcntlInt(uintptr(leaked), unix.F_GETFD, 0); err != nil || flags&unix.FD_CLOEXEC != 0 {
+		t.Fatalf("descriptor of the parent changed: flags %d, %v", flags, err)
+	}
+	cmd := exec.Command(other.Name())
+	if out, err := other.Run(context.Background(), cmd, true); err != nil || string(out) != "other\n" {
+		t.Fatalf("other runnable after WithCloseInheritedFDs = %q, %v", out, err)
+	}
+}
@@ -0,0 +1,67 @@
+//go:build !linux
+
+package emrun
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func applyCgroup(*exec.Cmd, string) (io.Closer, error) {
+	return nil, errors.New("cgroup placement is only supported on linux")
+}
+
+func applyForeground(*exec.Cmd) (func(), error) {
+	return nil, errors.New("foreground process groups are only supported on linux")
+}
+
+func applyGroups(*exec.Cmd, []uint32) error {
+	return errors.New("supplementary groups are only supported on linux")
+}
+
+func applyNamespaces(*exec.Cmd) error {
+	return errors.New("namespaces are only supported on linux")
+}
+
+func applyProcessGroup(*exec.Cmd) error {
+	return errors.New("killing the process group is only supported on linux")
+}
+
+func signalProcessGroup(process *os.Process, sig syscall.Signal) error {
+	return process.Signal(sig)
+}
+
+// pinnedGroup signals the process itself; process groups are only supported
+// on linux.
+type pinnedGroup struct {
+	process *os.Process
+}
+
+func pinProcessGroup(process *os.Process) *pinnedGroup {
+	if process == nil {
+		return nil
+	}
+	return &pinnedGroup{process: process}
+}
+
+func (g *pinnedGroup) signal(sig syscall.Signal) error {
+	if g == nil {
+		return os.ErrProcessDone
+	}
+	return g.process.Signal(sig)
+}
+
+func (g *pinnedGroup) close() {}
+
+func openPidFD(int) int {
+	return -1
+}
+
+func closePidFD(int) {}
+
+func pidfdSignal(int, syscall.Signal) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,181 @@
+package emrun
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The trampoline: os/exec offers no hook between fork and exec, so options
+// that must act in the child, WithCapabilities and WithCloseInheritedFDs,
+// make it re-execute the current program with these variables set. init
+// below, which runs in every program importing emrun, does their work and
+// execs the payload before main ever runs. trampolineTokenEnv holds a
+// one-time token the parent also stores in the file at descriptor
+// trampolineFDEnv, so the variables alone, leaked into some environment or
+// set by hand, never trigger it. capsKeepEnv and keepFDsEnv are only set for
+// the options asking for them.
+const (
+	trampolineExecEnv  = "EMRUN_TRAMPOLINE_EXEC"
+	trampolineFDEnv    = "EMRUN_TRAMPOLINE_FD"
+	trampolineTokenEnv = "EMRUN_TRAMPOLINE_TOKEN"
+	capsKeepEnv        = "EMRUN_CAPS_KEEP"
+	keepFDsEnv         = "EMRUN_KEEP_FDS"
+)
+
+func init() {
+	path, ok := os.LookupEnv(trampolineExecEnv)
+	if !ok {
+		return
+	}
+	fd, token := os.Getenv(trampolineFDEnv), os.Getenv(trampolineTokenEnv)
+	keepCaps, dropCaps := os.LookupEnv(capsKeepEnv)
+	keepFDs, closeFDs := os.LookupEnv(keepFDsEnv)
+	for _, name := range []string{trampolineExecEnv, trampolineFDEnv, trampolineTokenEnv, capsKeepEnv, keepFDsEnv} {
+		os.Unsetenv(name)
+	}
+	// Capabilities are per thread; the thread that drops them must be the
+	// one calling execve(2).
+	runtime.LockOSThread()
+	err := authenticateTrampoline(fd, token)
+	if err == nil && closeFDs {
+		err = closeInheritedFDs(keepFDs)
+	}
+	if err == nil && dropCaps {
+		err = dropCapabilities(keepCaps)
+	}
+	if err == nil {
+		err = unix.Exec(path, os.Args, os.Environ())
+	}
+	fmt.Fprintf(os.Stderr, "emrun: trampoline for %s: %v\n", path, err)
+	os.Exit(127)
+}
+
+// authenticateTrampoline refuses the trampoline when the program gained
+// privileges on execve(2), as a setuid or file capability binary does, since
+// whoever executed it then chose the variables without holding what it would
+// hand to the payload. Otherwise it checks that the file at descriptor fd
+// holds token, which only the parent that set the variables can have written.
+// The descriptor is closed either way.
+func authenticateTrampoline(fd, token string) error {
+	n, err := strconv.Atoi(fd)
+	if err != nil || n < 3 {
+		return fmt.Errorf("invalid token descriptor %q", fd)
+	}
+	file := os.NewFile(uintptr(n), "emrun-trampoline-token")
+	if file == nil {
+		return fmt.Errorf("invalid token descriptor %q", fd)
+	}
+	defer file.Close()
+	if secure, err := atSecure(); err != nil || secure {
+		return errors.New("refusing to run in a program that gained privileges on exec")
+	}
+	// The token is read with pread, so a retried child reads it as well.
+	got := make([]byte, len(token)+1)
+	n, err = file.ReadAt(got, 0)
+	if !errors.Is(err, io.EOF) || token == "" || subtle.ConstantTimeCompare(got[:n], []byte(token)) != 1 {
+		return errors.New("token mismatch")
+	}
+	return nil
+}
+
+// auxvSecure is AT_SECURE from <linux/auxvec.h>, which x/sys does not define.
+const auxvSecure = 23
+
+// atSecure reports whether the kernel set AT_SECURE in the auxiliary vector,
+// meaning the program runs with privileges its executor did not hold.
+func atSecure() (bool, error) {
+	auxv, err := unix.Auxv()
+	if err != nil {
+		return false, err
+	}
+	for _, kv := range auxv {
+		if kv[0] == auxvSecure {
+			return kv[1] != 0, nil
+		}
+	}
+	return false, errors.New("no AT_SECURE in the auxiliary vector")
+}
+
+// applyTrampoline rewrites cmd to run through the trampoline in
+// /proc/self/exe, which resolves to this program in the forked child, when
+// c asks for a step only the trampoline can take. The returned closer holds
+// the token and is closed once the child, and any retry of it, has started;
+// it is nil when cmd was left alone.
+func applyTrampoline(cmd *exec.Cmd, c *config) (io.Closer, error) {
+	if !c.dropCaps && !c.closeFDs {
+		return nil, nil
+	}
+	vars := make([]string, 0, 5)
+	if c.dropCaps {
+		keep, err := capabilityList(c.keepCaps)
+		if err != nil {
+			return nil, err
+		}
+		vars = append(vars, capsKeepEnv+"="+keep)
+	}
+	if c.closeFDs {
+		vars = append(vars, keepFDsEnv+"="+keptFDs(cmd))
+	}
+	var raw [32]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return nil, fmt.Errorf("trampoline token: %w", err)
+	}
+	token := hex.EncodeToString(raw[:])
+	file, err := tokenFile(token)
+	if err != nil {
+		return nil, fmt.Errorf("trampoline token: %w", err)
+	}
+	// ExtraFiles entry i becomes descriptor 3+i in the child.
+	cmd.ExtraFiles = append(slices.Clip(cmd.ExtraFiles), file)
+	fd := 3 + len(cmd.ExtraFiles) - 1
+	cmd.Env = append(cmd.Environ(), append(vars,
+		trampolineExecEnv+"="+cmd.Path,
+		trampolineFDEnv+"="+strconv.Itoa(fd),
+		trampolineTokenEnv+"="+token,
+	)...)
+	cmd.Path = "/proc/self/exe"
+	return file, nil
+}
+
+// tokenFile returns a sealed memfd holding token.
+func tokenFile(token string) (*os.File, error) {
+	fd, err := unix.MemfdCreate("emrun-trampoline-token", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), "emrun-trampoline-token")
+	if _, err := io.WriteString(file, token); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, unix.F_SEAL_SEAL|unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// executedPath returns the file cmd executes, the payload rather than
+// /proc/self/exe once applyTrampoline has routed cmd through the trampoline.
+func executedPath(cmd *exec.Cmd) string {
+	if cmd.Path == "/proc/self/exe" {
+		for _, kv := range slices.Backward(cmd.Env) {
+			if path, ok := strings.CutPrefix(kv, trampolineExecEnv+"="); ok {
+				return path
+			}
+		}
+	}
+	return cmd.Path
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package emrun
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+)
+
+func applyTrampoline(cmd *exec.Cmd, c *config) (io.Closer, error) {
+	switch {
+	case c.dropCaps:
+		return nil, errors.New("capability restriction is only supported on linux")
+	case c.closeFDs:
+		return nil, errors.New("closing inherited descriptors is only supported on linux")
+	}
+	return nil, nil
+}
+
+// executedPath returns the file cmd executes.
+func executedPath(cmd *exec.Cmd) string {
+	return cmd.Path
+}